@@ -1,8 +1,10 @@
 package BiliBili
 
 import (
+	"context"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/nv4d1k/live-stream-forwarder/app/engine/extractor"
 	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/httpweb"
@@ -18,6 +20,9 @@ func init() {
 		Factory: func(rid string, proxy *url.URL) (extractor.Extractor, error) {
 			return NewBiliBiliLink(rid, proxy)
 		},
+		ContextFactory: func(ctx context.Context, rid string, proxy *url.URL) (extractor.Extractor, error) {
+			return NewBiliBiliLinkContext(ctx, rid, proxy)
+		},
 		Mobile:       false,
 		InitialError: 500,
 	})
@@ -30,6 +35,12 @@ type Link struct {
 }
 
 func NewBiliBiliLink(rid string, proxy *url.URL) (*Link, error) {
+	return NewBiliBiliLinkContext(context.Background(), rid, proxy)
+}
+
+// NewBiliBiliLinkContext is like NewBiliBiliLink but aborts the room lookup
+// once ctx is done.
+func NewBiliBiliLinkContext(ctx context.Context, rid string, proxy *url.URL) (*Link, error) {
 	log := global.Log.WithField("func", "app.engine.extractor.BiliBili.NewBiliBiliLink")
 	l := &Link{rid: rid}
 	if proxy != nil {
@@ -37,7 +48,7 @@ func NewBiliBiliLink(rid string, proxy *url.URL) (*Link, error) {
 	} else {
 		l.client = &http.Client{Transport: httpweb.NewAddHeaderTransport(nil, false)}
 	}
-	if err := l.resolveRoomID(); err != nil {
+	if err := l.resolveRoomID(ctx); err != nil {
 		log.WithError(err).Errorln("failed to resolve room ID")
 		return nil, err
 	}
@@ -46,19 +57,32 @@ func NewBiliBiliLink(rid string, proxy *url.URL) (*Link, error) {
 }
 
 func (l *Link) Extract(format string) (*extractor.Result, error) {
+	return l.ExtractContext(context.Background(), format)
+}
+
+func (l *Link) ExtractContext(ctx context.Context, format string) (*extractor.Result, error) {
 	log := global.Log.WithField("func", "app.engine.extractor.BiliBili.Extract")
 	if format == "" {
 		format = l.DefaultFormat()
 	}
 	log.WithField("format", format).WithField("rid", l.rid).Debugln("extracting stream")
-	u, err := l.GetLink(format)
+	links, err := l.GetLinks(ctx, format)
 	if err != nil {
 		log.WithError(err).Errorln("failed to get stream link")
 		return nil, err
 	}
+	urls := make([]string, len(links))
+	for i, u := range links {
+		urls[i] = u.String()
+	}
 	headers := make(http.Header)
 	headers.Set("Referer", "https://live.bilibili.com")
-	return &extractor.Result{URL: u.String(), Headers: headers}, nil
+	result := &extractor.Result{URL: urls[0], Headers: headers, Candidates: extractor.CandidatesFrom(urls, 1)}
+	if exp, err := extractor.ExpiryFromQuery(urls[0], "expires", 10); err == nil {
+		result.ExpireAt = &exp
+		log.Debugf("stream URL expires at %s", exp.Format(time.RFC3339))
+	}
+	return result, nil
 }
 
 func (l *Link) SupportedFormats() []string {
@@ -1,10 +1,13 @@
 package BiliBili
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"slices"
+	"sort"
 	"testing"
 
 	"github.com/nv4d1k/live-stream-forwarder/app/engine/extractor"
@@ -41,12 +44,14 @@ func TestBiliBili_Extract_WithFormat(t *testing.T) {
 		name         string
 		format       string
 		expectSuffix string
+		expectExpire int64 // Unix seconds; 0 means no ExpireAt
 		v2Response   *playInfoResponse
 	}{
 		{
 			name:         "flv format",
 			format:       "flv",
-			expectSuffix: ".flv?key=abc",
+			expectSuffix: ".flv?expires=1700000000&key=abc",
+			expectExpire: 1700000000,
 			v2Response: func() *playInfoResponse {
 				resp := &playInfoResponse{Code: 0}
 				resp.Data.PlayURLInfo.PlayURL.Streams = []streamItem{
@@ -61,7 +66,7 @@ func TestBiliBili_Extract_WithFormat(t *testing.T) {
 										CurrentQn: 10000,
 										BaseURL:   "/live/stream.flv",
 										URLInfo: []urlItem{
-											{Host: "https://cdn.example.com", Extra: "?key=abc"},
+											{Host: "https://cdn.example.com", Extra: "?expires=1700000000&key=abc"},
 										},
 									},
 								},
@@ -131,7 +136,7 @@ func TestBiliBili_Extract_WithFormat(t *testing.T) {
 				wrapped: server.Client().Transport,
 			}
 
-			if err := l.resolveRoomID(); err != nil {
+			if err := l.resolveRoomID(context.Background()); err != nil {
 				t.Fatalf("resolveRoomID failed: %v", err)
 			}
 
@@ -153,6 +158,13 @@ func TestBiliBili_Extract_WithFormat(t *testing.T) {
 			if got := result.Headers.Get("Referer"); got != "https://live.bilibili.com" {
 				t.Errorf("expected Referer https://live.bilibili.com, got %q", got)
 			}
+
+			switch {
+			case tt.expectExpire == 0 && result.ExpireAt != nil:
+				t.Errorf("expected no ExpireAt, got %s", result.ExpireAt)
+			case tt.expectExpire != 0 && (result.ExpireAt == nil || result.ExpireAt.Unix() != tt.expectExpire):
+				t.Errorf("expected ExpireAt %d, got %v", tt.expectExpire, result.ExpireAt)
+			}
 		})
 	}
 }
@@ -272,7 +284,7 @@ func (t *rewriteBaseTransport) RoundTrip(req *http.Request) (*http.Response, err
 	return t.wrapped.RoundTrip(newReq)
 }
 
-func TestSelectStreamURL(t *testing.T) {
+func TestSelectStreamURLs(t *testing.T) {
 	tests := []struct {
 		name        string
 		format      string
@@ -462,7 +474,7 @@ func TestSelectStreamURL(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			url, err := selectStreamURL(tt.info, tt.format)
+			urls, err := selectStreamURLs(tt.info, tt.format)
 			if tt.expectErr {
 				if err == nil {
 					t.Fatal("expected error, got nil")
@@ -475,13 +487,58 @@ func TestSelectStreamURL(t *testing.T) {
 			if err != nil {
 				t.Fatalf("unexpected error: %v", err)
 			}
-			if url != tt.expectURL {
-				t.Errorf("expected URL %q, got %q", tt.expectURL, url)
+			if len(urls) != 1 || urls[0] != tt.expectURL {
+				t.Errorf("expected URLs [%q], got %q", tt.expectURL, urls)
 			}
 		})
 	}
 }
 
+func TestSelectStreamURLs_AllNodes(t *testing.T) {
+	resp := &playInfoResponse{Code: 0}
+	resp.Data.PlayURLInfo.PlayURL.Streams = []streamItem{
+		{
+			ProtocolName: "http_stream",
+			Formats: []formatItem{
+				{
+					FormatName: "flv",
+					Codecs: []codecItem{
+						{
+							CodecName: "avc",
+							BaseURL:   "/live/flv/",
+							URLInfo: []urlItem{
+								{Host: "https://cdn1.example.com", Extra: "?n=1"},
+								{Host: "https://cdn2.example.com", Extra: "?n=2"},
+								{Host: "https://cdn3.example.com", Extra: "?n=3"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	urls, err := selectStreamURLs(resp, "flv")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if urls[0] != "https://cdn1.example.com/live/flv/?n=1" {
+		t.Errorf("expected the primary node first, got %q", urls[0])
+	}
+	c := extractor.CandidatesFrom(urls, 1)
+	if c[0].Priority != 0 || c[1].Priority != 1 || c[2].Priority != 1 {
+		t.Errorf("expected only the primary node preferred, got %+v", c)
+	}
+	sort.Strings(urls)
+	want := []string{
+		"https://cdn1.example.com/live/flv/?n=1",
+		"https://cdn2.example.com/live/flv/?n=2",
+		"https://cdn3.example.com/live/flv/?n=3",
+	}
+	if !slices.Equal(urls, want) {
+		t.Errorf("expected URLs %q, got %q", want, urls)
+	}
+}
+
 func TestBiliBili_Registry(t *testing.T) {
 	entry, ok := extractor.Registry["bilibili"]
 	if !ok {
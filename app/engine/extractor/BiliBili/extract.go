@@ -1,23 +1,34 @@
 package BiliBili
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
+	"net/http"
 	"net/url"
 
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/stream"
 	"github.com/nv4d1k/live-stream-forwarder/global"
 )
 
-func (l *Link) resolveRoomID() error {
+func (l *Link) resolveRoomID(ctx context.Context) error {
 	log := global.Log.WithField("func", "app.engine.extractor.BiliBili.resolveRoomID")
-	resp, err := l.client.Get(fmt.Sprintf("https://api.live.bilibili.com/room/v1/Room/room_init?id=%s", l.rid))
+	initURL := fmt.Sprintf("https://api.live.bilibili.com/room/v1/Room/room_init?id=%s", l.rid)
+	req, err := http.NewRequestWithContext(ctx, "GET", initURL, nil)
 	if err != nil {
-		return fmt.Errorf("get room init info error: %w", err)
+		return fmt.Errorf("making room init request error: %w", err)
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return stream.WrapError("bilibili", stream.PhaseExtract, initURL, fmt.Errorf("get room init info error: %w", err))
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return stream.StatusError("bilibili", stream.PhaseExtract, initURL, resp)
+	}
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return fmt.Errorf("read room init info error: %w", err)
@@ -32,7 +43,7 @@ func (l *Link) resolveRoomID() error {
 	}
 	l.rid = fmt.Sprintf("%d", result.Data.RoomID)
 	if result.Data.LiveStatus != 1 {
-		return errors.New("live room is offline")
+		return fmt.Errorf("live room is offline: %w", stream.ErrOffline)
 	}
 	if result.Data.IsLocked {
 		return errors.New("live room is locked")
@@ -43,22 +54,40 @@ func (l *Link) resolveRoomID() error {
 	return nil
 }
 
-func (l *Link) GetLink(format string) (*url.URL, error) {
-	log := global.Log.WithField("func", "app.engine.extractor.BiliBili.GetLink")
+func (l *Link) GetLink(ctx context.Context, format string) (*url.URL, error) {
+	links, err := l.GetLinks(ctx, format)
+	if err != nil {
+		return nil, err
+	}
+	return links[0], nil
+}
+
+// GetLinks returns the stream URL on every CDN node offered by the API, in
+// random order for load balancing.
+func (l *Link) GetLinks(ctx context.Context, format string) ([]*url.URL, error) {
+	log := global.Log.WithField("func", "app.engine.extractor.BiliBili.GetLinks")
 
-	playInfo, err := l.getPlayInfo()
+	playInfo, err := l.getPlayInfo(ctx)
 	if err != nil {
 		return nil, err
 	}
-	streamURL, err := selectStreamURL(playInfo, format)
+	streamURLs, err := selectStreamURLs(playInfo, format)
 	if err != nil {
 		return nil, err
 	}
-	log.WithField("field", "stream url").Debug(streamURL)
-	return url.Parse(streamURL)
+	links := make([]*url.URL, 0, len(streamURLs))
+	for _, streamURL := range streamURLs {
+		log.WithField("field", "stream url").Debug(streamURL)
+		u, err := url.Parse(streamURL)
+		if err != nil {
+			return nil, fmt.Errorf("parse stream url error: %w", err)
+		}
+		links = append(links, u)
+	}
+	return links, nil
 }
 
-func (l *Link) getPlayInfo() (*playInfoResponse, error) {
+func (l *Link) getPlayInfo(ctx context.Context) (*playInfoResponse, error) {
 	log := global.Log.WithField("func", "app.engine.extractor.BiliBili.getPlayInfo")
 	u, _ := url.Parse("https://api.live.bilibili.com/xlive/web-room/v2/index/getRoomPlayInfo")
 	q := u.Query()
@@ -73,11 +102,18 @@ func (l *Link) getPlayInfo() (*playInfoResponse, error) {
 	q.Set("panorama", "1")
 	u.RawQuery = q.Encode()
 	log.WithField("field", "play info url").Debug(u.String())
-	resp, err := l.client.Get(u.String())
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
-		return nil, fmt.Errorf("get play info error: %w", err)
+		return nil, fmt.Errorf("making play info request error: %w", err)
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, stream.WrapError("bilibili", stream.PhaseExtract, u.String(), fmt.Errorf("get play info error: %w", err))
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, stream.StatusError("bilibili", stream.PhaseExtract, u.String(), resp)
+	}
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("read play info error: %w", err)
@@ -91,18 +127,24 @@ func (l *Link) getPlayInfo() (*playInfoResponse, error) {
 		return nil, fmt.Errorf("play info api error code %d: %s", result.Code, result.Message)
 	}
 	if len(result.Data.PlayURLInfo.PlayURL.Streams) == 0 {
+		if result.Data.LiveStatus != 1 {
+			// 0 is offline, 2 is a replay loop of past broadcasts.
+			return nil, fmt.Errorf("live room is offline (status %d): %w", result.Data.LiveStatus, stream.ErrOffline)
+		}
 		return nil, errors.New("no streams available")
 	}
 	return &result, nil
 }
 
-// selectStreamURL picks the best stream URL based on the requested format.
+// selectStreamURLs picks the best stream based on the requested format and
+// returns its URL on each CDN node.
 // For "flv": selects http_stream/flv protocol.
 // For "m3u8": selects http_hls protocol, preferring ts over fmp4 for compatibility.
 // Codec preference: avc (most compatible) > hevc.
-// CDN node: randomly selected from url_info for load balancing.
-func selectStreamURL(info *playInfoResponse, format string) (string, error) {
-	log := global.Log.WithField("func", "app.engine.extractor.BiliBili.selectStreamURL")
+// CDN nodes: all of url_info, the primary (first) node first and the others
+// shuffled for load balancing.
+func selectStreamURLs(info *playInfoResponse, format string) ([]string, error) {
+	log := global.Log.WithField("func", "app.engine.extractor.BiliBili.selectStreamURLs")
 	streams := info.Data.PlayURLInfo.PlayURL.Streams
 
 	log.WithField("format", format).Debugln("selecting stream URL")
@@ -128,7 +170,7 @@ func selectStreamURL(info *playInfoResponse, format string) (string, error) {
 	}
 	if targetStream == nil {
 		log.WithField("protocol", targetProtocol).Warnln("no matching protocol stream found")
-		return "", fmt.Errorf("no %s stream available", targetProtocol)
+		return nil, fmt.Errorf("no %s stream available", targetProtocol)
 	}
 
 	// Find the matching format, with fallback for HLS.
@@ -151,7 +193,7 @@ func selectStreamURL(info *playInfoResponse, format string) (string, error) {
 		}
 	}
 	if targetFmt == nil {
-		return "", fmt.Errorf("no %s/%s stream available", targetProtocol, targetFormat)
+		return nil, fmt.Errorf("no %s/%s stream available", targetProtocol, targetFormat)
 	}
 
 	// Pick the best codec: prefer avc for compatibility, then highest current_qn.
@@ -169,12 +211,17 @@ func selectStreamURL(info *playInfoResponse, format string) (string, error) {
 		}
 	}
 	if bestCodec == nil || len(bestCodec.URLInfo) == 0 {
-		return "", errors.New("no codec/URL available for selected stream")
+		return nil, errors.New("no codec/URL available for selected stream")
 	}
 
-	// Build the full URL from a random CDN node.
-	ui := bestCodec.URLInfo[rand.Intn(len(bestCodec.URLInfo))]
-	result := ui.Host + bestCodec.BaseURL + ui.Extra
-	log.WithField("codec", bestCodec.CodecName).WithField("protocol", targetProtocol).WithField("format", targetFormat).Debugln("stream URL selected")
-	return result, nil
+	// Build the full URL for every CDN node.
+	results := make([]string, len(bestCodec.URLInfo))
+	for i, ui := range bestCodec.URLInfo {
+		results[i] = ui.Host + bestCodec.BaseURL + ui.Extra
+	}
+	backups := results[1:]
+	rand.Shuffle(len(backups), func(i, j int) { backups[i], backups[j] = backups[j], backups[i] })
+	log.WithField("codec", bestCodec.CodecName).WithField("protocol", targetProtocol).WithField("format", targetFormat).
+		WithField("nodes", len(results)).Debugln("stream URL selected")
+	return results, nil
 }
@@ -1,9 +1,11 @@
 package DouYin
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/nv4d1k/live-stream-forwarder/app/engine/extractor"
 	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/httpweb"
@@ -19,6 +21,9 @@ func init() {
 		Factory: func(rid string, proxy *url.URL) (extractor.Extractor, error) {
 			return NewDouYinLink(rid, proxy)
 		},
+		ContextFactory: func(ctx context.Context, rid string, proxy *url.URL) (extractor.Extractor, error) {
+			return NewDouYinLinkContext(ctx, rid, proxy)
+		},
 		Mobile:       false,
 		InitialError: 500,
 	})
@@ -31,7 +36,13 @@ type Link struct {
 	client  *http.Client
 }
 
-func NewDouYinLink(rid string, proxy *url.URL) (douyin *Link, err error) {
+func NewDouYinLink(rid string, proxy *url.URL) (*Link, error) {
+	return NewDouYinLinkContext(context.Background(), rid, proxy)
+}
+
+// NewDouYinLinkContext is like NewDouYinLink but aborts the cookie request
+// once ctx is done.
+func NewDouYinLinkContext(ctx context.Context, rid string, proxy *url.URL) (douyin *Link, err error) {
 	log := global.Log.WithField("func", "app.engine.extractor.DouYin.NewDouYinLink")
 	douyin = new(Link)
 	douyin.rid = rid
@@ -42,7 +53,7 @@ func NewDouYinLink(rid string, proxy *url.URL) (douyin *Link, err error) {
 		douyin.client = &http.Client{Transport: httpweb.NewAddHeaderTransport(nil, false)}
 	}
 	douyin.cookies = &http.Cookie{}
-	err = douyin.getCookies()
+	err = douyin.getCookies(ctx)
 	if err != nil {
 		log.WithError(err).Errorln("failed to get cookies")
 		return nil, fmt.Errorf("get cookies error: %w", err)
@@ -51,18 +62,27 @@ func NewDouYinLink(rid string, proxy *url.URL) (douyin *Link, err error) {
 }
 
 func (l *Link) Extract(format string) (*extractor.Result, error) {
+	return l.ExtractContext(context.Background(), format)
+}
+
+func (l *Link) ExtractContext(ctx context.Context, format string) (*extractor.Result, error) {
 	log := global.Log.WithField("func", "app.engine.extractor.DouYin.Extract")
 	if format == "" {
 		format = l.DefaultFormat()
 	}
 	log.WithField("format", format).Infoln("extracting stream URL")
-	u, err := l.GetLink(format)
+	u, err := l.GetLink(ctx, format)
 	if err != nil {
 		log.WithError(err).Errorln("failed to get stream URL")
 		return nil, err
 	}
 	log.WithField("url", u.String()).Debugln("extracted stream URL")
-	return &extractor.Result{URL: u.String()}, nil
+	result := &extractor.Result{URL: u.String()}
+	if exp, err := extractor.ExpiryFromQuery(u.String(), "expire", 10); err == nil {
+		result.ExpireAt = &exp
+		log.Debugf("stream URL expires at %s", exp.Format(time.RFC3339))
+	}
+	return result, nil
 }
 
 func (l *Link) SupportedFormats() []string {
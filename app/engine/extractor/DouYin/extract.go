@@ -1,6 +1,7 @@
 package DouYin
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,18 +12,19 @@ import (
 	"strings"
 
 	"github.com/antchfx/htmlquery"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/stream"
 	"github.com/nv4d1k/live-stream-forwarder/global"
 	"github.com/tidwall/gjson"
 )
 
 var QIALITIES = []string{"origin", "hd", "sd", "ld", "md"}
 
-func (l *Link) getCookies() error {
+func (l *Link) getCookies(ctx context.Context) error {
 	log := global.Log.WithField("func", "app.engine.extractor.DouYin.getCookies")
 	reAcNonce := regexp.MustCompile(`(?i)__ac_nonce=([0-9a-f]*?);`)
 	reTtwid := regexp.MustCompile(`(?i)ttwid=(\S*);`)
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://live.douyin.com/%s", l.rid), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://live.douyin.com/%s", l.rid), nil)
 	if err != nil {
 		return fmt.Errorf("making request for get __ac_nonce or ttwid error: %w", err)
 	}
@@ -55,10 +57,11 @@ func (l *Link) getCookies() error {
 	return nil
 }
 
-func (l *Link) GetLink(format string) (*url.URL, error) {
+func (l *Link) GetLink(ctx context.Context, format string) (*url.URL, error) {
 	log := global.Log.WithField("func", "app.engine.extractor.DouYin.GetLink")
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://live.douyin.com/%s", l.rid), nil)
+	roomURL := fmt.Sprintf("https://live.douyin.com/%s", l.rid)
+	req, err := http.NewRequestWithContext(ctx, "GET", roomURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("making request for get link error: %w", err)
 	}
@@ -69,9 +72,12 @@ func (l *Link) GetLink(format string) (*url.URL, error) {
 	log.WithField("field", "sending requests with cookies").Debugf("%v\n", req)
 	resp, err := l.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("sending request for get link error: %w", err)
+		return nil, stream.WrapError("douyin", stream.PhaseExtract, roomURL, fmt.Errorf("sending request for get link error: %w", err))
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, stream.StatusError("douyin", stream.PhaseExtract, roomURL, resp)
+	}
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("parsing response body error: %w", err)
@@ -91,30 +97,36 @@ func (l *Link) GetLink(format string) (*url.URL, error) {
 			break
 		}
 	}
-	var stream gjson.Result
+	if liveData == "" {
+		return nil, errors.New("live data not found in room page")
+	}
+	var streamData gjson.Result
 	for _, quality := range QIALITIES {
 		if gjson.Get(liveData, fmt.Sprintf("data.%s", quality)).Exists() {
-			stream = gjson.Get(liveData, fmt.Sprintf("data.%s", quality))
+			streamData = gjson.Get(liveData, fmt.Sprintf("data.%s", quality))
 			break
 		}
 	}
 	var (
 		u string
 	)
-	log.WithField("field", "stream data").Debugln(stream.Raw)
+	log.WithField("field", "stream data").Debugln(streamData.Raw)
 	if format == "" {
 		format = "flv"
 	}
 	switch format {
 	case "flv":
-		u = stream.Get("main.flv").String()
+		u = streamData.Get("main.flv").String()
 		log.WithField("stream_url", u).Debugln("get origin flv url")
-		return url.Parse(u)
 	default:
-		u = stream.Get("main.hls").String()
+		u = streamData.Get("main.hls").String()
 		log.WithField("stream_url", u).Debugln("get origin hls url")
-		return url.Parse(u)
 	}
+	if u == "" {
+		// The room page carries no stream data while nobody is live.
+		return nil, fmt.Errorf("room is not live: %w", stream.ErrOffline)
+	}
+	return url.Parse(u)
 }
 
 func (l *Link) extractJSON(input string) (string, bool) {
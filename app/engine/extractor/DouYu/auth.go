@@ -1,6 +1,7 @@
 package DouYu
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
@@ -11,11 +12,12 @@ import (
 	"regexp"
 	"strings"
 
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/stream"
 	"github.com/nv4d1k/live-stream-forwarder/global"
 	"github.com/tidwall/gjson"
 )
 
-func (l *Link) getDeviceID() (did string, err error) {
+func (l *Link) getDeviceID(ctx context.Context) (did string, err error) {
 	log := global.Log.WithField("func", "app.engine.extractor.DouYu.getDeviceID")
 	var (
 		req      *http.Request
@@ -23,7 +25,7 @@ func (l *Link) getDeviceID() (did string, err error) {
 		body     []byte
 		didRegex = regexp.MustCompile(`axiosJsonpCallback1\((.*)\)`)
 	)
-	req, err = http.NewRequest("GET", fmt.Sprintf("https://passport.douyu.com/lapi/did/api/get?client_id=25&_=%s&callback=axiosJsonpCallback1", l.t13), nil)
+	req, err = http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://passport.douyu.com/lapi/did/api/get?client_id=25&_=%s&callback=axiosJsonpCallback1", l.t13), nil)
 	if err != nil {
 		return "", fmt.Errorf("making request error for get device id: %w", err)
 	}
@@ -49,12 +51,12 @@ func (l *Link) getDeviceID() (did string, err error) {
 	return didData.Get("data.did").String(), nil
 }
 
-func (l *Link) getEncryptData() (encData string, err error) {
+func (l *Link) getEncryptData(ctx context.Context) (encData string, err error) {
 	log := global.Log.WithField("func", "app.engine.extractor.DouYu.getEncryptData")
 	if len(l.did) <= 0 {
 		return "", errors.New("did is empty")
 	}
-	resp, err := l.client.Get(fmt.Sprintf("https://www.douyu.com/wgapi/livenc/liveweb/websec/getEncryption?did=%s", l.did))
+	resp, err := l.get(ctx, fmt.Sprintf("https://www.douyu.com/wgapi/livenc/liveweb/websec/getEncryption?did=%s", l.did))
 	if err != nil {
 		return "", fmt.Errorf("sending request error for get encrypt data: %w", err)
 	}
@@ -87,7 +89,7 @@ func (l *Link) calculateAuth() (auth string, err error) {
 	return auth, nil
 }
 
-func (l *Link) getRateStream() (gjson.Result, error) {
+func (l *Link) getRateStream(ctx context.Context) (gjson.Result, error) {
 	log := global.Log.WithField("func", "app.engine.extractor.DouYu.getRateStream")
 	auth, err := l.calculateAuth()
 	if err != nil {
@@ -105,7 +107,7 @@ func (l *Link) getRateStream() (gjson.Result, error) {
 	params.Set("fa", "0")
 	log.WithField("params", params.Encode()).Debugln("get rate stream")
 	rateStreamUrl := fmt.Sprintf("https://www.douyu.com/lapi/live/getH5PlayV1/%s", l.rid)
-	req, err := http.NewRequest(http.MethodPost, rateStreamUrl, strings.NewReader(params.Encode()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rateStreamUrl, strings.NewReader(params.Encode()))
 	if err != nil {
 		return gjson.Result{}, fmt.Errorf("making RateStream POST request error: %w", err)
 	}
@@ -116,9 +118,12 @@ func (l *Link) getRateStream() (gjson.Result, error) {
 
 	resp, err := l.client.Do(req)
 	if err != nil {
-		return gjson.Result{}, fmt.Errorf("sending RateStream POST request error: %w", err)
+		return gjson.Result{}, stream.WrapError("douyu", stream.PhaseExtract, rateStreamUrl, fmt.Errorf("sending RateStream POST request error: %w", err))
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return gjson.Result{}, stream.StatusError("douyu", stream.PhaseExtract, rateStreamUrl, resp)
+	}
 
 	// Step 8: Parse the JSON response and return it
 	body, err := io.ReadAll(resp.Body)
@@ -1,6 +1,7 @@
 package DouYu
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -21,6 +22,9 @@ func init() {
 		Factory: func(rid string, proxy *url.URL) (extractor.Extractor, error) {
 			return NewDouyuLink(rid, proxy)
 		},
+		ContextFactory: func(ctx context.Context, rid string, proxy *url.URL) (extractor.Extractor, error) {
+			return NewDouyuLinkContext(ctx, rid, proxy)
+		},
 		Mobile:       false,
 		InitialError: 400,
 	})
@@ -41,6 +45,12 @@ type Link struct {
 }
 
 func NewDouyuLink(rid string, proxy *url.URL) (*Link, error) {
+	return NewDouyuLinkContext(context.Background(), rid, proxy)
+}
+
+// NewDouyuLinkContext is like NewDouyuLink but aborts the room, device id and
+// encryption requests once ctx is done.
+func NewDouyuLinkContext(ctx context.Context, rid string, proxy *url.URL) (*Link, error) {
 	log := global.Log.WithField("func", "app.engine.extractor.DouYu.NewDouyuLink")
 	log.WithField("rid", rid).Infoln("creating DouYu extractor")
 	var (
@@ -56,19 +66,19 @@ func NewDouyuLink(rid string, proxy *url.URL) (*Link, error) {
 	} else {
 		dy.client = &http.Client{Transport: httpweb.NewAddHeaderTransport(nil, false)}
 	}
-	dy.streamParams, err = dy.getLegacyFirstStreamParameters(rid)
+	dy.streamParams, err = dy.getLegacyFirstStreamParameters(ctx, rid)
 	if err != nil {
 		log.WithError(err).Errorln("failed to get stream parameters")
 		return nil, fmt.Errorf("get real room id error: %w", err)
 	}
 	dy.rid = fmt.Sprintf("%d", dy.streamParams.RoomID)
 	log.WithField("rid", dy.rid).Debugln("resolved real room id")
-	dy.did, err = dy.getDeviceID()
+	dy.did, err = dy.getDeviceID(ctx)
 	if err != nil {
 		log.WithError(err).Errorln("failed to get device id")
 		return nil, fmt.Errorf("get device id error: %w", err)
 	}
-	dy.encData, err = dy.getEncryptData()
+	dy.encData, err = dy.getEncryptData(ctx)
 	if err != nil {
 		log.WithError(err).Errorln("failed to get encrypt data")
 		return nil, fmt.Errorf("get encrypt data error: %w", err)
@@ -78,15 +88,28 @@ func NewDouyuLink(rid string, proxy *url.URL) (*Link, error) {
 }
 
 func (l *Link) Extract(format string) (*extractor.Result, error) {
+	return l.ExtractContext(context.Background(), format)
+}
+
+func (l *Link) ExtractContext(ctx context.Context, format string) (*extractor.Result, error) {
 	log := global.Log.WithField("func", "app.engine.extractor.DouYu.Extract")
 	log.WithField("format", format).Debugln("extracting stream URL")
-	u, err := l.GetLink(format)
+	links, err := l.GetLinks(ctx, format)
 	if err != nil {
 		log.WithError(err).Errorln("failed to get stream link")
 		return nil, err
 	}
-	log.WithField("url", u.String()).Infoln("stream URL extracted")
-	return &extractor.Result{URL: u.String()}, nil
+	urls := make([]string, len(links))
+	for i, u := range links {
+		urls[i] = u.String()
+	}
+	log.WithField("url", urls[0]).WithField("edges", len(urls)).Infoln("stream URL extracted")
+	result := &extractor.Result{URL: urls[0], Candidates: extractor.CandidatesFrom(urls, 1)}
+	if exp, err := extractor.ExpiryFromQuery(urls[0], "txTime", 16); err == nil {
+		result.ExpireAt = &exp
+		log.Debugf("stream URL expires at %s", exp.Format(time.RFC3339))
+	}
+	return result, nil
 }
 
 func (l *Link) SupportedFormats() []string {
@@ -96,3 +119,12 @@ func (l *Link) SupportedFormats() []string {
 func (l *Link) DefaultFormat() string {
 	return "flv"
 }
+
+// get issues a GET request that is canceled along with ctx.
+func (l *Link) get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return l.client.Do(req)
+}
@@ -1,8 +1,10 @@
 package DouYu
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -13,28 +15,58 @@ import (
 	"strings"
 	"time"
 
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/stream"
 	"github.com/nv4d1k/live-stream-forwarder/global"
 	uuidgen "github.com/satori/go.uuid"
 	"github.com/tidwall/gjson"
 )
 
+// xsHost is the edge that serves p2p=2 streams as .xs. The host returned by
+// the API is kept as a fallback.
+const xsHost = "hlsh5p2.douyucdn2.cn"
+
+// rateStreamOffline is the getH5PlayV1 error code for a room that is not
+// broadcasting.
+const rateStreamOffline = -5
+
 // GetLink returns a stream URL. The format parameter is accepted for
 // interface consistency but DouYu's stream format is determined by the
 // server's p2p field; it cannot be selected by the caller.
-func (l *Link) GetLink(_ string) (*url.URL, error) {
-	log := global.Log.WithField("func", "app.engine.extractor.DouYu.GetLink")
-	data, err := l.getRateStream()
+func (l *Link) GetLink(ctx context.Context, format string) (*url.URL, error) {
+	links, err := l.GetLinks(ctx, format)
+	if err != nil {
+		return nil, err
+	}
+	return links[0], nil
+}
+
+// GetLinks is like GetLink but returns every known edge for the stream, in
+// order of preference.
+func (l *Link) GetLinks(ctx context.Context, _ string) ([]*url.URL, error) {
+	log := global.Log.WithField("func", "app.engine.extractor.DouYu.GetLinks")
+	data, err := l.getRateStream(ctx)
 	log.WithField("data", data.Raw).Debugln("rate stream data")
 	if err != nil {
 		return nil, fmt.Errorf("get rate stream error: %w", err)
 	}
+	switch code := data.Get("error").Int(); code {
+	case 0:
+	case rateStreamOffline:
+		return nil, fmt.Errorf("room is not live: %w", stream.ErrOffline)
+	default:
+		return nil, fmt.Errorf("rate stream api error %d: %s", code, data.Get("msg").String())
+	}
 	streamID := strings.Split(filepath.Base(data.Get("data.rtmp_live").String()), ".")[0]
 	uuid := uuidgen.NewV4()
 	s := rand.New(rand.NewSource(time.Now().Unix()))
 	playID := l.t13 + "-" + strconv.Itoa(int(math.Floor(s.Float64()*999999998))) + "1"
 	switch data.Get("data.p2p").Int() {
 	case 0, 9:
-		return url.Parse(fmt.Sprintf("%s/%s", data.Get("data.rtmp_url").String(), data.Get("data.rtmp_live").String()))
+		u, err := url.Parse(fmt.Sprintf("%s/%s", data.Get("data.rtmp_url").String(), data.Get("data.rtmp_live").String()))
+		if err != nil {
+			return nil, err
+		}
+		return []*url.URL{u}, nil
 	case 2:
 		txTime := fmt.Sprintf("%x", int64(math.Round((float64(time.Now().UnixMilli())+600000)/1000)))
 		streamID := strings.Split(data.Get("data.rtmp_live").String(), ".")[0]
@@ -54,50 +86,78 @@ func (l *Link) GetLink(_ string) (*url.URL, error) {
 		if err != nil {
 			return nil, fmt.Errorf("parse origin url error: %w", err)
 		}
-		u.Host = "hlsh5p2.douyucdn2.cn"
-		return url.Parse(strings.ReplaceAll(u.String(), ".flv", ".xs"))
+		hosts := []string{xsHost}
+		if u.Host != "" && u.Host != xsHost {
+			hosts = append(hosts, u.Host)
+		}
+		links := make([]*url.URL, 0, len(hosts))
+		for _, host := range hosts {
+			xs := *u
+			xs.Host = host
+			link, err := url.Parse(strings.ReplaceAll(xs.String(), ".flv", ".xs"))
+			if err != nil {
+				return nil, fmt.Errorf("parse xs url error: %w", err)
+			}
+			links = append(links, link)
+		}
+		return links, nil
 	case 10:
-		u := fmt.Sprintf("wss://%s/%s/live/%s&delay=%s&playid=%s&uuid=%s&txSecret=%s&txTime=%s",
-			func() string {
-				if data.Get("data.p2pMeta.dyxp2p_sug_egde").Exists() {
-					return data.Get("data.p2pMeta.dyxp2p_sug_egde").String()
-				}
-				hostURL := fmt.Sprintf("https://%s/%s.xs?playid=%s&uuid=%s",
-					data.Get("data.p2pMeta.xp2p_api_domain").String(),
-					streamID,
-					playID,
-					uuid.String(),
-				)
-				log.WithField("field", "host url").Debug(hostURL)
-				getHostBodyResp, err := l.client.Get(hostURL)
-				if err != nil {
-					log.WithField("field", "get host body error").Errorln(err.Error())
-					return ""
-				}
-				defer getHostBodyResp.Body.Close()
-				hostBody, err := io.ReadAll(getHostBodyResp.Body)
-				if err != nil {
-					log.WithField("field", "parse host body error").Errorln(err.Error())
-					return ""
-				}
-				log.WithField("field", "host body").Debug(string(hostBody))
-				return gjson.GetBytes(hostBody, "sug").Array()[0].String()
-			}(),
-			func() string {
-				if data.Get("data.p2pMeta.dyxp2p_domain").Exists() {
-					return data.Get("data.p2pMeta.dyxp2p_domain").String()
-				}
-				return data.Get("data.p2pMeta.xp2p_domain").String()
-			}(),
-			data.Get("data.rtmp_live").String(),
-			data.Get("data.p2pMeta.xp2p_txDelay").String(),
-			playID,
-			uuid.String(),
-			data.Get("data.p2pMeta.xp2p_txSecret").String(),
-			data.Get("data.p2pMeta.xp2p_txTime").String())
+		edges := func() []string {
+			if data.Get("data.p2pMeta.dyxp2p_sug_egde").Exists() {
+				return []string{data.Get("data.p2pMeta.dyxp2p_sug_egde").String()}
+			}
+			hostURL := fmt.Sprintf("https://%s/%s.xs?playid=%s&uuid=%s",
+				data.Get("data.p2pMeta.xp2p_api_domain").String(),
+				streamID,
+				playID,
+				uuid.String(),
+			)
+			log.WithField("field", "host url").Debug(hostURL)
+			getHostBodyResp, err := l.get(ctx, hostURL)
+			if err != nil {
+				log.WithField("field", "get host body error").Errorln(err.Error())
+				return nil
+			}
+			defer getHostBodyResp.Body.Close()
+			hostBody, err := io.ReadAll(getHostBodyResp.Body)
+			if err != nil {
+				log.WithField("field", "parse host body error").Errorln(err.Error())
+				return nil
+			}
+			log.WithField("field", "host body").Debug(string(hostBody))
+			var sug []string
+			for _, edge := range gjson.GetBytes(hostBody, "sug").Array() {
+				sug = append(sug, edge.String())
+			}
+			return sug
+		}()
+		if len(edges) == 0 {
+			return nil, errors.New("no xp2p edge available")
+		}
+		domain := data.Get("data.p2pMeta.xp2p_domain").String()
+		if data.Get("data.p2pMeta.dyxp2p_domain").Exists() {
+			domain = data.Get("data.p2pMeta.dyxp2p_domain").String()
+		}
+		links := make([]*url.URL, 0, len(edges))
+		for _, edge := range edges {
+			u := fmt.Sprintf("wss://%s/%s/live/%s&delay=%s&playid=%s&uuid=%s&txSecret=%s&txTime=%s",
+				edge,
+				domain,
+				data.Get("data.rtmp_live").String(),
+				data.Get("data.p2pMeta.xp2p_txDelay").String(),
+				playID,
+				uuid.String(),
+				data.Get("data.p2pMeta.xp2p_txSecret").String(),
+				data.Get("data.p2pMeta.xp2p_txTime").String())
 
-		u = strings.ReplaceAll(u, ".flv", ".xs")
-		return url.Parse(u)
+			u = strings.ReplaceAll(u, ".flv", ".xs")
+			link, err := url.Parse(u)
+			if err != nil {
+				return nil, fmt.Errorf("parse xp2p url error: %w", err)
+			}
+			links = append(links, link)
+		}
+		return links, nil
 	}
-	return nil, nil
+	return nil, fmt.Errorf("unsupported p2p type %d", data.Get("data.p2p").Int())
 }
@@ -1,6 +1,7 @@
 package DouYu
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -18,11 +19,11 @@ type streamParameters struct {
 	CookiePre string `json:"cookiePre"`
 }
 
-func (l *Link) getLegacyFirstStreamParameters(rfid string) (sp streamParameters, err error) {
+func (l *Link) getLegacyFirstStreamParameters(ctx context.Context, rfid string) (sp streamParameters, err error) {
 	log := global.Log.WithField("func", "app.engine.extractor.DouYu.getLegacyFirstStreamParameters")
 	log.WithField("rfid", rfid).Debugln("fetching stream parameters")
 	streamParamRegex := regexp.MustCompile(`window.preloadStreamUrlPromise = getLegacyFirstStream\((.*)\)\s?;`)
-	resp, err := l.client.Get(fmt.Sprintf("https://www.douyu.com/%s", rfid))
+	resp, err := l.get(ctx, fmt.Sprintf("https://www.douyu.com/%s", rfid))
 	if err != nil {
 		log.WithError(err).Errorln("failed to request room page")
 		return sp, fmt.Errorf("send request error when getting real room id: %w", err)
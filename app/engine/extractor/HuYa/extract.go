@@ -9,36 +9,60 @@ import (
 	"slices"
 	"time"
 
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/stream"
 	"github.com/nv4d1k/live-stream-forwarder/global"
 	"github.com/tidwall/gjson"
 )
 
 func (l *Link) GetLink(format string) (*url.URL, error) {
-	log := global.Log.WithField("func", "app.engine.extractor.HuYa.GetLink")
+	links, err := l.GetLinks(format)
+	if err != nil {
+		return nil, err
+	}
+	return links[0], nil
+}
+
+// GetLinks returns the stream URL on every CDN line of the room, in random
+// order for load balancing.
+func (l *Link) GetLinks(format string) ([]*url.URL, error) {
+	log := global.Log.WithField("func", "app.engine.extractor.HuYa.GetLinks")
 	liveStatus := l.res.Get("roomInfo.eLiveStatus").Int()
 	log.WithField("liveStatus", liveStatus).WithField("format", format).Debugln("getting stream link")
 	switch liveStatus {
 	case 2:
-		liveInfo, err := l.getLive(format)
+		lives, err := l.getLives(format)
 		if err != nil {
 			log.WithError(err).Errorln("failed to get live info")
 			return nil, fmt.Errorf("get live info error: %w", err)
 		}
-		return url.Parse(liveInfo)
+		links := make([]*url.URL, 0, len(lives))
+		for _, live := range lives {
+			u, err := url.Parse(live)
+			if err != nil {
+				return nil, fmt.Errorf("parse live url error: %w", err)
+			}
+			links = append(links, u)
+		}
+		return links, nil
 	case 3:
 		liveLineURL, err := base64.StdEncoding.DecodeString(l.res.Get("roomProfile.liveLineUrl").String())
 		if err != nil {
 			log.WithError(err).Errorln("failed to decode live line url")
 			return nil, fmt.Errorf("decoding live line url error: %w", err)
 		}
-		return url.Parse(fmt.Sprintf("https:%s", liveLineURL))
+		u, err := url.Parse(fmt.Sprintf("https:%s", liveLineURL))
+		if err != nil {
+			return nil, err
+		}
+		return []*url.URL{u}, nil
 	}
 	log.Warnln("room is not streaming")
-	return nil, errors.New("not streaming now")
+	return nil, fmt.Errorf("not streaming now: %w", stream.ErrOffline)
 }
 
-func (l *Link) getLive(format string) (string, error) {
-	log := global.Log.WithField("func", "app.engine.extractor.HuYa.getLive")
+// getLives returns the URLs of all lines for the requested format, shuffled.
+func (l *Link) getLives(format string) ([]string, error) {
+	log := global.Log.WithField("func", "app.engine.extractor.HuYa.getLives")
 	var (
 		stream_info     []string
 		flv_stream_info []string
@@ -85,22 +109,25 @@ func (l *Link) getLive(format string) (string, error) {
 	})
 	stream_info = slices.Concat(flv_stream_info, hls_stream_info)
 	if len(stream_info) <= 0 {
-		return "", errors.New("no validate link found")
+		return nil, errors.New("no validate link found")
 	}
-	r := rand.New(rand.NewSource(time.Now().Unix()))
 
+	var lives []string
 	switch format {
 	case "flv":
 		if len(flv_stream_info) <= 0 {
-			return "", errors.New("no validate flv link found")
+			return nil, errors.New("no validate flv link found")
 		}
-		return flv_stream_info[r.Intn(len(flv_stream_info)-1)], nil
+		lives = flv_stream_info
 	case "hls":
 		if len(hls_stream_info) <= 0 {
-			return "", errors.New("no validate hls link found")
+			return nil, errors.New("no validate hls link found")
 		}
-		return hls_stream_info[r.Intn(len(hls_stream_info)-1)], nil
+		lives = hls_stream_info
 	default:
-		return stream_info[r.Intn(len(stream_info)-1)], nil
+		lives = stream_info
 	}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	r.Shuffle(len(lives), func(i, j int) { lives[i], lives[j] = lives[j], lives[i] })
+	return lives, nil
 }
@@ -1,9 +1,11 @@
 package HuYa
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/nv4d1k/live-stream-forwarder/app/engine/extractor"
 	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/httpweb"
@@ -20,6 +22,9 @@ func init() {
 		Factory: func(rid string, proxy *url.URL) (extractor.Extractor, error) {
 			return NewHuyaLink(rid, proxy)
 		},
+		ContextFactory: func(ctx context.Context, rid string, proxy *url.URL) (extractor.Extractor, error) {
+			return NewHuyaLinkContext(ctx, rid, proxy)
+		},
 		Mobile:       true,
 		InitialError: 500,
 	})
@@ -32,9 +37,22 @@ type Link struct {
 	uuid   string
 	res    gjson.Result
 	client *http.Client
+
+	fetchedAt time.Time // when res was loaded; zero if it was not fetched
 }
 
+// roomInfoMaxAge is how long the room page is reused before Extract reloads
+// it, so re-extraction notices when the streamer goes offline or switches
+// lines.
+const roomInfoMaxAge = 10 * time.Second
+
 func NewHuyaLink(rid string, proxy *url.URL) (*Link, error) {
+	return NewHuyaLinkContext(context.Background(), rid, proxy)
+}
+
+// NewHuyaLinkContext is like NewHuyaLink but aborts the room info and login
+// requests once ctx is done.
+func NewHuyaLinkContext(ctx context.Context, rid string, proxy *url.URL) (*Link, error) {
 	log := global.Log.WithField("func", "app.engine.extractor.HuYa.NewHuyaLink")
 	var (
 		err error
@@ -47,12 +65,12 @@ func NewHuyaLink(rid string, proxy *url.URL) (*Link, error) {
 	} else {
 		hy.client = &http.Client{Transport: httpweb.NewAddHeaderTransport(nil, true)}
 	}
-	err = hy.getRoomInfo()
+	err = hy.getRoomInfo(ctx)
 	if err != nil {
 		log.WithError(err).Errorln("failed to get room info")
 		return nil, fmt.Errorf("get room info error: %w", err)
 	}
-	err = hy.getAnonymousUID()
+	err = hy.getAnonymousUID(ctx)
 	if err != nil {
 		log.WithError(err).Errorln("failed to get anonymous user id")
 		return nil, fmt.Errorf("get anonymous user id error: %w", err)
@@ -63,7 +81,18 @@ func NewHuyaLink(rid string, proxy *url.URL) (*Link, error) {
 }
 
 func (l *Link) Extract(format string) (*extractor.Result, error) {
+	return l.ExtractContext(context.Background(), format)
+}
+
+func (l *Link) ExtractContext(ctx context.Context, format string) (*extractor.Result, error) {
 	log := global.Log.WithField("func", "app.engine.extractor.HuYa.Extract")
+	if !l.fetchedAt.IsZero() && time.Since(l.fetchedAt) > roomInfoMaxAge {
+		log.Debugln("room info is stale, reloading")
+		if err := l.getRoomInfo(ctx); err != nil {
+			log.WithError(err).Errorln("failed to reload room info")
+			return nil, fmt.Errorf("get room info error: %w", err)
+		}
+	}
 	if format == "" {
 		format = l.DefaultFormat()
 	}
@@ -72,13 +101,23 @@ func (l *Link) Extract(format string) (*extractor.Result, error) {
 		log.Debugln("normalizing format from m3u8 to hls")
 		format = "hls"
 	}
-	u, err := l.GetLink(format)
+	links, err := l.GetLinks(format)
 	if err != nil {
 		log.WithError(err).Errorln("failed to get stream link")
 		return nil, err
 	}
-	log.WithField("url", u.String()).Infoln("extracted stream URL")
-	return &extractor.Result{URL: u.String()}, nil
+	urls := make([]string, len(links))
+	for i, u := range links {
+		urls[i] = u.String()
+	}
+	log.WithField("url", urls[0]).WithField("lines", len(urls)).Infoln("extracted stream URL")
+	// HuYa does not rank its lines; they are shuffled and tried as equals.
+	result := &extractor.Result{URL: urls[0], Candidates: extractor.CandidatesFrom(urls, 0)}
+	if exp, err := extractor.ExpiryFromQuery(urls[0], "wsTime", 16); err == nil {
+		result.ExpireAt = &exp
+		log.Debugf("stream URL expires at %s", exp.Format(time.RFC3339))
+	}
+	return result, nil
 }
 
 func (l *Link) SupportedFormats() []string {
@@ -1,6 +1,7 @@
 package HuYa
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -12,11 +13,12 @@ import (
 	"time"
 
 	"github.com/dop251/goja"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/stream"
 	"github.com/nv4d1k/live-stream-forwarder/global"
 	"github.com/tidwall/gjson"
 )
 
-func (l *Link) getAnonymousUID() (err error) {
+func (l *Link) getAnonymousUID(ctx context.Context) (err error) {
 	log := global.Log.WithField("func", "app.engine.extractor.HuYa.getAnonymousUID")
 	var (
 		resp *http.Response
@@ -29,7 +31,12 @@ func (l *Link) getAnonymousUID() (err error) {
         "version": "2.4",
         "data": {}
     }`
-	resp, err = l.client.Post("https://udblgn.huya.com/web/anonymousLogin", "application/json", strings.NewReader(data))
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://udblgn.huya.com/web/anonymousLogin", strings.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("making get anonymous uid request error: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = l.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("sending get anonymous uid request error: %w", err)
 	}
@@ -52,14 +59,15 @@ func (l *Link) getAnonymousUID() (err error) {
 	return nil
 }
 
-func (l *Link) getRoomInfo() (err error) {
+func (l *Link) getRoomInfo(ctx context.Context) (err error) {
 	log := global.Log.WithField("func", "app.engine.extractor.HuYa.getRoomInfo")
 	var (
 		req  *http.Request
 		resp *http.Response
 		body []byte
 	)
-	req, err = http.NewRequest("GET", fmt.Sprintf("https://m.huya.com/%s", l.rid), nil)
+	roomURL := fmt.Sprintf("https://m.huya.com/%s", l.rid)
+	req, err = http.NewRequestWithContext(ctx, "GET", roomURL, nil)
 	if err != nil {
 		return fmt.Errorf("making request for get room info error: %w", err)
 	}
@@ -67,7 +75,7 @@ func (l *Link) getRoomInfo() (err error) {
 	req.Header.Set("User-Agent", global.DEFAULT_MOBILE_USER_AGENT)
 	resp, err = l.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("sending request for get room info error: %w", err)
+		return stream.WrapError("huya", stream.PhaseExtract, roomURL, fmt.Errorf("sending request for get room info error: %w", err))
 	}
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
@@ -75,6 +83,9 @@ func (l *Link) getRoomInfo() (err error) {
 			log.Fatalln(err.Error())
 		}
 	}(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return stream.StatusError("huya", stream.PhaseExtract, roomURL, resp)
+	}
 	body, err = io.ReadAll(resp.Body)
 	if err != nil {
 		return
@@ -122,6 +133,7 @@ function init(){
 	log.WithField("data", res.Export().(string)).Debugln("extract room info")
 
 	l.res = gjson.Parse(res.Export().(string))
+	l.fetchedAt = time.Now()
 	return nil
 }
 
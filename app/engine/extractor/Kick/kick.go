@@ -1,6 +1,7 @@
 package Kick
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/nv4d1k/live-stream-forwarder/app/engine/extractor"
 	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/httpweb"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/stream"
 	"github.com/nv4d1k/live-stream-forwarder/global"
 )
 
@@ -63,10 +65,14 @@ func NewKickLink(rid string, proxy *url.URL) (*Link, error) {
 	return k, nil
 }
 
-func (l *Link) Extract(_ string) (*extractor.Result, error) {
+func (l *Link) Extract(format string) (*extractor.Result, error) {
+	return l.ExtractContext(context.Background(), format)
+}
+
+func (l *Link) ExtractContext(ctx context.Context, _ string) (*extractor.Result, error) {
 	log := global.Log.WithField("func", "app.engine.extractor.Kick.Extract")
 
-	ch, err := l.getChannel()
+	ch, err := l.getChannel(ctx)
 	if err != nil {
 		log.Errorf("failed to get channel info for room %s: %v", l.rid, err)
 		return nil, err
@@ -74,7 +80,7 @@ func (l *Link) Extract(_ string) (*extractor.Result, error) {
 
 	if ch.Livestream == nil || !ch.Livestream.IsLive {
 		log.Warnf("channel %s is offline", l.rid)
-		return nil, fmt.Errorf("channel %s is offline", l.rid)
+		return nil, fmt.Errorf("channel %s is offline: %w", l.rid, stream.ErrOffline)
 	}
 
 	if ch.PlaybackURL == "" {
@@ -110,11 +116,11 @@ func (l *Link) DefaultFormat() string {
 	return "m3u8"
 }
 
-func (l *Link) getChannel() (*channelResponse, error) {
+func (l *Link) getChannel(ctx context.Context) (*channelResponse, error) {
 	log := global.Log.WithField("func", "app.engine.extractor.Kick.getChannel")
 
 	apiURL := l.apiBase + "/api/v2/channels/" + url.PathEscape(l.rid)
-	req, err := http.NewRequest("GET", apiURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("create request: %w", err)
 	}
@@ -124,13 +130,13 @@ func (l *Link) getChannel() (*channelResponse, error) {
 	resp, err := l.client.Do(req)
 	if err != nil {
 		log.Errorf("API request failed for room %s: %v", l.rid, err)
-		return nil, fmt.Errorf("request channel API: %w", err)
+		return nil, stream.WrapError("kick", stream.PhaseExtract, apiURL, fmt.Errorf("request channel API: %w", err))
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		log.Warnf("API returned status %d for room %s", resp.StatusCode, l.rid)
-		return nil, fmt.Errorf("channel API returned status %d", resp.StatusCode)
+		return nil, stream.StatusError("kick", stream.PhaseExtract, apiURL, resp)
 	}
 
 	var ch channelResponse
@@ -1,8 +1,10 @@
 package Kick
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -236,12 +238,37 @@ func TestKick_getChannel_APIError(t *testing.T) {
 		apiBase: ts.URL,
 	}
 
-	_, err := l.getChannel()
+	_, err := l.getChannel(context.Background())
 	if err == nil {
 		t.Fatal("getChannel() should return error for 404 response")
 	}
 }
 
+func TestKick_ExtractContext_Canceled(t *testing.T) {
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer ts.Close()
+	defer close(block)
+
+	l := &Link{
+		rid:     "slow",
+		client:  ts.Client(),
+		apiBase: ts.URL,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	_, err := l.ExtractContext(ctx, "")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("ExtractContext() error = %v, want context.Canceled", err)
+	}
+}
+
 func TestKick_NewKickLink_WithProxy(t *testing.T) {
 	proxyURL, _ := url.Parse("http://proxy:8080")
 	l, err := NewKickLink("testchannel", proxyURL)
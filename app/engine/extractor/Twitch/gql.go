@@ -2,13 +2,16 @@ package Twitch
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math/big"
 	"net/http"
+	"time"
 
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/stream"
 	"github.com/nv4d1k/live-stream-forwarder/global"
 )
 
@@ -18,9 +21,21 @@ const (
 	ua       = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/147.0.0.0 Safari/537.36"
 )
 
-func (l *Link) getSigToken() error {
-	log := global.Log.WithField("func", "app.engine.extractor.Twitch.getSigToken")
-	log.WithField("rid", l.rid).Debugln("requesting playback access token")
+func (l *Link) getSigToken(ctx context.Context) error {
+	sig, token, err := l.playbackToken(ctx, "site")
+	if err != nil {
+		return err
+	}
+	l.sig, l.token = sig, token
+	l.expireAt = parseTokenExpiry(token)
+	return nil
+}
+
+// playbackToken requests a playback access token for playerType and returns
+// its signature and value.
+func (l *Link) playbackToken(ctx context.Context, playerType string) (sig, token string, err error) {
+	log := global.Log.WithField("func", "app.engine.extractor.Twitch.playbackToken")
+	log.WithField("rid", l.rid).WithField("player_type", playerType).Debugln("requesting playback access token")
 	payload := map[string]any{
 		"operationName": "PlaybackAccessToken_Template",
 		"query":         `query PlaybackAccessToken_Template($login:String!,$isLive:Boolean!,$vodID:ID!,$isVod:Boolean!,$playerType:String!){streamPlaybackAccessToken(channelName:$login,params:{platform:"web",playerBackend:"mediaplayer",playerType:$playerType})@include(if:$isLive){value signature __typename}videoPlaybackAccessToken(id:$vodID,params:{platform:"web",playerBackend:"mediaplayer",playerType:$playerType})@include(if:$isVod){value signature __typename}}`,
@@ -29,17 +44,17 @@ func (l *Link) getSigToken() error {
 			"login":      l.rid,
 			"isVod":      false,
 			"vodID":      "",
-			"playerType": "site",
+			"playerType": playerType,
 		},
 	}
 	body, err := json.Marshal(payload)
 	if err != nil {
-		return fmt.Errorf("marshal gql payload: %w", err)
+		return "", "", fmt.Errorf("marshal gql payload: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", gqlURL, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", gqlURL, bytes.NewReader(body))
 	if err != nil {
-		return err
+		return "", "", err
 	}
 	req.Header.Set("Content-Type", "text/plain;charset=UTF-8")
 	req.Header.Set("Client-ID", clientID)
@@ -49,13 +64,13 @@ func (l *Link) getSigToken() error {
 	resp, err := l.client.Do(req)
 	if err != nil {
 		log.Errorf("gql request failed for room %s: %v", l.rid, err)
-		return err
+		return "", "", stream.WrapError("twitch", stream.PhaseExtract, gqlURL, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		log.Warnf("gql request returned status %d for room %s", resp.StatusCode, l.rid)
-		return fmt.Errorf("gql request returned status %d", resp.StatusCode)
+		return "", "", stream.StatusError("twitch", stream.PhaseExtract, gqlURL, resp)
 	}
 
 	var out struct {
@@ -68,16 +83,26 @@ func (l *Link) getSigToken() error {
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
 		log.Errorf("failed to decode gql response for room %s: %v", l.rid, err)
-		return fmt.Errorf("decode gql response: %w", err)
+		return "", "", fmt.Errorf("decode gql response: %w", err)
 	}
 	if out.Data.StreamPlaybackAccessToken.Signature == "" {
 		log.Warnf("empty playback token for room %s (channel may be offline or restricted)", l.rid)
-		return fmt.Errorf("empty playback token (channel may be offline or restricted)")
+		return "", "", fmt.Errorf("empty playback token (channel may be offline or restricted)")
 	}
-	l.sig = out.Data.StreamPlaybackAccessToken.Signature
-	l.token = out.Data.StreamPlaybackAccessToken.Value
 	log.Debugf("obtained playback access token for room %s", l.rid)
-	return nil
+	return out.Data.StreamPlaybackAccessToken.Signature, out.Data.StreamPlaybackAccessToken.Value, nil
+}
+
+// parseTokenExpiry returns the "expires" field of a playback access token,
+// which is a JSON document. It returns the zero time if there is none.
+func parseTokenExpiry(token string) time.Time {
+	var claims struct {
+		Expires int64 `json:"expires"`
+	}
+	if err := json.Unmarshal([]byte(token), &claims); err != nil || claims.Expires <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Expires, 0)
 }
 
 func randHex(n int) string {
@@ -1,11 +1,14 @@
 package Twitch
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/nv4d1k/live-stream-forwarder/app/engine/extractor"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/hls"
 	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/httpweb"
 	"github.com/nv4d1k/live-stream-forwarder/global"
 )
@@ -19,19 +22,42 @@ func init() {
 		Factory: func(rid string, proxy *url.URL) (extractor.Extractor, error) {
 			return NewTwitchLink(rid, proxy)
 		},
+		ContextFactory: func(ctx context.Context, rid string, proxy *url.URL) (extractor.Extractor, error) {
+			return NewTwitchLinkContext(ctx, rid, proxy)
+		},
 		Mobile:       false,
 		InitialError: 500,
+		HLSAds:       extractor.AdOptions{Detector: hls.TwitchAds, Strategy: hls.AdsPassthrough},
 	})
 }
 
 type Link struct {
-	rid    string
-	sig    string
-	token  string
-	client *http.Client
+	rid        string
+	sig        string
+	token      string
+	expireAt   time.Time // token expiry; zero if unknown
+	adSig      string    // token for AdFreePlayerType, fetched on first use
+	adToken    string
+	adExpireAt time.Time
+	client     *http.Client
 }
 
+// AdFreePlayerType is the player type ExtractAdFree requests a playback token
+// for. Twitch stitches fewer ads into the playlists of some embedded players
+// than into the site player's.
+var AdFreePlayerType = "embed"
+
+// tokenRenewLead is how long before expiry Extract fetches a new playback
+// access token instead of reusing the current one.
+const tokenRenewLead = 2 * time.Minute
+
 func NewTwitchLink(rid string, proxy *url.URL) (*Link, error) {
+	return NewTwitchLinkContext(context.Background(), rid, proxy)
+}
+
+// NewTwitchLinkContext is like NewTwitchLink but aborts the access token
+// request once ctx is done.
+func NewTwitchLinkContext(ctx context.Context, rid string, proxy *url.URL) (*Link, error) {
 	log := global.Log.WithField("func", "app.engine.extractor.Twitch.NewTwitchLink")
 	tw := &Link{rid: rid}
 	if proxy != nil {
@@ -40,7 +66,7 @@ func NewTwitchLink(rid string, proxy *url.URL) (*Link, error) {
 		tw.client = &http.Client{Transport: httpweb.NewAddHeaderTransport(nil, false)}
 	}
 	log.Debugf("creating Twitch extractor for room %s", rid)
-	if err := tw.getSigToken(); err != nil {
+	if err := tw.getSigToken(ctx); err != nil {
 		log.Errorf("failed to get sig/token for room %s: %v", rid, err)
 		return nil, err
 	}
@@ -48,15 +74,58 @@ func NewTwitchLink(rid string, proxy *url.URL) (*Link, error) {
 	return tw, nil
 }
 
-func (l *Link) Extract(_ string) (*extractor.Result, error) {
+func (l *Link) Extract(format string) (*extractor.Result, error) {
+	return l.ExtractContext(context.Background(), format)
+}
+
+func (l *Link) ExtractContext(ctx context.Context, _ string) (*extractor.Result, error) {
 	log := global.Log.WithField("func", "app.engine.extractor.Twitch.Extract")
-	u, err := l.GetLink(l.DefaultFormat())
+	if !l.expireAt.IsZero() && time.Until(l.expireAt) < tokenRenewLead {
+		log.Debugf("playback token for room %s expires at %s, renewing", l.rid, l.expireAt.Format(time.RFC3339))
+		if err := l.getSigToken(ctx); err != nil {
+			log.Errorf("failed to renew sig/token for room %s: %v", l.rid, err)
+			return nil, err
+		}
+	}
+	u, err := l.usherURL(l.sig, l.token)
 	if err != nil {
 		log.Errorf("failed to get link for room %s: %v", l.rid, err)
 		return nil, err
 	}
 	log.Debugf("extracted stream URL for room %s", l.rid)
-	return &extractor.Result{URL: u.String()}, nil
+	result := &extractor.Result{URL: u.String()}
+	if !l.expireAt.IsZero() {
+		exp := l.expireAt
+		result.ExpireAt = &exp
+	}
+	return result, nil
+}
+
+// ExtractAdFree is like ExtractContext but returns the playlist served to
+// AdFreePlayerType, which an HLSStream switches to during ad breaks.
+func (l *Link) ExtractAdFree(ctx context.Context, _ string) (*extractor.Result, error) {
+	log := global.Log.WithField("func", "app.engine.extractor.Twitch.ExtractAdFree")
+	if l.adSig == "" || !l.adExpireAt.IsZero() && time.Until(l.adExpireAt) < tokenRenewLead {
+		sig, token, err := l.playbackToken(ctx, AdFreePlayerType)
+		if err != nil {
+			log.Errorf("failed to get %s sig/token for room %s: %v", AdFreePlayerType, l.rid, err)
+			return nil, err
+		}
+		l.adSig, l.adToken = sig, token
+		l.adExpireAt = parseTokenExpiry(token)
+	}
+	u, err := l.usherURL(l.adSig, l.adToken)
+	if err != nil {
+		log.Errorf("failed to get link for room %s: %v", l.rid, err)
+		return nil, err
+	}
+	log.Debugf("extracted %s stream URL for room %s", AdFreePlayerType, l.rid)
+	result := &extractor.Result{URL: u.String()}
+	if !l.adExpireAt.IsZero() {
+		exp := l.adExpireAt
+		result.ExpireAt = &exp
+	}
+	return result, nil
 }
 
 func (l *Link) SupportedFormats() []string {
@@ -68,6 +137,12 @@ func (l *Link) DefaultFormat() string {
 }
 
 func (l *Link) GetLink(_ string) (*url.URL, error) {
+	return l.usherURL(l.sig, l.token)
+}
+
+// usherURL returns the URL of the stream's master playlist for a playback
+// access token.
+func (l *Link) usherURL(sig, token string) (*url.URL, error) {
 	log := global.Log.WithField("func", "app.engine.extractor.Twitch.GetLink")
 	params := url.Values{}
 	params.Set("allow_source", "true")
@@ -79,8 +154,8 @@ func (l *Link) GetLink(_ string) (*url.URL, error) {
 	params.Set("player_backend", "mediaplayer")
 	params.Set("playlist_include_framerate", "true")
 	params.Set("reassignments_supported", "true")
-	params.Set("sig", l.sig)
-	params.Set("token", l.token)
+	params.Set("sig", sig)
+	params.Set("token", token)
 	params.Set("cdm", "wv")
 	params.Set("player_version", "1.30.0")
 
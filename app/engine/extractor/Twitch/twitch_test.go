@@ -51,6 +51,10 @@ func TestTwitch_Registry(t *testing.T) {
 	if entry.Factory == nil {
 		t.Error("Factory should not be nil")
 	}
+	if entry.HLSAds.Detector == nil {
+		t.Error("HLSAds.Detector should not be nil")
+	}
+	var _ extractor.AdFreeExtractor = (*Link)(nil)
 }
 
 func TestTwitch_GetLink(t *testing.T) {
@@ -162,3 +166,29 @@ func TestTwitch_GetLink_DifferentChannels(t *testing.T) {
 		})
 	}
 }
+
+func TestParseTokenExpiry(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		want  int64 // Unix seconds; 0 means the zero time
+	}{
+		{"with expires", `{"adblock":false,"channel":"test","expires":1700000000,"user_id":null}`, 1700000000},
+		{"without expires", `{"channel":"test"}`, 0},
+		{"not json", "abc", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseTokenExpiry(tt.token)
+			if tt.want == 0 {
+				if !got.IsZero() {
+					t.Errorf("parseTokenExpiry() = %s, want zero time", got)
+				}
+				return
+			}
+			if got.Unix() != tt.want {
+				t.Errorf("parseTokenExpiry() = %d, want %d", got.Unix(), tt.want)
+			}
+		})
+	}
+}
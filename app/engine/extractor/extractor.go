@@ -1,17 +1,68 @@
 package extractor
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
+
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/hls"
 )
 
 // Result holds the resolved stream URL and any headers required to fetch it.
 type Result struct {
 	URL             string
 	Headers         http.Header
-	ExpireAt        *time.Time // when the URL expires; nil means unknown or no expiry
-	VariantSelector any        // optional func([]*libm3u8.Variant) *libm3u8.Variant; used by HLS forwarder
+	ExpireAt        *time.Time  // when the URL expires; nil means unknown or no expiry
+	VariantSelector any         // optional func([]*libm3u8.Variant) *libm3u8.Variant; used by HLS forwarder
+	Candidates      []Candidate // optional alternate URLs for the same stream, including URL
+}
+
+// Candidate is one URL a stream can be fetched from, typically the same
+// stream on another CDN edge. Forwarders try candidates with a lower
+// Priority first and fall back to the others when an edge fails.
+type Candidate struct {
+	URL      string
+	Priority int
+}
+
+// CandidatesFrom builds the candidate list for urls in the given order. The
+// first preferred URLs, those the platform itself ranks first, get priority
+// 0 and the rest priority 1. A single URL needs no candidates, so fewer than
+// two URLs yield nil.
+func CandidatesFrom(urls []string, preferred int) []Candidate {
+	if len(urls) < 2 {
+		return nil
+	}
+	c := make([]Candidate, len(urls))
+	for i, u := range urls {
+		c[i] = Candidate{URL: u}
+		if i >= preferred {
+			c[i].Priority = 1
+		}
+	}
+	return c
+}
+
+// ExpiryFromQuery reads the expiry of a signed stream URL from its query
+// parameter key, a Unix time in seconds written in the given base (10, or
+// 16 for the hex timestamps used by Tencent-style CDN signatures).
+func ExpiryFromQuery(rawURL, key string, base int) (time.Time, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parse stream URL: %w", err)
+	}
+	v := u.Query().Get(key)
+	if v == "" {
+		return time.Time{}, fmt.Errorf("no %s query parameter", key)
+	}
+	sec, err := strconv.ParseInt(v, base, 64)
+	if err != nil || sec <= 0 {
+		return time.Time{}, fmt.Errorf("invalid %s query parameter %q", key, v)
+	}
+	return time.Unix(sec, 0), nil
 }
 
 // Extractor is the unified interface that every platform extractor must implement.
@@ -31,6 +82,44 @@ type Extractor interface {
 	DefaultFormat() string
 }
 
+// ContextExtractor is an optional interface for extractors whose API
+// requests can be canceled. Forwarders call it through ExtractContext.
+type ContextExtractor interface {
+	ExtractContext(ctx context.Context, format string) (*Result, error)
+}
+
+// ExtractContext resolves a stream URL under ctx. Extractors that implement
+// ContextExtractor are called directly; for the others Extract runs in the
+// background and its result is abandoned once ctx is done.
+func ExtractContext(ctx context.Context, e Extractor, format string) (*Result, error) {
+	if ce, ok := e.(ContextExtractor); ok {
+		return ce.ExtractContext(ctx, format)
+	}
+	type extractResult struct {
+		r   *Result
+		err error
+	}
+	ch := make(chan extractResult, 1)
+	go func() {
+		r, err := e.Extract(format)
+		ch <- extractResult{r, err}
+	}()
+	select {
+	case res := <-ch:
+		return res.r, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// AdFreeExtractor is an optional interface for extractors that can resolve
+// a playlist of the stream served without stitched ads, or with fewer, such
+// as Twitch's for another player type. The HLS forwarder plays it during ad
+// breaks with the "switch" ad strategy.
+type AdFreeExtractor interface {
+	ExtractAdFree(ctx context.Context, format string) (*Result, error)
+}
+
 // CookieSetter is an optional interface that extractors can implement to
 // receive a raw cookie string for authenticated API requests.
 type CookieSetter interface {
@@ -40,11 +129,50 @@ type CookieSetter interface {
 // Factory creates an Extractor for a given room ID and optional proxy.
 type Factory func(rid string, proxy *url.URL) (Extractor, error)
 
+// ContextFactory is like Factory but stops any API requests made while
+// creating the extractor once ctx is done.
+type ContextFactory func(ctx context.Context, rid string, proxy *url.URL) (Extractor, error)
+
 // RegistryEntry bundles a Factory with platform-specific forwarding config.
 type RegistryEntry struct {
-	Factory      Factory
-	Mobile       bool // whether to use mobile User-Agent for HTTP transport
-	InitialError int  // HTTP status code for initial extraction errors
+	Factory        Factory
+	ContextFactory ContextFactory // optional; preferred over Factory by New
+	Mobile         bool           // whether to use mobile User-Agent for HTTP transport
+	InitialError   int            // HTTP status code for initial extraction errors
+	HLSPrefetch    int            // HLS segments downloaded at once; 0 uses the forwarder's default
+	HLSAds         AdOptions      // handling of ads stitched into the platform's HLS playlists
+}
+
+// AdOptions configures how the HLS forwarder handles the ads a platform
+// stitches into its playlists. The zero value forwards them like any other
+// segment.
+type AdOptions struct {
+	Detector hls.AdDetector // optional, such as hls.TwitchAds
+	Strategy hls.AdStrategy // AdsSwitch plays an AdFreeExtractor's playlist during ad breaks
+}
+
+// New creates an extractor under ctx, using ContextFactory when the platform
+// provides one. Plain factories run in the background and their result is
+// abandoned once ctx is done.
+func (e RegistryEntry) New(ctx context.Context, rid string, proxy *url.URL) (Extractor, error) {
+	if e.ContextFactory != nil {
+		return e.ContextFactory(ctx, rid, proxy)
+	}
+	type factoryResult struct {
+		ext Extractor
+		err error
+	}
+	ch := make(chan factoryResult, 1)
+	go func() {
+		ext, err := e.Factory(rid, proxy)
+		ch <- factoryResult{ext, err}
+	}()
+	select {
+	case res := <-ch:
+		return res.ext, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 // Registry maps lowercase platform names to their entries.
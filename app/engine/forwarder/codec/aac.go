@@ -0,0 +1,175 @@
+package codec
+
+import (
+	"fmt"
+)
+
+// AAC audio object types.
+const (
+	AACMain = 1
+	AACLC   = 2
+	AACSSR  = 3
+	AACLTP  = 4
+	AACSBR  = 5  // HE-AAC
+	AACPS   = 29 // HE-AAC v2
+)
+
+// aacSampleRates maps the sampling frequency index to the rate in Hz.
+var aacSampleRates = [...]int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// AudioSpecificConfig holds the fields of an MPEG-4 AudioSpecificConfig
+// needed to frame AAC, the sequence header of AAC in FLV and MP4.
+type AudioSpecificConfig struct {
+	// ObjectType is the core object type: for HE-AAC signalled
+	// explicitly, the type of the underlying codec rather than SBR or PS.
+	ObjectType      int
+	SampleRateIndex int
+	SampleRate      int
+	Channels        int // channel configuration; 0 means defined in-band
+}
+
+// ParseAudioSpecificConfig parses an AudioSpecificConfig.
+func ParseAudioSpecificConfig(b []byte) (AudioSpecificConfig, error) {
+	r := &bitReader{b: b}
+	short := fmt.Errorf("%w: AudioSpecificConfig too short", ErrInvalidConfig)
+
+	objectType := func() (int, bool) {
+		t, ok := r.read(5)
+		if ok && t == 31 {
+			var ext int
+			ext, ok = r.read(6)
+			t = 32 + ext
+		}
+		return t, ok
+	}
+	sampleRate := func() (int, int, bool) {
+		idx, ok := r.read(4)
+		if !ok {
+			return 0, 0, false
+		}
+		if idx == 0x0F {
+			rate, ok := r.read(24)
+			return idx, rate, ok
+		}
+		if idx >= len(aacSampleRates) {
+			return idx, 0, true
+		}
+		return idx, aacSampleRates[idx], true
+	}
+
+	var c AudioSpecificConfig
+	var ok bool
+	if c.ObjectType, ok = objectType(); !ok {
+		return AudioSpecificConfig{}, short
+	}
+	if c.SampleRateIndex, c.SampleRate, ok = sampleRate(); !ok {
+		return AudioSpecificConfig{}, short
+	}
+	if c.Channels, ok = r.read(4); !ok {
+		return AudioSpecificConfig{}, short
+	}
+	if c.ObjectType == AACSBR || c.ObjectType == AACPS {
+		// Explicit SBR signalling: the extension sampling rate follows,
+		// then the core object type. ADTS carries the core codec.
+		if _, _, ok = sampleRate(); !ok {
+			return AudioSpecificConfig{}, short
+		}
+		if c.ObjectType, ok = objectType(); !ok {
+			return AudioSpecificConfig{}, short
+		}
+	}
+	if c.SampleRate == 0 {
+		return AudioSpecificConfig{}, fmt.Errorf("%w: reserved sampling frequency index %d", ErrInvalidConfig, c.SampleRateIndex)
+	}
+	return c, nil
+}
+
+// ADTSHeaderSize is the size of an ADTS header without CRC.
+const ADTSHeaderSize = 7
+
+// AppendADTSHeader appends the ADTS header for a raw AAC frame of
+// frameSize bytes to b. ADTS can only describe the first four object types
+// and the indexed sampling rates.
+func (c AudioSpecificConfig) AppendADTSHeader(b []byte, frameSize int) ([]byte, error) {
+	if c.ObjectType < AACMain || c.ObjectType > AACLTP {
+		return b, fmt.Errorf("%w: AAC object type %d cannot be carried in ADTS", ErrInvalidConfig, c.ObjectType)
+	}
+	if c.SampleRateIndex >= len(aacSampleRates) {
+		return b, fmt.Errorf("%w: sampling rate %d cannot be carried in ADTS", ErrInvalidConfig, c.SampleRate)
+	}
+	n := frameSize + ADTSHeaderSize
+	if n > 0x1FFF {
+		return b, fmt.Errorf("AAC frame of %d bytes too large for ADTS", frameSize)
+	}
+	profile := byte(c.ObjectType - 1)
+	return append(b,
+		0xFF,
+		0xF1, // MPEG-4, layer 0, no CRC
+		profile<<6|byte(c.SampleRateIndex)<<2|byte(c.Channels>>2)&0x01,
+		byte(c.Channels&0x03)<<6|byte(n>>11),
+		byte(n>>3),
+		byte(n&0x07)<<5|0x1F, // buffer fullness 0x7FF: variable rate
+		0xFC,                 // one raw data block
+	), nil
+}
+
+// AppendTo appends the configuration as an AudioSpecificConfig to b.
+func (c AudioSpecificConfig) AppendTo(b []byte) []byte {
+	w := &bitWriter{b: b}
+	if c.ObjectType >= 31 {
+		w.write(31, 5)
+		w.write(c.ObjectType-32, 6)
+	} else {
+		w.write(c.ObjectType, 5)
+	}
+	w.write(c.SampleRateIndex, 4)
+	if c.SampleRateIndex == 0x0F {
+		w.write(c.SampleRate, 24)
+	}
+	w.write(c.Channels, 4)
+	w.write(0, 3) // GASpecificConfig: 1024 samples, no core coder, no extension
+	return w.b
+}
+
+// ADTSHeader is the header of an ADTS frame.
+type ADTSHeader struct {
+	Config     AudioSpecificConfig
+	HeaderSize int // 7, or 9 with CRC
+	FrameSize  int // including the header
+}
+
+// ParseADTSHeader parses the ADTS header at the start of b.
+func ParseADTSHeader(b []byte) (ADTSHeader, error) {
+	if len(b) < ADTSHeaderSize {
+		return ADTSHeader{}, fmt.Errorf("%w: ADTS header too short", ErrInvalidConfig)
+	}
+	if b[0] != 0xFF || b[1]&0xF6 != 0xF0 {
+		return ADTSHeader{}, fmt.Errorf("%w: no ADTS sync word", ErrInvalidConfig)
+	}
+	h := ADTSHeader{
+		Config: AudioSpecificConfig{
+			ObjectType:      int(b[2]>>6) + 1,
+			SampleRateIndex: int(b[2] >> 2 & 0x0F),
+			Channels:        int(b[2]&0x01)<<2 | int(b[3]>>6),
+		},
+		HeaderSize: ADTSHeaderSize,
+		FrameSize:  int(b[3]&0x03)<<11 | int(b[4])<<3 | int(b[5]>>5),
+	}
+	if b[1]&0x01 == 0 {
+		h.HeaderSize += 2 // CRC
+	}
+	if h.Config.SampleRateIndex >= len(aacSampleRates) {
+		return ADTSHeader{}, fmt.Errorf("%w: reserved sampling frequency index %d", ErrInvalidConfig, h.Config.SampleRateIndex)
+	}
+	h.Config.SampleRate = aacSampleRates[h.Config.SampleRateIndex]
+	if h.FrameSize < h.HeaderSize {
+		return ADTSHeader{}, fmt.Errorf("%w: ADTS frame size %d", ErrInvalidConfig, h.FrameSize)
+	}
+	return h, nil
+}
+
+// CodecString returns the RFC 6381 codec parameter of the configuration,
+// e.g. "mp4a.40.2", as used in MIME types.
+func (c AudioSpecificConfig) CodecString() string {
+	return fmt.Sprintf("mp4a.40.%d", c.ObjectType)
+}
@@ -0,0 +1,344 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidConfig is returned for a malformed decoder configuration record
+// or AudioSpecificConfig.
+var ErrInvalidConfig = errors.New("invalid codec configuration")
+
+// H.264 NAL unit types.
+const (
+	AVCNALSlice = 1
+	AVCNALIDR   = 5
+	AVCNALSEI   = 6
+	AVCNALSPS   = 7
+	AVCNALPPS   = 8
+	AVCNALAUD   = 9
+)
+
+// AVCNALType returns the type of an H.264 NAL unit.
+func AVCNALType(nalu []byte) byte {
+	if len(nalu) == 0 {
+		return 0
+	}
+	return nalu[0] & 0x1F
+}
+
+// AVCConfig is an AVCDecoderConfigurationRecord (ISO/IEC 14496-15), the
+// sequence header of H.264 in FLV and MP4.
+type AVCConfig struct {
+	Profile        byte
+	Compatibility  byte
+	Level          byte
+	NALULengthSize int // size of the length prefix of every NAL unit
+	SPS            [][]byte
+	PPS            [][]byte
+}
+
+// ParseAVCConfig parses an AVCDecoderConfigurationRecord.
+func ParseAVCConfig(b []byte) (AVCConfig, error) {
+	if len(b) < 6 || b[0] != 1 {
+		return AVCConfig{}, fmt.Errorf("%w: AVC configuration record too short or wrong version", ErrInvalidConfig)
+	}
+	c := AVCConfig{
+		Profile:        b[1],
+		Compatibility:  b[2],
+		Level:          b[3],
+		NALULengthSize: int(b[4]&0x03) + 1,
+	}
+	var err error
+	off := 6
+	if c.SPS, off, err = readParameterSets(b, off, int(b[5]&0x1F)); err != nil {
+		return AVCConfig{}, err
+	}
+	if off >= len(b) {
+		return AVCConfig{}, fmt.Errorf("%w: AVC configuration record has no PPS count", ErrInvalidConfig)
+	}
+	if c.PPS, _, err = readParameterSets(b, off+1, int(b[off])); err != nil {
+		return AVCConfig{}, err
+	}
+	return c, nil
+}
+
+// readParameterSets reads count 16-bit length prefixed NAL units from b at
+// off.
+func readParameterSets(b []byte, off, count int) ([][]byte, int, error) {
+	sets := make([][]byte, 0, count)
+	for range count {
+		if off+2 > len(b) {
+			return nil, 0, fmt.Errorf("%w: truncated parameter set", ErrInvalidConfig)
+		}
+		n := int(binary.BigEndian.Uint16(b[off:]))
+		off += 2
+		if off+n > len(b) {
+			return nil, 0, fmt.Errorf("%w: truncated parameter set", ErrInvalidConfig)
+		}
+		sets = append(sets, b[off:off+n])
+		off += n
+	}
+	return sets, off, nil
+}
+
+// SplitLengthPrefixed splits a sample of NAL units, each prefixed by its
+// size in lengthSize bytes as in FLV and MP4, into the NAL units.
+func SplitLengthPrefixed(b []byte, lengthSize int) ([][]byte, error) {
+	if lengthSize < 1 || lengthSize > 4 {
+		return nil, fmt.Errorf("%w: NAL unit length size %d", ErrInvalidConfig, lengthSize)
+	}
+	var nalus [][]byte
+	for len(b) > 0 {
+		if len(b) < lengthSize {
+			return nalus, fmt.Errorf("truncated NAL unit length")
+		}
+		n := 0
+		for _, c := range b[:lengthSize] {
+			n = n<<8 | int(c)
+		}
+		b = b[lengthSize:]
+		if n > len(b) {
+			return nalus, fmt.Errorf("NAL unit of %d bytes truncated to %d", n, len(b))
+		}
+		if n > 0 {
+			nalus = append(nalus, b[:n])
+		}
+		b = b[n:]
+	}
+	return nalus, nil
+}
+
+// AppendAnnexB appends nalus to b in Annex B byte stream format, each
+// preceded by a four byte start code.
+func AppendAnnexB(b []byte, nalus ...[]byte) []byte {
+	for _, n := range nalus {
+		b = append(b, 0, 0, 0, 1)
+		b = append(b, n...)
+	}
+	return b
+}
+
+// AppendTo appends the configuration as an AVCDecoderConfigurationRecord to
+// b.
+func (c AVCConfig) AppendTo(b []byte) []byte {
+	lengthSize := c.NALULengthSize
+	if lengthSize == 0 {
+		lengthSize = 4
+	}
+	b = append(b, 1, c.Profile, c.Compatibility, c.Level, 0xFC|byte(lengthSize-1), 0xE0|byte(len(c.SPS)))
+	b = appendParameterSets(b, c.SPS)
+	b = append(b, byte(len(c.PPS)))
+	return appendParameterSets(b, c.PPS)
+}
+
+// NewAVCConfig returns the configuration for the given parameter sets, with
+// the profile and level taken from the first SPS and 4-byte NAL unit
+// lengths.
+func NewAVCConfig(sps, pps [][]byte) (AVCConfig, error) {
+	if len(sps) == 0 || len(sps[0]) < 4 || len(pps) == 0 {
+		return AVCConfig{}, fmt.Errorf("%w: missing or short H.264 parameter sets", ErrInvalidConfig)
+	}
+	return AVCConfig{
+		Profile:        sps[0][1],
+		Compatibility:  sps[0][2],
+		Level:          sps[0][3],
+		NALULengthSize: 4,
+		SPS:            sps,
+		PPS:            pps,
+	}, nil
+}
+
+// appendParameterSets appends sets to b, each prefixed by its 16-bit length.
+func appendParameterSets(b []byte, sets [][]byte) []byte {
+	for _, s := range sets {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+		b = append(b, s...)
+	}
+	return b
+}
+
+// SplitAnnexB splits an Annex B byte stream into its NAL units. Data before
+// the first start code is ignored.
+func SplitAnnexB(b []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(b); {
+		if b[i] != 0 || b[i+1] != 0 || b[i+2] != 1 {
+			i++
+			continue
+		}
+		if start >= 0 {
+			nalus = appendNALU(nalus, b[start:i])
+		}
+		i += 3
+		start = i
+	}
+	if start >= 0 {
+		nalus = appendNALU(nalus, b[start:])
+	}
+	return nalus
+}
+
+// RemoveEmulationPrevention returns nalu without its emulation prevention
+// bytes.
+func RemoveEmulationPrevention(nalu []byte) []byte {
+	return unescapeRBSP(nalu)
+}
+
+// appendNALU appends nalu without the zero bytes trailing it, which belong
+// to the next start code or are trailing_zero_8bits.
+func appendNALU(nalus [][]byte, nalu []byte) [][]byte {
+	for len(nalu) > 0 && nalu[len(nalu)-1] == 0 {
+		nalu = nalu[:len(nalu)-1]
+	}
+	if len(nalu) == 0 {
+		return nalus
+	}
+	return append(nalus, nalu)
+}
+
+// AppendLengthPrefixed appends nalus to b as in FLV and MP4 samples, each
+// preceded by its size in four bytes.
+func AppendLengthPrefixed(b []byte, nalus ...[]byte) []byte {
+	for _, n := range nalus {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(n)))
+		b = append(b, n...)
+	}
+	return b
+}
+
+// chromaSubsampling returns the horizontal and vertical crop units of a
+// chroma_format_idc, as used by the cropping of H.264 and H.265 SPSs.
+func chromaSubsampling(chromaFormat int) (int, int) {
+	switch chromaFormat {
+	case 1: // 4:2:0
+		return 2, 2
+	case 2: // 4:2:2
+		return 2, 1
+	default: // monochrome, 4:4:4
+		return 1, 1
+	}
+}
+
+// avcHighProfiles are the profile_idc values whose SPS carries chroma format
+// and bit depth fields.
+var avcHighProfiles = map[int]bool{100: true, 110: true, 122: true, 244: true, 44: true, 83: true, 86: true, 118: true, 128: true, 138: true, 139: true, 134: true, 135: true}
+
+// parseAVCSPSSize returns the picture size given by an H.264 SPS NAL unit.
+func parseAVCSPSSize(sps []byte) (width, height int, err error) {
+	if len(sps) < 4 {
+		return 0, 0, fmt.Errorf("%w: H.264 SPS too short", ErrInvalidConfig)
+	}
+	r := &bitReader{b: unescapeRBSP(sps[1:])}
+	ok := true
+	ue := func() int {
+		v, fieldOK := r.readUE()
+		ok = ok && fieldOK
+		return v
+	}
+	se := func() int {
+		v, fieldOK := r.readSE()
+		ok = ok && fieldOK
+		return v
+	}
+	bit := func() int {
+		v, fieldOK := r.read(1)
+		ok = ok && fieldOK
+		return v
+	}
+
+	profile, _ := r.read(8)
+	r.skip(16) // constraint flags, level_idc
+	ue()       // seq_parameter_set_id
+	chromaFormat := 1
+	if avcHighProfiles[profile] {
+		if chromaFormat = ue(); chromaFormat == 3 {
+			bit() // separate_colour_plane_flag
+		}
+		ue()            // bit_depth_luma_minus8
+		ue()            // bit_depth_chroma_minus8
+		bit()           // qpprime_y_zero_transform_bypass_flag
+		if bit() == 1 { // seq_scaling_matrix_present_flag
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := range lists {
+				if bit() == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for range size {
+					if next != 0 {
+						next = (last + se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	ue()          // log2_max_frame_num_minus4
+	switch ue() { // pic_order_cnt_type
+	case 0:
+		ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		bit() // delta_pic_order_always_zero_flag
+		se()  // offset_for_non_ref_pic
+		se()  // offset_for_top_to_bottom_field
+		for range min(ue(), 255) {
+			se() // offset_for_ref_frame
+		}
+	}
+	ue()  // max_num_ref_frames
+	bit() // gaps_in_frame_num_value_allowed_flag
+	widthMBs := ue() + 1
+	heightMapUnits := ue() + 1
+	frameMBsOnly := bit()
+	if frameMBsOnly == 0 {
+		bit() // mb_adaptive_frame_field_flag
+	}
+	bit() // direct_8x8_inference_flag
+	width = widthMBs * 16
+	height = (2 - frameMBsOnly) * heightMapUnits * 16
+	if bit() == 1 { // frame_cropping_flag
+		left, right, top, bottom := ue(), ue(), ue(), ue()
+		cropX, cropY := chromaSubsampling(chromaFormat)
+		if chromaFormat == 0 {
+			cropX, cropY = 1, 1
+		}
+		cropY *= 2 - frameMBsOnly
+		width -= cropX * (left + right)
+		height -= cropY * (top + bottom)
+	}
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: H.264 SPS too short", ErrInvalidConfig)
+	}
+	return width, height, nil
+}
+
+// Size returns the picture size given by the first SPS, or zeros if it
+// cannot be parsed.
+func (c AVCConfig) Size() (width, height int) {
+	if len(c.SPS) == 0 {
+		return 0, 0
+	}
+	width, height, err := parseAVCSPSSize(c.SPS[0])
+	if err != nil {
+		return 0, 0
+	}
+	return width, height
+}
+
+// CodecString returns the RFC 6381 codec parameter of the configuration,
+// e.g. "avc1.64001F", as used in MIME types.
+func (c AVCConfig) CodecString() string {
+	return fmt.Sprintf("avc1.%02X%02X%02X", c.Profile, c.Compatibility, c.Level)
+}
@@ -0,0 +1,88 @@
+package codec
+
+// bitReader reads big-endian bit fields.
+type bitReader struct {
+	b   []byte
+	pos int // in bits
+}
+
+func (r *bitReader) read(n int) (int, bool) {
+	if r.pos+n > len(r.b)*8 {
+		return 0, false
+	}
+	v := 0
+	for range n {
+		bit := (r.b[r.pos/8] >> (7 - r.pos%8)) & 1
+		v = v<<1 | int(bit)
+		r.pos++
+	}
+	return v, true
+}
+
+// skip skips n bits.
+func (r *bitReader) skip(n int) bool {
+	r.pos += n
+	return r.pos <= len(r.b)*8
+}
+
+// readUE reads an unsigned Exp-Golomb code.
+func (r *bitReader) readUE() (int, bool) {
+	zeros := 0
+	for {
+		bit, ok := r.read(1)
+		if !ok || zeros > 31 {
+			return 0, false
+		}
+		if bit == 1 {
+			break
+		}
+		zeros++
+	}
+	v, ok := r.read(zeros)
+	return 1<<zeros - 1 + v, ok
+}
+
+// readSE reads a signed Exp-Golomb code.
+func (r *bitReader) readSE() (int, bool) {
+	v, ok := r.readUE()
+	if v%2 == 0 {
+		return -v / 2, ok
+	}
+	return (v + 1) / 2, ok
+}
+
+// bitWriter appends big-endian bit fields to a byte slice.
+type bitWriter struct {
+	b []byte
+	n int // bits used in the last byte
+}
+
+func (w *bitWriter) write(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[len(w.b)-1] |= byte(v>>i&1) << (7 - w.n)
+		w.n = (w.n + 1) % 8
+	}
+}
+
+// unescapeRBSP removes the emulation prevention bytes from the payload of a
+// NAL unit.
+func unescapeRBSP(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 0x03 {
+			zeros = 0
+			continue
+		}
+		out = append(out, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
@@ -0,0 +1,295 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseAVCConfig(t *testing.T) {
+	sps := []byte{0x67, 0x64, 0x00, 0x1F, 0xAC}
+	pps := []byte{0x68, 0xEE, 0x3C, 0x80}
+	record := []byte{0x01, 0x64, 0x00, 0x1F, 0xFF, 0xE1, 0x00, byte(len(sps))}
+	record = append(record, sps...)
+	record = append(record, 0x01, 0x00, byte(len(pps)))
+	record = append(record, pps...)
+
+	got, err := ParseAVCConfig(record)
+	if err != nil {
+		t.Fatalf("ParseAVCConfig() error = %v", err)
+	}
+	want := AVCConfig{Profile: 0x64, Level: 0x1F, NALULengthSize: 4, SPS: [][]byte{sps}, PPS: [][]byte{pps}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseAVCConfig() = %+v, want %+v", got, want)
+	}
+
+	for _, bad := range [][]byte{record[:5], record[:10], record[:len(record)-1], append([]byte{0x02}, record[1:]...)} {
+		if _, err := ParseAVCConfig(bad); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("ParseAVCConfig(%x) error = %v, want ErrInvalidConfig", bad, err)
+		}
+	}
+}
+
+func TestParseHEVCConfig(t *testing.T) {
+	vps := []byte{0x40, 0x01, 0x0C}
+	sps := []byte{0x42, 0x01, 0x01}
+	pps := []byte{0x44, 0x01, 0xC1}
+	record := make([]byte, 23)
+	record[0] = 1
+	record[21] = 0x0F // NAL unit length size 4
+	record[22] = 3
+	for _, nalu := range [][]byte{vps, sps, pps} {
+		record = append(record, 0x80|HEVCNALType(nalu), 0x00, 0x01, 0x00, byte(len(nalu)))
+		record = append(record, nalu...)
+	}
+
+	got, err := ParseHEVCConfig(record)
+	if err != nil {
+		t.Fatalf("ParseHEVCConfig() error = %v", err)
+	}
+	want := HEVCConfig{NALULengthSize: 4, VPS: [][]byte{vps}, SPS: [][]byte{sps}, PPS: [][]byte{pps}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseHEVCConfig() = %+v, want %+v", got, want)
+	}
+	if _, err := ParseHEVCConfig(record[:len(record)-2]); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("ParseHEVCConfig(truncated) error = %v, want ErrInvalidConfig", err)
+	}
+}
+
+func TestSplitLengthPrefixed(t *testing.T) {
+	sample := []byte{0, 0, 0, 2, 0x65, 0x88, 0, 0, 0, 1, 0x41}
+	got, err := SplitLengthPrefixed(sample, 4)
+	if err != nil {
+		t.Fatalf("SplitLengthPrefixed() error = %v", err)
+	}
+	if want := [][]byte{{0x65, 0x88}, {0x41}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SplitLengthPrefixed() = %x, want %x", got, want)
+	}
+	if got := AppendAnnexB(nil, got...); !bytes.Equal(got, []byte{0, 0, 0, 1, 0x65, 0x88, 0, 0, 0, 1, 0x41}) {
+		t.Errorf("AppendAnnexB() = %x", got)
+	}
+	if _, err := SplitLengthPrefixed(sample[:len(sample)-1], 4); err == nil {
+		t.Error("SplitLengthPrefixed(truncated) succeeded")
+	}
+}
+
+func TestParseAudioSpecificConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    AudioSpecificConfig
+		wantErr bool
+	}{
+		{
+			name: "AAC-LC 44.1 kHz stereo",
+			data: []byte{0x12, 0x10},
+			want: AudioSpecificConfig{ObjectType: AACLC, SampleRateIndex: 4, SampleRate: 44100, Channels: 2},
+		},
+		{
+			name: "HE-AAC with explicit SBR",
+			data: []byte{0x2B, 0x11, 0x88},
+			want: AudioSpecificConfig{ObjectType: AACLC, SampleRateIndex: 6, SampleRate: 24000, Channels: 2},
+		},
+		{
+			name: "explicit sampling rate",
+			data: []byte{0x17, 0x80, 0x5D, 0xC0, 0x08},
+			want: AudioSpecificConfig{ObjectType: AACLC, SampleRateIndex: 15, SampleRate: 48000, Channels: 1},
+		},
+		{
+			name: "escaped object type",
+			data: []byte{0xF8, 0xE6, 0x40},
+			want: AudioSpecificConfig{ObjectType: 39, SampleRateIndex: 3, SampleRate: 48000, Channels: 2},
+		},
+		{name: "too short", data: []byte{0x12}, wantErr: true},
+		{name: "reserved sampling rate index", data: []byte{0x16, 0x90}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseAudioSpecificConfig(tt.data)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidConfig) {
+					t.Errorf("ParseAudioSpecificConfig() error = %v, want ErrInvalidConfig", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseAudioSpecificConfig() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseAudioSpecificConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAppendADTSHeader(t *testing.T) {
+	c := AudioSpecificConfig{ObjectType: AACLC, SampleRateIndex: 4, SampleRate: 44100, Channels: 2}
+	got, err := c.AppendADTSHeader(nil, 100)
+	if err != nil {
+		t.Fatalf("AppendADTSHeader() error = %v", err)
+	}
+	if want := []byte{0xFF, 0xF1, 0x50, 0x80, 0x0D, 0x7F, 0xFC}; !bytes.Equal(got, want) {
+		t.Errorf("AppendADTSHeader() = %x, want %x", got, want)
+	}
+
+	c.SampleRateIndex = 15
+	if _, err := c.AppendADTSHeader(nil, 100); err == nil {
+		t.Error("AppendADTSHeader() with an explicit sampling rate succeeded")
+	}
+}
+
+func TestAVCConfig_AppendTo(t *testing.T) {
+	sps := []byte{0x67, 0x64, 0x00, 0x1F, 0xAC}
+	pps := []byte{0x68, 0xEE, 0x3C, 0x80}
+	c, err := NewAVCConfig([][]byte{sps}, [][]byte{pps})
+	if err != nil {
+		t.Fatalf("NewAVCConfig() error = %v", err)
+	}
+	got, err := ParseAVCConfig(c.AppendTo(nil))
+	if err != nil {
+		t.Fatalf("ParseAVCConfig() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, c) {
+		t.Errorf("round trip = %+v, want %+v", got, c)
+	}
+	if _, err := NewAVCConfig(nil, [][]byte{pps}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("NewAVCConfig() without SPS error = %v, want ErrInvalidConfig", err)
+	}
+}
+
+func TestHEVCConfig_AppendTo(t *testing.T) {
+	// Main profile, level 3.1, 1280x720 4:2:0 8-bit, with emulation
+	// prevention bytes.
+	sps := []byte{
+		0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03,
+		0x00, 0x5D, 0xA0, 0x02, 0x80, 0x80, 0x2D, 0x16, 0x59, 0x59, 0xA4, 0x93, 0x2B, 0xC0, 0x5A, 0x70,
+		0x80, 0x00, 0x01, 0xF4, 0x80, 0x00, 0x3A, 0x98, 0x04,
+	}
+	vps := []byte{0x40, 0x01, 0x0C}
+	pps := []byte{0x44, 0x01, 0xC1}
+	c, err := NewHEVCConfig([][]byte{vps}, [][]byte{sps}, [][]byte{pps})
+	if err != nil {
+		t.Fatalf("NewHEVCConfig() error = %v", err)
+	}
+	record := c.AppendTo(nil)
+	wantHead := []byte{
+		0x01,
+		0x01, 0x60, 0x00, 0x00, 0x00, 0x90, 0x00, 0x00, 0x00, 0x00, 0x00, 0x5D, // profile, tier and level
+		0xF0, 0x00, 0xFC, 0xFD, 0xF8, 0xF8, 0x00, 0x00,
+		0x0F, // one temporal layer, nested, 4-byte lengths
+		0x03,
+	}
+	if !bytes.HasPrefix(record, wantHead) {
+		t.Errorf("record header = %x, want %x", record[:min(len(record), len(wantHead))], wantHead)
+	}
+	got, err := ParseHEVCConfig(record)
+	if err != nil {
+		t.Fatalf("ParseHEVCConfig() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, c) {
+		t.Errorf("round trip = %+v, want %+v", got, c)
+	}
+	if _, err := NewHEVCConfig([][]byte{vps}, [][]byte{sps[:8]}, [][]byte{pps}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("NewHEVCConfig() with a short SPS error = %v, want ErrInvalidConfig", err)
+	}
+	if w, h := c.Size(); w != 1280 || h != 720 {
+		t.Errorf("Size() = %dx%d, want 1280x720", w, h)
+	}
+	if got := c.CodecString(); got != "hvc1.1.6.L93.90" {
+		t.Errorf("CodecString() = %s, want hvc1.1.6.L93.90", got)
+	}
+}
+
+func TestAVCConfig_Size(t *testing.T) {
+	tests := []struct {
+		name          string
+		sps           []byte
+		width, height int
+	}{
+		{
+			"High 3.1 1280x720",
+			[]byte{0x67, 0x64, 0x00, 0x1F, 0xAC, 0xD9, 0x40, 0x50, 0x05, 0xBB, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0xC0, 0xF1, 0x83, 0x19, 0x60},
+			1280, 720,
+		},
+		{"truncated", []byte{0x67, 0x64, 0x00, 0x1F, 0xAC}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewAVCConfig([][]byte{tt.sps}, [][]byte{{0x68, 0xEE}})
+			if err != nil {
+				t.Fatalf("NewAVCConfig() error = %v", err)
+			}
+			if w, h := c.Size(); w != tt.width || h != tt.height {
+				t.Errorf("Size() = %dx%d, want %dx%d", w, h, tt.width, tt.height)
+			}
+			if got := c.CodecString(); got != "avc1.64001F" {
+				t.Errorf("CodecString() = %s, want avc1.64001F", got)
+			}
+		})
+	}
+}
+
+func TestSplitAnnexB(t *testing.T) {
+	stream := []byte{
+		0xAA, // before the first start code
+		0, 0, 0, 1, 0x09, 0xF0,
+		0, 0, 1, 0x67, 0x64, 0x00, 0x00, 0x03, 0x01, // 00 00 03 is not a start code
+		0, 0, 0, 1, 0x65, 0x88, 0x00, 0x00, // trailing zeros
+	}
+	want := [][]byte{{0x09, 0xF0}, {0x67, 0x64, 0x00, 0x00, 0x03, 0x01}, {0x65, 0x88}}
+	got := SplitAnnexB(stream)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SplitAnnexB() = %x, want %x", got, want)
+	}
+	if got := AppendLengthPrefixed(nil, want[0], want[2]); !bytes.Equal(got, []byte{0, 0, 0, 2, 0x09, 0xF0, 0, 0, 0, 2, 0x65, 0x88}) {
+		t.Errorf("AppendLengthPrefixed() = %x", got)
+	}
+	if got := SplitAnnexB([]byte{0x65, 0x88}); got != nil {
+		t.Errorf("SplitAnnexB() without start code = %x, want nil", got)
+	}
+}
+
+func TestAudioSpecificConfig_CodecString(t *testing.T) {
+	for _, tt := range []struct {
+		asc  []byte
+		want string
+	}{
+		{[]byte{0x12, 0x10}, "mp4a.40.2"},
+		// HE-AAC advertises its core object type, which every decoder
+		// accepts.
+		{[]byte{0x2B, 0x92, 0x08, 0x00}, "mp4a.40.2"},
+	} {
+		c, err := ParseAudioSpecificConfig(tt.asc)
+		if err != nil {
+			t.Fatalf("ParseAudioSpecificConfig(%x) error = %v", tt.asc, err)
+		}
+		if got := c.CodecString(); got != tt.want {
+			t.Errorf("CodecString() of %x = %s, want %s", tt.asc, got, tt.want)
+		}
+	}
+}
+
+func TestParseADTSHeader(t *testing.T) {
+	c := AudioSpecificConfig{ObjectType: AACLC, SampleRateIndex: 3, SampleRate: 48000, Channels: 2}
+	frame, err := c.AppendADTSHeader(nil, 200)
+	if err != nil {
+		t.Fatalf("AppendADTSHeader() error = %v", err)
+	}
+	h, err := ParseADTSHeader(frame)
+	if err != nil {
+		t.Fatalf("ParseADTSHeader() error = %v", err)
+	}
+	if want := (ADTSHeader{Config: c, HeaderSize: 7, FrameSize: 207}); h != want {
+		t.Errorf("ParseADTSHeader() = %+v, want %+v", h, want)
+	}
+	if got := c.AppendTo(nil); !bytes.Equal(got, []byte{0x11, 0x90}) {
+		t.Errorf("AppendTo() = %x, want 1190", got)
+	}
+
+	for _, bad := range [][]byte{frame[:5], {0xFF, 0xE1, 0x50, 0x80, 0x19, 0xFF, 0xFC}, {0xFF, 0xF1, 0x7C, 0x80, 0x19, 0xFF, 0xFC}} {
+		if _, err := ParseADTSHeader(bad); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("ParseADTSHeader(%x) error = %v, want ErrInvalidConfig", bad, err)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// H.265 NAL unit types.
+const (
+	HEVCNALBLAWLP    = 16 // first IRAP type
+	HEVCNALIDRWRADL  = 19
+	HEVCNALIDRNLP    = 20
+	HEVCNALCRA       = 21
+	HEVCNALVPS       = 32
+	HEVCNALSPS       = 33
+	HEVCNALPPS       = 34
+	HEVCNALAUD       = 35
+	HEVCNALSEIPrefix = 39
+)
+
+// HEVCNALType returns the type of an H.265 NAL unit.
+func HEVCNALType(nalu []byte) byte {
+	if len(nalu) == 0 {
+		return 0
+	}
+	return (nalu[0] >> 1) & 0x3F
+}
+
+// HEVCConfig is the parameter set part of an HEVCDecoderConfigurationRecord
+// (ISO/IEC 14496-15), the sequence header of H.265 in FLV and MP4.
+type HEVCConfig struct {
+	NALULengthSize int
+	VPS            [][]byte
+	SPS            [][]byte
+	PPS            [][]byte
+}
+
+// ParseHEVCConfig parses an HEVCDecoderConfigurationRecord.
+func ParseHEVCConfig(b []byte) (HEVCConfig, error) {
+	if len(b) < 23 || b[0] != 1 {
+		return HEVCConfig{}, fmt.Errorf("%w: HEVC configuration record too short or wrong version", ErrInvalidConfig)
+	}
+	c := HEVCConfig{NALULengthSize: int(b[21]&0x03) + 1}
+	numArrays := int(b[22])
+	off := 23
+	for range numArrays {
+		if off+3 > len(b) {
+			return HEVCConfig{}, fmt.Errorf("%w: truncated NAL unit array", ErrInvalidConfig)
+		}
+		typ := b[off] & 0x3F
+		count := int(binary.BigEndian.Uint16(b[off+1:]))
+		sets, next, err := readParameterSets(b, off+3, count)
+		if err != nil {
+			return HEVCConfig{}, err
+		}
+		off = next
+		switch typ {
+		case HEVCNALVPS:
+			c.VPS = append(c.VPS, sets...)
+		case HEVCNALSPS:
+			c.SPS = append(c.SPS, sets...)
+		case HEVCNALPPS:
+			c.PPS = append(c.PPS, sets...)
+		}
+	}
+	return c, nil
+}
+
+// NewHEVCConfig returns the configuration for the given parameter sets, with
+// 4-byte NAL unit lengths.
+func NewHEVCConfig(vps, sps, pps [][]byte) (HEVCConfig, error) {
+	if len(vps) == 0 || len(sps) == 0 || len(pps) == 0 {
+		return HEVCConfig{}, fmt.Errorf("%w: missing H.265 parameter sets", ErrInvalidConfig)
+	}
+	if _, err := parseHEVCSPS(sps[0]); err != nil {
+		return HEVCConfig{}, err
+	}
+	return HEVCConfig{NALULengthSize: 4, VPS: vps, SPS: sps, PPS: pps}, nil
+}
+
+// hevcSPSInfo holds the fields of an H.265 SPS that are repeated in the
+// HEVCDecoderConfigurationRecord.
+type hevcSPSInfo struct {
+	profileTierLevel [12]byte // general_profile_space to general_level_idc
+	temporalLayers   int
+	temporalIDNested bool
+	chromaFormat     int
+	bitDepthLuma     int // minus 8
+	bitDepthChroma   int // minus 8
+	width, height    int // after the conformance window
+}
+
+// parseHEVCSPS reads the fields of the configuration record from an SPS NAL
+// unit.
+func parseHEVCSPS(sps []byte) (hevcSPSInfo, error) {
+	short := fmt.Errorf("%w: H.265 SPS too short", ErrInvalidConfig)
+	if len(sps) < 2+13 {
+		return hevcSPSInfo{}, short
+	}
+	rbsp := unescapeRBSP(sps[2:])
+	if len(rbsp) < 13 {
+		return hevcSPSInfo{}, short
+	}
+	var info hevcSPSInfo
+	maxSubLayers := int(rbsp[0]>>1&0x07) + 1
+	info.temporalLayers = maxSubLayers
+	info.temporalIDNested = rbsp[0]&0x01 != 0
+	copy(info.profileTierLevel[:], rbsp[1:13])
+
+	r := &bitReader{b: rbsp, pos: 13 * 8}
+	var profilePresent, levelPresent [8]int
+	for i := range maxSubLayers - 1 {
+		profilePresent[i], _ = r.read(1)
+		levelPresent[i], _ = r.read(1)
+	}
+	if maxSubLayers > 1 {
+		r.skip(2 * (9 - maxSubLayers)) // reserved_zero_2bits
+	}
+	for i := range maxSubLayers - 1 {
+		r.skip(88 * profilePresent[i])
+		r.skip(8 * levelPresent[i])
+	}
+	ok := true
+	field := func() int {
+		v, fieldOK := r.readUE()
+		ok = ok && fieldOK
+		return v
+	}
+	field() // sps_seq_parameter_set_id
+	if info.chromaFormat = field(); info.chromaFormat == 3 {
+		r.skip(1) // separate_colour_plane_flag
+	}
+	info.width = field()
+	info.height = field()
+	if window, _ := r.read(1); window == 1 {
+		left, right, top, bottom := field(), field(), field(), field()
+		subWidth, subHeight := chromaSubsampling(info.chromaFormat)
+		info.width -= subWidth * (left + right)
+		info.height -= subHeight * (top + bottom)
+	}
+	info.bitDepthLuma = field()
+	info.bitDepthChroma = field()
+	if !ok {
+		return hevcSPSInfo{}, short
+	}
+	return info, nil
+}
+
+// AppendTo appends the configuration as an HEVCDecoderConfigurationRecord to
+// b. The profile, level and format fields are taken from the first SPS.
+func (c HEVCConfig) AppendTo(b []byte) []byte {
+	var info hevcSPSInfo
+	if len(c.SPS) > 0 {
+		info, _ = parseHEVCSPS(c.SPS[0])
+	}
+	lengthSize := c.NALULengthSize
+	if lengthSize == 0 {
+		lengthSize = 4
+	}
+	nested := byte(0)
+	if info.temporalIDNested {
+		nested = 1
+	}
+	b = append(b, 1)
+	b = append(b, info.profileTierLevel[:]...)
+	b = append(b,
+		0xF0, 0x00, // min_spatial_segmentation_idc 0
+		0xFC, // parallelismType unknown
+		0xFC|byte(info.chromaFormat),
+		0xF8|byte(info.bitDepthLuma),
+		0xF8|byte(info.bitDepthChroma),
+		0x00, 0x00, // avgFrameRate unspecified
+		byte(info.temporalLayers&0x07)<<3|nested<<2|byte(lengthSize-1),
+	)
+	arrays := []struct {
+		typ  byte
+		sets [][]byte
+	}{{HEVCNALVPS, c.VPS}, {HEVCNALSPS, c.SPS}, {HEVCNALPPS, c.PPS}}
+	count := 0
+	for _, a := range arrays {
+		if len(a.sets) > 0 {
+			count++
+		}
+	}
+	b = append(b, byte(count))
+	for _, a := range arrays {
+		if len(a.sets) == 0 {
+			continue
+		}
+		b = append(b, 0x80|a.typ) // array_completeness
+		b = binary.BigEndian.AppendUint16(b, uint16(len(a.sets)))
+		b = appendParameterSets(b, a.sets)
+	}
+	return b
+}
+
+// Size returns the picture size given by the first SPS, or zeros if it
+// cannot be parsed.
+func (c HEVCConfig) Size() (width, height int) {
+	if len(c.SPS) == 0 {
+		return 0, 0
+	}
+	info, err := parseHEVCSPS(c.SPS[0])
+	if err != nil {
+		return 0, 0
+	}
+	return info.width, info.height
+}
+
+// CodecString returns the RFC 6381 codec parameter of the configuration,
+// e.g. "hvc1.1.6.L93.B0", as used in MIME types.
+func (c HEVCConfig) CodecString() string {
+	if len(c.SPS) == 0 {
+		return "hvc1"
+	}
+	info, err := parseHEVCSPS(c.SPS[0])
+	if err != nil {
+		return "hvc1"
+	}
+	ptl := info.profileTierLevel
+	s := "hvc1."
+	if space := ptl[0] >> 6; space > 0 {
+		s += string(rune('A' + space - 1))
+	}
+	s += strconv.Itoa(int(ptl[0] & 0x1F))
+	// The compatibility flags are written in reverse bit order.
+	s += "." + strconv.FormatUint(uint64(bits.Reverse32(binary.BigEndian.Uint32(ptl[1:5]))), 16)
+	tier := "L"
+	if ptl[0]&0x20 != 0 {
+		tier = "H"
+	}
+	s += "." + tier + strconv.Itoa(int(ptl[11]))
+	constraints := ptl[5:11]
+	for len(constraints) > 0 && constraints[len(constraints)-1] == 0 {
+		constraints = constraints[:len(constraints)-1]
+	}
+	for _, b := range constraints {
+		s += "." + strings.ToUpper(strconv.FormatUint(uint64(b), 16))
+	}
+	return s
+}
@@ -0,0 +1,358 @@
+package flv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+// AMF0 type markers.
+const (
+	amf0Number      byte = 0x00
+	amf0Boolean     byte = 0x01
+	amf0String      byte = 0x02
+	amf0Object      byte = 0x03
+	amf0Null        byte = 0x05
+	amf0Undefined   byte = 0x06
+	amf0ECMAArray   byte = 0x08
+	amf0ObjectEnd   byte = 0x09
+	amf0StrictArray byte = 0x0A
+	amf0Date        byte = 0x0B
+	amf0LongString  byte = 0x0C
+)
+
+// maxAMF0Depth bounds the nesting of objects and arrays when decoding, so a
+// malicious stream cannot exhaust the stack.
+const maxAMF0Depth = 32
+
+// ErrAMF0 is returned for malformed or unsupported AMF0 data.
+var ErrAMF0 = errors.New("invalid AMF0 data")
+
+// AMF0 values decode to these Go types:
+//
+//	number        float64
+//	boolean       bool
+//	string        string (long strings too)
+//	null          nil
+//	undefined     Undefined
+//	object        Object
+//	ECMA array    ECMAArray
+//	strict array  []any
+//	date          time.Time
+//
+// EncodeAMF0 accepts the same types, plus any integer type and float32 as
+// numbers and map[string]any as an ECMA array with sorted keys.
+
+// Undefined is the AMF0 undefined value.
+type Undefined struct{}
+
+// Property is a key/value pair of an AMF0 object or ECMA array.
+type Property struct {
+	Key   string
+	Value any
+}
+
+// Object is an AMF0 anonymous object. Properties keep their encoded order.
+type Object []Property
+
+// ECMAArray is an AMF0 associative array, the usual type of onMetaData.
+type ECMAArray []Property
+
+// Get returns the value of the first property named key.
+func (o Object) Get(key string) (any, bool) {
+	return lookupProperty(o, key)
+}
+
+// Get returns the value of the first property named key.
+func (a ECMAArray) Get(key string) (any, bool) {
+	return lookupProperty(a, key)
+}
+
+func lookupProperty(props []Property, key string) (any, bool) {
+	for _, p := range props {
+		if p.Key == key {
+			return p.Value, true
+		}
+	}
+	return nil, false
+}
+
+// DecodeAMF0 decodes every AMF0 value in b.
+func DecodeAMF0(b []byte) ([]any, error) {
+	var values []any
+	for len(b) > 0 {
+		v, n, err := decodeAMF0Value(b, 0)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+		b = b[n:]
+	}
+	return values, nil
+}
+
+func decodeAMF0Value(b []byte, depth int) (any, int, error) {
+	if len(b) < 1 {
+		return nil, 0, fmt.Errorf("%w: missing type marker", ErrAMF0)
+	}
+	if depth > maxAMF0Depth {
+		return nil, 0, fmt.Errorf("%w: nested too deeply", ErrAMF0)
+	}
+	switch b[0] {
+	case amf0Number:
+		if len(b) < 9 {
+			return nil, 0, fmt.Errorf("%w: short number", ErrAMF0)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b[1:9])), 9, nil
+	case amf0Boolean:
+		if len(b) < 2 {
+			return nil, 0, fmt.Errorf("%w: short boolean", ErrAMF0)
+		}
+		return b[1] != 0, 2, nil
+	case amf0String:
+		s, n, err := decodeAMF0String(b[1:], false)
+		return s, 1 + n, err
+	case amf0LongString:
+		s, n, err := decodeAMF0String(b[1:], true)
+		return s, 1 + n, err
+	case amf0Null:
+		return nil, 1, nil
+	case amf0Undefined:
+		return Undefined{}, 1, nil
+	case amf0Object:
+		props, n, err := decodeAMF0Properties(b[1:], depth)
+		return Object(props), 1 + n, err
+	case amf0ECMAArray:
+		// The count is only a hint; the properties end with an end marker.
+		if len(b) < 5 {
+			return nil, 0, fmt.Errorf("%w: short ECMA array", ErrAMF0)
+		}
+		props, n, err := decodeAMF0Properties(b[5:], depth)
+		return ECMAArray(props), 5 + n, err
+	case amf0StrictArray:
+		if len(b) < 5 {
+			return nil, 0, fmt.Errorf("%w: short strict array", ErrAMF0)
+		}
+		count := binary.BigEndian.Uint32(b[1:5])
+		off := 5
+		// Every element takes at least one byte, which bounds the
+		// allocation for a bogus count.
+		if int64(count) > int64(len(b)-off) {
+			return nil, 0, fmt.Errorf("%w: strict array of %d elements in %d bytes", ErrAMF0, count, len(b)-off)
+		}
+		values := make([]any, 0, count)
+		for range count {
+			v, n, err := decodeAMF0Value(b[off:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			values = append(values, v)
+			off += n
+		}
+		return values, off, nil
+	case amf0Date:
+		if len(b) < 11 {
+			return nil, 0, fmt.Errorf("%w: short date", ErrAMF0)
+		}
+		ms := math.Float64frombits(binary.BigEndian.Uint64(b[1:9]))
+		// The trailing time zone is reserved and always 0.
+		return time.UnixMilli(int64(ms)).UTC(), 11, nil
+	default:
+		return nil, 0, fmt.Errorf("%w: unsupported type marker 0x%02x", ErrAMF0, b[0])
+	}
+}
+
+func decodeAMF0String(b []byte, long bool) (string, int, error) {
+	lenSize := 2
+	if long {
+		lenSize = 4
+	}
+	if len(b) < lenSize {
+		return "", 0, fmt.Errorf("%w: short string length", ErrAMF0)
+	}
+	var n int
+	if long {
+		n = int(binary.BigEndian.Uint32(b))
+	} else {
+		n = int(binary.BigEndian.Uint16(b))
+	}
+	if n < 0 || len(b)-lenSize < n {
+		return "", 0, fmt.Errorf("%w: string of %d bytes truncated", ErrAMF0, n)
+	}
+	return string(b[lenSize : lenSize+n]), lenSize + n, nil
+}
+
+// decodeAMF0Properties decodes key/value pairs up to and including the
+// object end marker.
+func decodeAMF0Properties(b []byte, depth int) ([]Property, int, error) {
+	var props []Property
+	off := 0
+	for {
+		key, n, err := decodeAMF0String(b[off:], false)
+		if err != nil {
+			return nil, 0, err
+		}
+		off += n
+		if key == "" {
+			if off >= len(b) {
+				// Some encoders omit the end marker at the end of
+				// the data.
+				return props, off, nil
+			}
+			if b[off] == amf0ObjectEnd {
+				return props, off + 1, nil
+			}
+		}
+		v, n, err := decodeAMF0Value(b[off:], depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		off += n
+		props = append(props, Property{Key: key, Value: v})
+	}
+}
+
+// EncodeAMF0 encodes values in order.
+func EncodeAMF0(values ...any) ([]byte, error) {
+	var b []byte
+	for _, v := range values {
+		var err error
+		if b, err = AppendAMF0(b, v); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// AppendAMF0 appends the AMF0 encoding of v to b.
+func AppendAMF0(b []byte, v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, amf0Null), nil
+	case Undefined:
+		return append(b, amf0Undefined), nil
+	case bool:
+		if v {
+			return append(b, amf0Boolean, 1), nil
+		}
+		return append(b, amf0Boolean, 0), nil
+	case float64:
+		return appendAMF0Number(b, v), nil
+	case float32:
+		return appendAMF0Number(b, float64(v)), nil
+	case int:
+		return appendAMF0Number(b, float64(v)), nil
+	case int8:
+		return appendAMF0Number(b, float64(v)), nil
+	case int16:
+		return appendAMF0Number(b, float64(v)), nil
+	case int32:
+		return appendAMF0Number(b, float64(v)), nil
+	case int64:
+		return appendAMF0Number(b, float64(v)), nil
+	case uint:
+		return appendAMF0Number(b, float64(v)), nil
+	case uint8:
+		return appendAMF0Number(b, float64(v)), nil
+	case uint16:
+		return appendAMF0Number(b, float64(v)), nil
+	case uint32:
+		return appendAMF0Number(b, float64(v)), nil
+	case uint64:
+		return appendAMF0Number(b, float64(v)), nil
+	case string:
+		if len(v) > math.MaxUint16 {
+			b = binary.BigEndian.AppendUint32(append(b, amf0LongString), uint32(len(v)))
+			return append(b, v...), nil
+		}
+		return appendAMF0Key(append(b, amf0String), v), nil
+	case time.Time:
+		b = appendAMF0Number(b, float64(v.UnixMilli()))
+		b[len(b)-9] = amf0Date
+		return append(b, 0, 0), nil
+	case Object:
+		return appendAMF0Properties(append(b, amf0Object), v)
+	case ECMAArray:
+		b = binary.BigEndian.AppendUint32(append(b, amf0ECMAArray), uint32(len(v)))
+		return appendAMF0Properties(b, v)
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		arr := make(ECMAArray, len(keys))
+		for i, k := range keys {
+			arr[i] = Property{Key: k, Value: v[k]}
+		}
+		return AppendAMF0(b, arr)
+	case []any:
+		b = binary.BigEndian.AppendUint32(append(b, amf0StrictArray), uint32(len(v)))
+		for _, e := range v {
+			var err error
+			if b, err = AppendAMF0(b, e); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("%w: cannot encode %T", ErrAMF0, v)
+	}
+}
+
+func appendAMF0Number(b []byte, f float64) []byte {
+	return binary.BigEndian.AppendUint64(append(b, amf0Number), math.Float64bits(f))
+}
+
+// appendAMF0Key appends a string without its type marker, as used for
+// property keys.
+func appendAMF0Key(b []byte, s string) []byte {
+	return append(binary.BigEndian.AppendUint16(b, uint16(len(s))), s...)
+}
+
+func appendAMF0Properties(b []byte, props []Property) ([]byte, error) {
+	for _, p := range props {
+		if len(p.Key) > math.MaxUint16 {
+			return nil, fmt.Errorf("%w: property key of %d bytes", ErrAMF0, len(p.Key))
+		}
+		b = appendAMF0Key(b, p.Key)
+		var err error
+		if b, err = AppendAMF0(b, p.Value); err != nil {
+			return nil, err
+		}
+	}
+	return append(b, 0, 0, amf0ObjectEnd), nil
+}
+
+// Script decodes a script data tag into its name, e.g. "onMetaData", and the
+// values that follow it.
+func (t Tag) Script() (string, []any, error) {
+	if t.Type != TagScript {
+		return "", nil, fmt.Errorf("%w: not a script data tag", ErrInvalidTag)
+	}
+	values, err := DecodeAMF0(t.Data)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(values) == 0 {
+		return "", nil, fmt.Errorf("%w: empty script data", ErrAMF0)
+	}
+	name, ok := values[0].(string)
+	if !ok {
+		return "", nil, fmt.Errorf("%w: script data name is %T", ErrAMF0, values[0])
+	}
+	return name, values[1:], nil
+}
+
+// NewScriptTag returns a script data tag calling name with values, e.g.
+// NewScriptTag(0, "onMetaData", ECMAArray{...}).
+func NewScriptTag(timestamp uint32, name string, values ...any) (Tag, error) {
+	data, err := EncodeAMF0(append([]any{name}, values...)...)
+	if err != nil {
+		return Tag{}, err
+	}
+	return Tag{Type: TagScript, Timestamp: timestamp, Data: data}, nil
+}
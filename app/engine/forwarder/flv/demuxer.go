@@ -0,0 +1,186 @@
+package flv
+
+import (
+	"errors"
+	"io"
+
+	"github.com/nv4d1k/live-stream-forwarder/global"
+)
+
+// maxResyncTagSize is the largest tag accepted as a resync point. Real tags
+// are far smaller; a bound keeps resync from waiting for megabytes of data on
+// a false match.
+const maxResyncTagSize = 4 << 20
+
+// Demuxer splits an FLV byte stream, written in chunks of any size, into its
+// file header and tags. Data after corruption, such as a tag with an unknown
+// type or a PreviousTagSize that does not match, is skipped up to the next
+// position where a well-formed tag begins.
+type Demuxer struct {
+	onHeader func(Header) error
+	onTag    func(Tag) error
+
+	buf       []byte
+	header    bool  // file header has been parsed
+	err       error // sticky ErrNotFLV
+	resyncing bool
+	resyncs   int
+	skipped   int64
+}
+
+// NewDemuxer returns a Demuxer that calls onTag for every tag in stream
+// order. The Tag's Data is only valid during the call; use Tag.Clone to keep
+// it.
+func NewDemuxer(onTag func(Tag) error) *Demuxer {
+	return &Demuxer{onTag: onTag}
+}
+
+// OnHeader sets a function called with the file header before the first tag.
+func (d *Demuxer) OnHeader(fn func(Header) error) {
+	d.onHeader = fn
+}
+
+// Write parses p and calls the callbacks for every header and tag it
+// completes. Errors from the callbacks are returned as is, after the tag
+// they were returned for has been consumed. ErrNotFLV is returned if the
+// stream does not start with an FLV header; the data then stays buffered
+// (see Pending) and later writes fail the same way.
+func (d *Demuxer) Write(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	d.buf = append(d.buf, p...)
+	consumed, err := d.parse()
+	d.buf = append(d.buf[:0], d.buf[consumed:]...)
+	if errors.Is(err, ErrNotFLV) {
+		d.err = err
+	}
+	return len(p), err
+}
+
+// Pending returns the data that has been written but not yet parsed: the
+// start of an incomplete header or tag. It is only valid until the next
+// Write.
+func (d *Demuxer) Pending() []byte {
+	return d.buf
+}
+
+// HeaderParsed reports whether the file header has been parsed.
+func (d *Demuxer) HeaderParsed() bool {
+	return d.header
+}
+
+// Resyncs returns the number of times the demuxer lost and regained tag
+// alignment, and the number of bytes it skipped doing so.
+func (d *Demuxer) Resyncs() (count int, skipped int64) {
+	return d.resyncs, d.skipped
+}
+
+// parse consumes every complete unit in d.buf and returns the number of bytes
+// consumed.
+func (d *Demuxer) parse() (int, error) {
+	buf := d.buf
+	offset := 0
+
+	if !d.header {
+		h, n, err := ParseHeader(buf)
+		if err == io.ErrUnexpectedEOF {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		d.header = true
+		offset = n
+		if d.onHeader != nil {
+			if err := d.onHeader(h); err != nil {
+				return offset, err
+			}
+		}
+	}
+
+	for offset < len(buf) {
+		if d.resyncing {
+			n, ok := d.resync(buf[offset:])
+			offset += n
+			if !ok {
+				return offset, nil
+			}
+			continue
+		}
+		t, n, err := ParseTag(buf[offset:])
+		if err == io.ErrUnexpectedEOF {
+			return offset, nil
+		}
+		if err != nil {
+			global.Log.WithField("func", "app.engine.forwarder.flv.Demuxer.parse").
+				WithError(err).Warn("corrupt FLV data, resynchronizing")
+			// Skip the byte parsing failed at and look for the
+			// next tag from there.
+			d.resyncing = true
+			d.resyncs++
+			d.skipped++
+			offset++
+			continue
+		}
+		offset += n
+		if d.onTag != nil {
+			if err := d.onTag(t); err != nil {
+				return offset, err
+			}
+		}
+	}
+	return offset, nil
+}
+
+// resync looks for the next well-formed tag in b. It returns the number of
+// bytes to skip, and whether a tag was found at that offset; if not, the
+// caller waits for more data. A complete tag wins over an earlier position
+// that only might start a tag, since garbage often looks like the start of a
+// large one.
+func (d *Demuxer) resync(b []byte) (int, bool) {
+	partial := -1
+	for i := 0; i < len(b); i++ {
+		t, _, err := ParseTag(b[i:])
+		switch {
+		case err == nil && t.StreamID == 0:
+			d.resyncing = false
+			d.skipped += int64(i)
+			global.Log.WithField("func", "app.engine.forwarder.flv.Demuxer.resync").
+				WithField("skipped", i).Debug("FLV tag alignment recovered")
+			return i, true
+		case err == io.ErrUnexpectedEOF && partial < 0 && plausibleTagStart(b[i:]):
+			// Might be a tag that has not fully arrived yet.
+			partial = i
+		}
+	}
+	if partial < 0 {
+		partial = len(b)
+	}
+	d.skipped += int64(partial)
+	return partial, false
+}
+
+// plausibleTagStart reports whether b, shorter than a full tag, begins with
+// what could be a tag header.
+func plausibleTagStart(b []byte) bool {
+	if b[0]&0xC0 != 0 {
+		return false
+	}
+	if typ := b[0] & 0x1F; typ != TagAudio && typ != TagVideo && typ != TagScript {
+		return false
+	}
+	if len(b) >= 4 {
+		dataSize := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+		if dataSize > maxResyncTagSize {
+			return false
+		}
+	}
+	// StreamID is always 0.
+	for i := 8; i < min(len(b), TagHeaderSize); i++ {
+		if b[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
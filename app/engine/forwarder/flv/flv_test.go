@@ -2,12 +2,14 @@ package flv
 
 import (
 	"bytes"
+	"errors"
 	"io"
-	"net/http"
 	"os"
+	"reflect"
+	"slices"
 	"testing"
+	"time"
 
-	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/stream"
 	"github.com/nv4d1k/live-stream-forwarder/global"
 	"github.com/sirupsen/logrus"
 )
@@ -75,6 +77,176 @@ func TestHeaderEntry_SetWait(t *testing.T) {
 	}
 }
 
+func TestHeaderCache_Lifecycle(t *testing.T) {
+	cache := NewHeaderCache()
+	cache.ttl = 20 * time.Millisecond
+	header := slices.Concat(Header{HasVideo: true}.Bytes(), buildFLVTag(TagVideo, []byte{0x17, 0x00, 0x01}))
+
+	e := cache.Acquire("test:lifecycle")
+	e.Set(header)
+	f := cache.Retain("test:lifecycle", io.NopCloser(bytes.NewReader(nil)))
+	if got := cache.Stats(); got.Entries != 1 || got.Bytes != len(header) || got.Headers[0].Refs != 2 || !got.Headers[0].Ready {
+		t.Fatalf("Stats() = %+v, want one ready entry of %d bytes with 2 refs", got, len(header))
+	}
+
+	e.Release()
+	f.Close()
+	f.Close() // releases only once
+	if got := cache.Stats(); got.Entries != 1 || got.Headers[0].Refs != 0 || got.Headers[0].EvictAt == nil {
+		t.Fatalf("Stats() after release = %+v, want entry pending eviction", got)
+	}
+
+	// Acquiring again before the TTL keeps the entry.
+	time.Sleep(5 * time.Millisecond)
+	if again := cache.Acquire("test:lifecycle"); again != e {
+		t.Fatal("Acquire() before the TTL returned a new entry")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := cache.Stats(); got.Entries != 1 {
+		t.Fatalf("Stats() = %+v, want the referenced entry kept", got)
+	}
+
+	e.Release()
+	time.Sleep(50 * time.Millisecond)
+	if got := cache.Stats(); got.Entries != 0 {
+		t.Fatalf("Stats() = %+v, want the entry evicted", got)
+	}
+	if cache.Acquire("test:lifecycle") == e {
+		t.Fatal("Acquire() after eviction returned the evicted entry")
+	}
+}
+
+func TestHeaderCache_Retain(t *testing.T) {
+	cache := NewHeaderCache()
+	cache.ttl = 20 * time.Millisecond
+
+	// The upstream holds the entry its writer records into, however
+	// long the room streams.
+	upstream := cache.Retain("test:retain", io.NopCloser(bytes.NewReader(nil)))
+	cache.GetOrCreate("test:retain").Set(Header{HasVideo: true}.Bytes())
+	time.Sleep(50 * time.Millisecond)
+	if got := cache.Stats(); got.Entries != 1 || got.Headers[0].Refs != 1 || !got.Headers[0].Ready {
+		t.Fatalf("Stats() = %+v, want the live entry kept past the TTL", got)
+	}
+
+	upstream.Close()
+	upstream.Close() // releases only once
+	if got := cache.Stats(); got.Entries != 1 || got.Headers[0].Refs != 0 || got.Headers[0].EvictAt == nil {
+		t.Fatalf("Stats() after close = %+v, want entry pending eviction", got)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := cache.Stats(); got.Entries != 0 {
+		t.Fatalf("Stats() = %+v, want the entry evicted after the upstream closed", got)
+	}
+}
+
+func TestHeaderCache_Invalidate(t *testing.T) {
+	cache := NewHeaderCache()
+	e := cache.Acquire("test:invalidate")
+	defer e.Release()
+	e.Set(Header{HasVideo: true}.Bytes())
+
+	cache.Invalidate("test:invalidate")
+	if e.IsReady() || e.Data() != nil {
+		t.Fatal("entry still ready after Invalidate")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		e.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Wait() returned before the next Set")
+	case <-time.After(20 * time.Millisecond):
+	}
+	e.Set(Header{HasAudio: true}.Bytes())
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Wait() did not return after Set")
+	}
+}
+
+func TestHeaderCache_CodecChange(t *testing.T) {
+	header := Header{HasAudio: true, HasVideo: true}.Bytes()
+	script := buildFLVTag(TagScript, []byte{0x02, 0x00, 0x01, 'x'})
+	avcSeq := buildFLVTag(TagVideo, []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01})
+	aacSeq := buildFLVTag(TagAudio, []byte{0xAF, 0x00, 0x12, 0x10})
+	key := buildFLVTagAt(TagVideo, 40, []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0xAA})
+	avcSeq2 := buildFLVTagAt(TagVideo, 2000, []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x02})
+	hevcSeq := buildFLVTagAt(TagVideo, 2000, []byte{0x90, 'h', 'v', 'c', '1', 0x03})
+	aacSeq2 := buildFLVTagAt(TagAudio, 2000, []byte{0xAF, 0x00, 0x11, 0x90})
+	opusSeq := buildFLVTagAt(TagAudio, 2000, []byte{0x90, 'O', 'p', 'u', 's', 'O'})
+
+	tests := []struct {
+		name        string
+		data        []byte
+		wantHeader  []byte
+		wantChanges int
+	}{
+		{
+			name:       "unchanged",
+			data:       slices.Concat(header, script, avcSeq, aacSeq, key, avcSeq, key),
+			wantHeader: slices.Concat(header, script, avcSeq, aacSeq),
+		},
+		{
+			name:        "new video configuration",
+			data:        slices.Concat(header, script, avcSeq, aacSeq, key, avcSeq2, key),
+			wantHeader:  slices.Concat(header, script, buildFLVTag(TagVideo, avcSeq2[11:len(avcSeq2)-4]), aacSeq),
+			wantChanges: 1,
+		},
+		{
+			name:        "switch to enhanced codecs",
+			data:        slices.Concat(header, script, avcSeq, aacSeq, key, hevcSeq, opusSeq, key),
+			wantHeader:  slices.Concat(header, script, buildFLVTag(TagVideo, hevcSeq[11:len(hevcSeq)-4]), buildFLVTag(TagAudio, opusSeq[11:len(opusSeq)-4])),
+			wantChanges: 2,
+		},
+		{
+			name:        "audio added",
+			data:        slices.Concat(header, script, avcSeq, key, aacSeq2, key),
+			wantHeader:  slices.Concat(header, script, avcSeq, buildFLVTag(TagAudio, aacSeq2[11:len(aacSeq2)-4])),
+			wantChanges: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewHeaderCache()
+			w := NewHeaderCacheWriter(io.Discard, cache, "test:codec")
+			for i := 0; i < len(tt.data); i += 7 {
+				if _, err := w.Write(tt.data[i:min(i+7, len(tt.data))]); err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+			}
+			entry := cache.GetOrCreate("test:codec")
+			if got := entry.Data(); !bytes.Equal(got, tt.wantHeader) {
+				t.Errorf("cached header = %x, want %x", got, tt.wantHeader)
+			}
+			if got := cache.Stats().Headers[0].CodecChanges; got != tt.wantChanges {
+				t.Errorf("CodecChanges = %d, want %d", got, tt.wantChanges)
+			}
+		})
+	}
+
+	t.Run("reconnect with a different codec", func(t *testing.T) {
+		cache := NewHeaderCache()
+		for _, data := range [][]byte{
+			slices.Concat(header, avcSeq, key),
+			slices.Concat(header, avcSeq, key),
+			slices.Concat(header, hevcSeq, key),
+		} {
+			w := NewHeaderCacheWriter(io.Discard, cache, "test:codec")
+			if _, err := w.Write(data); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+		}
+		if got := cache.Stats().Headers[0].CodecChanges; got != 1 {
+			t.Errorf("CodecChanges = %d, want 1", got)
+		}
+	})
+}
+
 func TestIsFLVConfigTag(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -142,6 +314,84 @@ func TestIsFLVConfigTag(t *testing.T) {
 			data:    []byte{0x17},
 			want:    false,
 		},
+		{
+			name:    "Enhanced HEVC Sequence Start",
+			tagType: 0x09,
+			data:    []byte{0x90, 'h', 'v', 'c', '1', 0x01}, // ExHeader + keyframe, SequenceStart
+			want:    true,
+		},
+		{
+			name:    "Enhanced AV1 Sequence Start",
+			tagType: 0x09,
+			data:    []byte{0x90, 'a', 'v', '0', '1', 0x81},
+			want:    true,
+		},
+		{
+			name:    "Enhanced VP9 Sequence Start",
+			tagType: 0x09,
+			data:    []byte{0x90, 'v', 'p', '0', '9', 0x01},
+			want:    true,
+		},
+		{
+			name:    "Enhanced HEVC coded frame",
+			tagType: 0x09,
+			data:    []byte{0x91, 'h', 'v', 'c', '1', 0x00, 0x00, 0x00, 0x01}, // CodedFrames
+			want:    false,
+		},
+		{
+			name:    "Enhanced video metadata",
+			tagType: 0x09,
+			data:    []byte{0x94, 'h', 'v', 'c', '1', 0x02, 0x00, 0x00}, // Metadata
+			want:    true,
+		},
+		{
+			name:    "Enhanced multitrack Sequence Start",
+			tagType: 0x09,
+			data:    []byte{0x96, 0x00, 'a', 'v', '0', '1', 0x00, 0x81}, // Multitrack, OneTrack + SequenceStart
+			want:    true,
+		},
+		{
+			name:    "Enhanced ModEx Sequence Start",
+			tagType: 0x09,
+			data:    []byte{0x97, 0x00, 0x00, 0x00, 'h', 'v', 'c', '1', 0x01}, // ModEx wrapping SequenceStart
+			want:    true,
+		},
+		{
+			name:    "Enhanced command frame",
+			tagType: 0x09,
+			data:    []byte{0xD0, 0x00}, // ExHeader + command frame
+			want:    false,
+		},
+		{
+			name:    "Enhanced video too short",
+			tagType: 0x09,
+			data:    []byte{0x90, 'h', 'v'},
+			want:    false,
+		},
+		{
+			name:    "Enhanced Opus Sequence Start",
+			tagType: 0x08,
+			data:    []byte{0x90, 'O', 'p', 'u', 's', 'O'}, // soundFormat=9 (ExHeader), SequenceStart
+			want:    true,
+		},
+		{
+			name:    "Enhanced FLAC Sequence Start",
+			tagType: 0x08,
+			data:    []byte{0x90, 'f', 'L', 'a', 'C', 0x00},
+			want:    true,
+		},
+		{
+			name:    "Enhanced Opus coded frame",
+			tagType: 0x08,
+			data:    []byte{0x91, 'O', 'p', 'u', 's', 0xFC},
+			want:    false,
+		},
+		{
+			name:    "Enhanced multichannel config",
+			tagType: 0x08,
+			data:    []byte{0x94, 'O', 'p', 'u', 's', 0x01, 0x02},
+			want:    true,
+		},
 		{
 			name:    "Unknown tag type",
 			tagType: 0x05,
@@ -265,64 +515,535 @@ func buildFLVTag(tagType byte, data []byte) []byte {
 	return tag
 }
 
-func TestFLVStream_ReadWithHeader(t *testing.T) {
-	cache := NewHeaderCache()
-	key := "test:flvstream"
-	headerData := []byte{0x46, 0x4C, 0x56, 0x01, 0x05} // "FLV\x01\x05"
+// buildFLVTagAt is buildFLVTag with a timestamp.
+func buildFLVTagAt(tagType byte, ts uint32, data []byte) []byte {
+	tag := buildFLVTag(tagType, data)
+	setTagTimestamp(tag, ts)
+	return tag
+}
 
-	// Pre-populate the cache with header data.
-	entry := cache.GetOrCreate(key)
-	entry.Set(headerData)
+// parseFLVTags splits an FLV body (after the file header) into tags.
+func parseFLVTags(t *testing.T, b []byte) [][]byte {
+	t.Helper()
+	var tags [][]byte
+	for len(b) > 0 {
+		if len(b) < 11 {
+			t.Fatalf("trailing %d bytes", len(b))
+		}
+		size := 11 + (int(b[1])<<16 | int(b[2])<<8 | int(b[3])) + 4
+		tags = append(tags, b[:size])
+		b = b[size:]
+	}
+	return tags
+}
 
-	// Build the inner stream using NewStream with a fetch function that
-	// returns data from a controlled pipe reader.
-	liveData := []byte("live-stream-data")
+func TestSplicer(t *testing.T) {
+	flvHeader := []byte{'F', 'L', 'V', 0x01, 0x05, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}
+	script := []byte{0x02, 0x00}
+	avc1 := []byte{0x17, 0x00, 0x01}
+	avc2 := []byte{0x17, 0x00, 0x02}
+	aac := []byte{0xAF, 0x00, 0x12}
+	frame := []byte{0x27, 0x01}
 
-	pr, pw := io.Pipe()
-	callCount := 0
-	extractFn := func(previous *stream.ExtractResult) (*stream.ExtractResult, error) {
-		callCount++
-		return &stream.ExtractResult{URL: "http://example.com/live.flv"}, nil
+	connection := func(avc []byte, start uint32) []byte {
+		var b []byte
+		b = append(b, flvHeader...)
+		b = append(b, buildFLVTagAt(0x12, 0, script)...)
+		b = append(b, buildFLVTagAt(0x09, 0, avc)...)
+		b = append(b, buildFLVTagAt(0x08, 0, aac)...)
+		b = append(b, buildFLVTagAt(0x09, start, frame)...)
+		b = append(b, buildFLVTagAt(0x09, start+40, frame)...)
+		return b
 	}
 
-	fetchFn := func(u string, headers http.Header) (io.ReadCloser, error) {
-		return pr, nil
+	var out bytes.Buffer
+	s := NewSplicer("test:splice")
+
+	// First connection passes through unchanged, delivered in small writes.
+	first := connection(avc1, 1000)
+	w := s.Wrap(&out)
+	for i := 0; i < len(first); i += 7 {
+		end := min(i+7, len(first))
+		if _, err := w.Write(first[i:end]); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if !bytes.Equal(out.Bytes(), first) {
+		t.Fatal("first connection should pass through unchanged")
 	}
 
-	innerStream := stream.NewStream(extractFn, fetchFn)
+	// Second connection: same config, timestamps restart from zero.
+	out.Reset()
+	if _, err := s.Wrap(&out).Write(connection(avc1, 0)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	tags := parseFLVTags(t, out.Bytes())
+	if len(tags) != 2 {
+		t.Fatalf("got %d tags after reconnect with same config, want 2 media tags", len(tags))
+	}
+	if got := tagTimestamp(tags[0]); got != 1080 {
+		t.Errorf("first spliced timestamp = %d, want 1080", got)
+	}
+	if got := tagTimestamp(tags[1]); got != 1120 {
+		t.Errorf("second spliced timestamp = %d, want 1120", got)
+	}
 
-	// Write live data then close the pipe writer to signal EOF.
-	go func() {
-		pw.Write(liveData)
-		pw.Close()
-	}()
+	// Third connection: video config changed, so it is forwarded once.
+	out.Reset()
+	if _, err := s.Wrap(&out).Write(connection(avc2, 5000)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	tags = parseFLVTags(t, out.Bytes())
+	if len(tags) != 3 {
+		t.Fatalf("got %d tags after reconnect with new config, want 3", len(tags))
+	}
+	if !isFLVConfigTag(tags[0][0], tags[0][11:len(tags[0])-4]) || !bytes.Equal(tags[0][11:len(tags[0])-4], avc2) {
+		t.Error("changed video sequence header should be forwarded first")
+	}
+	want := []uint32{1160, 1160, 1200}
+	for i, tag := range tags {
+		if got := tagTimestamp(tag); got != want[i] {
+			t.Errorf("tag %d timestamp = %d, want %d", i, got, want[i])
+		}
+	}
+}
+
+func TestGOPCache(t *testing.T) {
+	flvHeader := []byte{'F', 'L', 'V', 0x01, 0x05, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}
+	avcSeq := buildFLVTagAt(0x09, 0, []byte{0x17, 0x00, 0x01})
+	aacSeq := buildFLVTagAt(0x08, 0, []byte{0xAF, 0x00, 0x12})
+	key1 := buildFLVTagAt(0x09, 0, []byte{0x17, 0x01, 0xA1})
+	inter1 := buildFLVTagAt(0x09, 40, []byte{0x27, 0x01, 0xB1})
+	audio := buildFLVTagAt(0x08, 50, []byte{0xAF, 0x01, 0xC1})
+	key2 := buildFLVTagAt(0x09, 2000, []byte{0x17, 0x01, 0xA2})
+	inter2 := buildFLVTagAt(0x09, 2040, []byte{0x27, 0x01, 0xB2})
+	avcSeq2 := buildFLVTagAt(0x09, 4000, []byte{0x17, 0x00, 0x02})
+	key3 := buildFLVTagAt(0x09, 4000, []byte{0x17, 0x01, 0xA3})
+	hevcSeq := buildFLVTagAt(0x09, 0, []byte{0x90, 'h', 'v', 'c', '1', 0x01})
+	hevcKey := buildFLVTagAt(0x09, 0, []byte{0x93, 'h', 'v', 'c', '1', 0xA1})
+	hevcKey2 := buildFLVTagAt(0x09, 2000, []byte{0x93, 'h', 'v', 'c', '1', 0xA2})
+	meta := buildFLVTagAt(0x12, 0, []byte{0x02, 0x00, 0x0A, 'o', 'n', 'M', 'e', 't', 'a', 'D', 'a', 't', 'a'})
+	cue := buildFLVTagAt(0x12, 2010, []byte{0x02, 0x00, 0x0A, 'o', 'n', 'C', 'u', 'e', 'P', 'o', 'i', 'n', 't'})
+
+	concat := func(parts ...[]byte) []byte {
+		var b []byte
+		for _, p := range parts {
+			b = append(b, p...)
+		}
+		return b
+	}
+	// feed delivers data in odd-sized chunks, like the hub does.
+	feed := func(c *GOPCache, data []byte) {
+		for i := 0; i < len(data); i += 5 {
+			c.Observe(data[i:min(i+5, len(data))])
+		}
+	}
+
+	tests := []struct {
+		name    string
+		maxSize int
+		data    []byte
+		want    []byte
+	}{
+		{
+			name: "header not complete",
+			data: flvHeader[:8],
+			want: flvHeader[:8],
+		},
+		{
+			name: "no keyframe yet",
+			data: concat(flvHeader, avcSeq, aacSeq, inter1[:6]),
+			want: concat(flvHeader, aacSeq, avcSeq, inter1[:6]),
+		},
+		{
+			name: "latest GOP",
+			data: concat(flvHeader, avcSeq, aacSeq, key1, inter1, audio, key2, inter2),
+			want: concat(flvHeader, aacSeq, avcSeq, key2, inter2),
+		},
+		{
+			name: "partial tag after GOP",
+			data: concat(flvHeader, avcSeq, aacSeq, key1, inter1, audio[:9]),
+			want: concat(flvHeader, aacSeq, avcSeq, key1, inter1, audio[:9]),
+		},
+		{
+			name: "enhanced HEVC GOP",
+			data: concat(flvHeader, hevcSeq, hevcKey, inter1, hevcKey2, audio),
+			want: concat(flvHeader, hevcSeq, hevcKey2, audio),
+		},
+		{
+			name: "changed sequence header",
+			data: concat(flvHeader, avcSeq, aacSeq, key1, inter1, avcSeq2, key3),
+			want: concat(flvHeader, aacSeq, avcSeq2, key3),
+		},
+		{
+			name:    "GOP too large",
+			maxSize: len(key1) + len(inter1),
+			data:    concat(flvHeader, avcSeq, key1, inter1, audio),
+			want:    concat(flvHeader, avcSeq),
+		},
+		{
+			name: "metadata",
+			data: concat(flvHeader, meta, avcSeq, key1, key2, cue, inter2),
+			want: concat(flvHeader, meta, avcSeq, key2, inter2),
+		},
+		{
+			name: "not FLV",
+			data: []byte("#EXTM3U\n#EXT-X-VERSION:3\n"),
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewGOPCache("test:gop")
+			if tt.maxSize > 0 {
+				c.maxSize = tt.maxSize
+			}
+			feed(c, tt.data)
+			if got := c.Snapshot(); !bytes.Equal(got, tt.want) {
+				t.Errorf("Snapshot() = %d bytes, want %d bytes", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestParseTag(t *testing.T) {
+	tag := Tag{Type: TagVideo, Timestamp: 0x01020304, Data: []byte{0x17, 0x01, 0x00, 0x00, 0x21, 0xAA}}
+	encoded := tag.Bytes()
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{"complete", encoded, nil},
+		{"short header", encoded[:5], io.ErrUnexpectedEOF},
+		{"short body", encoded[:len(encoded)-1], io.ErrUnexpectedEOF},
+		{"unknown type", append([]byte{0x05}, encoded[1:]...), ErrInvalidTag},
+		{"bad PreviousTagSize", append(encoded[:len(encoded)-1:len(encoded)-1], 0xFF), ErrInvalidTag},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, n, err := ParseTag(tt.data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseTag() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if n != len(encoded) || got.Type != tag.Type || got.Timestamp != tag.Timestamp || !bytes.Equal(got.Data, tag.Data) {
+				t.Fatalf("ParseTag() = %+v, %d, want %+v, %d", got, n, tag, len(encoded))
+			}
+			v, err := got.Video()
+			if err != nil {
+				t.Fatalf("Video() error = %v", err)
+			}
+			want := VideoHeader{FrameType: FrameKey, CodecID: CodecAVC, PacketType: PacketNALU, CompositionTime: 0x21}
+			if v != want {
+				t.Errorf("Video() = %+v, want %+v", v, want)
+			}
+			if !got.IsKeyframe() || got.IsSequenceHeader() {
+				t.Errorf("IsKeyframe() = %v, IsSequenceHeader() = %v, want true, false", got.IsKeyframe(), got.IsSequenceHeader())
+			}
+			if !bytes.Equal(got.Payload(), []byte{0xAA}) {
+				t.Errorf("Payload() = %x, want aa", got.Payload())
+			}
+		})
+	}
+}
+
+func TestTag_Audio(t *testing.T) {
+	tag := Tag{Type: TagAudio, Data: []byte{0xAF, 0x00, 0x12, 0x10}}
+	a, err := tag.Audio()
+	if err != nil {
+		t.Fatalf("Audio() error = %v", err)
+	}
+	want := AudioHeader{SoundFormat: SoundFormatAAC, SoundRate: 3, SoundSize: 1, SoundType: 1, PacketType: PacketSequenceHeader}
+	if a != want {
+		t.Errorf("Audio() = %+v, want %+v", a, want)
+	}
+	if !tag.IsSequenceHeader() {
+		t.Error("IsSequenceHeader() = false, want true")
+	}
+	if !bytes.Equal(tag.Payload(), []byte{0x12, 0x10}) {
+		t.Errorf("Payload() = %x, want 1210", tag.Payload())
+	}
+	if _, err := (Tag{Type: TagVideo, Data: []byte{0x17}}).Audio(); err == nil {
+		t.Error("Audio() on a video tag succeeded, want error")
+	}
+}
+
+func TestTag_EnhancedRTMP(t *testing.T) {
+	tests := []struct {
+		name        string
+		tag         Tag
+		wantFourCC  string
+		wantPacket  byte
+		wantCT      int32
+		wantKey     bool
+		wantSeq     bool
+		wantPayload []byte
+	}{
+		{
+			name:        "HEVC sequence start",
+			tag:         Tag{Type: TagVideo, Data: []byte{0x90, 'h', 'v', 'c', '1', 0x01, 0x02}},
+			wantFourCC:  FourCCHEVC,
+			wantPacket:  ExPacketSequenceStart,
+			wantKey:     true,
+			wantSeq:     true,
+			wantPayload: []byte{0x01, 0x02},
+		},
+		{
+			name:        "HEVC keyframe with composition time",
+			tag:         Tag{Type: TagVideo, Data: []byte{0x91, 'h', 'v', 'c', '1', 0xFF, 0xFF, 0xF6, 0xAA}},
+			wantFourCC:  FourCCHEVC,
+			wantPacket:  ExPacketCodedFrames,
+			wantCT:      -10,
+			wantKey:     true,
+			wantPayload: []byte{0xAA},
+		},
+		{
+			name:        "AV1 keyframe",
+			tag:         Tag{Type: TagVideo, Data: []byte{0x91, 'a', 'v', '0', '1', 0x12, 0x00}},
+			wantFourCC:  FourCCAV1,
+			wantPacket:  ExPacketCodedFrames,
+			wantKey:     true,
+			wantPayload: []byte{0x12, 0x00},
+		},
+		{
+			name:        "VP9 inter frame without composition time",
+			tag:         Tag{Type: TagVideo, Data: []byte{0xA3, 'v', 'p', '0', '9', 0xBB}},
+			wantFourCC:  FourCCVP9,
+			wantPacket:  ExPacketCodedFramesX,
+			wantPayload: []byte{0xBB},
+		},
+		{
+			name:        "multitrack AV1 sequence start",
+			tag:         Tag{Type: TagVideo, Data: []byte{0x96, 0x00, 'a', 'v', '0', '1', 0x00, 0x81}},
+			wantFourCC:  FourCCAV1,
+			wantPacket:  ExPacketSequenceStart,
+			wantKey:     true,
+			wantSeq:     true,
+			wantPayload: []byte{0x00, 0x81},
+		},
+		{
+			name:        "Opus sequence start",
+			tag:         Tag{Type: TagAudio, Data: []byte{0x90, 'O', 'p', 'u', 's', 'O', 'H'}},
+			wantFourCC:  FourCCOpus,
+			wantPacket:  ExPacketSequenceStart,
+			wantSeq:     true,
+			wantPayload: []byte{'O', 'H'},
+		},
+		{
+			name:        "FLAC coded frames",
+			tag:         Tag{Type: TagAudio, Data: []byte{0x91, 'f', 'L', 'a', 'C', 0xFF, 0xF8}},
+			wantFourCC:  FourCCFLAC,
+			wantPacket:  ExPacketCodedFrames,
+			wantPayload: []byte{0xFF, 0xF8},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ex *ExHeader
+			var packet byte
+			var ct int32
+			if tt.tag.Type == TagVideo {
+				h, err := tt.tag.Video()
+				if err != nil {
+					t.Fatalf("Video() error = %v", err)
+				}
+				ex, packet, ct = h.Ex, h.PacketType, h.CompositionTime
+			} else {
+				h, err := tt.tag.Audio()
+				if err != nil {
+					t.Fatalf("Audio() error = %v", err)
+				}
+				if h.SoundFormat != SoundFormatExHeader {
+					t.Errorf("SoundFormat = %d, want %d", h.SoundFormat, SoundFormatExHeader)
+				}
+				ex, packet = h.Ex, h.PacketType
+			}
+			if ex == nil || ex.FourCC != tt.wantFourCC {
+				t.Fatalf("Ex = %+v, want FourCC %q", ex, tt.wantFourCC)
+			}
+			if packet != tt.wantPacket || ct != tt.wantCT {
+				t.Errorf("PacketType, CompositionTime = %d, %d, want %d, %d", packet, ct, tt.wantPacket, tt.wantCT)
+			}
+			if got := tt.tag.IsKeyframe(); got != tt.wantKey {
+				t.Errorf("IsKeyframe() = %v, want %v", got, tt.wantKey)
+			}
+			if got := tt.tag.IsSequenceHeader(); got != tt.wantSeq {
+				t.Errorf("IsSequenceHeader() = %v, want %v", got, tt.wantSeq)
+			}
+			if got := tt.tag.Payload(); !bytes.Equal(got, tt.wantPayload) {
+				t.Errorf("Payload() = %x, want %x", got, tt.wantPayload)
+			}
+		})
+	}
+}
 
-	flvStream := NewFLVStream(innerStream, cache, key)
+func TestDemuxer(t *testing.T) {
+	header := Header{Version: 1, HasAudio: true, HasVideo: true}
+	tags := []Tag{
+		{Type: TagScript, Data: []byte{0x02, 0x00, 0x01, 'x'}},
+		{Type: TagVideo, Data: []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01}},
+		{Type: TagAudio, Timestamp: 20, Data: []byte{0xAF, 0x01, 0x02}},
+		{Type: TagVideo, Timestamp: 40, Data: []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x03}},
+	}
+	var stream bytes.Buffer
+	m := NewMuxer(&stream)
+	if err := m.WriteHeader(header); err != nil {
+		t.Fatalf("WriteHeader: %v", err)
+	}
+	for _, tag := range tags {
+		if err := m.WriteTag(tag); err != nil {
+			t.Fatalf("WriteTag: %v", err)
+		}
+	}
+	clean := stream.Bytes()
+	garbage := []byte{0xFF, 0x09, 0x00, 0x00, 0x05, 0x12, 0x00}
 
-	// Read should get header first, then live data.
-	buf := make([]byte, 1024)
+	tests := []struct {
+		name        string
+		data        []byte
+		chunk       int
+		wantTags    int
+		wantResyncs int
+	}{
+		{"whole", clean, len(clean), 4, 0},
+		{"byte by byte", clean, 1, 4, 0},
+		{"odd chunks", clean, 7, 4, 0},
+		{
+			name:        "garbage between tags",
+			data:        slices.Concat(clean[:13+tags[0].Size()], garbage, clean[13+tags[0].Size():]),
+			chunk:       3,
+			wantTags:    4,
+			wantResyncs: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []Tag
+			var gotHeader *Header
+			d := NewDemuxer(func(tag Tag) error {
+				got = append(got, tag.Clone())
+				return nil
+			})
+			d.OnHeader(func(h Header) error {
+				gotHeader = &h
+				return nil
+			})
+			for i := 0; i < len(tt.data); i += tt.chunk {
+				if _, err := d.Write(tt.data[i:min(i+tt.chunk, len(tt.data))]); err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+			}
+			if gotHeader == nil || *gotHeader != header {
+				t.Fatalf("header = %+v, want %+v", gotHeader, header)
+			}
+			if len(got) != tt.wantTags {
+				t.Fatalf("got %d tags, want %d", len(got), tt.wantTags)
+			}
+			for i, tag := range got {
+				if tag.Type != tags[i].Type || tag.Timestamp != tags[i].Timestamp || !bytes.Equal(tag.Data, tags[i].Data) {
+					t.Errorf("tag %d = %+v, want %+v", i, tag, tags[i])
+				}
+			}
+			if resyncs, _ := d.Resyncs(); resyncs != tt.wantResyncs {
+				t.Errorf("Resyncs() = %d, want %d", resyncs, tt.wantResyncs)
+			}
+			if len(d.Pending()) != 0 {
+				t.Errorf("Pending() = %d bytes, want 0", len(d.Pending()))
+			}
+		})
+	}
 
-	// First read: header data.
-	n, err := flvStream.Read(buf)
+	t.Run("not FLV", func(t *testing.T) {
+		d := NewDemuxer(nil)
+		if _, err := d.Write([]byte("#EXTM3U\n")); !errors.Is(err, ErrNotFLV) {
+			t.Fatalf("Write() error = %v, want ErrNotFLV", err)
+		}
+		if string(d.Pending()) != "#EXTM3U\n" {
+			t.Errorf("Pending() = %q, want the unparsed data", d.Pending())
+		}
+	})
+}
+
+func TestAMF0_RoundTrip(t *testing.T) {
+	date := time.UnixMilli(1700000000123).UTC()
+	values := []any{
+		"onMetaData",
+		ECMAArray{
+			{Key: "duration", Value: float64(0)},
+			{Key: "width", Value: float64(1920)},
+			{Key: "stereo", Value: true},
+			{Key: "encoder", Value: "obs"},
+			{Key: "nested", Value: Object{{Key: "a", Value: nil}, {Key: "b", Value: Undefined{}}}},
+			{Key: "list", Value: []any{float64(1), "two"}},
+			{Key: "created", Value: date},
+		},
+	}
+	encoded, err := EncodeAMF0(values...)
+	if err != nil {
+		t.Fatalf("EncodeAMF0: %v", err)
+	}
+	decoded, err := DecodeAMF0(encoded)
 	if err != nil {
-		t.Fatalf("first Read returned error: %v", err)
+		t.Fatalf("DecodeAMF0: %v", err)
 	}
-	if !bytes.Equal(buf[:n], headerData) {
-		t.Fatalf("first Read got %v, want %v", buf[:n], headerData)
+	if !reflect.DeepEqual(decoded, values) {
+		t.Fatalf("round trip = %#v, want %#v", decoded, values)
 	}
 
-	// Second read: live data.
-	n, err = flvStream.Read(buf)
+	tag, err := NewScriptTag(0, "onMetaData", map[string]any{"width": 1280, "height": 720})
 	if err != nil {
-		t.Fatalf("second Read returned error: %v", err)
+		t.Fatalf("NewScriptTag: %v", err)
 	}
-	if !bytes.Equal(buf[:n], liveData) {
-		t.Fatalf("second Read got %v, want %v", buf[:n], liveData)
+	name, args, err := tag.Script()
+	if err != nil || name != "onMetaData" || len(args) != 1 {
+		t.Fatalf("Script() = %q, %v, %v", name, args, err)
 	}
+	meta, ok := args[0].(ECMAArray)
+	if !ok {
+		t.Fatalf("metadata is %T, want ECMAArray", args[0])
+	}
+	if w, _ := meta.Get("width"); w != float64(1280) {
+		t.Errorf("width = %v, want 1280", w)
+	}
+	if h, _ := meta.Get("height"); h != float64(720) {
+		t.Errorf("height = %v, want 720", h)
+	}
+}
+
+func TestAMF0_Malformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"short number", []byte{0x00, 0x01}},
+		{"truncated string", []byte{0x02, 0x00, 0x05, 'a'}},
+		{"strict array count too large", []byte{0x0A, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{"unsupported marker", []byte{0x0D}},
+		{"too deep", bytes.Repeat([]byte{0x03, 0x00, 0x01, 'k'}, maxAMF0Depth+2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeAMF0(tt.data); !errors.Is(err, ErrAMF0) {
+				t.Errorf("DecodeAMF0() error = %v, want ErrAMF0", err)
+			}
+		})
+	}
+}
+
+// tagTimestamp returns the 32-bit timestamp of an FLV tag, including the
+// extended byte.
+func tagTimestamp(tag []byte) uint32 {
+	return uint32(tag[7])<<24 | uint32(tag[4])<<16 | uint32(tag[5])<<8 | uint32(tag[6])
+}
 
-	// The inner stream's produce goroutine is still running after the pipe
-	// writer closes. Since closeWithError does not use closeOnce, calling
-	// Close() here would panic with "close of closed channel". We skip
-	// cleanup — the goroutine will exit on its own after the pipe error
-	// propagates. This test only validates the Read (header + live) behavior.
+func setTagTimestamp(tag []byte, ts uint32) {
+	tag[4] = byte(ts >> 16)
+	tag[5] = byte(ts >> 8)
+	tag[6] = byte(ts)
+	tag[7] = byte(ts >> 24)
 }
@@ -0,0 +1,133 @@
+package flv
+
+import (
+	"sync"
+
+	"github.com/nv4d1k/live-stream-forwarder/global"
+)
+
+// DefaultMaxGOPSize bounds the bytes a GOPCache keeps. A stream whose GOP
+// grows past it (or that has no video keyframes at all) is not cached until
+// the next keyframe; late subscribers then start at the next tag instead.
+var DefaultMaxGOPSize = 4 << 20
+
+// GOPCache follows a shared FLV upstream and keeps what a subscriber joining
+// mid-stream needs to start playback: the file header, the metadata and the
+// latest sequence headers, and every tag since the latest video keyframe. It
+// implements stream.JoinCache. Since it sees the same data the hub
+// broadcasts, its snapshot is one tag-aligned prefix of the live data, and
+// playback starts on a keyframe instead of showing grey frames until the
+// next one arrives.
+type GOPCache struct {
+	key     string
+	maxSize int
+
+	mu        sync.Mutex
+	demux     *Demuxer
+	disabled  bool   // data is not FLV
+	header    []byte // file header and PreviousTagSize0
+	script    []byte // script tags before the first media tag
+	mediaSeen bool   // a media tag has been seen
+	started   bool   // gop begins with a keyframe
+	gop       []byte // complete tags since the latest keyframe
+	audioSeq  []byte // latest audio sequence header tag
+	videoSeq  []byte // latest video sequence header tag
+}
+
+func NewGOPCache(key string) *GOPCache {
+	log := global.Log.WithField("func", "app.engine.forwarder.flv.NewGOPCache")
+	log.WithField("key", key).Debug("creating GOPCache")
+	c := &GOPCache{key: key, maxSize: DefaultMaxGOPSize}
+	c.demux = NewDemuxer(c.add)
+	c.demux.OnHeader(func(h Header) error {
+		c.header = h.AppendTo(nil)
+		return nil
+	})
+	return c
+}
+
+// Observe parses the next chunk of the upstream.
+func (c *GOPCache) Observe(p []byte) {
+	log := global.Log.WithField("func", "app.engine.forwarder.flv.GOPCache.Observe")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.disabled {
+		return
+	}
+	if _, err := c.demux.Write(p); err != nil {
+		log.WithField("key", c.key).WithError(err).Debug("disabling GOP cache")
+		c.disabled = true
+		c.header = nil
+		c.script = nil
+		c.gop = nil
+		c.audioSeq = nil
+		c.videoSeq = nil
+	}
+}
+
+// Snapshot returns the data a subscriber joining now needs ahead of the live
+// data: the file header, the metadata, the latest sequence headers, the
+// current GOP, and the partial tag the live data continues. Before the file
+// header is complete, it returns the part of it seen so far. It returns nil
+// if the upstream is not FLV.
+func (c *GOPCache) Snapshot() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.disabled {
+		return nil
+	}
+	pending := c.demux.Pending()
+	if !c.demux.HeaderParsed() {
+		return append([]byte(nil), pending...)
+	}
+	out := make([]byte, 0, len(c.header)+len(c.script)+len(c.audioSeq)+len(c.videoSeq)+len(c.gop)+len(pending))
+	out = append(out, c.header...)
+	out = append(out, c.script...)
+	out = append(out, c.audioSeq...)
+	out = append(out, c.videoSeq...)
+	if c.started {
+		out = append(out, c.gop...)
+	}
+	return append(out, pending...)
+}
+
+// add records a complete tag. Called by the demuxer with c.mu held.
+func (c *GOPCache) add(t Tag) error {
+	log := global.Log.WithField("func", "app.engine.forwarder.flv.GOPCache.add")
+	if t.Type == TagScript {
+		// Metadata comes ahead of the media; later script tags, such
+		// as cue points, only matter to clients that see them live.
+		if !c.mediaSeen {
+			c.script = t.AppendTo(c.script)
+		}
+		return nil
+	}
+	if t.IsSequenceHeader() {
+		// A later sequence header replaces the earlier one, and goes
+		// ahead of the GOP it configures.
+		if t.Type == TagAudio {
+			c.audioSeq = t.Bytes()
+		} else {
+			c.videoSeq = t.Bytes()
+		}
+		return nil
+	}
+	c.mediaSeen = true
+
+	if t.IsKeyframe() {
+		c.gop = c.gop[:0]
+		c.started = true
+	}
+	if !c.started {
+		return nil
+	}
+	if len(c.gop)+t.Size() > c.maxSize {
+		log.WithField("key", c.key).WithField("maxSize", c.maxSize).
+			Debug("GOP exceeds cache size, dropping it until the next keyframe")
+		c.gop = nil
+		c.started = false
+		return nil
+	}
+	c.gop = t.AppendTo(c.gop)
+	return nil
+}
@@ -1,23 +1,45 @@
 package flv
 
 import (
+	"bytes"
+	"io"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/nv4d1k/live-stream-forwarder/global"
 )
 
-// HeaderCache stores cached FLV headers keyed by "platform:room".
+// DefaultHeaderTTL is how long a header stays cached after the last stream
+// using it has closed, so a client reconnecting shortly after does not find
+// the cache empty.
+var DefaultHeaderTTL = 5 * time.Minute
+
+// HeaderCache stores cached FLV headers keyed by the shared upstream's key,
+// "platform:room" plus any forced format. Entries are reference counted by
+// the streams reading them and evicted once unused for the cache's TTL.
 type HeaderCache struct {
-	mu      sync.RWMutex
+	mu      sync.Mutex
 	entries map[string]*HeaderEntry
+	ttl     time.Duration
 }
 
 // HeaderEntry holds a cached FLV header and a readiness signal.
 type HeaderEntry struct {
-	mu    sync.RWMutex
-	data  []byte
-	ready chan struct{}
-	once  sync.Once
+	cache *HeaderCache
+	key   string
+
+	// Guarded by cache.mu.
+	refs    int
+	evict   *time.Timer // pending eviction while refs is 0
+	evictAt time.Time
+
+	mu           sync.RWMutex
+	data         []byte
+	ready        chan struct{}
+	isReady      bool
+	updatedAt    time.Time
+	codecChanges int
 }
 
 // DefaultCache is the process-wide FLV header cache.
@@ -28,66 +50,245 @@ func NewHeaderCache() *HeaderCache {
 	log.Debug("creating HeaderCache")
 	return &HeaderCache{
 		entries: make(map[string]*HeaderEntry),
+		ttl:     DefaultHeaderTTL,
 	}
 }
 
 // GetOrCreate returns the existing HeaderEntry for key, or creates a new one.
+// It does not take a reference: an entry nobody acquires is evicted after the
+// TTL.
 func (c *HeaderCache) GetOrCreate(key string) *HeaderEntry {
-	log := global.Log.WithField("func", "app.engine.forwarder.flv.GetOrCreate")
-	c.mu.RLock()
-	e, ok := c.entries[key]
-	c.mu.RUnlock()
-	if ok {
-		return e
-	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.getOrCreateLocked(key)
+}
 
+// Acquire returns the HeaderEntry for key like GetOrCreate and keeps it
+// cached until Release is called.
+func (c *HeaderCache) Acquire(key string) *HeaderEntry {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	// Double-check after acquiring write lock.
-	if e, ok = c.entries[key]; ok {
+	e := c.getOrCreateLocked(key)
+	e.refs++
+	if e.evict != nil {
+		e.evict.Stop()
+		e.evict = nil
+		e.evictAt = time.Time{}
+	}
+	return e
+}
+
+// Retain keeps the entry for key cached while r, the upstream recording
+// into it, is open. Closing the returned reader closes r and releases the
+// entry, which is then evicted after the TTL unless acquired again.
+func (c *HeaderCache) Retain(key string, r io.ReadCloser) io.ReadCloser {
+	return &retained{ReadCloser: r, entry: c.Acquire(key)}
+}
+
+// retained is an upstream holding a reference to its HeaderEntry.
+type retained struct {
+	io.ReadCloser
+	entry       *HeaderEntry
+	releaseOnce sync.Once
+}
+
+func (r *retained) Close() error {
+	r.releaseOnce.Do(r.entry.Release)
+	return r.ReadCloser.Close()
+}
+
+func (c *HeaderCache) getOrCreateLocked(key string) *HeaderEntry {
+	log := global.Log.WithField("func", "app.engine.forwarder.flv.GetOrCreate")
+	if e, ok := c.entries[key]; ok {
 		return e
 	}
-	e = newHeaderEntry()
+	e := newHeaderEntry()
+	e.cache, e.key = c, key
 	c.entries[key] = e
+	c.scheduleEvictLocked(e)
 	log.WithField("key", key).Debug("created new header cache entry")
 	return e
 }
 
+// Invalidate drops the cached header for key. The entry stays, but is not
+// ready again until the next Set. It is used when a new upstream opens: the
+// new upstream sends its own header, and a previous upstream's header may no
+// longer match it.
+func (c *HeaderCache) Invalidate(key string) {
+	log := global.Log.WithField("func", "app.engine.forwarder.flv.Invalidate")
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.isReady {
+		return
+	}
+	e.data = nil
+	e.isReady = false
+	e.ready = make(chan struct{})
+	log.WithField("key", key).Debug("invalidated cached FLV header")
+}
+
+// scheduleEvictLocked arms the eviction timer of an unreferenced entry.
+// Called with c.mu held.
+func (c *HeaderCache) scheduleEvictLocked(e *HeaderEntry) {
+	if e.refs > 0 || e.evict != nil {
+		return
+	}
+	e.evictAt = time.Now().Add(c.ttl)
+	e.evict = time.AfterFunc(c.ttl, func() { c.evictEntry(e) })
+}
+
+func (c *HeaderCache) evictEntry(e *HeaderEntry) {
+	log := global.Log.WithField("func", "app.engine.forwarder.flv.evictEntry")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e.refs > 0 || c.entries[e.key] != e {
+		return
+	}
+	delete(c.entries, e.key)
+	e.evict = nil
+	log.WithField("key", e.key).Debug("evicted header cache entry")
+}
+
+// HeaderCacheStats describes the contents of a HeaderCache.
+type HeaderCacheStats struct {
+	Entries int                `json:"entries"`
+	Bytes   int                `json:"bytes"`
+	Headers []HeaderEntryStats `json:"headers"`
+}
+
+// HeaderEntryStats describes a single cached header.
+type HeaderEntryStats struct {
+	Key          string     `json:"key"`
+	Size         int        `json:"size"`
+	Ready        bool       `json:"ready"`
+	Refs         int        `json:"refs"`
+	CodecChanges int        `json:"codec_changes"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty"`
+	EvictAt      *time.Time `json:"evict_at,omitempty"`
+}
+
+// Stats returns the cache's size and a description of every entry, sorted by
+// key.
+func (c *HeaderCache) Stats() HeaderCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := HeaderCacheStats{Entries: len(c.entries), Headers: make([]HeaderEntryStats, 0, len(c.entries))}
+	for key, e := range c.entries {
+		es := HeaderEntryStats{Key: key, Refs: e.refs}
+		if e.evict != nil {
+			evictAt := e.evictAt
+			es.EvictAt = &evictAt
+		}
+		e.mu.RLock()
+		es.Size = len(e.data)
+		es.Ready = e.isReady
+		es.CodecChanges = e.codecChanges
+		if !e.updatedAt.IsZero() {
+			updatedAt := e.updatedAt
+			es.UpdatedAt = &updatedAt
+		}
+		e.mu.RUnlock()
+		s.Bytes += es.Size
+		s.Headers = append(s.Headers, es)
+	}
+	sort.Slice(s.Headers, func(i, j int) bool { return s.Headers[i].Key < s.Headers[j].Key })
+	return s
+}
+
 func newHeaderEntry() *HeaderEntry {
 	return &HeaderEntry{
 		ready: make(chan struct{}),
 	}
 }
 
+// Release drops a reference taken with Acquire. The entry is evicted once it
+// has had no references for the cache's TTL.
+func (e *HeaderEntry) Release() {
+	c := e.cache
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e.refs > 0 {
+		e.refs--
+	}
+	c.scheduleEvictLocked(e)
+}
+
 // Set stores the FLV header data and signals readiness.
 // May be called multiple times (on 403 reconnect with a fresh stream);
-// each call updates the cached data.
+// each call updates the cached data. A change of codec configuration against
+// the previous header is logged and counted.
 func (e *HeaderEntry) Set(data []byte) {
 	log := global.Log.WithField("func", "app.engine.forwarder.flv.Set")
 	copied := make([]byte, len(data))
 	copy(copied, data)
 
 	e.mu.Lock()
+	changed := e.data != nil && !sameSequenceHeaders(e.data, copied)
+	if changed {
+		e.codecChanges++
+	}
 	e.data = copied
+	e.updatedAt = time.Now()
+	if !e.isReady {
+		e.isReady = true
+		close(e.ready)
+	}
 	e.mu.Unlock()
 
-	e.once.Do(func() { close(e.ready) })
+	if changed {
+		log.WithField("key", e.key).Info("codec configuration changed, replaced cached FLV header")
+	}
 	log.WithField("size", len(data)).Debug("cached FLV header")
 }
 
+// UpdateSequenceHeader replaces the sequence header of t's type in the cached
+// header with t, if they differ. It returns whether the cached header
+// changed. A header that is not cached yet is left alone; the next Set
+// provides it.
+func (e *HeaderEntry) UpdateSequenceHeader(t Tag) bool {
+	log := global.Log.WithField("func", "app.engine.forwarder.flv.UpdateSequenceHeader")
+	e.mu.Lock()
+	if !e.isReady {
+		e.mu.Unlock()
+		return false
+	}
+	data, changed := replaceSequenceHeader(e.data, t)
+	if changed {
+		e.data = data
+		e.updatedAt = time.Now()
+		e.codecChanges++
+	}
+	e.mu.Unlock()
+
+	if changed {
+		log.WithField("key", e.key).WithField("tagType", t.Type).
+			Info("codec configuration changed mid-stream, updated cached FLV header")
+	}
+	return changed
+}
+
 // Wait blocks until the header data is available (Set has been called at least once).
 func (e *HeaderEntry) Wait() {
-	<-e.ready
+	e.mu.RLock()
+	ready := e.ready
+	e.mu.RUnlock()
+	<-ready
 }
 
 // IsReady returns whether the header data is available without blocking.
 func (e *HeaderEntry) IsReady() bool {
-	select {
-	case <-e.ready:
-		return true
-	default:
-		return false
-	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.isReady
 }
 
 // Data returns the cached header data. Caller should call Wait first to ensure
@@ -97,3 +298,73 @@ func (e *HeaderEntry) Data() []byte {
 	defer e.mu.RUnlock()
 	return e.data
 }
+
+// sequenceHeaders returns the sequence header tag bodies in a cached header,
+// by tag type.
+func sequenceHeaders(header []byte) map[byte][]byte {
+	_, n, err := ParseHeader(header)
+	if err != nil {
+		return nil
+	}
+	seqs := make(map[byte][]byte)
+	for b := header[n:]; len(b) > 0; {
+		t, n, err := ParseTag(b)
+		if err != nil {
+			break
+		}
+		if t.IsSequenceHeader() {
+			seqs[t.Type] = t.Data
+		}
+		b = b[n:]
+	}
+	return seqs
+}
+
+// sameSequenceHeaders reports whether two cached headers carry the same codec
+// configuration.
+func sameSequenceHeaders(a, b []byte) bool {
+	seqA, seqB := sequenceHeaders(a), sequenceHeaders(b)
+	if len(seqA) != len(seqB) {
+		return false
+	}
+	for typ, data := range seqA {
+		if other, ok := seqB[typ]; !ok || !bytes.Equal(data, other) {
+			return false
+		}
+	}
+	return true
+}
+
+// replaceSequenceHeader returns header with its sequence header of t's type
+// replaced by t, or t appended if it has none. It reports false and returns
+// header unchanged if the header already carries t or cannot be parsed.
+func replaceSequenceHeader(header []byte, t Tag) ([]byte, bool) {
+	_, n, err := ParseHeader(header)
+	if err != nil {
+		return header, false
+	}
+	out := append(make([]byte, 0, len(header)+t.Size()), header[:n]...)
+	replaced := false
+	for b := header[n:]; len(b) > 0; {
+		old, size, err := ParseTag(b)
+		if err != nil {
+			return header, false
+		}
+		if !replaced && old.Type == t.Type && old.IsSequenceHeader() {
+			if bytes.Equal(old.Data, t.Data) {
+				return header, false
+			}
+			t.Timestamp = old.Timestamp
+			out = t.AppendTo(out)
+			replaced = true
+		} else {
+			out = append(out, b[:size]...)
+		}
+		b = b[size:]
+	}
+	if !replaced {
+		t.Timestamp = 0
+		out = t.AppendTo(out)
+	}
+	return out, true
+}
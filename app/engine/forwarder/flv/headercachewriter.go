@@ -16,7 +16,8 @@ const (
 
 // HeaderCacheWriter intercepts writes to detect and cache FLV header/config tags,
 // then strips them from the output. Once all config tags are detected, subsequent
-// writes pass through directly to the underlying writer.
+// writes pass through directly to the underlying writer, while sequence headers
+// that change mid-stream are still recorded in the cached header.
 type HeaderCacheWriter struct {
 	next  io.Writer
 	cache *HeaderCache
@@ -25,6 +26,8 @@ type HeaderCacheWriter struct {
 	mu    sync.Mutex
 	buf   []byte
 	state detectState
+	entry *HeaderEntry // set once the header is cached
+	demux *Demuxer     // follows the stream for sequence header changes
 }
 
 func NewHeaderCacheWriter(next io.Writer, cache *HeaderCache, key string) *HeaderCacheWriter {
@@ -44,6 +47,7 @@ func (w *HeaderCacheWriter) Write(p []byte) (int, error) {
 	defer w.mu.Unlock()
 
 	if w.state == statePassthrough {
+		w.track(p)
 		return w.next.Write(p)
 	}
 
@@ -64,15 +68,39 @@ func (w *HeaderCacheWriter) Write(p []byte) (int, error) {
 	default:
 		// Header detected: cache it, write all buffered data to pipe (header is NOT stripped).
 		log.WithField("headerSize", offset).Debug("FLV header detected and cached")
-		entry := w.cache.GetOrCreate(w.key)
-		entry.Set(w.buf[:offset])
+		w.entry = w.cache.GetOrCreate(w.key)
+		w.entry.Set(w.buf[:offset])
 		w.state = statePassthrough
+		w.demux = NewDemuxer(w.trackTag)
+		w.track(w.buf)
 		_, err := w.next.Write(w.buf)
 		w.buf = nil
 		return len(p), err
 	}
 }
 
+// track feeds passthrough data to the demuxer following sequence headers.
+// Called with w.mu held.
+func (w *HeaderCacheWriter) track(p []byte) {
+	if w.demux == nil {
+		return
+	}
+	if _, err := w.demux.Write(p); err != nil {
+		global.Log.WithField("func", "app.engine.forwarder.flv.track").
+			WithField("key", w.key).WithError(err).Debug("no longer following sequence headers")
+		w.demux = nil
+	}
+}
+
+// trackTag updates the cached header when a sequence header differs from
+// the cached one, so clients joining later get the current configuration.
+func (w *HeaderCacheWriter) trackTag(t Tag) error {
+	if t.IsSequenceHeader() {
+		w.entry.UpdateSequenceHeader(t)
+	}
+	return nil
+}
+
 // detectHeaderBoundary returns the byte offset where media data begins.
 // Returns -1 if the boundary cannot be determined yet (incomplete data).
 // Returns 0 if the data does not appear to be valid FLV.
@@ -125,34 +153,8 @@ func (w *HeaderCacheWriter) detectHeaderBoundary() int {
 // isFLVConfigTag returns true if the tag is a configuration tag that should
 // be cached as part of the FLV header (not media data).
 func isFLVConfigTag(tagType byte, data []byte) bool {
-	switch tagType {
-	case 0x12: // Script Data (onMetaData etc.)
+	if tagType == TagScript { // onMetaData etc.
 		return true
-	case 0x08: // Audio
-		if len(data) < 2 {
-			return false
-		}
-		soundFormat := (data[0] >> 4) & 0x0F
-		if soundFormat == 10 { // AAC
-			return data[1] == 0 // AAC Sequence Header
-		}
-		return false
-	case 0x09: // Video
-		if len(data) < 2 {
-			return false
-		}
-		frameType := (data[0] >> 4) & 0x0F
-		codecID := data[0] & 0x0F
-		if frameType == 1 { // Keyframe
-			if codecID == 7 { // AVC/H.264
-				return data[1] == 0 // AVC Sequence Header
-			}
-			if codecID == 12 { // HEVC/H.265
-				return data[1] == 0 // HEVC Sequence Header
-			}
-		}
-		return false
-	default:
-		return false
 	}
+	return Tag{Type: tagType, Data: data}.isCodecConfig()
 }
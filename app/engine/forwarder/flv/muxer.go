@@ -0,0 +1,34 @@
+package flv
+
+import (
+	"io"
+	"sync"
+)
+
+// Muxer writes an FLV stream.
+type Muxer struct {
+	w   io.Writer
+	mu  sync.Mutex
+	buf []byte
+}
+
+func NewMuxer(w io.Writer) *Muxer {
+	return &Muxer{w: w}
+}
+
+// WriteHeader writes the FLV file header and PreviousTagSize0.
+func (m *Muxer) WriteHeader(h Header) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.w.Write(h.Bytes())
+	return err
+}
+
+// WriteTag writes t and its PreviousTagSize in a single Write.
+func (m *Muxer) WriteTag(t Tag) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.buf = t.AppendTo(m.buf[:0])
+	_, err := m.w.Write(m.buf)
+	return err
+}
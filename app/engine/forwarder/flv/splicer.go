@@ -0,0 +1,178 @@
+package flv
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/nv4d1k/live-stream-forwarder/global"
+)
+
+// spliceGap is the timestamp step, in milliseconds, inserted between the last
+// tag of one upstream connection and the first tag of the next (roughly one
+// frame at 25 fps).
+const spliceGap = 40
+
+// Splicer joins the FLV bodies of successive upstream connections into one
+// continuous FLV stream. It keeps its state across reconnects; Wrap is used
+// as the stream.WriterWrapperFunc, which is called once per connection.
+//
+// For every connection after the first, the splicer drops the FLV file header
+// and script data, forwards sequence headers only if the codec configuration
+// differs from the one already sent, and shifts tag timestamps so they
+// continue from where the previous connection stopped.
+type Splicer struct {
+	key string
+
+	mu       sync.Mutex
+	segments int    // connections seen so far
+	lastTS   uint32 // highest timestamp written
+	wroteAny bool   // whether any tag has been written
+	audioSeq []byte // last forwarded audio sequence header payload
+	videoSeq []byte // last forwarded video sequence header payload
+}
+
+func NewSplicer(key string) *Splicer {
+	log := global.Log.WithField("func", "app.engine.forwarder.flv.NewSplicer")
+	log.WithField("key", key).Debug("creating Splicer")
+	return &Splicer{key: key}
+}
+
+// Wrap returns a writer for the next upstream connection.
+func (s *Splicer) Wrap(next io.Writer) io.Writer {
+	log := global.Log.WithField("func", "app.engine.forwarder.flv.Wrap")
+	s.mu.Lock()
+	s.segments++
+	w := &spliceWriter{s: s, next: next, first: s.segments == 1}
+	if !w.first {
+		w.offset = s.lastTS
+		if s.wroteAny {
+			w.offset += spliceGap
+		}
+		log.WithField("key", s.key).WithField("offset", w.offset).
+			Debug("splicing reconnected upstream")
+	}
+	s.mu.Unlock()
+	return w
+}
+
+// spliceWriter parses the FLV body of a single upstream connection.
+type spliceWriter struct {
+	s     *Splicer
+	next  io.Writer
+	first bool // first connection: header and timestamps pass unchanged
+
+	demux       *Demuxer
+	out         []byte // output of the current Write
+	passthrough bool   // data is not FLV; forward as is
+	offset      uint32 // output timestamp of this connection's first media tag
+	base        uint32 // input timestamp of this connection's first media tag
+	based       bool   // base has been set
+}
+
+func (w *spliceWriter) Write(p []byte) (int, error) {
+	log := global.Log.WithField("func", "app.engine.forwarder.flv.spliceWriter.Write")
+	if w.passthrough {
+		return w.next.Write(p)
+	}
+	if w.demux == nil {
+		w.demux = NewDemuxer(w.writeTag)
+		w.demux.OnHeader(w.writeHeader)
+	}
+
+	w.out = w.out[:0]
+	w.s.mu.Lock()
+	_, err := w.demux.Write(p)
+	w.s.mu.Unlock()
+	if errors.Is(err, ErrNotFLV) {
+		log.WithField("key", w.s.key).Debug("no FLV header detected, switching to passthrough mode")
+		w.passthrough = true
+		w.out = append(w.out, w.demux.Pending()...)
+	}
+
+	if len(w.out) > 0 {
+		if _, err := w.next.Write(w.out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// writeHeader forwards the FLV file header of the first connection only.
+// Called with w.s.mu held.
+func (w *spliceWriter) writeHeader(h Header) error {
+	if w.first {
+		w.out = h.AppendTo(w.out)
+	}
+	return nil
+}
+
+// writeTag forwards a single tag, or drops it if it repeats configuration
+// that was already sent. Called with w.s.mu held.
+func (w *spliceWriter) writeTag(t Tag) error {
+	if t.Type == TagScript {
+		// Script data describes the file; repeating it mid-stream makes
+		// some players reinitialize.
+		if w.first {
+			w.out = t.AppendTo(w.out)
+		}
+		return nil
+	}
+
+	if t.IsSequenceHeader() {
+		last := &w.s.audioSeq
+		if t.Type == TagVideo {
+			last = &w.s.videoSeq
+		}
+		if *last != nil && bytes.Equal(*last, t.Data) {
+			return nil
+		}
+		*last = append([]byte(nil), t.Data...)
+		if w.first {
+			w.emit(t, t.Timestamp)
+			return nil
+		}
+		// Configuration changed: send it at the splice point.
+		global.Log.WithField("func", "app.engine.forwarder.flv.writeTag").
+			WithField("key", w.s.key).WithField("tagType", t.Type).
+			Debug("codec configuration changed across reconnect")
+		w.emit(t, w.nextTimestamp())
+		return nil
+	}
+
+	ts := t.Timestamp
+	if w.first {
+		w.emit(t, ts)
+		return nil
+	}
+	if !w.based {
+		w.base = ts
+		w.based = true
+	}
+	if ts < w.base {
+		// Interleaved audio/video may start slightly before the first tag.
+		ts = w.base
+	}
+	w.emit(t, w.offset+(ts-w.base))
+	return nil
+}
+
+// nextTimestamp returns the timestamp for a configuration tag sent before
+// this connection's first media tag.
+func (w *spliceWriter) nextTimestamp() uint32 {
+	if w.based {
+		return w.s.lastTS
+	}
+	return w.offset
+}
+
+// emit appends t to the output with its timestamp replaced by ts.
+func (w *spliceWriter) emit(t Tag, ts uint32) {
+	t.Timestamp = ts
+	w.out = t.AppendTo(w.out)
+	if !w.s.wroteAny || ts > w.s.lastTS {
+		w.s.lastTS = ts
+	}
+	w.s.wroteAny = true
+}
@@ -0,0 +1,505 @@
+package flv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Tag types.
+const (
+	TagAudio  byte = 0x08
+	TagVideo  byte = 0x09
+	TagScript byte = 0x12
+)
+
+const (
+	HeaderSize      = 9  // FLV file header, without PreviousTagSize0
+	TagHeaderSize   = 11 // tag header preceding the tag data
+	PrevTagSizeSize = 4  // PreviousTagSize field following every tag
+)
+
+// Sound formats of an audio tag.
+const (
+	SoundFormatPCM      byte = 0
+	SoundFormatADPCM    byte = 1
+	SoundFormatMP3      byte = 2
+	SoundFormatG711A    byte = 7
+	SoundFormatG711U    byte = 8
+	SoundFormatExHeader byte = 9 // Enhanced RTMP: the codec is given by a FourCC
+	SoundFormatAAC      byte = 10
+	SoundFormatSpeex    byte = 11
+	SoundFormatOpus     byte = 13 // not in the FLV spec; used by some CDNs
+)
+
+// Codec IDs of a video tag.
+const (
+	CodecH263 byte = 2
+	CodecVP6  byte = 4
+	CodecAVC  byte = 7
+	CodecHEVC byte = 12 // not in the FLV spec; the de facto value used by CDNs
+)
+
+// FourCC codec identifiers of Enhanced RTMP audio and video tags.
+const (
+	FourCCAVC  = "avc1"
+	FourCCHEVC = "hvc1"
+	FourCCAV1  = "av01"
+	FourCCVP8  = "vp08"
+	FourCCVP9  = "vp09"
+	FourCCAAC  = "mp4a"
+	FourCCMP3  = ".mp3"
+	FourCCOpus = "Opus"
+	FourCCFLAC = "fLaC"
+	FourCCAC3  = "ac-3"
+	FourCCEAC3 = "ec-3"
+)
+
+// Frame types of a video tag.
+const (
+	FrameKey         byte = 1
+	FrameInter       byte = 2
+	FrameDisposable  byte = 3
+	FrameGenerated   byte = 4
+	FrameInfoCommand byte = 5
+)
+
+// Packet types of AAC audio and AVC/HEVC video tags.
+const (
+	PacketSequenceHeader byte = 0
+	PacketNALU           byte = 1 // AAC raw frame for audio
+	PacketEndOfSequence  byte = 2
+)
+
+// Packet types of Enhanced RTMP tags. The first three share their values
+// with the legacy packet types above.
+const (
+	ExPacketSequenceStart        byte = 0
+	ExPacketCodedFrames          byte = 1
+	ExPacketSequenceEnd          byte = 2
+	ExPacketCodedFramesX         byte = 3 // video only: no composition time
+	ExPacketMetadata             byte = 4 // video only: AMF0 colour info
+	ExPacketMPEG2TSSequenceStart byte = 5 // video only
+	ExPacketMultitrack           byte = 6 // video; audio uses 5
+	ExPacketModEx                byte = 7
+
+	ExAudioPacketMultichannelConfig byte = 4
+	ExAudioPacketMultitrack         byte = 5
+)
+
+// Multitrack types of Enhanced RTMP multitrack tags.
+const (
+	MultitrackOneTrack             byte = 0
+	MultitrackManyTracks           byte = 1
+	MultitrackManyTracksManyCodecs byte = 2
+)
+
+var (
+	// ErrNotFLV is returned for data that does not start with an FLV
+	// file header.
+	ErrNotFLV = errors.New("not an FLV stream")
+	// ErrInvalidTag is returned for a tag whose header or PreviousTagSize
+	// is inconsistent.
+	ErrInvalidTag = errors.New("invalid FLV tag")
+)
+
+// Header is the FLV file header.
+type Header struct {
+	Version  byte
+	HasAudio bool
+	HasVideo bool
+}
+
+// ParseHeader parses the FLV file header and PreviousTagSize0 at the start of
+// b. It returns the header and the number of bytes it occupies, or
+// io.ErrUnexpectedEOF if b is too short to tell.
+func ParseHeader(b []byte) (Header, int, error) {
+	if len(b) < 3 {
+		return Header{}, 0, io.ErrUnexpectedEOF
+	}
+	if b[0] != 'F' || b[1] != 'L' || b[2] != 'V' {
+		return Header{}, 0, ErrNotFLV
+	}
+	if len(b) < HeaderSize {
+		return Header{}, 0, io.ErrUnexpectedEOF
+	}
+	dataOffset := int(binary.BigEndian.Uint32(b[5:9]))
+	if dataOffset < HeaderSize {
+		return Header{}, 0, fmt.Errorf("%w: header size %d", ErrNotFLV, dataOffset)
+	}
+	if len(b) < dataOffset+PrevTagSizeSize {
+		return Header{}, 0, io.ErrUnexpectedEOF
+	}
+	h := Header{
+		Version:  b[3],
+		HasAudio: b[4]&0x04 != 0,
+		HasVideo: b[4]&0x01 != 0,
+	}
+	return h, dataOffset + PrevTagSizeSize, nil
+}
+
+// AppendTo appends the encoded header and PreviousTagSize0 to b.
+func (h Header) AppendTo(b []byte) []byte {
+	var flags byte
+	if h.HasAudio {
+		flags |= 0x04
+	}
+	if h.HasVideo {
+		flags |= 0x01
+	}
+	version := h.Version
+	if version == 0 {
+		version = 1
+	}
+	return append(b, 'F', 'L', 'V', version, flags, 0, 0, 0, HeaderSize, 0, 0, 0, 0)
+}
+
+// Bytes returns the encoded header and PreviousTagSize0.
+func (h Header) Bytes() []byte {
+	return h.AppendTo(make([]byte, 0, HeaderSize+PrevTagSizeSize))
+}
+
+// Tag is a single FLV tag. Data is the tag body: for audio and video it
+// starts with the codec header described by Audio and Video.
+type Tag struct {
+	Type      byte
+	Filter    bool   // the body is encrypted
+	Timestamp uint32 // milliseconds, including the extended byte
+	StreamID  uint32 // always 0 in practice
+	Data      []byte
+}
+
+// ParseTag parses the tag and its PreviousTagSize at the start of b. It
+// returns the tag, whose Data aliases b, and the number of bytes it occupies.
+// It returns io.ErrUnexpectedEOF if b holds only part of the tag, and
+// ErrInvalidTag if the tag type is unknown or the PreviousTagSize does not
+// match.
+func ParseTag(b []byte) (Tag, int, error) {
+	if len(b) < TagHeaderSize {
+		return Tag{}, 0, io.ErrUnexpectedEOF
+	}
+	t := Tag{
+		Type:      b[0] & 0x1F,
+		Filter:    b[0]&0x20 != 0,
+		Timestamp: uint32(b[7])<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6]),
+		StreamID:  uint32(b[8])<<16 | uint32(b[9])<<8 | uint32(b[10]),
+	}
+	if b[0]&0xC0 != 0 || (t.Type != TagAudio && t.Type != TagVideo && t.Type != TagScript) {
+		return Tag{}, 0, fmt.Errorf("%w: tag type 0x%02x", ErrInvalidTag, b[0])
+	}
+	dataSize := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	size := TagHeaderSize + dataSize + PrevTagSizeSize
+	if len(b) < size {
+		return Tag{}, 0, io.ErrUnexpectedEOF
+	}
+	if prev := binary.BigEndian.Uint32(b[size-PrevTagSizeSize : size]); prev != uint32(TagHeaderSize+dataSize) {
+		return Tag{}, 0, fmt.Errorf("%w: PreviousTagSize %d, want %d", ErrInvalidTag, prev, TagHeaderSize+dataSize)
+	}
+	t.Data = b[TagHeaderSize : TagHeaderSize+dataSize]
+	return t, size, nil
+}
+
+// Size returns the encoded size of the tag, including its PreviousTagSize.
+func (t Tag) Size() int {
+	return TagHeaderSize + len(t.Data) + PrevTagSizeSize
+}
+
+// AppendTo appends the encoded tag and its PreviousTagSize to b.
+func (t Tag) AppendTo(b []byte) []byte {
+	typ := t.Type & 0x1F
+	if t.Filter {
+		typ |= 0x20
+	}
+	n := len(t.Data)
+	b = append(b,
+		typ, byte(n>>16), byte(n>>8), byte(n),
+		byte(t.Timestamp>>16), byte(t.Timestamp>>8), byte(t.Timestamp), byte(t.Timestamp>>24),
+		byte(t.StreamID>>16), byte(t.StreamID>>8), byte(t.StreamID))
+	b = append(b, t.Data...)
+	return binary.BigEndian.AppendUint32(b, uint32(TagHeaderSize+n))
+}
+
+// Bytes returns the encoded tag and its PreviousTagSize.
+func (t Tag) Bytes() []byte {
+	return t.AppendTo(make([]byte, 0, t.Size()))
+}
+
+// Clone returns a copy of t that does not share Data.
+func (t Tag) Clone() Tag {
+	t.Data = append([]byte(nil), t.Data...)
+	return t
+}
+
+// ExHeader holds the Enhanced RTMP fields that follow the first byte of an
+// audio or video tag whose codec is given by a FourCC.
+type ExHeader struct {
+	// FourCC identifies the codec, e.g. FourCCHEVC. For a multitrack tag
+	// with a codec per track it is the codec of the first track.
+	FourCC string
+	// Multitrack is set for a multitrack tag; the payload then holds the
+	// tracks, each prefixed by its track ID and, unless MultitrackType is
+	// MultitrackOneTrack, its size.
+	Multitrack     bool
+	MultitrackType byte
+}
+
+// AudioHeader holds the codec fields at the start of an audio tag.
+type AudioHeader struct {
+	SoundFormat byte
+	SoundRate   byte // 0 = 5.5 kHz, 1 = 11 kHz, 2 = 22 kHz, 3 = 44 kHz
+	SoundSize   byte // 0 = 8-bit, 1 = 16-bit samples
+	SoundType   byte // 0 = mono, 1 = stereo
+	// PacketType is the AACPacketType for AAC, or the Enhanced RTMP
+	// AudioPacketType if Ex is set.
+	PacketType byte
+	// Ex is set if SoundFormat is SoundFormatExHeader.
+	Ex *ExHeader
+}
+
+// Audio parses the codec header of an audio tag.
+func (t Tag) Audio() (AudioHeader, error) {
+	h, _, err := t.audio()
+	return h, err
+}
+
+// audio parses the codec header of an audio tag and returns its size.
+func (t Tag) audio() (AudioHeader, int, error) {
+	if t.Type != TagAudio || len(t.Data) < 1 {
+		return AudioHeader{}, 0, fmt.Errorf("%w: not an audio tag", ErrInvalidTag)
+	}
+	h := AudioHeader{SoundFormat: t.Data[0] >> 4}
+	size := 1
+	switch h.SoundFormat {
+	case SoundFormatExHeader:
+		ex, packetType, n, err := parseExHeader(t.Data, t.Data[0]&0x0F, ExAudioPacketMultitrack)
+		if err != nil {
+			return AudioHeader{}, 0, err
+		}
+		h.PacketType, h.Ex, size = packetType, ex, n
+	case SoundFormatAAC:
+		if len(t.Data) < 2 {
+			return AudioHeader{}, 0, fmt.Errorf("%w: short AAC tag", ErrInvalidTag)
+		}
+		h.PacketType = t.Data[1]
+		size = 2
+		fallthrough
+	default:
+		h.SoundRate = (t.Data[0] >> 2) & 0x03
+		h.SoundSize = (t.Data[0] >> 1) & 0x01
+		h.SoundType = t.Data[0] & 0x01
+	}
+	return h, size, nil
+}
+
+// VideoHeader holds the codec fields at the start of a video tag.
+type VideoHeader struct {
+	FrameType byte
+	CodecID   byte // legacy codec ID; 0 if Ex is set
+	// PacketType is the AVCPacketType for AVC and HEVC, or the Enhanced
+	// RTMP VideoPacketType if Ex is set.
+	PacketType byte
+	// CompositionTime is the composition time offset in milliseconds of
+	// AVC and HEVC coded frames.
+	CompositionTime int32
+	// Ex is set if the tag uses the Enhanced RTMP extended header.
+	Ex *ExHeader
+}
+
+// Video parses the codec header of a video tag.
+func (t Tag) Video() (VideoHeader, error) {
+	h, _, err := t.video()
+	return h, err
+}
+
+// video parses the codec header of a video tag and returns its size.
+func (t Tag) video() (VideoHeader, int, error) {
+	if t.Type != TagVideo || len(t.Data) < 1 {
+		return VideoHeader{}, 0, fmt.Errorf("%w: not a video tag", ErrInvalidTag)
+	}
+	h := VideoHeader{FrameType: videoFrameType(t.Data[0])}
+	size := 1
+	hasCompositionTime := false
+	if t.Data[0]&0x80 != 0 {
+		packetType := t.Data[0] & 0x0F
+		if h.FrameType == FrameInfoCommand && packetType != ExPacketMetadata {
+			// A command frame carries a single VideoCommand byte and
+			// no codec.
+			h.PacketType = packetType
+			h.Ex = &ExHeader{}
+			return h, size, nil
+		}
+		ex, packetType, n, err := parseExHeader(t.Data, packetType, ExPacketMultitrack)
+		if err != nil {
+			return VideoHeader{}, 0, err
+		}
+		h.PacketType, h.Ex, size = packetType, ex, n
+		hasCompositionTime = packetType == ExPacketCodedFrames && !ex.Multitrack &&
+			(ex.FourCC == FourCCAVC || ex.FourCC == FourCCHEVC)
+	} else {
+		h.CodecID = t.Data[0] & 0x0F
+		if h.CodecID == CodecAVC || h.CodecID == CodecHEVC {
+			if len(t.Data) < 2 {
+				return VideoHeader{}, 0, fmt.Errorf("%w: short AVC/HEVC tag", ErrInvalidTag)
+			}
+			h.PacketType = t.Data[1]
+			size = 2
+			hasCompositionTime = true
+		}
+	}
+	if hasCompositionTime {
+		if len(t.Data) < size+3 {
+			return VideoHeader{}, 0, fmt.Errorf("%w: short AVC/HEVC tag", ErrInvalidTag)
+		}
+		c := t.Data[size : size+3]
+		// 24-bit signed composition time offset.
+		h.CompositionTime = int32(uint32(c[0])<<24|uint32(c[1])<<16|uint32(c[2])<<8) >> 8
+		size += 3
+	}
+	return h, size, nil
+}
+
+// videoFrameType returns the frame type from the first byte of a video tag.
+// The extended header takes the top bit for its flag.
+func videoFrameType(b byte) byte {
+	if b&0x80 != 0 {
+		return (b >> 4) & 0x07
+	}
+	return b >> 4
+}
+
+// parseExHeader parses the Enhanced RTMP fields following the first byte of
+// data, given the packet type from that byte and the packet type value that
+// marks a multitrack tag. It returns the header, the effective packet type
+// and the number of bytes up to the payload.
+func parseExHeader(data []byte, packetType, multitrack byte) (*ExHeader, byte, int, error) {
+	ex := &ExHeader{}
+	off := 1
+	short := func() (*ExHeader, byte, int, error) {
+		return nil, 0, 0, fmt.Errorf("%w: short extended header", ErrInvalidTag)
+	}
+
+	// Modifier extensions wrap the real packet type; none are defined
+	// that change how the rest is parsed, so they are skipped.
+	for packetType == ExPacketModEx {
+		if off >= len(data) {
+			return short()
+		}
+		size := int(data[off]) + 1
+		off++
+		if size == 256 {
+			if off+2 > len(data) {
+				return short()
+			}
+			size = int(binary.BigEndian.Uint16(data[off:])) + 1
+			off += 2
+		}
+		off += size
+		if off >= len(data) {
+			return short()
+		}
+		packetType = data[off] & 0x0F
+		off++
+	}
+
+	if packetType == multitrack {
+		if off >= len(data) {
+			return short()
+		}
+		ex.Multitrack = true
+		ex.MultitrackType = data[off] >> 4
+		packetType = data[off] & 0x0F
+		off++
+		if ex.MultitrackType == MultitrackManyTracksManyCodecs {
+			// Each track names its codec after its track ID.
+			if off+5 > len(data) {
+				return short()
+			}
+			ex.FourCC = string(data[off+1 : off+5])
+			return ex, packetType, off, nil
+		}
+	}
+	if off+4 > len(data) {
+		return short()
+	}
+	ex.FourCC = string(data[off : off+4])
+	return ex, packetType, off + 4, nil
+}
+
+// Payload returns the tag body after its codec header: the raw AAC frame or
+// AudioSpecificConfig, the AVC/HEVC NAL units or decoder configuration
+// record, the codec data of an Enhanced RTMP tag (the tracks of a multitrack
+// tag), or the whole body for script data.
+func (t Tag) Payload() []byte {
+	switch t.Type {
+	case TagAudio:
+		if _, n, err := t.audio(); err == nil {
+			return t.Data[n:]
+		}
+	case TagVideo:
+		if _, n, err := t.video(); err == nil {
+			return t.Data[n:]
+		}
+	case TagScript:
+		return t.Data
+	}
+	return nil
+}
+
+// IsKeyframe reports whether t is a video keyframe, sequence headers
+// included.
+func (t Tag) IsKeyframe() bool {
+	return t.Type == TagVideo && len(t.Data) > 0 && videoFrameType(t.Data[0]) == FrameKey
+}
+
+// IsSequenceHeader reports whether t carries decoder configuration: an AAC
+// AudioSpecificConfig, an AVC/HEVC decoder configuration record, or the
+// sequence start of an Enhanced RTMP codec such as HEVC, AV1, VP9, Opus or
+// FLAC.
+func (t Tag) IsSequenceHeader() bool {
+	switch t.Type {
+	case TagAudio:
+		h, err := t.Audio()
+		if err != nil {
+			return false
+		}
+		if h.Ex != nil {
+			return h.PacketType == ExPacketSequenceStart
+		}
+		return h.SoundFormat == SoundFormatAAC && h.PacketType == PacketSequenceHeader
+	case TagVideo:
+		if len(t.Data) < 2 {
+			return false
+		}
+		if t.Data[0]&0x80 != 0 {
+			h, err := t.Video()
+			return err == nil && h.FrameType != FrameInfoCommand &&
+				(h.PacketType == ExPacketSequenceStart || h.PacketType == ExPacketMPEG2TSSequenceStart)
+		}
+		frameType, codecID := t.Data[0]>>4, t.Data[0]&0x0F
+		return frameType == FrameKey && (codecID == CodecAVC || codecID == CodecHEVC) &&
+			t.Data[1] == PacketSequenceHeader
+	}
+	return false
+}
+
+// isCodecConfig reports whether t configures the decoder rather than carrying
+// media: a sequence header, Enhanced RTMP video metadata such as HDR colour
+// info, or an Enhanced RTMP multichannel audio configuration.
+func (t Tag) isCodecConfig() bool {
+	if t.IsSequenceHeader() {
+		return true
+	}
+	if len(t.Data) < 1 {
+		return false
+	}
+	switch {
+	case t.Type == TagVideo && t.Data[0]&0x80 != 0:
+		h, err := t.Video()
+		return err == nil && h.PacketType == ExPacketMetadata
+	case t.Type == TagAudio && t.Data[0]>>4 == SoundFormatExHeader:
+		h, err := t.Audio()
+		return err == nil && h.PacketType == ExAudioPacketMultichannelConfig
+	}
+	return false
+}
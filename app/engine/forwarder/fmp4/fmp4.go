@@ -0,0 +1,91 @@
+// Package fmp4 writes fragmented MP4 (ISO/IEC 14496-12): an init segment
+// describing the tracks, followed by movie fragments carrying the samples,
+// as played by browsers through Media Source Extensions.
+package fmp4
+
+import (
+	"encoding/binary"
+)
+
+// Handler types of a track.
+const (
+	HandlerVideo = "vide"
+	HandlerAudio = "soun"
+)
+
+// Track describes a track of the init segment.
+type Track struct {
+	ID        uint32
+	Handler   string // HandlerVideo or HandlerAudio
+	Timescale uint32 // units per second of the track's timestamps
+
+	// SampleEntry is the sample entry type: "avc1", "hvc1" or "mp4a".
+	SampleEntry string
+	// Config is the decoder configuration: an AVC or HEVC decoder
+	// configuration record, or an AudioSpecificConfig.
+	Config []byte
+
+	Width, Height        int // video
+	Channels, SampleRate int // audio
+}
+
+// Sample is a sample of a track fragment.
+type Sample struct {
+	Duration          uint32
+	CompositionOffset int32 // PTS - DTS
+	Keyframe          bool
+	Data              []byte
+}
+
+// TrackFragment is the run of samples of one track in a fragment.
+type TrackFragment struct {
+	TrackID             uint32
+	BaseMediaDecodeTime uint64 // DTS of the first sample
+	Samples             []Sample
+}
+
+// Sample flags of the track run: sample_depends_on and
+// sample_is_non_sync_sample.
+const (
+	sampleFlagsSync    = 0x02000000
+	sampleFlagsNonSync = 0x01010000
+)
+
+// boxes builds nested boxes in a byte slice.
+type boxes struct {
+	b     []byte
+	stack []int // offsets of the open boxes
+}
+
+// open starts a box of type typ; close ends it.
+func (w *boxes) open(typ string) {
+	w.stack = append(w.stack, len(w.b))
+	w.b = append(w.b, 0, 0, 0, 0)
+	w.b = append(w.b, typ...)
+}
+
+// openFull starts a full box with a version and flags.
+func (w *boxes) openFull(typ string, version byte, flags uint32) {
+	w.open(typ)
+	w.b = append(w.b, version, byte(flags>>16), byte(flags>>8), byte(flags))
+}
+
+func (w *boxes) close() {
+	start := w.stack[len(w.stack)-1]
+	w.stack = w.stack[:len(w.stack)-1]
+	binary.BigEndian.PutUint32(w.b[start:], uint32(len(w.b)-start))
+}
+
+func (w *boxes) u8(v byte)    { w.b = append(w.b, v) }
+func (w *boxes) u16(v uint16) { w.b = binary.BigEndian.AppendUint16(w.b, v) }
+func (w *boxes) u32(v uint32) { w.b = binary.BigEndian.AppendUint32(w.b, v) }
+func (w *boxes) u64(v uint64) { w.b = binary.BigEndian.AppendUint64(w.b, v) }
+func (w *boxes) zeros(n int)  { w.b = append(w.b, make([]byte, n)...) }
+func (w *boxes) raw(p []byte) { w.b = append(w.b, p...) }
+
+// matrix writes the identity transformation matrix.
+func (w *boxes) matrix() {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		w.u32(v)
+	}
+}
@@ -0,0 +1,196 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// findBoxes returns the payloads of the boxes at path, e.g. "moov", "trak",
+// descending into sample descriptions past their fields.
+func findBoxes(t *testing.T, b []byte, path ...string) [][]byte {
+	t.Helper()
+	var found [][]byte
+	for len(b) > 0 {
+		if len(b) < 8 {
+			t.Fatalf("truncated box header %x", b)
+		}
+		size := int(binary.BigEndian.Uint32(b))
+		if size < 8 || size > len(b) {
+			t.Fatalf("box %q of size %d in %d bytes", b[4:8], size, len(b))
+		}
+		typ, payload := string(b[4:8]), b[8:size]
+		b = b[size:]
+		if typ != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			found = append(found, payload)
+			continue
+		}
+		skip := 0
+		switch typ {
+		case "stsd", "dref":
+			skip = 8 // version, flags, entry_count
+		case "avc1", "hvc1":
+			skip = 78 // visual sample entry fields
+		case "mp4a":
+			skip = 28 // audio sample entry fields
+		}
+		found = append(found, findBoxes(t, payload[skip:], path[1:]...)...)
+	}
+	return found
+}
+
+func TestAppendInit(t *testing.T) {
+	avcC := []byte{0x01, 0x64, 0x00, 0x1F, 0xFF, 0xE1, 0x00, 0x01, 0x67, 0x01, 0x00, 0x01, 0x68}
+	asc := []byte{0x12, 0x10}
+	init := AppendInit(nil,
+		Track{ID: 1, Handler: HandlerVideo, Timescale: 1000, SampleEntry: "avc1", Config: avcC, Width: 1280, Height: 720},
+		Track{ID: 2, Handler: HandlerAudio, Timescale: 44100, SampleEntry: "mp4a", Config: asc, Channels: 2, SampleRate: 44100},
+	)
+
+	if ftyp := findBoxes(t, init, "ftyp"); len(ftyp) != 1 || !bytes.HasPrefix(ftyp[0], []byte("iso5")) {
+		t.Errorf("ftyp = %q", ftyp)
+	}
+	if got := len(findBoxes(t, init, "moov", "trak")); got != 2 {
+		t.Fatalf("%d tracks, want 2", got)
+	}
+	tkhd := findBoxes(t, init, "moov", "trak", "tkhd")
+	if id := binary.BigEndian.Uint32(tkhd[0][12:]); id != 1 {
+		t.Errorf("video track ID %d", id)
+	}
+	if w, h := binary.BigEndian.Uint32(tkhd[0][76:]), binary.BigEndian.Uint32(tkhd[0][80:]); w != 1280<<16 || h != 720<<16 {
+		t.Errorf("video track size %dx%d", w>>16, h>>16)
+	}
+	mdhd := findBoxes(t, init, "moov", "trak", "mdia", "mdhd")
+	if ts := binary.BigEndian.Uint32(mdhd[1][12:]); ts != 44100 {
+		t.Errorf("audio timescale %d, want 44100", ts)
+	}
+	if got := findBoxes(t, init, "moov", "trak", "mdia", "minf", "stbl", "stsd", "avc1", "avcC"); len(got) != 1 || !bytes.Equal(got[0], avcC) {
+		t.Errorf("avcC = %x, want %x", got, avcC)
+	}
+	esds := findBoxes(t, init, "moov", "trak", "mdia", "minf", "stbl", "stsd", "mp4a", "esds")
+	if len(esds) != 1 || !bytes.HasSuffix(esds[0], []byte{0x05, 0x02, 0x12, 0x10, 0x06, 0x01, 0x02}) {
+		t.Errorf("esds = %x, want the AudioSpecificConfig and SLConfigDescriptor at the end", esds)
+	}
+	if got := len(findBoxes(t, init, "moov", "mvex", "trex")); got != 2 {
+		t.Errorf("%d trex boxes, want 2", got)
+	}
+}
+
+func TestAppendFragment(t *testing.T) {
+	prefix := []byte("previous data")
+	b := AppendFragment(bytes.Clone(prefix), 7,
+		TrackFragment{TrackID: 1, BaseMediaDecodeTime: 1 << 40, Samples: []Sample{
+			{Duration: 40, CompositionOffset: 80, Keyframe: true, Data: []byte{1, 1, 1}},
+			{Duration: 40, CompositionOffset: -40, Data: []byte{2, 2}},
+		}},
+		TrackFragment{TrackID: 2, BaseMediaDecodeTime: 1024, Samples: []Sample{
+			{Duration: 1024, Keyframe: true, Data: []byte{3}},
+		}},
+	)
+	frag := b[len(prefix):]
+
+	if mfhd := findBoxes(t, frag, "moof", "mfhd"); binary.BigEndian.Uint32(mfhd[0][4:]) != 7 {
+		t.Errorf("sequence number %d, want 7", binary.BigEndian.Uint32(mfhd[0][4:]))
+	}
+	tfdt := findBoxes(t, frag, "moof", "traf", "tfdt")
+	if base := binary.BigEndian.Uint64(tfdt[0][4:]); base != 1<<40 {
+		t.Errorf("base media decode time %d", base)
+	}
+	truns := findBoxes(t, frag, "moof", "traf", "trun")
+	if len(truns) != 2 {
+		t.Fatalf("%d track runs, want 2", len(truns))
+	}
+	wantData := [][]byte{{1, 1, 1, 2, 2}, {3}}
+	for i, trun := range truns {
+		count := int(binary.BigEndian.Uint32(trun[4:]))
+		offset := int(binary.BigEndian.Uint32(trun[8:]))
+		size := 0
+		for s := range count {
+			size += int(binary.BigEndian.Uint32(trun[12+16*s+4:]))
+		}
+		if got := frag[offset : offset+size]; !bytes.Equal(got, wantData[i]) {
+			t.Errorf("track run %d data = %x, want %x", i, got, wantData[i])
+		}
+	}
+	second := truns[0][12+16:]
+	if flags := binary.BigEndian.Uint32(second[8:]); flags != sampleFlagsNonSync {
+		t.Errorf("flags of a non-keyframe = 0x%08X", flags)
+	}
+	if cto := int32(binary.BigEndian.Uint32(second[12:])); cto != -40 {
+		t.Errorf("composition offset = %d, want -40", cto)
+	}
+}
+
+func TestDescriptor(t *testing.T) {
+	if got := descriptor(0x05, []byte{0x12, 0x10}); !bytes.Equal(got, []byte{0x05, 0x02, 0x12, 0x10}) {
+		t.Errorf("descriptor() = %x", got)
+	}
+	if got := descriptor(0x04, make([]byte, 200))[:3]; !bytes.Equal(got, []byte{0x04, 0x81, 0x48}) {
+		t.Errorf("descriptor() of 200 bytes starts with %x, want 048148", got)
+	}
+}
+
+func TestInitCache(t *testing.T) {
+	box := func(typ string, payload string) []byte {
+		b := binary.BigEndian.AppendUint32(nil, uint32(8+len(payload)))
+		return append(append(b, typ...), payload...)
+	}
+	initA := append(box("ftyp", "isom"), box("moov", "tracks A")...)
+	initB := append(box("ftyp", "isom"), box("moov", "tracks B")...)
+	var upstream []byte
+	for _, b := range [][]byte{
+		initA,
+		box("moof", "1"), box("mdat", "frames 1"),
+		box("styp", "msdh"), box("moof", "2"), box("mdat", "frames 2"),
+		initB,
+		box("moof", "3"), box("mdat", "frames 3"),
+	} {
+		upstream = append(upstream, b...)
+	}
+	initBAt := bytes.Index(upstream, initB) + len(initB)
+
+	for k := 0; k <= len(upstream); k++ {
+		c := NewInitCache()
+		for p := upstream[:k]; len(p) > 0; p = p[min(3, len(p)):] {
+			c.Observe(p[:min(3, len(p))])
+		}
+		snap := c.Snapshot()
+		if k < len(initA) {
+			if snap != nil {
+				t.Fatalf("Snapshot() after %d bytes = %q, want nil before the init segment", k, snap)
+			}
+			continue
+		}
+		want := initA
+		if k >= initBAt {
+			want = initB
+		}
+		if !bytes.HasPrefix(snap, want) {
+			t.Fatalf("Snapshot() after %d bytes = %q, want the init segment %q first", k, snap, want)
+		}
+		// What a late subscriber receives must be whole boxes, with a
+		// fragment starting right after the init segment.
+		joined := append(snap, upstream[k:]...)
+		var types []string
+		for b := joined; len(b) > 0; {
+			size := int(binary.BigEndian.Uint32(b))
+			if size < 8 || size > len(b) {
+				t.Fatalf("joined after %d bytes: box of size %d in %d bytes: %q", k, size, len(b), joined)
+			}
+			types = append(types, string(b[4:8]))
+			b = b[size:]
+		}
+		if len(types) > 2 && types[2] != "moof" && types[2] != "styp" && types[2] != "ftyp" {
+			t.Errorf("joined after %d bytes starts %v, want a fragment after the init segment", k, types)
+		}
+	}
+
+	c := NewInitCache()
+	c.Observe([]byte("#EXTM3U\n#EXT-X-VERSION:3\n"))
+	if snap := c.Snapshot(); snap != nil {
+		t.Errorf("Snapshot() of non-MP4 data = %q, want nil", snap)
+	}
+}
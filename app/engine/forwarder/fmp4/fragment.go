@@ -0,0 +1,73 @@
+package fmp4
+
+import "encoding/binary"
+
+// Flags of the track fragment header and track run boxes.
+const (
+	tfhdDefaultBaseIsMoof = 0x020000
+
+	trunDataOffset        = 0x000001
+	trunSampleDuration    = 0x000100
+	trunSampleSize        = 0x000200
+	trunSampleFlags       = 0x000400
+	trunSampleCompOffsets = 0x000800
+)
+
+// AppendFragment appends a movie fragment to b: a moof box with sequence
+// number seq and a track fragment for each of trafs, followed by an mdat box
+// with their samples.
+func AppendFragment(b []byte, seq uint32, trafs ...TrackFragment) []byte {
+	start := len(b)
+	w := &boxes{b: b}
+	var offsets []int // positions of the trun data offsets
+
+	w.open("moof")
+	w.openFull("mfhd", 0, 0)
+	w.u32(seq)
+	w.close()
+	for _, tf := range trafs {
+		w.open("traf")
+		w.openFull("tfhd", 0, tfhdDefaultBaseIsMoof)
+		w.u32(tf.TrackID)
+		w.close()
+		w.openFull("tfdt", 1, 0)
+		w.u64(tf.BaseMediaDecodeTime)
+		w.close()
+		// Version 1 allows negative composition offsets.
+		w.openFull("trun", 1, trunDataOffset|trunSampleDuration|trunSampleSize|trunSampleFlags|trunSampleCompOffsets)
+		w.u32(uint32(len(tf.Samples)))
+		offsets = append(offsets, len(w.b))
+		w.u32(0) // data_offset, set below
+		for _, s := range tf.Samples {
+			w.u32(s.Duration)
+			w.u32(uint32(len(s.Data)))
+			if s.Keyframe {
+				w.u32(sampleFlagsSync)
+			} else {
+				w.u32(sampleFlagsNonSync)
+			}
+			w.u32(uint32(s.CompositionOffset))
+		}
+		w.close()
+		w.close()
+	}
+	w.close()
+
+	// Sample data follows the mdat header, in track fragment order.
+	dataOffset := len(w.b) - start + 8
+	for i, tf := range trafs {
+		binary.BigEndian.PutUint32(w.b[offsets[i]:], uint32(dataOffset))
+		for _, s := range tf.Samples {
+			dataOffset += len(s.Data)
+		}
+	}
+
+	w.open("mdat")
+	for _, tf := range trafs {
+		for _, s := range tf.Samples {
+			w.raw(s.Data)
+		}
+	}
+	w.close()
+	return w.b
+}
@@ -0,0 +1,197 @@
+package fmp4
+
+// AppendInit appends an init segment for tracks to b: an ftyp box and a moov
+// box with no samples that announces movie fragments.
+func AppendInit(b []byte, tracks ...Track) []byte {
+	w := &boxes{b: b}
+
+	w.open("ftyp")
+	w.raw([]byte("iso5"))
+	w.u32(512)
+	w.raw([]byte("iso5iso6mp41"))
+	w.close()
+
+	w.open("moov")
+	w.openFull("mvhd", 0, 0)
+	w.u32(0)    // creation_time
+	w.u32(0)    // modification_time
+	w.u32(1000) // timescale
+	w.u32(0)    // duration
+	w.u32(0x00010000)
+	w.u16(0x0100) // volume
+	w.zeros(10)
+	w.matrix()
+	w.zeros(24) // pre_defined
+	next := uint32(1)
+	for _, t := range tracks {
+		next = max(next, t.ID+1)
+	}
+	w.u32(next) // next_track_ID
+	w.close()
+	for _, t := range tracks {
+		w.trak(t)
+	}
+	w.open("mvex")
+	for _, t := range tracks {
+		w.openFull("trex", 0, 0)
+		w.u32(t.ID)
+		w.u32(1) // default_sample_description_index
+		w.u32(0) // default_sample_duration
+		w.u32(0) // default_sample_size
+		w.u32(0) // default_sample_flags
+		w.close()
+	}
+	w.close()
+	w.close()
+	return w.b
+}
+
+func (w *boxes) trak(t Track) {
+	video := t.Handler == HandlerVideo
+	w.open("trak")
+
+	w.openFull("tkhd", 0, 0x000003) // enabled, in movie
+	w.u32(0)                        // creation_time
+	w.u32(0)                        // modification_time
+	w.u32(t.ID)
+	w.u32(0) // reserved
+	w.u32(0) // duration
+	w.zeros(8)
+	w.u16(0) // layer
+	w.u16(0) // alternate_group
+	if video {
+		w.u16(0)
+	} else {
+		w.u16(0x0100) // volume
+	}
+	w.u16(0)
+	w.matrix()
+	w.u32(uint32(t.Width) << 16)
+	w.u32(uint32(t.Height) << 16)
+	w.close()
+
+	w.open("mdia")
+	w.openFull("mdhd", 0, 0)
+	w.u32(0) // creation_time
+	w.u32(0) // modification_time
+	w.u32(t.Timescale)
+	w.u32(0)      // duration
+	w.u16(0x55C4) // language "und"
+	w.u16(0)
+	w.close()
+	w.openFull("hdlr", 0, 0)
+	w.u32(0) // pre_defined
+	w.raw([]byte(t.Handler))
+	w.zeros(12)
+	if video {
+		w.raw([]byte("VideoHandler\x00"))
+	} else {
+		w.raw([]byte("SoundHandler\x00"))
+	}
+	w.close()
+
+	w.open("minf")
+	if video {
+		w.openFull("vmhd", 0, 1)
+		w.zeros(8) // graphicsmode, opcolor
+	} else {
+		w.openFull("smhd", 0, 0)
+		w.zeros(4) // balance, reserved
+	}
+	w.close()
+	w.open("dinf")
+	w.openFull("dref", 0, 0)
+	w.u32(1)
+	w.openFull("url ", 0, 1) // media in the same file
+	w.close()
+	w.close()
+	w.close()
+
+	w.open("stbl")
+	w.openFull("stsd", 0, 0)
+	w.u32(1)
+	if video {
+		w.videoSampleEntry(t)
+	} else {
+		w.audioSampleEntry(t)
+	}
+	w.close()
+	for _, typ := range []string{"stts", "stsc", "stco"} {
+		w.openFull(typ, 0, 0)
+		w.u32(0) // entry_count
+		w.close()
+	}
+	w.openFull("stsz", 0, 0)
+	w.u32(0) // sample_size
+	w.u32(0) // sample_count
+	w.close()
+	w.close() // stbl
+
+	w.close() // minf
+	w.close() // mdia
+	w.close() // trak
+}
+
+func (w *boxes) videoSampleEntry(t Track) {
+	w.open(t.SampleEntry)
+	w.zeros(6)
+	w.u16(1) // data_reference_index
+	w.zeros(16)
+	w.u16(uint16(t.Width))
+	w.u16(uint16(t.Height))
+	w.u32(0x00480000) // 72 dpi
+	w.u32(0x00480000)
+	w.u32(0)
+	w.u16(1) // frame_count
+	w.zeros(32)
+	w.u16(0x0018) // depth
+	w.u16(0xFFFF) // pre_defined
+	if t.SampleEntry == "hvc1" {
+		w.open("hvcC")
+	} else {
+		w.open("avcC")
+	}
+	w.raw(t.Config)
+	w.close()
+	w.close()
+}
+
+func (w *boxes) audioSampleEntry(t Track) {
+	w.open(t.SampleEntry)
+	w.zeros(6)
+	w.u16(1) // data_reference_index
+	w.zeros(8)
+	w.u16(uint16(t.Channels))
+	w.u16(16) // samplesize
+	w.zeros(4)
+	w.u32(uint32(t.SampleRate&0xFFFF) << 16)
+
+	w.openFull("esds", 0, 0)
+	decoderSpecific := descriptor(0x05, t.Config)
+	decoderConfig := descriptor(0x04, append([]byte{
+		0x40,          // Audio ISO/IEC 14496-3
+		0x15,          // audio stream
+		0x00, 0x00, 0, // bufferSizeDB
+		0, 0, 0, 0, // maxBitrate
+		0, 0, 0, 0, // avgBitrate
+	}, decoderSpecific...))
+	es := append([]byte{byte(t.ID >> 8), byte(t.ID), 0x00}, decoderConfig...)
+	es = append(es, descriptor(0x06, []byte{0x02})...) // SLConfigDescriptor
+	w.raw(descriptor(0x03, es))
+	w.close()
+
+	w.close()
+}
+
+// descriptor returns an MPEG-4 descriptor with the given tag and body.
+func descriptor(tag byte, body []byte) []byte {
+	d := []byte{tag}
+	n := len(body)
+	for shift := 21; shift > 0; shift -= 7 {
+		if n>>shift > 0 {
+			d = append(d, 0x80|byte(n>>shift)&0x7F)
+		}
+	}
+	d = append(d, byte(n&0x7F))
+	return append(d, body...)
+}
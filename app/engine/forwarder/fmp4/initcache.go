@@ -0,0 +1,126 @@
+package fmp4
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+)
+
+// InitCache follows a shared fragmented MP4 upstream and keeps its latest
+// init segment (ftyp and moov) and the boxes since the start of the latest
+// fragment. It implements stream.JoinCache: a subscriber joining mid-stream
+// receives the init segment, then the fragment in progress, then the live
+// data, so it starts on a box boundary its player can decode from.
+type InitCache struct {
+	mu       sync.Mutex
+	disabled bool   // data is not MP4
+	header   []byte // header of the next box, while incomplete
+	typ      string // type of the box being read, "" between boxes
+	left     uint64 // bytes of the box not read yet
+	prev     string // type of the previous box
+	init     []byte // the latest complete init segment
+	next     []byte // the init segment being read, if any
+	frag     []byte // boxes since the start of the latest fragment
+}
+
+func NewInitCache() *InitCache {
+	return &InitCache{}
+}
+
+// Observe parses the next chunk of the upstream.
+func (c *InitCache) Observe(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(p) > 0 && !c.disabled {
+		if c.typ == "" {
+			p = c.readHeader(p)
+			continue
+		}
+		n := int(min(c.left, uint64(len(p))))
+		c.appendBox(p[:n])
+		p = p[n:]
+		c.left -= uint64(n)
+		if c.left == 0 {
+			c.endBox()
+		}
+	}
+}
+
+// Snapshot returns the data a subscriber joining now needs ahead of the live
+// data: the init segment, the fragment in progress and the partial box the
+// live data continues. It returns nil until an init segment has passed, or
+// if the upstream is not MP4.
+func (c *InitCache) Snapshot() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.disabled || c.init == nil {
+		return nil
+	}
+	out := make([]byte, 0, len(c.init)+len(c.frag)+len(c.next)+len(c.header))
+	out = append(out, c.init...)
+	out = append(out, c.frag...)
+	out = append(out, c.next...)
+	return append(out, c.header...)
+}
+
+// readHeader reads the header of the next box from p and returns the rest.
+func (c *InitCache) readHeader(p []byte) []byte {
+	need := 8
+	if len(c.header) >= 4 && binary.BigEndian.Uint32(c.header) == 1 {
+		need = 16 // 64-bit size
+	}
+	n := min(need-len(c.header), len(p))
+	c.header = append(c.header, p[:n]...)
+	p = p[n:]
+	if len(c.header) < need {
+		return p
+	}
+	if need == 8 && binary.BigEndian.Uint32(c.header) == 1 {
+		return p
+	}
+	size := uint64(binary.BigEndian.Uint32(c.header))
+	switch {
+	case size == 1:
+		size = binary.BigEndian.Uint64(c.header[8:])
+	case size == 0:
+		size = math.MaxUint64 // to the end of the stream
+	}
+	if size < uint64(len(c.header)) {
+		c.disabled = true
+		c.init, c.next, c.frag = nil, nil, nil
+		return nil
+	}
+	c.typ = string(c.header[4:8])
+	c.left = size - uint64(len(c.header))
+	header := c.header
+	c.header = nil
+	switch {
+	case c.typ == "ftyp":
+		c.next = nil
+	case c.typ == "styp", c.typ == "moof" && c.prev != "styp":
+		c.frag = nil // a new fragment
+	}
+	c.appendBox(header)
+	if c.left == 0 {
+		c.endBox()
+	}
+	return p
+}
+
+// appendBox records data of the box being read.
+func (c *InitCache) appendBox(data []byte) {
+	if c.typ == "ftyp" || c.typ == "moov" {
+		c.next = append(c.next, data...)
+	} else {
+		c.frag = append(c.frag, data...)
+	}
+}
+
+// endBox completes the box being read.
+func (c *InitCache) endBox() {
+	if c.typ == "moov" {
+		c.init, c.next = c.next, nil
+		c.frag = nil
+	}
+	c.prev, c.typ = c.typ, ""
+}
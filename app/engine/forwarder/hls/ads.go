@@ -0,0 +1,136 @@
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	libm3u8 "github.com/grafov/m3u8"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/stream"
+)
+
+// AdStrategy is what an HLSStream does with the ads an upstream stitches into
+// its playlist.
+type AdStrategy int
+
+const (
+	AdsPassthrough AdStrategy = iota // forward them like any other segment
+	AdsSkip                          // leave them out and wait for the live segments
+	AdsSwitch                        // play the AdPolicy's alternate playlist for a while
+)
+
+func (a AdStrategy) String() string {
+	switch a {
+	case AdsPassthrough:
+		return "passthrough"
+	case AdsSkip:
+		return "skip"
+	case AdsSwitch:
+		return "switch"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseAdStrategy parses the String form of an AdStrategy. The empty string
+// is AdsPassthrough.
+func ParseAdStrategy(s string) (AdStrategy, error) {
+	if s == "" {
+		return AdsPassthrough, nil
+	}
+	for _, a := range []AdStrategy{AdsPassthrough, AdsSkip, AdsSwitch} {
+		if strings.EqualFold(s, a.String()) {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown ad strategy %q (want passthrough, skip or switch)", s)
+}
+
+// DateRange is an EXT-X-DATERANGE tag of a media playlist.
+type DateRange struct {
+	ID    string
+	Class string
+	Start time.Time
+	End   time.Time // from END-DATE or DURATION; zero if unknown
+	Attrs map[string]string
+}
+
+// Contains reports whether t falls in the range. A range of unknown end
+// contains nothing.
+func (r DateRange) Contains(t time.Time) bool {
+	return !t.IsZero() && !t.Before(r.Start) && t.Before(r.End)
+}
+
+// AdDetector reports whether a segment of a media playlist listing
+// dateRanges is an ad. Extractors pass one in their registry entry.
+type AdDetector = func(seg *libm3u8.MediaSegment, dateRanges []DateRange) bool
+
+// TwitchAds detects the ads Twitch stitches into its playlists: segments in
+// a date range of class twitch-stitched-ad, or titled other than "live".
+func TwitchAds(seg *libm3u8.MediaSegment, dateRanges []DateRange) bool {
+	if seg.Title != "" && !strings.HasPrefix(seg.Title, "live") {
+		return true
+	}
+	for _, r := range dateRanges {
+		if (r.Class == "twitch-stitched-ad" || strings.HasPrefix(r.ID, "stitched-ad-")) && r.Contains(seg.ProgramDateTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultAdHold is how long AdsSwitch plays the alternate playlist before
+// trying the main one again.
+var DefaultAdHold = 2 * time.Minute
+
+// AdPolicy configures the handling of ads. The zero value forwards them.
+type AdPolicy struct {
+	Detect   AdDetector // nil turns ad handling off
+	Strategy AdStrategy
+	// Alternate extracts the playlist played during ads by AdsSwitch,
+	// such as Twitch's for another player type. Without one, AdsSwitch
+	// skips the ads.
+	Alternate stream.ExtractFunc
+	Hold      time.Duration // how long the alternate is played; 0 is DefaultAdHold
+}
+
+// WithAds sets how the stream handles ads stitched into the playlist. The
+// default forwards them like any other segment. A Publisher leaves them out
+// of its playlists with AdsSwitch too.
+func WithAds(p AdPolicy) HLSStreamOption {
+	return func(s *HLSStream) { s.ads = p }
+}
+
+// hold returns how long the alternate playlist is played.
+func (p AdPolicy) hold() time.Duration {
+	if p.Hold > 0 {
+		return p.Hold
+	}
+	return DefaultAdHold
+}
+
+// parseDateRanges returns the EXT-X-DATERANGE tags of a media playlist,
+// which grafov/m3u8 does not parse.
+func parseDateRanges(body []byte) []DateRange {
+	var ranges []DateRange
+	sc := bufio.NewScanner(bytes.NewReader(body))
+	for sc.Scan() {
+		value, ok := strings.CutPrefix(strings.TrimSpace(sc.Text()), "#EXT-X-DATERANGE:")
+		if !ok {
+			continue
+		}
+		attrs := parseAttributes(value)
+		r := DateRange{ID: attrs["ID"], Class: attrs["CLASS"], Attrs: attrs}
+		r.Start, _ = time.Parse(time.RFC3339Nano, attrs["START-DATE"])
+		if end, err := time.Parse(time.RFC3339Nano, attrs["END-DATE"]); err == nil {
+			r.End = end
+		} else if d, err := strconv.ParseFloat(attrs["DURATION"], 64); err == nil && !r.Start.IsZero() {
+			r.End = r.Start.Add(time.Duration(d * float64(time.Second)))
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
@@ -0,0 +1,297 @@
+package hls
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	libm3u8 "github.com/grafov/m3u8"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/codec"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/mpegts"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/stream"
+	"github.com/nv4d1k/live-stream-forwarder/global"
+)
+
+// Encryption methods of EXT-X-KEY.
+const (
+	MethodNone      = "NONE"
+	MethodAES128    = "AES-128"
+	MethodSampleAES = "SAMPLE-AES"
+)
+
+// KeyCacheTTL is how long a fetched key is reused for segments naming the
+// same key URI.
+var KeyCacheTTL = 10 * time.Minute
+
+// maxKeySize bounds a key response; AES-128 keys are 16 bytes.
+const maxKeySize = 1024
+
+// ErrUnsupportedEncryption is returned for segments encrypted in a way lsf
+// cannot decrypt, such as a DRM key format.
+var ErrUnsupportedEncryption = errors.New("unsupported HLS encryption")
+
+// errDecrypt is returned for a segment that does not decrypt, such as a
+// truncated one or one whose key changed behind a cached URI. The segment is
+// retried with the key fetched again.
+var errDecrypt = errors.New("segment decryption failed")
+
+// segmentKey is the key a segment is encrypted with.
+type segmentKey struct {
+	Method    string
+	URI       string // absolute
+	IV        []byte // explicit, or from the media sequence number
+	KeyFormat string
+}
+
+// keyOf returns the key of a segment with sequence number seq under the
+// EXT-X-KEY tag key, which may be nil. Key URIs are resolved against
+// playlistURL. It returns nil for clear segments.
+func keyOf(key *libm3u8.Key, playlistURL string, seq uint64) (*segmentKey, error) {
+	if key == nil || key.Method == "" || key.Method == MethodNone {
+		return nil, nil
+	}
+	k := &segmentKey{Method: key.Method, URI: resolveURL(playlistURL, key.URI), KeyFormat: key.Keyformat}
+	if key.IV != "" {
+		iv, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(key.IV, "0x"), "0X"))
+		if err != nil || len(iv) > aes.BlockSize {
+			return nil, fmt.Errorf("%w: invalid IV %q", ErrUnsupportedEncryption, key.IV)
+		}
+		k.IV = make([]byte, aes.BlockSize-len(iv), aes.BlockSize)
+		k.IV = append(k.IV, iv...)
+	} else {
+		k.IV = binary.BigEndian.AppendUint64(make([]byte, 8, aes.BlockSize), seq)
+	}
+	if (k.Method != MethodAES128 && k.Method != MethodSampleAES) || (k.KeyFormat != "" && k.KeyFormat != "identity") {
+		return k, fmt.Errorf("%w: METHOD=%s KEYFORMAT=%s", ErrUnsupportedEncryption, k.Method, k.KeyFormat)
+	}
+	return k, nil
+}
+
+// KeyCache holds fetched keys by URI, so the segments and clients sharing a
+// key fetch it once. It is safe for concurrent use.
+type KeyCache struct {
+	mu      sync.Mutex
+	entries map[string]*keyEntry
+}
+
+type keyEntry struct {
+	done    chan struct{} // closed once data is set or the fetch failed
+	data    []byte
+	fetched time.Time
+}
+
+// DefaultKeys is the key cache of the HLS forwarders.
+var DefaultKeys = NewKeyCache()
+
+func NewKeyCache() *KeyCache {
+	return &KeyCache{entries: make(map[string]*keyEntry)}
+}
+
+// Get returns the key at keyURL, fetching it with the stream's client and
+// headers unless a fresh copy is cached or being fetched. Fetch errors are
+// classified like those of segments, so an expired key URL leads to a
+// re-extraction.
+func (c *KeyCache) Get(ctx context.Context, hc *http.Client, keyURL string, headers http.Header, timeouts stream.Timeouts, platform string) ([]byte, error) {
+	for {
+		c.mu.Lock()
+		e, ok := c.entries[keyURL]
+		if !ok || (e.data != nil && time.Since(e.fetched) >= KeyCacheTTL) {
+			break // with the lock held
+		}
+		c.mu.Unlock()
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if e.data != nil {
+			return e.data, nil
+		}
+		// The fetch failed; try again ourselves.
+		c.mu.Lock()
+		if c.entries[keyURL] == e {
+			delete(c.entries, keyURL)
+		}
+		c.mu.Unlock()
+	}
+	e := &keyEntry{done: make(chan struct{})}
+	now := time.Now()
+	for u, old := range c.entries {
+		if old.data != nil && now.Sub(old.fetched) >= KeyCacheTTL {
+			delete(c.entries, u)
+		}
+	}
+	c.entries[keyURL] = e
+	c.mu.Unlock()
+
+	data, err := fetchKey(ctx, hc, keyURL, headers, timeouts, platform)
+	c.mu.Lock()
+	if err == nil {
+		e.data, e.fetched = data, time.Now()
+	} else if c.entries[keyURL] == e {
+		delete(c.entries, keyURL)
+	}
+	c.mu.Unlock()
+	close(e.done)
+	return data, err
+}
+
+// Forget drops the cached key at keyURL.
+func (c *KeyCache) Forget(keyURL string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, keyURL)
+}
+
+// fetchKey downloads a key.
+func fetchKey(ctx context.Context, hc *http.Client, keyURL string, headers http.Header, timeouts stream.Timeouts, platform string) ([]byte, error) {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.fetchKey")
+	ctx, cancel := stream.WithTimeout(ctx, timeouts.Fetch)
+	defer cancel()
+	resp, err := doRequestWithHeaders(ctx, hc, "GET", keyURL, headers)
+	if err != nil {
+		log.Warnf("fetch key error: %s", err.Error())
+		return nil, stream.WrapError(platform, stream.PhaseFetch, keyURL, fmt.Errorf("fetch key error: %w", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Warnf("fetch key got status: %s", resp.Status)
+		return nil, stream.StatusError(platform, stream.PhaseFetch, keyURL, resp)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxKeySize))
+	if err != nil {
+		return nil, stream.WrapError(platform, stream.PhaseCopy, keyURL, err)
+	}
+	if len(data) != aes.BlockSize {
+		return nil, fmt.Errorf("%w: key of %d bytes at %s", ErrUnsupportedEncryption, len(data), keyURL)
+	}
+	log.Debugf("fetched key %s", keyURL)
+	return data, nil
+}
+
+// decryptAES128 decrypts a segment encrypted whole with AES-128-CBC and
+// PKCS#7 padding.
+func decryptAES128(data, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("%w: %d bytes is not a whole number of blocks", errDecrypt, len(data))
+	}
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+	pad := int(data[len(data)-1])
+	if pad == 0 || pad > aes.BlockSize || !bytes.Equal(data[len(data)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, fmt.Errorf("%w: bad padding, wrong key or IV", errDecrypt)
+	}
+	return data[:len(data)-pad], nil
+}
+
+// SAMPLE-AES stream types of the program map table, and their clear
+// counterparts.
+var sampleAESStreamTypes = map[byte]byte{
+	0xDB: mpegts.StreamTypeH264,
+	0xCF: mpegts.StreamTypeAAC,
+}
+
+// sampleAESDecrypter decrypts MPEG-TS segments encrypted with SAMPLE-AES:
+// H.264 slices and AAC frames are encrypted inside the PES packets, which
+// are rewritten in the clear. It keeps the muxer's state across segments,
+// so successive segments form one continuous transport stream.
+type sampleAESDecrypter struct {
+	demux *mpegts.Demuxer
+	mux   *mpegts.Muxer
+	out   bytes.Buffer
+	block cipher.Block
+	iv    []byte
+	warn  map[byte]bool // stream types already reported as left encrypted
+}
+
+func newSampleAESDecrypter() *sampleAESDecrypter {
+	d := &sampleAESDecrypter{warn: make(map[byte]bool)}
+	d.mux = mpegts.NewMuxer(&d.out)
+	d.demux = mpegts.NewDemuxer(d.writeFrame)
+	return d
+}
+
+// decrypt returns the segment data in the clear.
+func (d *sampleAESDecrypter) decrypt(data, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	d.block, d.iv = block, iv
+	d.out.Reset()
+	if _, err := d.demux.Write(data); err != nil {
+		return nil, err
+	}
+	if err := d.demux.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.Clone(d.out.Bytes()), nil
+}
+
+func (d *sampleAESDecrypter) writeFrame(f mpegts.Frame) error {
+	data := bytes.Clone(f.Data)
+	streamType, ok := sampleAESStreamTypes[f.StreamType]
+	switch {
+	case !ok:
+		streamType = f.StreamType
+	case streamType == mpegts.StreamTypeH264:
+		data = d.decryptH264(data)
+	default:
+		d.decryptADTS(data)
+	}
+	if !ok && f.StreamType >= 0xC0 && !d.warn[f.StreamType] {
+		d.warn[f.StreamType] = true
+		global.Log.WithField("func", "app.engine.forwarder.hls.sampleAESDecrypter.writeFrame").
+			Warnf("cannot decrypt SAMPLE-AES stream type 0x%02x, passing it through", f.StreamType)
+	}
+	d.mux.SetStream(f.PID, streamType)
+	return d.mux.WritePES(f.PID, f.PTS, f.DTS, f.RandomAccess, data)
+}
+
+// decryptH264 decrypts the slices of an access unit. Of every slice NAL
+// unit over 48 bytes, without its emulation prevention bytes, the first 32
+// bytes are clear, then one block in ten is encrypted, the last partial
+// block never. The decrypted NAL unit carries its own emulation prevention.
+func (d *sampleAESDecrypter) decryptH264(au []byte) []byte {
+	out := make([]byte, 0, len(au))
+	for _, nalu := range codec.SplitAnnexB(au) {
+		if t := codec.AVCNALType(nalu); len(nalu) > 48 && (t == codec.AVCNALSlice || t == codec.AVCNALIDR) {
+			nalu = codec.RemoveEmulationPrevention(nalu)
+			dec := cipher.NewCBCDecrypter(d.block, d.iv)
+			for p := 32; len(nalu)-p > aes.BlockSize; p += 10 * aes.BlockSize {
+				dec.CryptBlocks(nalu[p:p+aes.BlockSize], nalu[p:p+aes.BlockSize])
+			}
+		}
+		out = codec.AppendAnnexB(out, nalu)
+	}
+	return out
+}
+
+// decryptADTS decrypts AAC frames in place. Past the ADTS header, the first
+// 16 bytes of a frame are clear, then all whole blocks are encrypted.
+func (d *sampleAESDecrypter) decryptADTS(b []byte) {
+	for len(b) >= codec.ADTSHeaderSize {
+		h, err := codec.ParseADTSHeader(b)
+		if err != nil || h.FrameSize > len(b) {
+			return
+		}
+		if enc := b[min(h.HeaderSize+aes.BlockSize, h.FrameSize):h.FrameSize]; len(enc) >= aes.BlockSize {
+			n := len(enc) / aes.BlockSize * aes.BlockSize
+			cipher.NewCBCDecrypter(d.block, d.iv).CryptBlocks(enc[:n], enc[:n])
+		}
+		b = b[h.FrameSize:]
+	}
+}
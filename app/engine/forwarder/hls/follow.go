@@ -0,0 +1,774 @@
+package hls
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	libm3u8 "github.com/grafov/m3u8"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/stream"
+	"github.com/nv4d1k/live-stream-forwarder/global"
+)
+
+// follower is the producer of an HLSStream. It extracts the stream, polls
+// its media playlist and pipes the new segments in order, keeping the state
+// it needs between polls.
+type follower struct {
+	s       *HLSStream
+	backoff *stream.Backoff
+
+	// The media playlist followed, from the latest extraction. An empty
+	// playlistURL re-extracts.
+	previous        *stream.ExtractResult
+	playlistURL     string
+	alternates      []string // candidate playlist URLs from the latest extraction not yet tried
+	headers         http.Header
+	variantSelector func([]*libm3u8.Variant) *libm3u8.Variant
+	variantCodecs   string    // CODECS of the variant picked from a master playlist
+	reextracted     bool      // the playlist is polled anew after an extraction
+	offlineSince    time.Time // when extraction first reported the stream offline
+	refreshTimer    *time.Timer
+
+	// The segments taken so far. The last listed segment taken, by number
+	// and name, tells whether the playlist after a re-extraction continues
+	// the same sequence.
+	lastSeqID    uint64
+	hasLastSeqID bool
+	lastProgress time.Time // when the playlist last yielded a new segment
+	anchorSeq    uint64
+	anchorName   string
+
+	// Init segments (EXT-X-MAP) are queued ahead of the segments they
+	// initialize, and again after a discontinuity.
+	initQueued, initSent string // URLs without their query
+	resync               bool   // the next segment starts a discontinuity
+
+	// Ad breaks are followed as segments are queued. AdsSwitch plays the
+	// alternate playlist until alternateUntil.
+	adBreak, onAlternate          bool
+	alternateUntil, noSwitchUntil time.Time
+
+	// A low-latency playlist is followed part by part from a cursor: the
+	// next part to queue is part llPart of segment llMSN.
+	llActive, llBlocking bool
+	llMSN                uint64
+	llPart               int
+	llHold               time.Duration // how long the server may hold a blocking reload
+
+	// Segments download in the background and are piped in order by
+	// deliver, between playlist polls.
+	pf            *prefetcher
+	sampleAES     *sampleAESDecrypter // created for the first SAMPLE-AES segment
+	lastDelivered time.Time           // when a segment was last piped
+}
+
+func newFollower(s *HLSStream) *follower {
+	return &follower{
+		s:             s,
+		backoff:       s.retry.NewBackoff(),
+		pf:            newPrefetcher(s.ctx, s.hc, s.prefetch, s.timeouts, s.retry),
+		lastDelivered: time.Now(),
+	}
+}
+
+// listing is a polled media playlist, indexed by media sequence number. A
+// key applies from its tag to the next one, and so does a map.
+type listing struct {
+	pl          *libm3u8.MediaPlaylist
+	segs        map[uint64]*libm3u8.MediaSegment
+	keys        map[uint64]*libm3u8.Key
+	maps        map[uint64]*libm3u8.Map
+	key         *libm3u8.Key // in effect after the last segment
+	segMap      *libm3u8.Map // in effect after the last segment
+	first, last uint64
+	dateRanges  []DateRange // parsed only when ads are detected
+	ll          *lowLatency // nil unless low-latency playlists are followed
+}
+
+func newListing(mediapl *libm3u8.MediaPlaylist, body []byte, ads, lowLatency bool) *listing {
+	l := &listing{
+		pl:     mediapl,
+		segs:   make(map[uint64]*libm3u8.MediaSegment),
+		keys:   make(map[uint64]*libm3u8.Key),
+		maps:   make(map[uint64]*libm3u8.Map),
+		segMap: mediapl.Map,
+	}
+	for _, seg := range mediapl.Segments {
+		if seg == nil {
+			continue
+		}
+		if seg.Key != nil {
+			l.key = seg.Key
+		}
+		if seg.Map != nil {
+			l.segMap = seg.Map
+		}
+		if len(l.segs) == 0 {
+			l.first = seg.SeqId
+		}
+		l.last = seg.SeqId
+		l.segs[seg.SeqId], l.keys[seg.SeqId], l.maps[seg.SeqId] = seg, l.key, l.segMap
+	}
+	if ads {
+		l.dateRanges = parseDateRanges(body)
+	}
+	if lowLatency {
+		l.ll = parseLowLatency(body)
+	}
+	return l
+}
+
+// keyAt returns the key of segment seq, or the key in effect after the last
+// segment for one not listed yet.
+func (l *listing) keyAt(seq uint64) *libm3u8.Key {
+	if k, ok := l.keys[seq]; ok {
+		return k
+	}
+	return l.key
+}
+
+// run follows the stream until it ends or the client goes away.
+func (f *follower) run() {
+	defer f.pf.reset()
+	defer f.stopRefresh()
+	for f.s.pipe.Err() == nil {
+		f.leaveAlternate()
+		if f.playlistURL == "" {
+			if !f.extract() {
+				return
+			}
+			continue
+		}
+		interval, ok := f.follow()
+		if !ok {
+			return
+		}
+		if f.playlistURL == "" || interval == 0 {
+			continue
+		}
+		if !f.pipeUntil(interval) {
+			return
+		}
+	}
+}
+
+// retry waits before the next attempt. It returns false when the stream
+// should stop, either because the client went away or the retry budget is
+// spent.
+func (f *follower) retry(cause error) bool {
+	if err := f.backoff.WaitAtLeast(f.s.pipe.Done(), stream.RetryAfter(cause)); err != nil {
+		if err != stream.ErrRetryCanceled {
+			f.s.giveUp(fmt.Errorf("%w after %d attempts: %w", err, f.backoff.Attempts(), cause))
+		}
+		return false
+	}
+	return true
+}
+
+// rewind drops the queued downloads, so that the next poll queues segment
+// seq again.
+func (f *follower) rewind(seq uint64) {
+	f.pf.reset()
+	f.lastSeqID, f.hasLastSeqID = seq-1, seq > 0
+	f.llActive, f.llBlocking = false, false
+	f.initQueued = f.initSent
+}
+
+// leaveAlternate goes back to the main playlist once the alternate has been
+// played through the ad break.
+func (f *follower) leaveAlternate() {
+	if f.onAlternate && time.Now().After(f.alternateUntil) {
+		global.Log.WithField("func", "app.engine.forwarder.hls.follower.leaveAlternate").
+			Infoln("returning to the main playlist after the ad break")
+		f.onAlternate = false
+		f.playlistURL = ""
+	}
+}
+
+// extract gets the media playlist URL to follow, from the extractor or,
+// during an ad break, the alternate playlist. It returns false when the
+// stream should stop.
+func (f *follower) extract() bool {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.follower.extract")
+	s := f.s
+	extract := s.extractFn
+	if f.onAlternate {
+		extract = s.ads.Alternate
+	}
+	ectx, cancelExtract := stream.WithTimeout(s.ctx, s.timeouts.Extract)
+	result, err := extract(ectx, f.previous)
+	cancelExtract()
+	if s.ctx.Err() != nil {
+		return false
+	}
+	if f.onAlternate && err != nil {
+		log.Warnf("alternate playlist extract error, skipping the ads instead: %s", err.Error())
+		f.onAlternate = false
+		f.noSwitchUntil = time.Now().Add(s.ads.hold())
+		return true
+	}
+	if stream.IsOffline(err) {
+		if f.offlineSince.IsZero() {
+			f.offlineSince = time.Now()
+			log.Infof("stream offline, applying %s policy: %s", s.offline.Action, err.Error())
+		}
+		if err := s.offline.Check(err, f.offlineSince); err != nil {
+			s.giveUp(err)
+			return false
+		}
+		select {
+		case <-time.After(s.offline.Poll):
+			return true
+		case <-s.pipe.Done():
+			return false
+		case <-s.ctx.Done():
+			return false
+		}
+	}
+	if err != nil {
+		log.Warnf("extract error: %s", err.Error())
+		return f.retry(err)
+	}
+	if !f.offlineSince.IsZero() {
+		log.Infof("stream back online after %s", time.Since(f.offlineSince).Round(time.Second))
+		f.offlineSince = time.Time{}
+	}
+	if !f.onAlternate {
+		f.previous = result
+	}
+	s.platform = result.Platform
+	f.playlistURL = result.URL
+	f.alternates = nil
+	if urls := s.health.Order(result.AllCandidates()); len(urls) > 0 {
+		f.playlistURL = urls[0]
+		f.alternates = urls[1:]
+	}
+	f.headers = result.Headers
+	if sel, ok := result.VariantSelector.(func([]*libm3u8.Variant) *libm3u8.Variant); ok {
+		f.variantSelector = sel
+	} else {
+		f.variantSelector = nil
+	}
+	f.reextracted = true
+	f.llActive, f.llBlocking = false, false
+	f.lastProgress = time.Now()
+	f.scheduleRefresh(result.ExpireAt)
+	return true
+}
+
+// scheduleRefresh sets a timer to trigger re-extraction before the URL
+// expires.
+func (f *follower) scheduleRefresh(expireAt *time.Time) {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.follower.scheduleRefresh")
+	f.stopRefresh()
+	if expireAt == nil {
+		return
+	}
+	when := stream.RefreshDelay(*expireAt)
+	log.Debugf("scheduling token refresh in %s (expires at %s)", when, expireAt.Format(time.RFC3339))
+	f.refreshTimer = time.AfterFunc(when, func() {
+		select {
+		case f.s.refreshCh <- struct{}{}:
+		default:
+		}
+	})
+}
+
+func (f *follower) stopRefresh() {
+	if f.refreshTimer != nil {
+		f.refreshTimer.Stop()
+		f.refreshTimer = nil
+	}
+}
+
+// failover switches to the next candidate playlist after a connection-level
+// failure of the current one, and reports whether there was one. Otherwise
+// the caller re-extracts or retries.
+func (f *follower) failover(cause error) bool {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.follower.failover")
+	if stream.Classify(cause) != stream.ClassTransient {
+		f.alternates = nil
+		return false
+	}
+	f.s.health.Failure(f.playlistURL)
+	if len(f.alternates) == 0 {
+		return false
+	}
+	log.Warnf("playlist host failed, trying alternate %s: %s", f.alternates[0], cause.Error())
+	f.playlistURL = f.alternates[0]
+	f.alternates = f.alternates[1:]
+	f.lastProgress = time.Now()
+	return true
+}
+
+// follow fetches the playlist and queues its new segments. It returns how
+// long to pipe segments before the next poll, 0 to go on at once, and false
+// when the stream should stop.
+func (f *follower) follow() (time.Duration, bool) {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.follower.follow")
+	s := f.s
+	// A blocking reload returns once the next part is listed.
+	playlistURL, fetchTimeout := f.playlistURL, s.timeouts.Fetch
+	if f.llBlocking {
+		playlistURL = blockingReloadURL(f.playlistURL, f.llMSN, f.llPart)
+		fetchTimeout = max(fetchTimeout, f.llHold)
+	}
+	pctx, cancelPlaylist := stream.WithTimeout(s.ctx, fetchTimeout)
+	playlist, listType, body, err := fetchPlaylist(pctx, s.hc, playlistURL, f.headers)
+	cancelPlaylist()
+	if s.ctx.Err() != nil {
+		return 0, false
+	}
+	if err != nil {
+		return 0, f.playlistFailed(err)
+	}
+
+	switch listType {
+	case libm3u8.MASTER:
+		return 0, f.selectVariant(playlist.(*libm3u8.MasterPlaylist))
+	case libm3u8.MEDIA:
+		return f.followMedia(playlist.(*libm3u8.MediaPlaylist), body)
+	default:
+		log.Warnf("unknown playlist type: %d, re-extracting", listType)
+		f.playlistURL = ""
+		return 0, f.retry(fmt.Errorf("unknown playlist type: %d", listType))
+	}
+}
+
+// playlistFailed handles a failed playlist fetch. It returns false when the
+// stream should stop.
+func (f *follower) playlistFailed(err error) bool {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.follower.playlistFailed")
+	err = stream.WithPlatform(err, f.s.platform)
+	if isExpiredHLS(err) {
+		log.Warnf("playlist fetch 403, re-extracting: %s", err.Error())
+		f.playlistURL = ""
+		return f.retry(err)
+	}
+	if f.failover(err) {
+		return true
+	}
+	if isTransientHLS(err) {
+		log.Warnf("playlist fetch transient error, retrying: %s", err.Error())
+		return f.retry(err)
+	}
+	log.Errorf("playlist fetch error: %s", err.Error())
+	f.s.closeWithError(err)
+	return false
+}
+
+// selectVariant picks the media playlist to follow from a master playlist.
+// It returns false when the stream should stop.
+func (f *follower) selectVariant(masterpl *libm3u8.MasterPlaylist) bool {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.follower.selectVariant")
+	s := f.s
+	if len(masterpl.Variants) == 0 {
+		log.Warnln("master playlist has no variants, re-extracting")
+		f.playlistURL = ""
+		return f.retry(errors.New("master playlist has no variants"))
+	}
+	var variant *libm3u8.Variant
+	switch {
+	case len(s.quality) > 0:
+		var err error
+		variant, err = s.quality.Select(masterpl.Variants)
+		if err != nil && !f.hasLastSeqID {
+			log.Errorf("variant selection error: %s", err.Error())
+			s.closeWithError(err)
+			return false
+		}
+		if err != nil {
+			// A stream re-extracted without the variant goes on at
+			// another rather than ending.
+			log.Warnf("%s, playing the highest bandwidth", err.Error())
+			variant = pickHighestBandwidthVariant(masterpl.Variants)
+		}
+	case f.variantSelector != nil:
+		variant = f.variantSelector(masterpl.Variants)
+	default:
+		variant = pickHighestBandwidthVariant(masterpl.Variants)
+	}
+	f.playlistURL = resolveURL(f.playlistURL, variant.URI)
+	f.variantCodecs = variant.Codecs
+	return true
+}
+
+// followMedia queues the new segments of a media playlist, ends the stream
+// at the end of a VOD playlist and re-extracts a live one that stopped
+// advancing. It returns as follow does.
+func (f *follower) followMedia(mediapl *libm3u8.MediaPlaylist, body []byte) (time.Duration, bool) {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.follower.followMedia")
+	s := f.s
+	s.setContentType(mediapl, f.variantCodecs)
+	l := newListing(mediapl, body, s.ads.Detect != nil, s.lowLatency)
+	f.checkSequence(l)
+
+	queue := f.queueSegments
+	if l.ll.partial() && !mediapl.Closed {
+		queue = f.queueParts
+	}
+	if !queue(l) {
+		return 0, false
+	}
+
+	if mediapl.Closed {
+		return 0, f.finishVOD()
+	}
+
+	// A live playlist that stops advancing is as stuck as a silent
+	// connection; re-extract in case the CDN edge froze.
+	if window := stallWindow(s.timeouts.Stall, mediapl); f.playlistURL != "" && window > 0 && time.Since(f.lastProgress) > window {
+		stallErr := fmt.Errorf("playlist not advancing: %w", stream.ErrStalled)
+		if f.failover(stallErr) {
+			log.WithField("event", "stall").Warnf("playlist has not advanced for %s", window)
+			return 0, true
+		}
+		log.WithField("event", "stall").Warnf("playlist has not advanced for %s, re-extracting", window)
+		f.playlistURL = ""
+		return 0, f.retry(stallErr)
+	}
+	if f.playlistURL == "" {
+		// A segment got a 403, or an ad break switches playlists;
+		// re-extract.
+		return 0, true
+	}
+	return f.pollInterval(l), true
+}
+
+// checkSequence follows jumps of the media sequence, after a re-extraction
+// to a stream numbered anew or when the upstream restarts. Small gaps are
+// segments missed; beyond a playlist's length, playback resyncs at the live
+// edge.
+func (f *follower) checkSequence(l *listing) {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.follower.checkSequence")
+	if f.hasLastSeqID && len(l.segs) > 0 {
+		renumbered := f.reextracted && f.anchorName != "" && l.segs[f.anchorSeq] != nil && segmentName(l.segs[f.anchorSeq].URI) != f.anchorName
+		window := uint64(len(l.segs))
+		switch {
+		case renumbered || l.last+window < f.lastSeqID || l.first > f.lastSeqID+1+window:
+			log.Warnf("media sequence jumped from %d to %d-%d, resyncing at the live edge", f.lastSeqID, l.first, l.last)
+			f.lastSeqID, f.hasLastSeqID = l.last-min(l.last, startSegments), l.last >= startSegments
+			f.llActive, f.resync = false, true
+		case l.first > f.lastSeqID+1:
+			log.Warnf("missed segments %d to %d", f.lastSeqID+1, l.first-1)
+		}
+	}
+	f.reextracted = false
+}
+
+// skipAd reports whether segment seq is an ad to leave out, following ad
+// breaks as segments are queued in order. A segment not listed yet goes
+// with the one before it.
+func (f *follower) skipAd(l *listing, seq uint64) bool {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.follower.skipAd")
+	ads := f.s.ads
+	if ads.Detect == nil {
+		return false
+	}
+	ad := f.adBreak
+	if seg := l.segs[seq]; seg != nil {
+		ad = ads.Detect(seg, l.dateRanges)
+	}
+	if ad != f.adBreak {
+		f.adBreak = ad
+		if ad {
+			log.Infof("ad break from segment %d, applying %s strategy", seq, ads.Strategy)
+		} else {
+			log.Infof("ad break over at segment %d", seq)
+			f.resync = ads.Strategy != AdsPassthrough
+		}
+	}
+	if !ad || ads.Strategy == AdsPassthrough {
+		return false
+	}
+	if ads.Strategy == AdsSwitch && ads.Alternate != nil && !f.onAlternate && time.Now().After(f.noSwitchUntil) {
+		log.Infof("switching to the alternate playlist for %s", ads.hold())
+		f.onAlternate, f.alternateUntil = true, time.Now().Add(ads.hold())
+		f.playlistURL = ""
+	}
+	f.lastProgress = time.Now() // the playlist advances, with ads
+	return true
+}
+
+// queue queues the segment or part at uri, of media sequence number seq, to
+// be piped once downloaded and decrypted. It returns false when the stream
+// should stop.
+func (f *follower) queue(l *listing, uri string, seq uint64, key *libm3u8.Key, kind fetchKind) bool {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.follower.queue")
+	if f.playlistURL == "" || f.skipAd(l, seq) {
+		return true // switching playlists, or an ad
+	}
+	segKey, err := keyOf(key, f.playlistURL, seq)
+	if err == nil && segKey != nil && segKey.Method == MethodSampleAES && l.pl.Map != nil {
+		err = fmt.Errorf("%w: SAMPLE-AES in fragmented MP4", ErrUnsupportedEncryption)
+	}
+	if err != nil {
+		log.Errorf("segment error: %s", err.Error())
+		f.s.closeWithError(err)
+		return false
+	}
+	f.pf.add(&segmentFetch{url: resolveURL(f.playlistURL, uri), headers: f.headers, platform: f.s.platform, key: segKey, kind: kind, seq: seq})
+	f.lastProgress = time.Now()
+	return true
+}
+
+// begin queues the init segment of segment seq ahead of it, unless the same
+// one was sent and there is no discontinuity. It returns false once the
+// stream switches playlists, for the segments from seq to be taken from the
+// next one.
+func (f *follower) begin(l *listing, seq uint64) bool {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.follower.begin")
+	if f.playlistURL == "" || f.skipAd(l, seq) {
+		return f.playlistURL != ""
+	}
+	m, ok := l.maps[seq]
+	if !ok {
+		m = l.segMap // a segment in progress or announced
+	}
+	discontinuity := f.resync || (l.segs[seq] != nil && l.segs[seq].Discontinuity)
+	if discontinuity {
+		log.Infof("discontinuity before segment %d", seq)
+	}
+	f.resync = false
+	if m == nil || m.URI == "" {
+		return true
+	}
+	initURL := resolveURL(f.playlistURL, m.URI)
+	if stripQuery(initURL) == f.initQueued && !discontinuity {
+		return true
+	}
+	f.pf.add(&segmentFetch{url: initURL, headers: f.headers, platform: f.s.platform, kind: kindInit, seq: seq})
+	f.initQueued = stripQuery(initURL)
+	return true
+}
+
+// queueParts follows a low-latency playlist's parts from the cursor, which
+// starts at the segment in progress. Whole segments are queued while
+// catching up, parts once they are all that is listed. It returns false
+// when the stream should stop.
+func (f *follower) queueParts(l *listing) bool {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.follower.queueParts")
+	ll := l.ll
+	if !f.llActive {
+		f.llActive = true
+		f.llMSN, f.llPart = ll.nextMSN, 0
+		if f.hasLastSeqID {
+			f.llMSN = f.lastSeqID + 1
+		}
+		log.Debugf("following low-latency playlist from segment %d", f.llMSN)
+	}
+	if first := ll.nextMSN - uint64(len(l.segs)); f.llMSN < first {
+		f.llMSN, f.llPart = first, 0 // fell behind the playlist
+	}
+	for {
+		seg := l.segs[f.llMSN]
+		if seg != nil && f.llPart == 0 {
+			if !f.begin(l, f.llMSN) {
+				break
+			}
+			if !f.queue(l, seg.URI, f.llMSN, l.keyAt(f.llMSN), kindMedia) {
+				return false
+			}
+			f.anchorSeq, f.anchorName = f.llMSN, segmentName(seg.URI)
+			f.llMSN++
+			continue
+		}
+		if part := ll.part(f.llMSN, f.llPart); part != nil {
+			if f.llPart == 0 && !f.begin(l, f.llMSN) {
+				break
+			}
+			if !f.queue(l, part.uri, f.llMSN, l.keyAt(f.llMSN), kindMedia) {
+				return false
+			}
+			f.llPart++
+			continue
+		}
+		if seg != nil {
+			f.anchorSeq, f.anchorName = f.llMSN, segmentName(seg.URI)
+			f.llMSN, f.llPart = f.llMSN+1, 0 // all its parts are queued
+			continue
+		}
+		break
+	}
+	if h := ll.hint; h != nil && h.msn == f.llMSN && h.index == f.llPart && (f.llPart > 0 || f.begin(l, f.llMSN)) {
+		if !f.queue(l, h.uri, f.llMSN, l.keyAt(f.llMSN), kindHint) {
+			return false
+		}
+		f.llPart++
+	}
+	switch {
+	case f.llPart > 0:
+		f.lastSeqID, f.hasLastSeqID = f.llMSN, true // a part taken counts as the segment
+	case f.llMSN > 0:
+		f.lastSeqID, f.hasLastSeqID = f.llMSN-1, true
+	}
+	f.llBlocking = ll.canBlockReload
+	f.llHold = 3 * time.Duration(l.pl.TargetDuration) * time.Second
+	return true
+}
+
+// queueSegments queues the segments listed after the last one taken, and
+// the segments Twitch lists ahead of time. It returns false when the stream
+// should stop.
+func (f *follower) queueSegments(l *listing) bool {
+	f.llActive, f.llBlocking = false, false
+	for _, seg := range l.pl.Segments {
+		if seg == nil || (f.hasLastSeqID && seg.SeqId <= f.lastSeqID) {
+			continue
+		}
+		if !f.begin(l, seg.SeqId) {
+			break // switching playlists
+		}
+		if !f.queue(l, seg.URI, seg.SeqId, l.keys[seg.SeqId], kindMedia) {
+			return false
+		}
+		f.lastSeqID, f.hasLastSeqID = seg.SeqId, true
+		f.anchorSeq, f.anchorName = seg.SeqId, segmentName(seg.URI)
+	}
+	for i, uri := range l.ll.twitchPrefetch() {
+		seq := l.ll.nextMSN + uint64(i)
+		if f.hasLastSeqID && seq <= f.lastSeqID {
+			continue
+		}
+		if !f.begin(l, seq) {
+			break
+		}
+		if !f.queue(l, uri, seq, l.key, kindHint) {
+			return false
+		}
+		f.lastSeqID, f.hasLastSeqID = seq, true
+	}
+	return true
+}
+
+// finishVOD pipes the rest of an ended playlist and ends the stream, unless
+// a segment asked for a re-extraction. It returns false when the stream
+// should stop.
+func (f *follower) finishVOD() bool {
+	for ready := f.pf.ready(); ready != nil && f.playlistURL != ""; ready = f.pf.ready() {
+		select {
+		case <-ready:
+			if !f.deliver(f.pf.next()) {
+				return false
+			}
+		case <-f.s.ctx.Done():
+			return false
+		}
+	}
+	if f.playlistURL != "" {
+		f.s.closeWithError(io.EOF)
+		return false
+	}
+	return true
+}
+
+// pollInterval returns how long to wait before polling a live playlist
+// again. A low-latency playlist is polled every part.
+func (f *follower) pollInterval(l *listing) time.Duration {
+	interval := 3 * time.Second
+	if l.pl.TargetDuration > 0 {
+		interval = time.Duration(l.pl.TargetDuration) * time.Second
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	if f.llActive && !f.llBlocking && l.ll.partTarget > 0 {
+		interval = max(l.ll.partTarget, minPartPoll)
+	}
+	return interval
+}
+
+// pipeUntil pipes segments as they finish until the next poll, in interval,
+// but wakes early if the token needs refreshing. A playlist whose server
+// blocks reloads is reloaded as soon as the queued parts are piped. It
+// returns false when the stream should stop.
+func (f *follower) pipeUntil(interval time.Duration) bool {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.follower.pipeUntil")
+	poll := time.NewTimer(interval)
+	defer poll.Stop()
+	for !f.llBlocking || f.pf.ready() != nil {
+		select {
+		case <-f.pf.ready():
+			if !f.deliver(f.pf.next()) {
+				return false
+			}
+			if f.playlistURL == "" {
+				return true
+			}
+		case <-f.s.refreshCh:
+			log.Infoln("token refresh triggered, re-extracting")
+			f.playlistURL = ""
+			return true
+		case <-poll.C:
+			return true
+		case <-f.s.ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// deliver pipes a downloaded segment, or handles its failure. It returns
+// false when the stream should stop.
+func (f *follower) deliver(sf *segmentFetch) bool {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.follower.deliver")
+	s := f.s
+	if err := sf.err; err != nil {
+		if s.ctx.Err() != nil {
+			return false
+		}
+		if isExpiredHLS(err) {
+			log.Warnf("segment fetch 403, re-extracting: %s", err.Error())
+			f.rewind(sf.seq)
+			f.playlistURL = ""
+			return true
+		}
+		if sf.kind == kindHint {
+			log.Warnf("prefetched segment failed, skipping: %s", err.Error())
+			return true
+		}
+		if sf.kind == kindInit && isTransientHLS(err) {
+			// The segments after it are useless without it.
+			log.Warnf("init segment fetch transient error, retrying: %s", err.Error())
+			f.rewind(sf.seq)
+			return f.retry(err)
+		}
+		if isTransientHLS(err) {
+			// The prefetcher has retried it already. Waiting more would
+			// hold back the segments downloaded after it, so backoff is
+			// left to playlist and extraction failures, unless no
+			// segment has got through for a while.
+			if s.timeouts.Stall > 0 && time.Since(f.lastDelivered) > s.timeouts.Stall {
+				log.Warnf("no segment delivered for %s, backing off: %s", s.timeouts.Stall, err.Error())
+				return f.retry(err)
+			}
+			log.Warnf("segment fetch transient error, skipping: %s", err.Error())
+			return true
+		}
+		s.closeWithError(err)
+		return false
+	}
+	data := sf.data.Bytes()
+	if sf.key != nil && sf.key.Method == MethodSampleAES {
+		if f.sampleAES == nil {
+			f.sampleAES = newSampleAESDecrypter()
+		}
+		var err error
+		if data, err = f.sampleAES.decrypt(data, sf.keyData, sf.key.IV); err != nil {
+			log.Warnf("SAMPLE-AES segment error, skipping: %s", err.Error())
+			return true
+		}
+	}
+	if _, err := s.pipe.Write(data); err != nil {
+		return false
+	}
+	if sf.kind == kindInit {
+		f.initSent = stripQuery(sf.url)
+	}
+	f.backoff.Reset()
+	f.lastDelivered = time.Now()
+	s.health.Success(sf.url)
+	return s.pipe.Err() == nil
+}
@@ -33,8 +33,8 @@ func NewHLSForwarder(proxy *url.URL, mobile bool) *HLSForwarder {
 
 // Stream returns an *HLSStream that continuously fetches the HLS playlist,
 // downloads segments, and pipes raw MPEG-TS data to the client.
-func (h *HLSForwarder) Stream(extractFn stream.ExtractFunc) *HLSStream {
+func (h *HLSForwarder) Stream(extractFn stream.ExtractFunc, opts ...HLSStreamOption) *HLSStream {
 	log := global.Log.WithField("func", "app.engine.forwarder.hls.HLSForwarder.Stream")
 	log.Debug("creating HLSStream from extractFn")
-	return NewHLSStream(extractFn, h.hc)
+	return NewHLSStream(extractFn, h.hc, opts...)
 }
@@ -1,14 +1,28 @@
 package hls
 
 import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/grafov/m3u8"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/mpegts"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/stream"
 	"github.com/nv4d1k/live-stream-forwarder/global"
 	"github.com/sirupsen/logrus"
 )
@@ -143,6 +157,128 @@ lower.m3u8
 	}
 }
 
+func TestQuality(t *testing.T) {
+	// As Twitch lists its qualities, each named by a VIDEO rendition.
+	master := `#EXTM3U
+#EXT-X-MEDIA:TYPE=VIDEO,GROUP-ID="chunked",NAME="1080p60 (source)",AUTOSELECT=YES,DEFAULT=YES
+#EXT-X-STREAM-INF:BANDWIDTH=6000000,RESOLUTION=1920x1080,CODECS="avc1.64002A,mp4a.40.2",VIDEO="chunked",FRAME-RATE=60.000
+source.m3u8
+#EXT-X-MEDIA:TYPE=VIDEO,GROUP-ID="720p60",NAME="720p60",AUTOSELECT=YES,DEFAULT=YES
+#EXT-X-STREAM-INF:BANDWIDTH=3000000,RESOLUTION=1280x720,CODECS="avc1.4D401F,mp4a.40.2",VIDEO="720p60",FRAME-RATE=60.000
+720p60.m3u8
+#EXT-X-MEDIA:TYPE=VIDEO,GROUP-ID="720p30",NAME="720p30",AUTOSELECT=YES,DEFAULT=YES
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720,CODECS="avc1.4D401F,mp4a.40.2",VIDEO="720p30",FRAME-RATE=30.000
+720p30.m3u8
+#EXT-X-MEDIA:TYPE=VIDEO,GROUP-ID="480p30",NAME="480p",AUTOSELECT=YES,DEFAULT=YES
+#EXT-X-STREAM-INF:BANDWIDTH=1000000,RESOLUTION=852x480,CODECS="avc1.4D401E,mp4a.40.2",VIDEO="480p30",FRAME-RATE=29.970
+480p30.m3u8
+#EXT-X-MEDIA:TYPE=VIDEO,GROUP-ID="audio_only",NAME="audio_only",AUTOSELECT=NO,DEFAULT=NO
+#EXT-X-STREAM-INF:BANDWIDTH=160000,CODECS="mp4a.40.2",VIDEO="audio_only"
+audio_only.m3u8
+`
+	p, _, err := m3u8.DecodeFrom(strings.NewReader(master), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	variants := p.(*m3u8.MasterPlaylist).Variants
+	tests := []struct {
+		quality string
+		want    string // URI, or "" for ErrNoVariant
+	}{
+		{"720p", "720p60.m3u8"},
+		{"720p30", "720p30.m3u8"},
+		{"480p30", "480p30.m3u8"},
+		{"source", "source.m3u8"},
+		{"best", "source.m3u8"},
+		{"worst", "480p30.m3u8"},
+		{"audio_only", "audio_only.m3u8"},
+		{"720P60", "720p60.m3u8"},
+		{"30fps", "720p30.m3u8"},
+		{"2500k", "720p30.m3u8"},
+		{"1m", "480p30.m3u8"},
+		{"1440p", ""},
+		{"1440p,720p30", "720p30.m3u8"},
+		{"1440p, 360p, worst", "480p30.m3u8"},
+		{"1080p60 (source)", "source.m3u8"},
+		{"160p", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.quality, func(t *testing.T) {
+			q, err := ParseQuality(tt.quality)
+			if err != nil {
+				t.Fatalf("ParseQuality: %v", err)
+			}
+			v, err := q.Select(variants)
+			if tt.want == "" {
+				if !errors.Is(err, ErrNoVariant) {
+					t.Fatalf("Select() error = %v, want ErrNoVariant", err)
+				}
+				if !strings.Contains(err.Error(), "1080p60 (source), 720p60, 720p30, 480p, audio_only") {
+					t.Errorf("error %q does not list the variants", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Select: %v", err)
+			}
+			if v.URI != tt.want {
+				t.Errorf("Select() = %s, want %s", v.URI, tt.want)
+			}
+		})
+	}
+
+	for _, bad := range []string{"720p&x=1", `"source"`} {
+		if _, err := ParseQuality(bad); err == nil {
+			t.Errorf("ParseQuality(%q) succeeded, want error", bad)
+		}
+	}
+	if q, _ := ParseQuality("Source, 720p"); q.String() != "source,720p" {
+		t.Errorf("String() = %q, want %q", q.String(), "source,720p")
+	}
+
+	// Streams that do not name their source play the highest bandwidth.
+	p, _, err = m3u8.DecodeFrom(strings.NewReader("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=500000,RESOLUTION=640x360\nlow.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080\nhigh.m3u8\n"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, _ := ParseQuality("source")
+	if v, err := q.Select(p.(*m3u8.MasterPlaylist).Variants); err != nil || v.URI != "high.m3u8" {
+		t.Errorf("Select(source) = %v, %v; want high.m3u8", v, err)
+	}
+}
+
+func TestHLSStream_Quality(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/master.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080\nhigh.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=500000,RESOLUTION=640x360\nlow.m3u8\n")
+		case "/high.m3u8", "/low.m3u8":
+			fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1,\n%s.ts\n#EXT-X-ENDLIST\n", strings.TrimSuffix(r.URL.Path[1:], ".m3u8"))
+		default:
+			fmt.Fprint(w, r.URL.Path[1:])
+		}
+	}))
+	defer srv.Close()
+	extractFn := func(context.Context, *stream.ExtractResult) (*stream.ExtractResult, error) {
+		return &stream.ExtractResult{URL: srv.URL + "/master.m3u8"}, nil
+	}
+
+	q, _ := ParseQuality("360p")
+	s := NewHLSStream(extractFn, srv.Client(), WithQuality(q))
+	got, err := io.ReadAll(s)
+	s.Close()
+	if err != nil || string(got) != "low.ts" {
+		t.Errorf("stream = %q, %v; want %q", got, err, "low.ts")
+	}
+
+	q, _ = ParseQuality("720p")
+	s = NewHLSStream(extractFn, srv.Client(), WithQuality(q))
+	defer s.Close()
+	if _, err := s.ContentType(); !errors.Is(err, ErrNoVariant) {
+		t.Errorf("ContentType() error = %v, want ErrNoVariant", err)
+	}
+}
+
 func TestResolveURL(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -205,8 +341,8 @@ func TestIsExpiredHLS(t *testing.T) {
 		want bool
 	}{
 		{
-			name: "error containing 403",
-			err:  errors.New("get m3u8 err got: 403 Forbidden"),
+			name: "403 on playlist",
+			err:  &stream.UpstreamError{Phase: stream.PhaseFetch, StatusCode: 403},
 			want: true,
 		},
 		{
@@ -220,13 +356,18 @@ func TestIsExpiredHLS(t *testing.T) {
 			want: false,
 		},
 		{
-			name: "error with 403 in status text",
-			err:  errors.New("fetch segment err got: HTTP 403"),
+			name: "wrapped 404 on segment",
+			err:  fmt.Errorf("segment: %w", &stream.UpstreamError{Phase: stream.PhaseFetch, StatusCode: 404}),
 			want: true,
 		},
+		{
+			name: "403 in message text only",
+			err:  errors.New("fetch segment err got: HTTP 403"),
+			want: false,
+		},
 		{
 			name: "EOF error is not expired",
-			err:  errors.New("unexpected EOF"),
+			err:  io.ErrUnexpectedEOF,
 			want: false,
 		},
 	}
@@ -249,7 +390,7 @@ func TestIsTransientHLS(t *testing.T) {
 	}{
 		{
 			name: "EOF error",
-			err:  errors.New("unexpected EOF"),
+			err:  io.ErrUnexpectedEOF,
 			want: true,
 		},
 		{
@@ -259,14 +400,24 @@ func TestIsTransientHLS(t *testing.T) {
 		},
 		{
 			name: "connection reset",
-			err:  errors.New("connection reset by peer"),
+			err:  &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET},
 			want: true,
 		},
 		{
 			name: "403 is not transient",
-			err:  errors.New("HTTP 403 Forbidden"),
+			err:  &stream.UpstreamError{Phase: stream.PhaseFetch, StatusCode: 403},
 			want: false,
 		},
+		{
+			name: "503 is transient",
+			err:  &stream.UpstreamError{Phase: stream.PhaseFetch, StatusCode: 503},
+			want: true,
+		},
+		{
+			name: "429 is transient",
+			err:  &stream.UpstreamError{Phase: stream.PhaseFetch, StatusCode: 429},
+			want: true,
+		},
 		{
 			name: "timeout error",
 			err:  &timeoutError{},
@@ -278,8 +429,8 @@ func TestIsTransientHLS(t *testing.T) {
 			want: false,
 		},
 		{
-			name: "temporary in message",
-			err:  fmt.Errorf("dial tcp: temporary failure in name resolution"),
+			name: "temporary DNS failure",
+			err:  &net.DNSError{Err: "temporary failure in name resolution", Name: "cdn.example", IsTemporary: true},
 			want: true,
 		},
 	}
@@ -302,3 +453,971 @@ func (e *timeoutError) Timeout() bool   { return true }
 func (e *timeoutError) Temporary() bool { return true }
 
 var _ net.Error = (*timeoutError)(nil)
+
+func TestWindow(t *testing.T) {
+	w := NewWindow(2)
+	w.SetInit([]byte("init1"))
+	w.Append(6, ".m4s", []byte("a"))
+	w.Append(6, ".m4s", []byte("b"))
+	w.Discontinue()
+	w.SetInit([]byte("init2"))
+	w.Append(4.5, ".m4s", []byte("c"))
+
+	want := `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:1
+#EXT-X-MAP:URI="v0-init1.mp4"
+#EXTINF:6.000,
+v0-1.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-MAP:URI="v0-init2.mp4"
+#EXTINF:4.500,
+v0-2.m4s
+`
+	if got := string(w.Playlist("v0")); got != want {
+		t.Errorf("Playlist() =\n%s\nwant\n%s", got, want)
+	}
+
+	w.Append(4, ".m4s", []byte("d"))
+	w.Append(4, ".m4s", []byte("e"))
+	got := string(w.Playlist("v0"))
+	if !strings.Contains(got, "#EXT-X-DISCONTINUITY-SEQUENCE:1\n") || strings.Contains(got, "#EXT-X-DISCONTINUITY\n") {
+		t.Errorf("Playlist() after the discontinuity left =\n%s", got)
+	}
+	if seg, ok := w.Segment(0); !ok || string(seg.Data) != "a" {
+		t.Errorf("Segment(0) within the grace period = %v, %v", seg, ok)
+	}
+
+	w.Append(4, ".m4s", []byte("f"))
+	w.Append(4, ".m4s", []byte("g"))
+	if _, ok := w.Segment(0); ok {
+		t.Error("Segment(0) still held after the grace period")
+	}
+	if _, ok := w.Init(1); ok {
+		t.Error("Init(1) still held without segments")
+	}
+	if data, ok := w.Init(2); !ok || string(data) != "init2" {
+		t.Errorf("Init(2) = %q, %v", data, ok)
+	}
+
+	w.End()
+	if got := string(w.Playlist("v0")); !strings.HasSuffix(got, "v0-6.m4s\n#EXT-X-ENDLIST\n") {
+		t.Errorf("Playlist() after End =\n%s", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := NewWindow(3).Wait(ctx); err != context.Canceled {
+		t.Errorf("Wait() on an empty window = %v, want context.Canceled", err)
+	}
+}
+
+func TestWindow_Keys(t *testing.T) {
+	w := NewWindow(4)
+	k1 := &Key{Method: MethodAES128, IV: bytes.Repeat([]byte{1}, 16), Data: []byte("k1")}
+	w.SetKey(k1)
+	w.Append(1, ".ts", nil)
+	w.SetKey(&Key{Method: MethodAES128, IV: bytes.Repeat([]byte{1}, 16), Data: []byte("k1")}) // same key
+	w.Append(1, ".ts", nil)
+	w.SetKey(nil)
+	w.Append(1, ".ts", nil)
+	w.SetKey(&Key{Method: MethodSampleAES, IV: bytes.Repeat([]byte{2}, 16), KeyFormat: "identity", Data: []byte("k2")})
+	w.Append(1, ".ts", nil)
+
+	want := "#EXTM3U\n#EXT-X-VERSION:5\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"v0-key1.key\",IV=0x01010101010101010101010101010101\n" +
+		"#EXTINF:1.000,\nv0-0.ts\n#EXTINF:1.000,\nv0-1.ts\n" +
+		"#EXT-X-KEY:METHOD=NONE\n#EXTINF:1.000,\nv0-2.ts\n" +
+		"#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"v0-key2.key\",IV=0x02020202020202020202020202020202,KEYFORMAT=\"identity\"\n" +
+		"#EXTINF:1.000,\nv0-3.ts\n"
+	if got := string(w.Playlist("v0")); got != want {
+		t.Errorf("Playlist() =\n%s\nwant\n%s", got, want)
+	}
+	if k, ok := w.Key(2); !ok || string(k.Data) != "k2" {
+		t.Errorf("Key(2) = %v, %v", k, ok)
+	}
+
+	// Keys go with the last segment using them.
+	for range 4 + windowGrace {
+		w.Append(1, ".ts", nil)
+	}
+	if _, ok := w.Key(1); ok {
+		t.Error("Key(1) still held")
+	}
+}
+
+func TestHLSStream_Prefetch(t *testing.T) {
+	const segments, limit = 6, 3
+	var active, peak atomic.Int32
+	var failed atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/index.m3u8" {
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n")
+			for n := range segments {
+				fmt.Fprintf(w, "#EXTINF:1.0,\nseg%d.ts\n", n)
+			}
+			fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+			return
+		}
+		n := active.Add(1)
+		defer active.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		var seg int
+		fmt.Sscanf(r.URL.Path, "/seg%d.ts", &seg)
+		if seg == 2 && failed.CompareAndSwap(false, true) {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		// Later segments finish first.
+		time.Sleep(time.Duration(segments-seg) * 20 * time.Millisecond)
+		fmt.Fprintf(w, "seg%d;", seg)
+	}))
+	defer srv.Close()
+
+	extractFn := func(context.Context, *stream.ExtractResult) (*stream.ExtractResult, error) {
+		return &stream.ExtractResult{URL: srv.URL + "/index.m3u8"}, nil
+	}
+	s := NewHLSStream(extractFn, srv.Client(), WithPrefetch(limit),
+		WithRetryPolicy(stream.RetryPolicy{InitialDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond, Multiplier: 1}))
+	defer s.Close()
+	if ct, err := s.ContentType(); err != nil || ct != "video/mp2t" {
+		t.Errorf("ContentType() = %q, %v, want video/mp2t", ct, err)
+	}
+
+	got, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if want := "seg0;seg1;seg2;seg3;seg4;seg5;"; string(got) != want {
+		t.Errorf("stream = %q, want %q", got, want)
+	}
+	if !failed.Load() {
+		t.Error("segment 2 was not retried")
+	}
+	if p := peak.Load(); p < 2 || p > limit {
+		t.Errorf("peak concurrent downloads = %d, want 2..%d", p, limit)
+	}
+}
+
+// encryptAES128 encrypts a segment as an AES-128 HLS upstream does.
+func encryptAES128(t *testing.T, data, key, iv []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pad := aes.BlockSize - len(data)%aes.BlockSize
+	out := append(bytes.Clone(data), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, out)
+	return out
+}
+
+func TestHLSStream_SkipsFailedSegments(t *testing.T) {
+	// Failed segments are skipped without spending the retry budget,
+	// which two attempts would exhaust.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/live.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1,\ns0.ts\n#EXTINF:1,\nbad1.ts\n#EXTINF:1,\nbad2.ts\n#EXTINF:1,\nbad3.ts\n#EXTINF:1,\ns4.ts\n#EXT-X-ENDLIST\n")
+		case strings.HasPrefix(r.URL.Path, "/bad"):
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		default:
+			fmt.Fprintf(w, "%s;", strings.TrimSuffix(r.URL.Path[1:], ".ts"))
+		}
+	}))
+	defer srv.Close()
+	extractFn := func(context.Context, *stream.ExtractResult) (*stream.ExtractResult, error) {
+		return &stream.ExtractResult{URL: srv.URL + "/live.m3u8"}, nil
+	}
+	s := NewHLSStream(extractFn, srv.Client(),
+		WithRetryPolicy(stream.RetryPolicy{InitialDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond, Multiplier: 1, MaxAttempts: 2}))
+	defer s.Close()
+	got, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "s0;s4;" {
+		t.Errorf("stream = %q, want %q", got, "s0;s4;")
+	}
+}
+
+func TestHLSStream_AES128(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	explicitIV := bytes.Repeat([]byte{0xA5}, aes.BlockSize)
+	var keyFetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Referer") != "https://example.com/" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/index.m3u8":
+			fmt.Fprintf(w, `#EXTM3U
+#EXT-X-TARGETDURATION:1
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin"
+#EXTINF:1.0,
+seg7.ts
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x%X
+#EXTINF:1.0,
+seg8.ts
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:1.0,
+seg9.ts
+#EXT-X-ENDLIST
+`, explicitIV)
+		case "/key.bin":
+			keyFetches.Add(1)
+			w.Write(key)
+		case "/seg7.ts":
+			w.Write(encryptAES128(t, []byte("segment seven;"), key, binary.BigEndian.AppendUint64(make([]byte, 8), 7)))
+		case "/seg8.ts":
+			w.Write(encryptAES128(t, []byte("segment eight, a block and more;"), key, explicitIV))
+		case "/seg9.ts":
+			fmt.Fprint(w, "segment nine;")
+		}
+	}))
+	defer srv.Close()
+	defer DefaultKeys.Forget(srv.URL + "/key.bin")
+
+	extractFn := func(context.Context, *stream.ExtractResult) (*stream.ExtractResult, error) {
+		return &stream.ExtractResult{URL: srv.URL + "/index.m3u8", Headers: http.Header{"Referer": {"https://example.com/"}}}, nil
+	}
+	s := NewHLSStream(extractFn, srv.Client())
+	defer s.Close()
+	got, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if want := "segment seven;segment eight, a block and more;segment nine;"; string(got) != want {
+		t.Errorf("stream = %q, want %q", got, want)
+	}
+	if n := keyFetches.Load(); n != 1 {
+		t.Errorf("key fetched %d times, want 1", n)
+	}
+}
+
+func TestHLSStream_UnsupportedEncryption(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n"+
+			"#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"skd://key\",KEYFORMAT=\"com.apple.streamingkeydelivery\"\n"+
+			"#EXTINF:1.0,\nseg0.ts\n")
+	}))
+	defer srv.Close()
+	extractFn := func(context.Context, *stream.ExtractResult) (*stream.ExtractResult, error) {
+		return &stream.ExtractResult{URL: srv.URL + "/index.m3u8"}, nil
+	}
+	s := NewHLSStream(extractFn, srv.Client())
+	defer s.Close()
+	if _, err := io.ReadAll(s); !errors.Is(err, ErrUnsupportedEncryption) {
+		t.Errorf("ReadAll() error = %v, want ErrUnsupportedEncryption", err)
+	}
+}
+
+func TestParseLowLatency(t *testing.T) {
+	tests := []struct {
+		name     string
+		playlist string
+		want     lowLatency
+	}{
+		{
+			name: "parts and preload hint",
+			playlist: `#EXTM3U
+#EXT-X-TARGETDURATION:2
+#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=1.0
+#EXT-X-PART-INF:PART-TARGET=0.5
+#EXT-X-MEDIA-SEQUENCE:10
+#EXTINF:2.0,
+seg10.ts
+#EXT-X-PART:DURATION=0.5,URI="part11.0.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.5,URI="part11.1.ts"
+#EXTINF:1.0,
+seg11.ts
+#EXT-X-PART:DURATION=0.5,URI="part12.0.ts",INDEPENDENT=YES
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part12.1.ts"
+`,
+			want: lowLatency{
+				canBlockReload: true,
+				partTarget:     500 * time.Millisecond,
+				parts:          []llPart{{11, 0, "part11.0.ts"}, {11, 1, "part11.1.ts"}, {12, 0, "part12.0.ts"}},
+				hint:           &llPart{12, 1, "part12.1.ts"},
+				nextMSN:        12,
+			},
+		},
+		{
+			name: "byte range parts",
+			playlist: `#EXTM3U
+#EXT-X-PART-INF:PART-TARGET=1
+#EXT-X-PART:DURATION=1,URI="seg0.mp4",BYTERANGE=1000@0
+`,
+			want: lowLatency{partTarget: time.Second, parts: []llPart{{0, 0, "seg0.mp4"}}, byteRange: true},
+		},
+		{
+			name: "twitch prefetch",
+			playlist: `#EXTM3U
+#EXT-X-MEDIA-SEQUENCE:3
+#EXTINF:2.000,live
+seg3.ts
+#EXT-X-TWITCH-PREFETCH:https://cdn.example.com/seg4.ts
+#EXT-X-TWITCH-PREFETCH:https://cdn.example.com/seg5.ts
+`,
+			want: lowLatency{prefetch: []string{"https://cdn.example.com/seg4.ts", "https://cdn.example.com/seg5.ts"}, nextMSN: 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseLowLatency([]byte(tt.playlist))
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("parseLowLatency() = %+v (hint %+v), want %+v (hint %+v)", *got, got.hint, tt.want, tt.want.hint)
+			}
+		})
+	}
+}
+
+func TestParseAttributes(t *testing.T) {
+	got := parseAttributes(`TYPE=PART,URI="a,b.ts",BYTERANGE-START=0`)
+	want := map[string]string{"TYPE": "PART", "URI": "a,b.ts", "BYTERANGE-START": "0"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseAttributes() = %v, want %v", got, want)
+	}
+}
+
+// llUpstream is a live low-latency HLS server producing one part every
+// partDur, two parts to a segment.
+type llUpstream struct {
+	start    time.Time
+	partDur  time.Duration
+	blocking bool
+
+	blockingReloads atomic.Int32
+	earlyHints      atomic.Int32 // hinted parts requested before they were produced
+}
+
+// produced returns the number of parts produced so far.
+func (u *llUpstream) produced() int {
+	return 5 + int(time.Since(u.start)/u.partDur)
+}
+
+// waitFor waits until part n is produced.
+func (u *llUpstream) waitFor(ctx context.Context, n int) {
+	for u.produced() <= n && ctx.Err() == nil {
+		time.Sleep(u.partDur / 5)
+	}
+}
+
+func (u *llUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var msn, part int
+	switch {
+	case r.URL.Path == "/index.m3u8":
+		if q := r.URL.Query(); q.Has("_HLS_msn") {
+			u.blockingReloads.Add(1)
+			fmt.Sscan(q.Get("_HLS_msn"), &msn)
+			fmt.Sscan(q.Get("_HLS_part"), &part)
+			u.waitFor(r.Context(), 2*msn+part)
+		}
+		n := u.produced()
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-VERSION:9\n#EXT-X-TARGETDURATION:1\n#EXT-X-PART-INF:PART-TARGET=0.05\n")
+		if u.blocking {
+			fmt.Fprint(w, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES\n")
+		}
+		for i := range n {
+			if i/2 >= n/2-1 {
+				fmt.Fprintf(w, "#EXT-X-PART:DURATION=0.05,URI=\"part%d.%d.ts\"\n", i/2, i%2)
+			}
+			if i%2 == 1 {
+				fmt.Fprintf(w, "#EXTINF:0.1,\nseg%d.ts\n", i/2)
+			}
+		}
+		fmt.Fprintf(w, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part%d.%d.ts\"\n", n/2, n%2)
+	case strings.HasPrefix(r.URL.Path, "/part"):
+		fmt.Sscanf(r.URL.Path, "/part%d.%d.ts", &msn, &part)
+		if u.produced() <= 2*msn+part {
+			u.earlyHints.Add(1)
+		}
+		u.waitFor(r.Context(), 2*msn+part)
+		fmt.Fprintf(w, "%d.%d;", msn, part)
+	default:
+		fmt.Sscanf(r.URL.Path, "/seg%d.ts", &msn)
+		fmt.Fprintf(w, "%d.0;%d.1;", msn, msn)
+	}
+}
+
+func TestHLSStream_LowLatency(t *testing.T) {
+	for _, blocking := range []bool{true, false} {
+		t.Run(fmt.Sprintf("blocking=%v", blocking), func(t *testing.T) {
+			u := &llUpstream{start: time.Now(), partDur: 50 * time.Millisecond, blocking: blocking}
+			srv := httptest.NewServer(u)
+			defer srv.Close()
+			extractFn := func(context.Context, *stream.ExtractResult) (*stream.ExtractResult, error) {
+				return &stream.ExtractResult{URL: srv.URL + "/index.m3u8"}, nil
+			}
+			s := NewHLSStream(extractFn, srv.Client())
+			defer s.Close()
+
+			// Expect consecutive parts from the segment in progress on.
+			var got []string
+			buf := make([]byte, 64)
+			var pending string
+			for len(got) < 10 {
+				n, err := s.Read(buf)
+				if err != nil {
+					t.Fatalf("Read: %v", err)
+				}
+				pending += string(buf[:n])
+				for {
+					tok, rest, ok := strings.Cut(pending, ";")
+					if !ok {
+						break
+					}
+					got, pending = append(got, tok), rest
+				}
+			}
+			if got[0] != "2.0" {
+				t.Errorf("stream starts at %s, want 2.0", got[0])
+			}
+			for i := 1; i < len(got); i++ {
+				var m, p, pm, pp int
+				fmt.Sscanf(got[i], "%d.%d", &m, &p)
+				fmt.Sscanf(got[i-1], "%d.%d", &pm, &pp)
+				if 2*m+p != 2*pm+pp+1 {
+					t.Fatalf("stream = %v, want consecutive parts", got)
+				}
+			}
+			if u.earlyHints.Load() == 0 {
+				t.Error("no preload hint was fetched ahead")
+			}
+			if n := u.blockingReloads.Load(); blocking != (n > 0) {
+				t.Errorf("blocking reloads = %d with CAN-BLOCK-RELOAD=%v", n, blocking)
+			}
+		})
+	}
+}
+
+func TestHLSStream_TwitchPrefetch(t *testing.T) {
+	var polls, early atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/index.m3u8" {
+			// Each poll lists two more segments and prefetches two.
+			n := int(polls.Add(1)) * 2
+			fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:%d\n", n)
+			for seq := n; seq < n+2; seq++ {
+				fmt.Fprintf(w, "#EXTINF:1.000,live\nseg%d.ts\n", seq)
+			}
+			fmt.Fprintf(w, "#EXT-X-TWITCH-PREFETCH:seg%d.ts\n#EXT-X-TWITCH-PREFETCH:seg%d.ts\n", n+2, n+3)
+			return
+		}
+		var seq int
+		fmt.Sscanf(r.URL.Path, "/seg%d.ts", &seq)
+		if seq >= 2*int(polls.Load())+2 {
+			early.Add(1)
+		}
+		fmt.Fprintf(w, "seg%d;", seq)
+	}))
+	defer srv.Close()
+	extractFn := func(context.Context, *stream.ExtractResult) (*stream.ExtractResult, error) {
+		return &stream.ExtractResult{URL: srv.URL + "/index.m3u8"}, nil
+	}
+	s := NewHLSStream(extractFn, srv.Client())
+	defer s.Close()
+
+	want := "seg2;seg3;seg4;seg5;seg6;seg7;"
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("stream = %q, want %q", got, want)
+	}
+	if early.Load() == 0 {
+		t.Error("no prefetch segment was fetched before it was listed")
+	}
+}
+
+func TestHLSStream_FMP4(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/master.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000000,CODECS=\"avc1.64001f,mp4a.40.2\"\nindex.m3u8\n")
+		case "/index.m3u8":
+			fmt.Fprint(w, `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:1
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:1.0,
+seg0.m4s
+#EXT-X-DISCONTINUITY
+#EXTINF:1.0,
+seg1.m4s
+#EXT-X-MAP:URI="init2.mp4"
+#EXTINF:1.0,
+seg2.m4s
+#EXTINF:1.0,
+seg3.m4s
+#EXT-X-ENDLIST
+`)
+		default:
+			fmt.Fprintf(w, "%s;", strings.TrimPrefix(r.URL.Path, "/"))
+		}
+	}))
+	defer srv.Close()
+	extractFn := func(context.Context, *stream.ExtractResult) (*stream.ExtractResult, error) {
+		return &stream.ExtractResult{URL: srv.URL + "/master.m3u8"}, nil
+	}
+	s := NewHLSStream(extractFn, srv.Client())
+	defer s.Close()
+
+	if ct, err := s.ContentType(); err != nil || ct != `video/mp4; codecs="avc1.64001f,mp4a.40.2"` {
+		t.Errorf("ContentType() = %q, %v, want video/mp4 with the variant's codecs", ct, err)
+	}
+	got, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	// The init segment comes first, again after the discontinuity and
+	// when the map changes.
+	if want := "init.mp4;seg0.m4s;init.mp4;seg1.m4s;init2.mp4;seg2.m4s;seg3.m4s;"; string(got) != want {
+		t.Errorf("stream = %q, want %q", got, want)
+	}
+}
+
+func TestHLSStream_Resync(t *testing.T) {
+	// The first playlist lists s0..s2, then expires; the one extracted
+	// next is the second playlist.
+	tests := []struct {
+		name   string
+		second string
+		want   string
+	}{
+		{
+			name:   "continues",
+			second: "#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:1,\ns1.ts?t=2\n#EXTINF:1,\ns2.ts?t=2\n#EXTINF:1,\ns3.ts?t=2\n#EXTINF:1,\ns4.ts?t=2\n",
+			want:   "s0;s1;s2;s3;s4;",
+		},
+		{
+			name:   "missed segments",
+			second: "#EXT-X-MEDIA-SEQUENCE:5\n#EXTINF:1,\ns5.ts\n#EXTINF:1,\ns6.ts\n",
+			want:   "s0;s1;s2;s5;s6;",
+		},
+		{
+			name:   "renumbered",
+			second: "#EXTINF:1,\nr0.ts\n#EXTINF:1,\nr1.ts\n#EXTINF:1,\nr2.ts\n#EXTINF:1,\nr3.ts\n#EXTINF:1,\nr4.ts\n",
+			want:   "s0;s1;s2;r2;r3;r4;",
+		},
+		{
+			name:   "jumped ahead",
+			second: "#EXT-X-MEDIA-SEQUENCE:100\n#EXTINF:1,\nj100.ts\n#EXTINF:1,\nj101.ts\n#EXTINF:1,\nj102.ts\n#EXTINF:1,\nj103.ts\n",
+			want:   "s0;s1;s2;j101;j102;j103;",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var firstPolls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/first.m3u8":
+					if firstPolls.Add(1) > 1 {
+						http.Error(w, "expired", http.StatusForbidden)
+						return
+					}
+					fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1,\ns0.ts\n#EXTINF:1,\ns1.ts\n#EXTINF:1,\ns2.ts\n")
+				case "/second.m3u8":
+					fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n"+tt.second+"#EXT-X-ENDLIST\n")
+				default:
+					fmt.Fprintf(w, "%s;", strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".ts"))
+				}
+			}))
+			defer srv.Close()
+			extractFn := func(_ context.Context, previous *stream.ExtractResult) (*stream.ExtractResult, error) {
+				if previous == nil {
+					return &stream.ExtractResult{URL: srv.URL + "/first.m3u8"}, nil
+				}
+				return &stream.ExtractResult{URL: srv.URL + "/second.m3u8"}, nil
+			}
+			s := NewHLSStream(extractFn, srv.Client(),
+				WithRetryPolicy(stream.RetryPolicy{InitialDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond, Multiplier: 1}))
+			defer s.Close()
+			got, err := io.ReadAll(s)
+			if err != nil {
+				t.Fatalf("ReadAll: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("stream = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTwitchAds(t *testing.T) {
+	body := `#EXTM3U
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-DATERANGE:ID="stitched-ad-1",CLASS="twitch-stitched-ad",START-DATE="2026-01-01T00:00:02.000Z",DURATION=4.000
+#EXT-X-PROGRAM-DATE-TIME:2026-01-01T00:00:00.000Z
+#EXTINF:2.000,live
+s0.ts
+#EXT-X-PROGRAM-DATE-TIME:2026-01-01T00:00:02.000Z
+#EXTINF:2.000,live
+s1.ts
+#EXT-X-PROGRAM-DATE-TIME:2026-01-01T00:00:04.000Z
+#EXTINF:2.000,Amazon|12345
+s2.ts
+#EXT-X-PROGRAM-DATE-TIME:2026-01-01T00:00:06.000Z
+#EXTINF:2.000,live
+s3.ts
+`
+	ranges := parseDateRanges([]byte(body))
+	if len(ranges) != 1 || ranges[0].ID != "stitched-ad-1" || ranges[0].End.Sub(ranges[0].Start) != 4*time.Second {
+		t.Fatalf("parseDateRanges() = %+v", ranges)
+	}
+	p, _, err := m3u8.DecodeFrom(strings.NewReader(body), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []bool
+	for _, seg := range p.(*m3u8.MediaPlaylist).Segments {
+		if seg != nil {
+			got = append(got, TwitchAds(seg, ranges))
+		}
+	}
+	if want := []bool{false, true, true, false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("TwitchAds() = %v, want %v", got, want)
+	}
+}
+
+func TestHLSStream_Ads(t *testing.T) {
+	// The main playlist breaks for ads after s0, then lists s3 and s4
+	// once polled again. The alternate playlist has no ads.
+	tests := []struct {
+		name      string
+		strategy  AdStrategy
+		alternate bool
+		want      string
+	}{
+		{name: "passthrough", strategy: AdsPassthrough, want: "s0;a1;a2;s3;s4;"},
+		{name: "skip", strategy: AdsSkip, want: "s0;s3;s4;"},
+		{name: "switch", strategy: AdsSwitch, alternate: true, want: "s0;e1;e2;s3;s4;"},
+		{name: "switch without alternate", strategy: AdsSwitch, want: "s0;s3;s4;"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mainPolls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/main.m3u8":
+					if mainPolls.Add(1) == 1 {
+						fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1,live\ns0.ts\n#EXTINF:1,Amazon|1\na1.ts\n#EXTINF:1,Amazon|1\na2.ts\n")
+						return
+					}
+					fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:3\n#EXTINF:1,live\ns3.ts\n#EXTINF:1,live\ns4.ts\n#EXT-X-ENDLIST\n")
+				case "/embed.m3u8":
+					fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:1,live\ne1.ts\n#EXTINF:1,live\ne2.ts\n")
+				default:
+					fmt.Fprintf(w, "%s;", strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".ts"))
+				}
+			}))
+			defer srv.Close()
+			extractFn := func(context.Context, *stream.ExtractResult) (*stream.ExtractResult, error) {
+				return &stream.ExtractResult{URL: srv.URL + "/main.m3u8"}, nil
+			}
+			policy := AdPolicy{Detect: TwitchAds, Strategy: tt.strategy, Hold: 100 * time.Millisecond}
+			if tt.alternate {
+				policy.Alternate = func(context.Context, *stream.ExtractResult) (*stream.ExtractResult, error) {
+					return &stream.ExtractResult{URL: srv.URL + "/embed.m3u8"}, nil
+				}
+			}
+			s := NewHLSStream(extractFn, srv.Client(), WithAds(policy))
+			defer s.Close()
+			got, err := io.ReadAll(s)
+			if err != nil {
+				t.Fatalf("ReadAll: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("stream = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// escapeNALU adds emulation prevention bytes to a NAL unit.
+func escapeNALU(b []byte) []byte {
+	var out []byte
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+func TestSampleAESDecrypter(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := bytes.Repeat([]byte{0x3C}, aes.BlockSize)
+	block, _ := aes.NewCipher(key)
+
+	// A slice of 32 clear bytes, then one encrypted block in ten; the
+	// tail under a block stays clear.
+	slice := []byte{0x65}
+	for i := 1; i < 32+16+144+16+7; i++ {
+		slice = append(slice, byte(i%250+1))
+	}
+	encSlice := bytes.Clone(slice)
+	enc := cipher.NewCBCEncrypter(block, iv)
+	for p := 32; len(encSlice)-p > aes.BlockSize; p += 10 * aes.BlockSize {
+		enc.CryptBlocks(encSlice[p:p+aes.BlockSize], encSlice[p:p+aes.BlockSize])
+	}
+	sps := []byte{0x67, 0x64, 0x00, 0x1F}
+	au := append(append([]byte{0, 0, 0, 1}, sps...), append([]byte{0, 0, 0, 1}, slice...)...)
+	encAU := append(append([]byte{0, 0, 0, 1}, sps...), append([]byte{0, 0, 0, 1}, escapeNALU(encSlice)...)...)
+
+	// An AAC frame: 16 clear bytes after the header, then whole blocks.
+	payload := bytes.Repeat([]byte{0x5A}, 16+2*aes.BlockSize+5)
+	n := len(payload) + 7
+	frame := append([]byte{0xFF, 0xF1, 0x50, 0x80, byte(n >> 3), byte(n&7)<<5 | 0x1F, 0xFC}, payload...)
+	encFrame := bytes.Clone(frame)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encFrame[7+16:7+16+2*aes.BlockSize], encFrame[7+16:7+16+2*aes.BlockSize])
+
+	var in bytes.Buffer
+	m := mpegts.NewMuxer(&in)
+	m.SetStream(mpegts.PIDVideo, 0xDB)
+	m.SetStream(mpegts.PIDAudio, 0xCF)
+	if err := m.WritePES(mpegts.PIDVideo, 180000, 180000, true, encAU); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WritePES(mpegts.PIDAudio, 180000, 180000, true, encFrame); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := newSampleAESDecrypter().decrypt(in.Bytes(), key, iv)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	var frames []mpegts.Frame
+	d := mpegts.NewDemuxer(func(f mpegts.Frame) error {
+		f.Data = bytes.Clone(f.Data)
+		frames = append(frames, f)
+		return nil
+	})
+	d.Write(out)
+	d.Flush()
+	if len(frames) != 2 {
+		t.Fatalf("got %d frames, want 2", len(frames))
+	}
+	for _, f := range frames {
+		want, wantType := frame, mpegts.StreamTypeAAC
+		if f.PID == mpegts.PIDVideo {
+			want, wantType = au, mpegts.StreamTypeH264
+		}
+		if f.StreamType != wantType {
+			t.Errorf("PID 0x%x stream type = 0x%x, want 0x%x", f.PID, f.StreamType, wantType)
+		}
+		if !bytes.Equal(f.Data, want) {
+			t.Errorf("PID 0x%x data = % x, want % x", f.PID, f.Data, want)
+		}
+	}
+}
+
+// testUpstream is an HLS server with a master playlist and a live media
+// playlist of one-second segments. URLs carry a token; only the current one
+// is accepted.
+type testUpstream struct {
+	token atomic.Int32 // current token
+	first atomic.Int32 // first listed segment
+}
+
+func (u *testUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var token int32
+	var file string
+	if _, err := fmt.Sscanf(r.URL.Path, "/t%d/%s", &token, &file); err != nil || token != u.token.Load() {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	switch {
+	case file == "master.m3u8":
+		fmt.Fprint(w, `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="en",DEFAULT=YES,URI="audio.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720,AUDIO="aud"
+hi.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=500000,RESOLUTION=640x360,AUDIO="aud"
+lo.m3u8
+`)
+	case strings.HasSuffix(file, ".m3u8"):
+		first := u.first.Load()
+		fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+		for n := first; n < first+5; n++ {
+			fmt.Fprintf(w, "#EXTINF:1.0,\nseg%d.ts\n", n)
+		}
+	default:
+		fmt.Fprint(w, strings.TrimSuffix(file, ".ts"))
+	}
+}
+
+// waitFile polls f until its content contains want.
+func waitFile(t *testing.T, p *Publisher, file, want string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		data, _, err := p.File(ctx, file)
+		cancel()
+		if err == nil && strings.Contains(string(data), want) {
+			return string(data)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("File(%q) = %q, %v; want it to contain %q", file, data, err, want)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestPublisher(t *testing.T) {
+	up := &testUpstream{}
+	up.first.Store(10)
+	srv := httptest.NewServer(up)
+	defer srv.Close()
+
+	var extractions atomic.Int32
+	extractFn := func(ctx context.Context, previous *stream.ExtractResult) (*stream.ExtractResult, error) {
+		extractions.Add(1)
+		return &stream.ExtractResult{URL: fmt.Sprintf("%s/t%d/master.m3u8", srv.URL, up.token.Load())}, nil
+	}
+	p := NewPublisher(extractFn, srv.Client(),
+		WithRetryPolicy(stream.RetryPolicy{InitialDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond, Multiplier: 1}))
+	defer p.Close()
+	ctx := context.Background()
+
+	master, contentType, err := p.File(ctx, "index.m3u8")
+	if err != nil {
+		t.Fatalf("File(index.m3u8) error = %v", err)
+	}
+	if contentType != ContentTypePlaylist {
+		t.Errorf("content type = %s", contentType)
+	}
+	for _, want := range []string{"BANDWIDTH=2000000,RESOLUTION=1280x720", "\nv0.m3u8\n", "\nv1.m3u8\n", `URI="r0.m3u8"`} {
+		if !strings.Contains(string(master), want) {
+			t.Errorf("master playlist lacks %q:\n%s", want, master)
+		}
+	}
+
+	// Polling starts three segments from the live edge.
+	waitFile(t, p, "v0.m3u8", "v0-2.ts")
+	if data, contentType, err := p.File(ctx, "v0-0.ts"); string(data) != "seg12" || contentType != "video/mp2t" || err != nil {
+		t.Errorf("File(v0-0.ts) = %q, %s, %v, want seg12", data, contentType, err)
+	}
+
+	up.first.Add(1)
+	waitFile(t, p, "v0.m3u8", "v0-3.ts")
+	if data, _, _ := p.File(ctx, "v0-3.ts"); string(data) != "seg15" {
+		t.Errorf("File(v0-3.ts) = %q, want seg15", data)
+	}
+
+	// An expired token is re-extracted server-side, and polling goes on
+	// where it was.
+	up.token.Add(1)
+	up.first.Add(1)
+	playlist := waitFile(t, p, "v0.m3u8", "v0-4.ts")
+	if data, _, _ := p.File(ctx, "v0-4.ts"); string(data) != "seg16" {
+		t.Errorf("File(v0-4.ts) = %q, want seg16", data)
+	}
+	if strings.Contains(playlist, "DISCONTINUITY") {
+		t.Errorf("playlist has a discontinuity after re-extraction:\n%s", playlist)
+	}
+	if n := extractions.Load(); n != 2 {
+		t.Errorf("%d extractions, want 2", n)
+	}
+
+	for _, file := range []string{"v9.m3u8", "v0-99.ts", "v0-1.m4s", "x-1.ts", "v0-init1.mp4"} {
+		if _, _, err := p.File(ctx, file); !errors.Is(err, ErrNotFound) {
+			t.Errorf("File(%q) error = %v, want ErrNotFound", file, err)
+		}
+	}
+
+	p.Close()
+	waitFile(t, p, "v0.m3u8", "#EXT-X-ENDLIST")
+}
+
+func TestFeedPublisher(t *testing.T) {
+	next := make(chan struct{})
+	p := NewFeedPublisher(context.Background(), func(ctx context.Context, w *Window) error {
+		w.SetInit([]byte("init"))
+		w.Append(2, ".m4s", []byte("seg0"))
+		<-next
+		w.Append(1.5, ".m4s", []byte("seg1"))
+		return nil
+	})
+	ctx := context.Background()
+
+	pl := waitFile(t, p, "index.m3u8", "v0-0.m4s")
+	if !strings.Contains(pl, `#EXT-X-MAP:URI="v0-init1.mp4"`) {
+		t.Errorf("playlist lacks the init section:\n%s", pl)
+	}
+	if data, _, err := p.File(ctx, "v0-init1.mp4"); err != nil || string(data) != "init" {
+		t.Errorf("File(v0-init1.mp4) = %q, %v", data, err)
+	}
+	if data, contentType, err := p.File(ctx, "v0-0.m4s"); err != nil || string(data) != "seg0" || contentType != "video/mp4" {
+		t.Errorf("File(v0-0.m4s) = %q, %s, %v", data, contentType, err)
+	}
+	if _, _, err := p.File(ctx, "v1.m3u8"); err != ErrNotFound {
+		t.Errorf("File(v1.m3u8) error = %v, want ErrNotFound", err)
+	}
+
+	// The playlist ends with the feed.
+	close(next)
+	select {
+	case <-p.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("publisher not closed after the feed ended")
+	}
+	if pl := waitFile(t, p, "v0.m3u8", "#EXT-X-ENDLIST"); !strings.Contains(pl, "v0-1.m4s") {
+		t.Errorf("playlist lacks the last segment:\n%s", pl)
+	}
+}
+
+func TestPublisherSet(t *testing.T) {
+	defer func(d time.Duration) { PublisherIdleTimeout = d }(PublisherIdleTimeout)
+	PublisherIdleTimeout = 50 * time.Millisecond
+
+	s := NewPublisherSet()
+	defer s.Close()
+	var opens atomic.Int32
+	open := func(ctx context.Context) (*Publisher, error) {
+		opens.Add(1)
+		// Extraction never finishes: the publisher ends only when idle.
+		extractFn := func(ctx context.Context, _ *stream.ExtractResult) (*stream.ExtractResult, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return NewPublisher(extractFn, http.DefaultClient, WithContext(ctx)), nil
+	}
+	p1, err := s.Get(context.Background(), "k", open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, _ := s.Get(context.Background(), "k", open)
+	if p1 != p2 || opens.Load() != 1 {
+		t.Errorf("second Get opened another publisher")
+	}
+
+	select {
+	case <-p1.Done():
+	case <-time.After(time.Second):
+		t.Fatal("idle publisher not closed")
+	}
+	if p3, _ := s.Get(context.Background(), "k", open); p3 == p1 || opens.Load() != 2 {
+		t.Errorf("Get after the idle timeout returned the closed publisher")
+	}
+
+	failing := func(context.Context) (*Publisher, error) { return nil, errors.New("no stream") }
+	if _, err := s.Get(context.Background(), "other", failing); err == nil {
+		t.Error("Get() with a failing open succeeded")
+	}
+}
@@ -1,12 +1,12 @@
 package hls
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"net/url"
-	"strings"
 	"sync"
 	"time"
 
@@ -15,35 +15,192 @@ import (
 	"github.com/nv4d1k/live-stream-forwarder/global"
 )
 
-// HLSStream continuously fetches an HLS playlist, downloads segments in order,
-// and pipes raw MPEG-TS data to the client via a Pipe. Each client gets its
-// own HLSStream with independent upstream connections.
+// HLSStream continuously fetches an HLS playlist, downloads segments a few
+// at a time, and pipes them in order as raw MPEG-TS or fragmented MP4 data
+// to the client via a Pipe. Fragmented MP4 is preceded by its init segment,
+// which is sent again when it changes and after a discontinuity.
 type HLSStream struct {
-	pipe      *stream.Pipe
-	done      chan struct{}
-	closeErr  error
-	closeOnce sync.Once
-	hc        *http.Client
-	extractFn stream.ExtractFunc
-
-	// refreshCh signals the produce loop to re-extract before the URL expires.
+	pipe        *stream.Pipe
+	done        chan struct{}
+	typed       chan struct{} // closed once contentType is known
+	contentType string
+	closeErr    error
+	closeOnce   sync.Once
+	hc          *http.Client
+	extractFn   stream.ExtractFunc
+	platform    string // from the latest extraction, for error reporting
+
+	// refreshCh signals the follower to re-extract before the URL expires.
 	refreshCh chan struct{}
+
+	retry        stream.RetryPolicy
+	bufferSize   int
+	bufferPolicy stream.OverflowPolicy
+	timeouts     stream.Timeouts
+	health       *stream.HostHealth
+	offline      stream.OfflinePolicy
+	prefetch     int
+	lowLatency   bool
+	ads          AdPolicy
+	quality      Quality
+
+	parent     context.Context
+	ctx        context.Context // canceled when the stream ends
+	cancel     context.CancelFunc
+	stopParent func() bool
+}
+
+// HLSStreamOption configures an HLSStream during creation.
+type HLSStreamOption func(*HLSStream)
+
+// WithBuffer sets the size and overflow policy of the stream's pipe. The
+// default is stream.DefaultBufferSize with stream.OverflowBlock, which
+// delays segment downloads until the consumer catches up.
+func WithBuffer(size int, policy stream.OverflowPolicy) HLSStreamOption {
+	return func(s *HLSStream) {
+		s.bufferSize = size
+		s.bufferPolicy = policy
+	}
+}
+
+// WithRetryPolicy overrides stream.DefaultRetryPolicy for the playlist and
+// segment retry loop.
+func WithRetryPolicy(p stream.RetryPolicy) HLSStreamOption {
+	return func(s *HLSStream) { s.retry = p }
+}
+
+// WithContext sets the parent context of the stream. Canceling it closes the
+// stream and aborts any in-flight extraction, playlist or segment request.
+func WithContext(ctx context.Context) HLSStreamOption {
+	return func(s *HLSStream) { s.parent = ctx }
+}
+
+// WithTimeouts overrides stream.DefaultTimeouts. The fetch timeout bounds
+// each playlist request and the time to a segment's response headers. The
+// stall timeout bounds both a silent segment download and a live playlist
+// that stops advancing; for the latter it is raised to three target
+// durations if that is longer.
+func WithTimeouts(t stream.Timeouts) HLSStreamOption {
+	return func(s *HLSStream) { s.timeouts = t }
+}
+
+// WithHostHealth overrides stream.DefaultHealth, which orders candidate
+// playlist URLs and records failing hosts.
+func WithHostHealth(h *stream.HostHealth) HLSStreamOption {
+	return func(s *HLSStream) { s.health = h }
 }
 
-func NewHLSStream(extractFn stream.ExtractFunc, hc *http.Client) *HLSStream {
+// WithOfflinePolicy overrides stream.DefaultOfflinePolicy. HLS has no
+// placeholder support; OfflinePlaceholder behaves like OfflineWait.
+func WithOfflinePolicy(p stream.OfflinePolicy) HLSStreamOption {
+	return func(s *HLSStream) { s.offline = p }
+}
+
+// WithPrefetch sets how many segments are downloaded at the same time,
+// ahead of the one being piped; 1 downloads them one by one. Values below 1
+// keep DefaultPrefetch.
+func WithPrefetch(n int) HLSStreamOption {
+	return func(s *HLSStream) {
+		if n > 0 {
+			s.prefetch = n
+		}
+	}
+}
+
+// WithLowLatency turns the following of low-latency playlists on or off.
+// When on, a playlist advertising partial segments is followed part by part,
+// preload hints are fetched ahead and, if the server can block reloads, the
+// playlist is reloaded with _HLS_msn/_HLS_part instead of polled. Twitch's
+// prefetch segments are fetched as soon as they are listed. Playlists
+// without these tags are followed as before. The default is
+// DefaultLowLatency.
+func WithLowLatency(enabled bool) HLSStreamOption {
+	return func(s *HLSStream) { s.lowLatency = enabled }
+}
+
+// DefaultLowLatency is whether HLSStreams follow low-latency playlists
+// unless overridden with WithLowLatency.
+var DefaultLowLatency = true
+
+// DefaultStallTimeout replaces stream.DefaultTimeouts.Stall for HLS, whose
+// playlists legitimately go quiet for a few target durations.
+var DefaultStallTimeout = 30 * time.Second
+
+func NewHLSStream(extractFn stream.ExtractFunc, hc *http.Client, opts ...HLSStreamOption) *HLSStream {
 	log := global.Log.WithField("func", "app.engine.forwarder.hls.NewHLSStream")
 	log.Debug("creating HLSStream")
+	s := newHLSStream(extractFn, hc, opts)
+	s.pipe = stream.NewBoundedPipe(s.bufferSize, s.bufferPolicy)
+	s.ctx, s.cancel = context.WithCancel(s.parent)
+	s.stopParent = context.AfterFunc(s.parent, func() { s.Close() })
+	go s.produce()
+	return s
+}
+
+// newHLSStream returns an HLSStream with the defaults and opts applied, but
+// not started.
+func newHLSStream(extractFn stream.ExtractFunc, hc *http.Client, opts []HLSStreamOption) *HLSStream {
 	s := &HLSStream{
-		pipe:      stream.NewPipe(),
-		done:      make(chan struct{}),
-		hc:        hc,
-		extractFn: extractFn,
-		refreshCh: make(chan struct{}, 1),
+		done:         make(chan struct{}),
+		typed:        make(chan struct{}),
+		hc:           hc,
+		extractFn:    extractFn,
+		refreshCh:    make(chan struct{}, 1),
+		retry:        stream.DefaultRetryPolicy,
+		bufferSize:   stream.DefaultBufferSize,
+		bufferPolicy: stream.OverflowBlock,
+		timeouts:     stream.DefaultTimeouts,
+		health:       stream.DefaultHealth,
+		offline:      stream.DefaultOfflinePolicy,
+		prefetch:     DefaultPrefetch,
+		lowLatency:   DefaultLowLatency,
+		parent:       context.Background(),
+	}
+	s.timeouts.Stall = DefaultStallTimeout
+	for _, opt := range opts {
+		opt(s)
 	}
-	go s.produce()
 	return s
 }
 
+// ContentType returns the MIME type of the stream: video/mp4, with the
+// variant's codecs if the master playlist lists them, for fragmented MP4
+// playlists (those with an EXT-X-MAP), video/mp2t otherwise. It waits for
+// the first media playlist, or until the stream ends.
+func (s *HLSStream) ContentType() (string, error) {
+	select {
+	case <-s.typed:
+		return s.contentType, nil
+	case <-s.done:
+	}
+	select {
+	case <-s.typed:
+		return s.contentType, nil
+	default:
+	}
+	if s.closeErr != nil {
+		return "", s.closeErr
+	}
+	return "", io.ErrClosedPipe
+}
+
+// setContentType sets the content type from the first media playlist.
+func (s *HLSStream) setContentType(mediapl *libm3u8.MediaPlaylist, codecs string) {
+	select {
+	case <-s.typed:
+		return
+	default:
+	}
+	s.contentType = "video/mp2t"
+	if mediapl.Map != nil {
+		s.contentType = "video/mp4"
+		if codecs != "" {
+			s.contentType += `; codecs="` + codecs + `"`
+		}
+	}
+	close(s.typed)
+}
+
 func (s *HLSStream) Read(p []byte) (int, error) {
 	return s.pipe.Read(p)
 }
@@ -51,11 +208,20 @@ func (s *HLSStream) Read(p []byte) (int, error) {
 func (s *HLSStream) Close() error {
 	log := global.Log.WithField("func", "app.engine.forwarder.hls.HLSStream.Close")
 	log.Debug("closing HLSStream")
+	s.pipe.BreakWithError(io.ErrClosedPipe)
+	s.finish(nil)
+	return nil
+}
+
+// finish marks the stream as done and releases its context. err is the
+// reason Wait reports; only the first call to finish records one.
+func (s *HLSStream) finish(err error) {
 	s.closeOnce.Do(func() {
-		s.pipe.BreakWithError(io.ErrClosedPipe)
+		s.closeErr = err
+		s.stopParent()
+		s.cancel()
 		close(s.done)
 	})
-	return nil
 }
 
 func (s *HLSStream) Wait() error {
@@ -66,256 +232,107 @@ func (s *HLSStream) Wait() error {
 func (s *HLSStream) closeWithError(err error) {
 	log := global.Log.WithField("func", "app.engine.forwarder.hls.HLSStream.closeWithError")
 	log.Warnf("closing HLSStream with error: %s", err.Error())
-	s.closeErr = err
 	s.pipe.CloseWithError(err)
-	s.closeOnce.Do(func() {
-		close(s.done)
-	})
+	s.finish(err)
 }
 
-func (s *HLSStream) produce() {
-	log := global.Log.WithField("func", "app.engine.forwarder.hls.HLSStream.produce")
-
-	var previous *stream.ExtractResult
-	var mediaPlaylistURL string
-	var currentHeaders http.Header
-	var currentVariantSelector func([]*libm3u8.Variant) *libm3u8.Variant
-	var lastSeqID uint64
-	var hasLastSeqID bool
-	var initSegmentFetched bool
-
-	// scheduleRefresh sets a timer to trigger re-extraction before the URL expires.
-	var refreshTimer *time.Timer
-	scheduleRefresh := func(expireAt *time.Time) {
-		if refreshTimer != nil {
-			refreshTimer.Stop()
-			refreshTimer = nil
-		}
-		if expireAt == nil {
-			return
-		}
-		// Refresh 60 seconds before expiry, but no less than 5 seconds from now.
-		leadTime := 60 * time.Second
-		remaining := time.Until(*expireAt)
-		if remaining <= leadTime+5*time.Second {
-			leadTime = remaining - 5*time.Second
-			if leadTime < 0 {
-				leadTime = 0
-			}
-		}
-		when := remaining - leadTime
-		if when < 0 {
-			when = 0
-		}
-		log.Debugf("scheduling token refresh in %s (expires at %s)", when, expireAt.Format(time.RFC3339))
-		refreshTimer = time.AfterFunc(when, func() {
-			select {
-			case s.refreshCh <- struct{}{}:
-			default:
-			}
-		})
-	}
-	defer func() {
-		if refreshTimer != nil {
-			refreshTimer.Stop()
-		}
-	}()
-
-	for {
-		// Check if client disconnected.
-		if s.pipe.Err() != nil {
-			return
-		}
-
-		// Extract phase: get the initial m3u8 URL.
-		if mediaPlaylistURL == "" {
-			result, err := s.extractFn(previous)
-			if err != nil {
-				log.Warnf("extract error: %s", err.Error())
-				time.Sleep(2 * time.Second)
-				continue
-			}
-			previous = result
-			mediaPlaylistURL = result.URL
-			currentHeaders = result.Headers
-			if sel, ok := result.VariantSelector.(func([]*libm3u8.Variant) *libm3u8.Variant); ok {
-				currentVariantSelector = sel
-			} else {
-				currentVariantSelector = nil
-			}
-			hasLastSeqID = false
-			initSegmentFetched = false
-			scheduleRefresh(result.ExpireAt)
-			continue
-		}
-
-		// Poll phase: fetch and parse the playlist.
-		playlist, listType, err := fetchAndParseM3U8(s.hc, mediaPlaylistURL, currentHeaders)
-		if err != nil {
-			if isExpiredHLS(err) {
-				log.Warnf("playlist fetch 403, re-extracting: %s", err.Error())
-				mediaPlaylistURL = ""
-				continue
-			}
-			if isTransientHLS(err) {
-				log.Warnf("playlist fetch transient error, retrying: %s", err.Error())
-				time.Sleep(2 * time.Second)
-				continue
-			}
-			log.Errorf("playlist fetch error: %s", err.Error())
-			s.closeWithError(err)
-			return
-		}
-
-		switch listType {
-		case libm3u8.MASTER:
-			masterpl := playlist.(*libm3u8.MasterPlaylist)
-			if len(masterpl.Variants) == 0 {
-				log.Warnln("master playlist has no variants, re-extracting")
-				mediaPlaylistURL = ""
-				continue
-			}
-			var variant *libm3u8.Variant
-			if currentVariantSelector != nil {
-				variant = currentVariantSelector(masterpl.Variants)
-			} else {
-				variant = pickHighestBandwidthVariant(masterpl.Variants)
-			}
-			resolved := resolveURL(mediaPlaylistURL, variant.URI)
-			mediaPlaylistURL = resolved
-			continue // Re-fetch as media playlist.
-
-		case libm3u8.MEDIA:
-			mediapl := playlist.(*libm3u8.MediaPlaylist)
-
-			// Fetch init segment (#EXT-X-MAP) if present.
-			if mediapl.Map != nil && mediapl.Map.URI != "" && !initSegmentFetched {
-				segURL := resolveURL(mediaPlaylistURL, mediapl.Map.URI)
-				if err := s.fetchAndPipeSegment(segURL, currentHeaders); err != nil {
-					if isExpiredHLS(err) {
-						log.Warnf("init segment fetch 403, re-extracting: %s", err.Error())
-						mediaPlaylistURL = ""
-						continue
-					}
-					if isTransientHLS(err) {
-						log.Warnf("init segment fetch transient error, retrying: %s", err.Error())
-						time.Sleep(2 * time.Second)
-						continue
-					}
-					s.closeWithError(err)
-					return
-				}
-				initSegmentFetched = true
-			}
-
-			// Download new segments in order.
-			for _, seg := range mediapl.Segments {
-				if seg == nil {
-					continue
-				}
-				if hasLastSeqID && seg.SeqId <= lastSeqID {
-					continue
-				}
-
-				segURL := resolveURL(mediaPlaylistURL, seg.URI)
-				if err := s.fetchAndPipeSegment(segURL, currentHeaders); err != nil {
-					if isExpiredHLS(err) {
-						log.Warnf("segment fetch 403, re-extracting: %s", err.Error())
-						mediaPlaylistURL = ""
-						break
-					}
-					if isTransientHLS(err) {
-						log.Warnf("segment fetch transient error, skipping: %s", err.Error())
-						time.Sleep(1 * time.Second)
-						continue
-					}
-					s.closeWithError(err)
-					return
-				}
-
-				lastSeqID = seg.SeqId
-				hasLastSeqID = true
-
-				if s.pipe.Err() != nil {
-					return
-				}
-			}
-
-			// VOD ended.
-			if mediapl.Closed {
-				s.closeWithError(io.EOF)
-				return
-			}
-
-		default:
-			log.Warnf("unknown playlist type: %d, re-extracting", listType)
-			mediaPlaylistURL = ""
-			continue
-		}
-
-		if mediaPlaylistURL == "" {
-			// Reset happened during segment loop; re-extract.
-			continue
-		}
-
-		// Sleep before next poll, but wake early if token needs refreshing.
-		targetDur := 3 * time.Second
-		if ml, ok := playlist.(*libm3u8.MediaPlaylist); ok && ml.TargetDuration > 0 {
-			targetDur = time.Duration(ml.TargetDuration) * time.Second
-		}
-		if targetDur < time.Second {
-			targetDur = time.Second
-		}
-
-		select {
-		case <-s.refreshCh:
-			log.Infoln("token refresh triggered, re-extracting")
-			mediaPlaylistURL = ""
-		case <-time.After(targetDur):
-		}
+// giveUp ends the stream after the retry budget is spent. The consumer sees
+// a clean end-of-stream; Wait reports the reason.
+func (s *HLSStream) giveUp(err error) {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.HLSStream.giveUp")
+	log.Warnf("giving up on HLSStream: %s", err.Error())
+	s.pipe.CloseWithError(io.EOF)
+	s.finish(err)
+}
 
-		if s.pipe.Err() != nil {
-			return
-		}
-	}
+// produce follows the upstream playlists and pipes their segments until the
+// stream ends.
+func (s *HLSStream) produce() {
+	newFollower(s).run()
 }
 
-func (s *HLSStream) fetchAndPipeSegment(segURL string, headers http.Header) error {
-	log := global.Log.WithField("func", "app.engine.forwarder.hls.HLSStream.fetchAndPipeSegment")
-	resp, err := doRequestWithHeaders(s.hc, "GET", segURL, headers)
+// fetchSegment downloads a segment into w. The fetch timeout bounds the time
+// to the response headers, the stall timeout a silent download.
+func fetchSegment(ctx context.Context, hc *http.Client, w io.Writer, segURL string, headers http.Header, timeouts stream.Timeouts, platform string) error {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.fetchSegment")
+	ctx, stopTimer, cancel := stream.WithPhaseTimeout(ctx, timeouts.Fetch)
+	defer cancel()
+	resp, err := doRequestWithHeaders(ctx, hc, "GET", segURL, headers)
+	if !stopTimer() && err == nil {
+		resp.Body.Close()
+		err = context.DeadlineExceeded
+	}
 	if err != nil {
+		if stream.PhaseTimedOut(ctx) {
+			err = fmt.Errorf("no response after %s: %w", timeouts.Fetch, context.DeadlineExceeded)
+		}
 		log.Warnf("fetch segment error: %s", err.Error())
-		return fmt.Errorf("fetch segment error: %w", err)
+		return stream.WrapError(platform, stream.PhaseFetch, segURL, fmt.Errorf("fetch segment error: %w", err))
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		log.Warnf("fetch segment got status: %s", resp.Status)
-		return fmt.Errorf("fetch segment err got: %s", resp.Status)
+		return stream.StatusError(platform, stream.PhaseFetch, segURL, resp)
+	}
+	// A stalled download is cut off by canceling its request.
+	watchdog := stream.NewWatchdog(timeouts.Stall, cancel)
+	_, err = io.Copy(w, stream.WatchReader(resp.Body, watchdog))
+	watchdog.Disarm()
+	if watchdog.Stalled() {
+		log.WithField("event", "stall").Warnf("no data from segment for %s, skipping", timeouts.Stall)
 	}
-	_, err = io.Copy(s.pipe, resp.Body)
 	if err != nil {
-		log.Warnf("pipe segment data error: %s", err.Error())
+		log.Warnf("copy segment data error: %s", err.Error())
+		return stream.WrapError(platform, stream.PhaseCopy, segURL, err)
+	}
+	return nil
+}
+
+// stallWindow returns how long a live media playlist may go without a new
+// segment before it is considered stalled, or 0 if stall detection is off.
+func stallWindow(stall time.Duration, mediapl *libm3u8.MediaPlaylist) time.Duration {
+	if stall <= 0 {
+		return 0
+	}
+	window := 3 * time.Duration(mediapl.TargetDuration) * time.Second
+	if window < stall {
+		window = stall
 	}
-	return err
+	return window
 }
 
-func fetchAndParseM3U8(hc *http.Client, m3u8URL string, headers http.Header) (libm3u8.Playlist, libm3u8.ListType, error) {
-	log := global.Log.WithField("func", "app.engine.forwarder.hls.fetchAndParseM3U8")
-	resp, err := doRequestWithHeaders(hc, "GET", m3u8URL, headers)
+func fetchAndParseM3U8(ctx context.Context, hc *http.Client, m3u8URL string, headers http.Header) (libm3u8.Playlist, libm3u8.ListType, error) {
+	playlist, listType, _, err := fetchPlaylist(ctx, hc, m3u8URL, headers)
+	return playlist, listType, err
+}
+
+// fetchPlaylist is fetchAndParseM3U8 that also returns the playlist as
+// fetched, for the tags grafov/m3u8 does not parse.
+func fetchPlaylist(ctx context.Context, hc *http.Client, m3u8URL string, headers http.Header) (libm3u8.Playlist, libm3u8.ListType, []byte, error) {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.fetchPlaylist")
+	resp, err := doRequestWithHeaders(ctx, hc, "GET", m3u8URL, headers)
 	if err != nil {
 		log.Warnf("get m3u8 file error: %s", err.Error())
-		return nil, 0, fmt.Errorf("get m3u8 file error: %w", err)
+		return nil, 0, nil, stream.WrapError("", stream.PhaseFetch, m3u8URL, fmt.Errorf("get m3u8 file error: %w", err))
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		log.Warnf("get m3u8 got status: %s", resp.Status)
-		return nil, 0, fmt.Errorf("get m3u8 err got: %s", resp.Status)
+		return nil, 0, nil, stream.StatusError("", stream.PhaseFetch, m3u8URL, resp)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, nil, stream.WrapError("", stream.PhaseCopy, m3u8URL, err)
+	}
+	playlist, listType, err := libm3u8.DecodeFrom(bytes.NewReader(body), true)
+	if err != nil {
+		return nil, 0, nil, stream.WrapError("", stream.PhaseCopy, m3u8URL, err)
 	}
-	return libm3u8.DecodeFrom(resp.Body, true)
+	return playlist, listType, body, nil
 }
 
-func doRequestWithHeaders(hc *http.Client, method, rawURL string, headers http.Header) (*http.Response, error) {
-	req, err := http.NewRequest(method, rawURL, nil)
+func doRequestWithHeaders(ctx context.Context, hc *http.Client, method, rawURL string, headers http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -337,32 +354,32 @@ func resolveURL(baseURL, refURL string) string {
 	return base.ResolveReference(ref).String()
 }
 
-// isExpiredHLS reports whether the error indicates the URL has expired (403),
-// requiring re-extraction to obtain a fresh URL.
-func isExpiredHLS(err error) bool {
-	if err == nil {
-		return false
+// stripQuery returns rawURL without its query string, which often carries a
+// token that changes on re-extraction.
+func stripQuery(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil {
+		u.RawQuery = ""
+		return u.String()
 	}
-	return strings.Contains(err.Error(), "403")
+	return rawURL
 }
 
-// isTransientHLS reports whether the error is a transient network issue
-// (EOF, connection reset, timeout) that can be retried with the same URL.
-func isTransientHLS(err error) bool {
-	if err == nil {
-		return false
-	}
-	msg := err.Error()
-	if strings.Contains(msg, "EOF") {
-		return true
-	}
-	if strings.Contains(msg, "connection reset") {
-		return true
-	}
-	if strings.Contains(msg, "temporary") {
+// isExpiredHLS reports whether the error indicates the URL is no longer
+// valid (expired token, or the stream moved away), requiring re-extraction
+// to obtain a fresh URL.
+func isExpiredHLS(err error) bool {
+	switch stream.Classify(err) {
+	case stream.ClassExpired, stream.ClassOffline:
 		return true
 	}
-	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+	return false
+}
+
+// isTransientHLS reports whether the error is a transient network or server
+// issue (reset, timeout, 5xx, 429) that can be retried with the same URL.
+func isTransientHLS(err error) bool {
+	switch stream.Classify(err) {
+	case stream.ClassTransient, stream.ClassRateLimited:
 		return true
 	}
 	return false
@@ -0,0 +1,146 @@
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// minPartPoll bounds how often a low-latency playlist without blocking
+// reloads is polled.
+const minPartPoll = 200 * time.Millisecond
+
+// lowLatency holds what a media playlist offers for low-latency playback,
+// which grafov/m3u8 does not parse: partial segments (EXT-X-PART), preload
+// hints, blocking reloads (EXT-X-SERVER-CONTROL) and Twitch's prefetch
+// segments.
+type lowLatency struct {
+	canBlockReload bool
+	partTarget     time.Duration
+	parts          []llPart
+	hint           *llPart  // the part announced by EXT-X-PRELOAD-HINT
+	prefetch       []string // EXT-X-TWITCH-PREFETCH URIs, the segments after the listed ones
+	nextMSN        uint64   // media sequence number of the segment after the listed ones
+	byteRange      bool     // parts or hints are byte ranges, which are not supported
+}
+
+// llPart is a partial segment: part index of segment msn.
+type llPart struct {
+	msn   uint64
+	index int
+	uri   string
+}
+
+// parseLowLatency scans a media playlist for its low-latency tags.
+func parseLowLatency(body []byte) *lowLatency {
+	ll := &lowLatency{}
+	var msn uint64
+	index := 0
+	sc := bufio.NewScanner(bytes.NewReader(body))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		tag, value, _ := strings.Cut(line, ":")
+		switch tag {
+		case "#EXT-X-MEDIA-SEQUENCE":
+			msn, _ = strconv.ParseUint(value, 10, 64)
+		case "#EXT-X-SERVER-CONTROL":
+			ll.canBlockReload = parseAttributes(value)["CAN-BLOCK-RELOAD"] == "YES"
+		case "#EXT-X-PART-INF":
+			if target, err := strconv.ParseFloat(parseAttributes(value)["PART-TARGET"], 64); err == nil {
+				ll.partTarget = time.Duration(target * float64(time.Second))
+			}
+		case "#EXT-X-PART":
+			attrs := parseAttributes(value)
+			if attrs["BYTERANGE"] != "" {
+				ll.byteRange = true
+			}
+			ll.parts = append(ll.parts, llPart{msn: msn, index: index, uri: attrs["URI"]})
+			index++
+		case "#EXT-X-PRELOAD-HINT":
+			attrs := parseAttributes(value)
+			if attrs["TYPE"] == "PART" {
+				if attrs["BYTERANGE-START"] != "" {
+					ll.byteRange = true
+				}
+				ll.hint = &llPart{msn: msn, index: index, uri: attrs["URI"]}
+			}
+		case "#EXT-X-TWITCH-PREFETCH":
+			ll.prefetch = append(ll.prefetch, value)
+		default:
+			if line != "" && !strings.HasPrefix(line, "#") {
+				msn++
+				index = 0
+			}
+		}
+	}
+	ll.nextMSN = msn
+	return ll
+}
+
+// partial reports whether the playlist can be followed part by part.
+func (ll *lowLatency) partial() bool {
+	return ll != nil && len(ll.parts) > 0 && !ll.byteRange
+}
+
+// twitchPrefetch returns the URIs of the segments Twitch lists ahead of
+// time, if any.
+func (ll *lowLatency) twitchPrefetch() []string {
+	if ll == nil {
+		return nil
+	}
+	return ll.prefetch
+}
+
+// part returns the listed part index of segment msn, or nil.
+func (ll *lowLatency) part(msn uint64, index int) *llPart {
+	for i := range ll.parts {
+		if p := &ll.parts[i]; p.msn == msn && p.index == index {
+			return p
+		}
+	}
+	return nil
+}
+
+// blockingReloadURL returns the URL of a blocking playlist reload, which the
+// server answers once the playlist lists part index of segment msn.
+func blockingReloadURL(playlistURL string, msn uint64, index int) string {
+	u, err := url.Parse(playlistURL)
+	if err != nil {
+		return playlistURL
+	}
+	q := u.Query()
+	q.Set("_HLS_msn", strconv.FormatUint(msn, 10))
+	q.Set("_HLS_part", strconv.Itoa(index))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// parseAttributes parses an HLS attribute list: comma-separated NAME=VALUE
+// pairs whose values may be quoted strings containing commas.
+func parseAttributes(s string) map[string]string {
+	attrs := make(map[string]string)
+	for s != "" {
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+			_, rest, _ = strings.Cut(rest, ",")
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		attrs[strings.TrimSpace(name)] = value
+		s = rest
+	}
+	return attrs
+}
@@ -0,0 +1,155 @@
+package hls
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/stream"
+	"github.com/nv4d1k/live-stream-forwarder/global"
+)
+
+// DefaultPrefetch is the number of segments an HLSStream downloads at the
+// same time unless overridden with WithPrefetch.
+var DefaultPrefetch = 3
+
+// segmentAttempts is how many times a segment download is tried before the
+// segment is skipped.
+const segmentAttempts = 3
+
+// fetchKind is what a queued download is.
+type fetchKind int
+
+const (
+	kindMedia fetchKind = iota // a listed segment or part
+	kindHint                   // announced ahead of time; failing it skips it
+	kindInit                   // an init segment (EXT-X-MAP)
+)
+
+// segmentFetch is the download of one segment into memory.
+type segmentFetch struct {
+	url      string
+	headers  http.Header
+	platform string
+	key      *segmentKey // nil for clear segments
+	kind     fetchKind
+	seq      uint64 // media sequence number of the segment
+	started  bool
+	done     chan struct{} // closed once data and err are final
+	data     bytes.Buffer  // AES-128 is decrypted, SAMPLE-AES is not
+	keyData  []byte
+	err      error
+}
+
+// prefetcher downloads the segments queued by an HLSStream in the
+// background, at most limit at a time and oldest first, and hands them back
+// in queue order. A segment is downloaded only once fewer than limit are
+// ahead of it, so a consumer that stops taking them stops the downloads.
+// Only the goroutine owning it may call its methods.
+type prefetcher struct {
+	parent   context.Context
+	ctx      context.Context // canceled by reset
+	cancel   context.CancelFunc
+	hc       *http.Client
+	limit    int
+	timeouts stream.Timeouts
+	retry    stream.RetryPolicy
+	queue    []*segmentFetch
+}
+
+func newPrefetcher(ctx context.Context, hc *http.Client, limit int, timeouts stream.Timeouts, retry stream.RetryPolicy) *prefetcher {
+	p := &prefetcher{parent: ctx, hc: hc, limit: max(limit, 1), timeouts: timeouts, retry: retry}
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	return p
+}
+
+// add queues the download f.
+func (p *prefetcher) add(f *segmentFetch) {
+	f.done = make(chan struct{})
+	p.queue = append(p.queue, f)
+	p.start()
+}
+
+// ready returns a channel closed once the oldest queued segment is
+// downloaded, or nil if none is queued.
+func (p *prefetcher) ready() <-chan struct{} {
+	if len(p.queue) == 0 {
+		return nil
+	}
+	return p.queue[0].done
+}
+
+// next removes the oldest queued segment, which must be ready, and starts
+// the download of the next one waiting.
+func (p *prefetcher) next() *segmentFetch {
+	f := p.queue[0]
+	p.queue[0] = nil
+	p.queue = p.queue[1:]
+	p.start()
+	return f
+}
+
+// reset drops the queued segments, canceling their downloads.
+func (p *prefetcher) reset() {
+	p.cancel()
+	p.queue = nil
+	p.ctx, p.cancel = context.WithCancel(p.parent)
+}
+
+// start starts the downloads of the first limit queued segments.
+func (p *prefetcher) start() {
+	for _, f := range p.queue[:min(len(p.queue), p.limit)] {
+		if !f.started {
+			f.started = true
+			go p.download(p.ctx, f)
+		}
+	}
+}
+
+// download fetches a segment and its key, retrying transient failures.
+func (p *prefetcher) download(ctx context.Context, f *segmentFetch) {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.prefetcher.download")
+	defer close(f.done)
+	backoff := p.retry.NewBackoff()
+	for attempt := 1; ; attempt++ {
+		f.err = p.get(ctx, f)
+		if f.err == nil || attempt >= segmentAttempts || ctx.Err() != nil || !isRetryableSegment(f.err) {
+			return
+		}
+		log.Debugf("segment attempt %d failed, retrying: %s", attempt, f.err.Error())
+		if backoff.WaitAtLeast(ctx.Done(), stream.RetryAfter(f.err)) != nil {
+			return
+		}
+	}
+}
+
+func (p *prefetcher) get(ctx context.Context, f *segmentFetch) error {
+	f.data.Reset()
+	if err := fetchSegment(ctx, p.hc, &f.data, f.url, f.headers, p.timeouts, f.platform); err != nil {
+		return err
+	}
+	if f.key == nil {
+		return nil
+	}
+	key, err := DefaultKeys.Get(ctx, p.hc, f.key.URI, f.headers, p.timeouts, f.platform)
+	if err != nil {
+		return err
+	}
+	f.keyData = key
+	if f.key.Method == MethodAES128 {
+		clear, err := decryptAES128(f.data.Bytes(), key, f.key.IV)
+		if err != nil {
+			DefaultKeys.Forget(f.key.URI)
+			return err
+		}
+		f.data.Truncate(len(clear))
+	}
+	return nil
+}
+
+// isRetryableSegment reports whether a segment that failed may succeed if
+// tried again.
+func isRetryableSegment(err error) bool {
+	return isTransientHLS(err) || errors.Is(err, errDecrypt)
+}
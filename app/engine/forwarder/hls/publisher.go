@@ -0,0 +1,956 @@
+package hls
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	libm3u8 "github.com/grafov/m3u8"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/stream"
+	"github.com/nv4d1k/live-stream-forwarder/global"
+)
+
+// ErrNotFound is returned by Publisher.File for files it does not serve,
+// such as segments that left the window.
+var ErrNotFound = errors.New("hls: file not found")
+
+// PublisherIdleTimeout is how long a publisher, or the polling of one of its
+// media playlists, runs without a client request.
+var PublisherIdleTimeout = time.Minute
+
+// startSegments is the number of segments taken from a media playlist when
+// polling starts; players start about three segments from the live edge.
+const startSegments = 3
+
+// Content types of the files served by a Publisher.
+const (
+	ContentTypePlaylist = "application/vnd.apple.mpegurl"
+	contentTypeInit     = "video/mp4"
+	contentTypeKey      = "application/octet-stream"
+)
+
+// Publisher re-publishes a stream as HLS. For an HLS upstream it polls the
+// upstream media playlists once for all clients, caches their recent
+// segments in memory and serves playlists whose URIs point back at itself.
+// Extraction, headers, token refresh and re-extraction on 403 stay
+// server-side. Other streams are cut into segments by a feed (see
+// NewFeedPublisher).
+//
+// Files are named relative to the playlist they are listed in:
+//
+//	index.m3u8      master playlist, or the media playlist without variants
+//	v<i>.m3u8       media playlist of variant i
+//	r<i>.m3u8       media playlist of rendition i (EXT-X-MEDIA with a URI)
+//	v<i>-<seq>.ts   segment; the extension follows the upstream's
+//	v<i>-init<n>.mp4 init section (EXT-X-MAP)
+type Publisher struct {
+	hc        *http.Client
+	extractFn stream.ExtractFunc
+	retry     stream.RetryPolicy
+	timeouts  stream.Timeouts
+	health    *stream.HostHealth
+	offline   stream.OfflinePolicy
+	ads       AdPolicy
+	window    int
+
+	ctx        context.Context // canceled when the publisher is closed
+	cancel     context.CancelFunc
+	stopParent func() bool
+	done       chan struct{}
+	closeOnce  sync.Once
+
+	// invalidateCh wakes the run loop to re-extract; refreshCh does so
+	// before the URL expires.
+	invalidateCh chan error
+	refreshCh    chan struct{}
+
+	mu         sync.Mutex
+	gen        int           // bumped by every extraction
+	ready      chan struct{} // closed once the sources of gen are known
+	sources    map[string]string
+	headers    http.Header
+	platform   string
+	master     []byte // rewritten master playlist; nil without variants
+	polls      map[string]*poll
+	progressed bool // a segment arrived since the last extraction
+	err        error
+}
+
+// poll is the polling of one upstream media playlist into a window.
+type poll struct {
+	name     string
+	window   *Window
+	running  bool
+	lastUsed time.Time
+}
+
+// Publish returns a Publisher for the stream. It takes the HLSStream options;
+// WithBuffer and WithPrefetch have no effect. WithContext bounds the
+// publisher's lifetime.
+func (h *HLSForwarder) Publish(extractFn stream.ExtractFunc, opts ...HLSStreamOption) *Publisher {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.HLSForwarder.Publish")
+	log.Debug("creating Publisher from extractFn")
+	return NewPublisher(extractFn, h.hc, opts...)
+}
+
+func NewPublisher(extractFn stream.ExtractFunc, hc *http.Client, opts ...HLSStreamOption) *Publisher {
+	s := newHLSStream(extractFn, hc, opts)
+	p := &Publisher{
+		hc:           hc,
+		extractFn:    extractFn,
+		retry:        s.retry,
+		timeouts:     s.timeouts,
+		health:       s.health,
+		offline:      s.offline,
+		ads:          s.ads,
+		window:       DefaultWindow,
+		done:         make(chan struct{}),
+		invalidateCh: make(chan error, 1),
+		refreshCh:    make(chan struct{}, 1),
+		ready:        make(chan struct{}),
+		polls:        make(map[string]*poll),
+	}
+	p.ctx, p.cancel = context.WithCancel(s.parent)
+	p.stopParent = context.AfterFunc(s.parent, func() { p.Close() })
+	go p.run()
+	return p
+}
+
+// FeedFunc appends the segments of a stream to w until the stream ends or
+// ctx is done.
+type FeedFunc func(ctx context.Context, w *Window) error
+
+// NewFeedPublisher returns a Publisher serving a single media playlist,
+// v0.m3u8, of the segments feed appends, such as those cut from an FLV
+// stream. It stops when feed returns or ctx is done.
+func NewFeedPublisher(ctx context.Context, feed FeedFunc) *Publisher {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.NewFeedPublisher")
+	log.Debug("creating Publisher from feed")
+	pl := &poll{name: "v0", window: NewWindow(DefaultWindow), running: true}
+	p := &Publisher{
+		done:    make(chan struct{}),
+		ready:   make(chan struct{}),
+		gen:     1,
+		sources: map[string]string{pl.name: ""},
+		polls:   map[string]*poll{pl.name: pl},
+	}
+	close(p.ready)
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	p.stopParent = context.AfterFunc(ctx, func() { p.Close() })
+	go func() {
+		err := feed(p.ctx, pl.window)
+		if p.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			p.fail(err)
+			return
+		}
+		log.Debug("feed ended")
+		p.Close()
+	}()
+	return p
+}
+
+// Close stops polling the upstream. Playlists already served end with
+// EXT-X-ENDLIST.
+func (p *Publisher) Close() error {
+	p.closeOnce.Do(func() {
+		global.Log.WithField("func", "app.engine.forwarder.hls.Publisher.Close").Debug("closing Publisher")
+		p.stopParent()
+		p.cancel()
+		p.mu.Lock()
+		for _, pl := range p.polls {
+			pl.window.End()
+		}
+		p.mu.Unlock()
+		close(p.done)
+	})
+	return nil
+}
+
+// Done is closed when the publisher has stopped, after Close or when it gave
+// up on the upstream; Err then reports why.
+func (p *Publisher) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *Publisher) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// fail stops the publisher because the upstream cannot be played.
+func (p *Publisher) fail(err error) {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.Publisher.fail")
+	log.Warnf("giving up on Publisher: %s", err.Error())
+	p.mu.Lock()
+	p.err = err
+	p.mu.Unlock()
+	p.Close()
+}
+
+// File returns the content and content type of a file of the re-published
+// stream, starting the polling of a media playlist on its first request. A
+// media playlist is returned once it lists a segment, which may take until
+// ctx is done.
+func (p *Publisher) File(ctx context.Context, file string) ([]byte, string, error) {
+	if file == "index.m3u8" {
+		if err := p.started(ctx); err != nil {
+			return nil, "", err
+		}
+		p.mu.Lock()
+		master := p.master
+		p.mu.Unlock()
+		if master != nil {
+			return master, ContentTypePlaylist, nil
+		}
+		file = "v0.m3u8"
+	}
+	if name, ok := strings.CutSuffix(file, ".m3u8"); ok {
+		pl, err := p.poll(ctx, name)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := pl.window.Wait(ctx); err != nil {
+			return nil, "", err
+		}
+		return pl.window.Playlist(name), ContentTypePlaylist, nil
+	}
+
+	name, rest, _ := strings.Cut(file, "-")
+	p.mu.Lock()
+	pl, ok := p.polls[name]
+	p.mu.Unlock()
+	if !ok {
+		return nil, "", ErrNotFound
+	}
+	if id, ok := strings.CutPrefix(rest, "key"); ok {
+		n, err := strconv.Atoi(strings.TrimSuffix(id, ".key"))
+		if err != nil {
+			return nil, "", ErrNotFound
+		}
+		if k, ok := pl.window.Key(n); ok {
+			return k.Data, contentTypeKey, nil
+		}
+		return nil, "", ErrNotFound
+	}
+	if id, ok := strings.CutPrefix(rest, "init"); ok {
+		n, err := strconv.Atoi(strings.TrimSuffix(id, ".mp4"))
+		if err != nil {
+			return nil, "", ErrNotFound
+		}
+		if data, ok := pl.window.Init(n); ok {
+			return data, contentTypeInit, nil
+		}
+		return nil, "", ErrNotFound
+	}
+	ext := path.Ext(rest)
+	seq, err := strconv.ParseUint(strings.TrimSuffix(rest, ext), 10, 64)
+	if err != nil {
+		return nil, "", ErrNotFound
+	}
+	seg, ok := pl.window.Segment(seq)
+	if !ok || seg.Ext != ext {
+		return nil, "", ErrNotFound
+	}
+	return seg.Data, segmentContentType(ext), nil
+}
+
+// wait blocks until the upstream playlists of the current extraction are
+// known.
+func (p *Publisher) wait(ctx context.Context) error {
+	p.mu.Lock()
+	ready := p.ready
+	p.mu.Unlock()
+	select {
+	case <-ready:
+		return nil
+	case <-p.done:
+		if err := p.Err(); err != nil {
+			return err
+		}
+		return context.Canceled
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// started blocks until the first extraction has resolved the upstream
+// playlists. Later re-extractions keep serving the previous ones.
+func (p *Publisher) started(ctx context.Context) error {
+	p.mu.Lock()
+	gen := p.gen
+	p.mu.Unlock()
+	if gen > 0 {
+		return nil
+	}
+	return p.wait(ctx)
+}
+
+// poll returns the polling of the named media playlist, starting it if
+// needed.
+func (p *Publisher) poll(ctx context.Context, name string) (*poll, error) {
+	if err := p.started(ctx); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.sources[name]; !ok {
+		return nil, ErrNotFound
+	}
+	pl, ok := p.polls[name]
+	if !ok {
+		pl = &poll{name: name, window: NewWindow(p.window)}
+		p.polls[name] = pl
+	}
+	pl.lastUsed = time.Now()
+	if !pl.running && p.ctx.Err() == nil {
+		pl.running = true
+		go p.runPoll(pl)
+	}
+	return pl, nil
+}
+
+// source returns the current upstream URL of the named media playlist and
+// its extraction, waiting for a re-extraction in progress.
+func (p *Publisher) source(name string) (string, http.Header, int, error) {
+	if err := p.wait(p.ctx); err != nil {
+		return "", nil, 0, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	u, ok := p.sources[name]
+	if !ok {
+		return "", nil, 0, ErrNotFound
+	}
+	return u, p.headers, p.gen, nil
+}
+
+// invalidate asks for a re-extraction because the sources of extraction gen
+// failed with cause. Pollers wait for it in source.
+func (p *Publisher) invalidate(gen int, cause error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if gen != p.gen {
+		return
+	}
+	if p.unready() {
+		p.invalidateCh <- cause
+	}
+}
+
+// unready makes pollers wait for the next extraction, and reports whether
+// they did not already. It is called with p.mu held.
+func (p *Publisher) unready() bool {
+	select {
+	case <-p.ready:
+		p.ready = make(chan struct{})
+		return true
+	default:
+		return false
+	}
+}
+
+// run extracts the stream and resolves its playlists, and again whenever a
+// poller invalidates them or the URL is about to expire.
+func (p *Publisher) run() {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.Publisher.run")
+	backoff := p.retry.NewBackoff()
+	var previous *stream.ExtractResult
+	var offlineSince time.Time
+
+	var refreshTimer *time.Timer
+	defer func() {
+		if refreshTimer != nil {
+			refreshTimer.Stop()
+		}
+	}()
+
+	// retry waits before the next attempt. It returns false when the
+	// publisher should stop.
+	retry := func(cause error) bool {
+		if err := backoff.WaitAtLeast(p.ctx.Done(), stream.RetryAfter(cause)); err != nil {
+			if err != stream.ErrRetryCanceled {
+				p.fail(fmt.Errorf("%w after %d attempts: %w", err, backoff.Attempts(), cause))
+			}
+			return false
+		}
+		return true
+	}
+
+	for {
+		ectx, cancel := stream.WithTimeout(p.ctx, p.timeouts.Extract)
+		result, err := p.extractFn(ectx, previous)
+		cancel()
+		if p.ctx.Err() != nil {
+			return
+		}
+		if stream.IsOffline(err) {
+			if offlineSince.IsZero() {
+				offlineSince = time.Now()
+				log.Infof("stream offline, applying %s policy: %s", p.offline.Action, err.Error())
+			}
+			if err := p.offline.Check(err, offlineSince); err != nil {
+				p.fail(err)
+				return
+			}
+			select {
+			case <-time.After(p.offline.Poll):
+			case <-p.ctx.Done():
+				return
+			}
+			continue
+		}
+		if err == nil {
+			previous = result
+			err = p.resolve(result)
+		}
+		if err != nil {
+			log.Warnf("extract error: %s", err.Error())
+			if !retry(err) {
+				return
+			}
+			continue
+		}
+		if !offlineSince.IsZero() {
+			log.Infof("stream back online after %s", time.Since(offlineSince).Round(time.Second))
+			offlineSince = time.Time{}
+		}
+
+		if refreshTimer != nil {
+			refreshTimer.Stop()
+			refreshTimer = nil
+		}
+		if result.ExpireAt != nil {
+			when := stream.RefreshDelay(*result.ExpireAt)
+			log.Debugf("scheduling token refresh in %s (expires at %s)", when, result.ExpireAt.Format(time.RFC3339))
+			refreshTimer = time.AfterFunc(when, func() {
+				select {
+				case p.refreshCh <- struct{}{}:
+				default:
+				}
+			})
+		}
+
+		var cause error
+		select {
+		case cause = <-p.invalidateCh:
+			log.Warnf("upstream playlist failed, re-extracting: %s", cause.Error())
+		case <-p.refreshCh:
+			log.Infoln("token refresh triggered, re-extracting")
+			p.mu.Lock()
+			if !p.unready() {
+				// A poller invalidated the sources meanwhile.
+				cause = <-p.invalidateCh
+			}
+			p.mu.Unlock()
+		case <-p.ctx.Done():
+			return
+		}
+		p.mu.Lock()
+		progressed := p.progressed
+		p.progressed = false
+		p.mu.Unlock()
+		if progressed {
+			backoff.Reset()
+		} else if cause != nil && !retry(cause) {
+			// Re-extracting over and over without a single segment.
+			return
+		}
+	}
+}
+
+// resolve fetches the playlist of an extraction and publishes its media
+// playlists as the new sources.
+func (p *Publisher) resolve(result *stream.ExtractResult) error {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.Publisher.resolve")
+	var err error
+	for _, u := range p.health.Order(result.AllCandidates()) {
+		ctx, cancel := stream.WithTimeout(p.ctx, p.timeouts.Fetch)
+		var playlist libm3u8.Playlist
+		var listType libm3u8.ListType
+		playlist, listType, err = fetchAndParseM3U8(ctx, p.hc, u, result.Headers)
+		cancel()
+		if err != nil {
+			err = stream.WithPlatform(err, result.Platform)
+			if stream.Classify(err) == stream.ClassTransient {
+				log.Warnf("playlist host failed, trying the next: %s", err.Error())
+				p.health.Failure(u)
+				continue
+			}
+			return err
+		}
+
+		sources := map[string]string{"v0": u}
+		var master []byte
+		if listType == libm3u8.MASTER {
+			master, sources, err = rewriteMaster(u, playlist.(*libm3u8.MasterPlaylist))
+			if err != nil {
+				return err
+			}
+		}
+		p.mu.Lock()
+		p.gen++
+		p.sources = sources
+		p.headers = result.Headers
+		p.platform = result.Platform
+		p.master = master
+		close(p.ready)
+		p.mu.Unlock()
+		log.Debugf("publishing %d media playlists", len(sources))
+		return nil
+	}
+	return err
+}
+
+// rewriteMaster returns a copy of an upstream master playlist with the URIs
+// replaced by the publisher's names, and the upstream URL of each name.
+// I-frame playlists are left out.
+func rewriteMaster(baseURL string, m *libm3u8.MasterPlaylist) ([]byte, map[string]string, error) {
+	out := libm3u8.NewMasterPlaylist()
+	out.SetIndependentSegments(m.IndependentSegments())
+	sources := make(map[string]string)
+	renditions := make(map[*libm3u8.Alternative]*libm3u8.Alternative)
+	for _, v := range m.Variants {
+		if v == nil || v.Iframe {
+			continue
+		}
+		name := fmt.Sprintf("v%d", len(out.Variants))
+		sources[name] = resolveURL(baseURL, v.URI)
+		params := v.VariantParams
+		params.Alternatives = nil
+		for _, alt := range v.Alternatives {
+			r, ok := renditions[alt]
+			if !ok {
+				c := *alt
+				r = &c
+				if alt.URI != "" {
+					rname := fmt.Sprintf("r%d", len(renditions))
+					sources[rname] = resolveURL(baseURL, alt.URI)
+					r.URI = rname + ".m3u8"
+				}
+				renditions[alt] = r
+			}
+			params.Alternatives = append(params.Alternatives, r)
+		}
+		out.Append(name+".m3u8", nil, params)
+	}
+	if len(out.Variants) == 0 {
+		return nil, nil, errors.New("master playlist has no variants")
+	}
+	return out.Encode().Bytes(), sources, nil
+}
+
+// runPoll polls an upstream media playlist and appends its new segments to
+// the window, until the publisher closes or no client asked for the playlist
+// for PublisherIdleTimeout.
+func (p *Publisher) runPoll(pl *poll) {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.Publisher.runPoll").WithField("playlist", pl.name)
+	defer func() {
+		p.mu.Lock()
+		pl.running = false
+		p.mu.Unlock()
+	}()
+	backoff := p.retry.NewBackoff()
+	gen := 0
+	var lastSeqID uint64
+	var lastSegment string // file name of the last segment taken
+	var hasLastSeqID bool
+	var lastProgress time.Time
+	var initURL string
+	var adBreak bool // the last segment listed was an ad left out
+
+	// retry waits before the next attempt. When the retry budget is spent
+	// the sources are re-extracted instead.
+	retry := func(cause error) bool {
+		if err := backoff.WaitAtLeast(p.ctx.Done(), stream.RetryAfter(cause)); err != nil {
+			if err == stream.ErrRetryCanceled {
+				return false
+			}
+			p.invalidate(gen, cause)
+			backoff.Reset()
+		}
+		return true
+	}
+
+	for {
+		p.mu.Lock()
+		idle := time.Since(pl.lastUsed) > PublisherIdleTimeout
+		p.mu.Unlock()
+		if idle {
+			log.Debug("no requests, stopping")
+			return
+		}
+		mediaURL, headers, g, err := p.source(pl.name)
+		if errors.Is(err, ErrNotFound) {
+			log.Info("playlist gone after re-extraction")
+			pl.window.End()
+			return
+		}
+		if err != nil {
+			return
+		}
+		newGen := g != gen
+		if newGen {
+			gen = g
+			initURL = ""
+			lastProgress = time.Now()
+		}
+
+		ctx, cancel := stream.WithTimeout(p.ctx, p.timeouts.Fetch)
+		playlist, listType, body, err := fetchPlaylist(ctx, p.hc, mediaURL, headers)
+		cancel()
+		if p.ctx.Err() != nil {
+			return
+		}
+		if err == nil && listType != libm3u8.MEDIA {
+			err = fmt.Errorf("expected a media playlist at %s", mediaURL)
+		}
+		if err != nil {
+			err = stream.WithPlatform(err, p.platform)
+			if isTransientHLS(err) {
+				log.Warnf("playlist fetch transient error, retrying: %s", err.Error())
+				if !retry(err) {
+					return
+				}
+				continue
+			}
+			p.invalidate(gen, err)
+			continue
+		}
+		mediapl := playlist.(*libm3u8.MediaPlaylist)
+		if newGen && hasLastSeqID && !continues(mediapl, lastSeqID, lastSegment) {
+			// Not the same stream after the re-extraction, so its
+			// segments are numbered anew.
+			hasLastSeqID = false
+			pl.window.Discontinue()
+		}
+
+		segments := make([]*libm3u8.MediaSegment, 0, len(mediapl.Segments))
+		for _, seg := range mediapl.Segments {
+			if seg != nil {
+				segments = append(segments, seg)
+			}
+		}
+		// Segments stay encrypted; their keys are served by the window.
+		// A key applies from its tag to the next one, and so does a map.
+		keys := make([]*libm3u8.Key, len(segments))
+		maps := make([]*libm3u8.Map, len(segments))
+		for i, seg := range segments {
+			keys[i], maps[i] = seg.Key, seg.Map
+			if keys[i] == nil && i > 0 {
+				keys[i] = keys[i-1]
+			}
+			if maps[i] == nil {
+				maps[i] = mediapl.Map
+				if i > 0 {
+					maps[i] = maps[i-1]
+				}
+			}
+		}
+		if !hasLastSeqID {
+			first := max(len(segments)-startSegments, 0)
+			segments, keys, maps = segments[first:], keys[first:], maps[first:]
+		}
+		// Ads are left out of the served playlists unless passed through;
+		// the live segments after them start a discontinuity.
+		var dateRanges []DateRange
+		skipAds := p.ads.Detect != nil && p.ads.Strategy != AdsPassthrough
+		if skipAds {
+			dateRanges = parseDateRanges(body)
+		}
+		for i, seg := range segments {
+			if hasLastSeqID && seg.SeqId <= lastSeqID {
+				continue
+			}
+			if skipAds && p.ads.Detect(seg, dateRanges) {
+				if !adBreak {
+					log.Infof("ad break from segment %d, leaving it out", seg.SeqId)
+					adBreak = true
+				}
+				lastSeqID, lastSegment, hasLastSeqID = seg.SeqId, segmentName(seg.URI), true
+				lastProgress = time.Now()
+				continue
+			}
+			if adBreak {
+				log.Infof("ad break over at segment %d", seg.SeqId)
+				pl.window.Discontinue()
+				adBreak = false
+			}
+			if m := maps[i]; m != nil && m.URI != "" {
+				if u := resolveURL(mediaURL, m.URI); stripQuery(u) != initURL {
+					var buf bytes.Buffer
+					if err := fetchSegment(p.ctx, p.hc, &buf, u, headers, p.timeouts, p.platform); err != nil {
+						if p.ctx.Err() != nil {
+							return
+						}
+						if isTransientHLS(err) {
+							log.Warnf("init segment fetch transient error, retrying: %s", err.Error())
+							if !retry(err) {
+								return
+							}
+							break
+						}
+						p.invalidate(gen, err)
+						break
+					}
+					pl.window.SetInit(buf.Bytes())
+					initURL = stripQuery(u)
+				}
+			}
+			if seg.Discontinuity {
+				pl.window.Discontinue()
+			}
+			segURL := resolveURL(mediaURL, seg.URI)
+			var buf bytes.Buffer
+			key, err := p.key(keys[i], mediaURL, seg.SeqId, headers)
+			if err == nil {
+				err = fetchSegment(p.ctx, p.hc, &buf, segURL, headers, p.timeouts, p.platform)
+			}
+			if errors.Is(err, ErrUnsupportedEncryption) {
+				log.Errorf("segment error: %s", err.Error())
+				p.fail(err)
+				return
+			}
+			if err != nil {
+				if p.ctx.Err() != nil {
+					return
+				}
+				if isTransientHLS(err) {
+					// Without backoff, which would delay the segments
+					// after it; the stall check catches a playlist
+					// whose segments all fail.
+					log.Warnf("segment fetch transient error, skipping: %s", err.Error())
+					continue
+				}
+				log.Warnf("segment fetch error, re-extracting: %s", err.Error())
+				p.invalidate(gen, err)
+				break
+			}
+			pl.window.SetKey(key)
+			pl.window.Append(seg.Duration, segmentExt(segURL, maps[i] != nil), buf.Bytes())
+			lastSeqID = seg.SeqId
+			lastSegment = segmentName(segURL)
+			hasLastSeqID = true
+			lastProgress = time.Now()
+			backoff.Reset()
+			p.health.Success(segURL)
+			p.mu.Lock()
+			p.progressed = true
+			p.mu.Unlock()
+		}
+
+		if mediapl.Closed {
+			pl.window.End()
+			return
+		}
+		if window := stallWindow(p.timeouts.Stall, mediapl); window > 0 && time.Since(lastProgress) > window {
+			log.WithField("event", "stall").Warnf("playlist has not advanced for %s, re-extracting", window)
+			p.invalidate(gen, fmt.Errorf("playlist not advancing: %w", stream.ErrStalled))
+			lastProgress = time.Now()
+			continue
+		}
+
+		targetDur := max(time.Duration(mediapl.TargetDuration)*time.Second, time.Second)
+		select {
+		case <-time.After(targetDur):
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// key returns the window key of the segment with sequence number seq under
+// the EXT-X-KEY tag k, fetching it through the key cache, or nil for a clear
+// segment.
+func (p *Publisher) key(k *libm3u8.Key, mediaURL string, seq uint64, headers http.Header) (*Key, error) {
+	sk, err := keyOf(k, mediaURL, seq)
+	if sk == nil || err != nil {
+		return nil, err
+	}
+	data, err := DefaultKeys.Get(p.ctx, p.hc, sk.URI, headers, p.timeouts, p.platform)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{Method: sk.Method, IV: sk.IV, KeyFormat: sk.KeyFormat, Data: data}, nil
+}
+
+// continues reports whether a media playlist fetched after a re-extraction
+// still lists the last segment taken, so polling can go on where it was.
+func continues(mediapl *libm3u8.MediaPlaylist, lastSeqID uint64, lastSegment string) bool {
+	for _, seg := range mediapl.Segments {
+		if seg != nil && seg.SeqId == lastSeqID {
+			return segmentName(seg.URI) == lastSegment
+		}
+	}
+	return false
+}
+
+// segmentName returns the file name of a segment URI, without the query
+// string, which often carries a token that changes on re-extraction.
+func segmentName(uri string) string {
+	if u, err := url.Parse(uri); err == nil {
+		return path.Base(u.Path)
+	}
+	return uri
+}
+
+// segmentExt returns the file extension a segment is served with: the
+// upstream's if it is a known media type, otherwise that of the container.
+func segmentExt(segURL string, fmp4 bool) string {
+	if u, err := url.Parse(segURL); err == nil {
+		switch ext := path.Ext(u.Path); ext {
+		case ".ts", ".m4s", ".mp4", ".aac":
+			return ext
+		}
+	}
+	if fmp4 {
+		return ".m4s"
+	}
+	return ".ts"
+}
+
+// segmentContentType returns the content type of a segment by extension.
+func segmentContentType(ext string) string {
+	switch ext {
+	case ".ts":
+		return "video/mp2t"
+	case ".aac":
+		return "audio/aac"
+	default:
+		return "video/mp4"
+	}
+}
+
+// PublisherSet holds the running publishers by key, so all clients of a
+// room share one. A publisher is closed after PublisherIdleTimeout without
+// requests.
+type PublisherSet struct {
+	mu      sync.Mutex
+	entries map[string]*publisherEntry
+
+	ctx    context.Context // parent of every publisher's context
+	cancel context.CancelFunc
+}
+
+type publisherEntry struct {
+	ready    chan struct{} // closed once open has returned
+	p        *Publisher
+	err      error
+	lastUsed time.Time
+	timer    *time.Timer
+}
+
+// OpenPublisherFunc opens the publisher for a PublisherSet entry. It is
+// called once per entry; ctx belongs to the set and should be passed to the
+// publisher with WithContext.
+type OpenPublisherFunc func(ctx context.Context) (*Publisher, error)
+
+// DefaultPublishers is the process-wide publisher set.
+var DefaultPublishers = NewPublisherSet()
+
+func NewPublisherSet() *PublisherSet {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &PublisherSet{
+		entries: make(map[string]*publisherEntry),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Get returns the publisher for key, calling open to create it if there is
+// none or it stopped. Concurrent callers wait for the same open.
+func (s *PublisherSet) Get(ctx context.Context, key string, open OpenPublisherFunc) (*Publisher, error) {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.PublisherSet.Get").WithField("key", key)
+	s.mu.Lock()
+	if err := s.ctx.Err(); err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	e, ok := s.entries[key]
+	if ok && e.p != nil {
+		select {
+		case <-e.p.Done():
+			e.timer.Stop()
+			ok = false
+		default:
+		}
+	}
+	if !ok {
+		log.Debug("opening publisher")
+		e = &publisherEntry{ready: make(chan struct{})}
+		s.entries[key] = e
+		go s.open(key, e, open)
+	}
+	e.lastUsed = time.Now()
+	s.mu.Unlock()
+
+	select {
+	case <-e.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.p, nil
+}
+
+func (s *PublisherSet) open(key string, e *publisherEntry, open OpenPublisherFunc) {
+	p, err := open(s.ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.p, e.err = p, err
+	if err != nil {
+		if s.entries[key] == e {
+			delete(s.entries, key)
+		}
+	} else {
+		e.timer = time.AfterFunc(PublisherIdleTimeout, func() { s.expire(key, e) })
+	}
+	close(e.ready)
+}
+
+// expire closes the publisher of an entry that had no request for
+// PublisherIdleTimeout.
+func (s *PublisherSet) expire(key string, e *publisherEntry) {
+	s.mu.Lock()
+	if idle := time.Since(e.lastUsed); idle < PublisherIdleTimeout {
+		e.timer.Reset(PublisherIdleTimeout - idle)
+		s.mu.Unlock()
+		return
+	}
+	if s.entries[key] == e {
+		delete(s.entries, key)
+	}
+	s.mu.Unlock()
+	global.Log.WithField("func", "app.engine.forwarder.hls.PublisherSet.expire").WithField("key", key).Debug("closing idle publisher")
+	e.p.Close()
+}
+
+// Close closes every publisher and makes further Get calls fail. It is used
+// on server shutdown.
+func (s *PublisherSet) Close() {
+	s.mu.Lock()
+	s.cancel()
+	entries := s.entries
+	s.entries = make(map[string]*publisherEntry)
+	s.mu.Unlock()
+	for _, e := range entries {
+		<-e.ready
+		if e.p != nil {
+			e.timer.Stop()
+			e.p.Close()
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package hls
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	libm3u8 "github.com/grafov/m3u8"
+	"github.com/nv4d1k/live-stream-forwarder/global"
+)
+
+// ErrNoVariant is returned when no variant of a master playlist satisfies a
+// Quality.
+var ErrNoVariant = errors.New("no variant of the stream matches")
+
+// Quality selects a variant of a master playlist. It is a list of
+// preferences tried in order, so that "720p,480p,worst" falls back to 480p,
+// then to the lowest bandwidth, when the stream has no 720p variant. A
+// preference is one of:
+//
+//	720p, 720p60  height, and frame rate if given
+//	30fps         frame rate at most
+//	3000k, 3m     bandwidth at most, in bits/s
+//	best          the highest bandwidth
+//	source        the variant named the source, as Twitch's, or else best
+//	worst         the lowest bandwidth with video
+//	audio_only    audio only
+//	<name>        the NAME of the variant or of its VIDEO rendition, as
+//	              Twitch lists its qualities
+//
+// Among the variants satisfying a preference, the highest bandwidth wins.
+type Quality []qualityPref
+
+// qualityPref is one preference of a Quality.
+type qualityPref struct {
+	raw    string
+	match  func(v *libm3u8.Variant) bool
+	lowest bool // pick the lowest bandwidth match instead of the highest
+}
+
+var (
+	resolutionPref = regexp.MustCompile(`^(\d+)p(\d+)?$`)
+	frameRatePref  = regexp.MustCompile(`^(\d+(?:\.\d+)?)fps$`)
+	bandwidthPref  = regexp.MustCompile(`^(\d+(?:\.\d+)?)([km]?)(?:bps)?$`)
+	namePref       = regexp.MustCompile(`^[\w .()+-]+$`)
+)
+
+// WithQuality sets the variant played from a master playlist, over the
+// extractor's VariantSelector. If no variant satisfies q, the stream ends
+// with an error wrapping ErrNoVariant, or goes on at the highest bandwidth
+// once it has started. The default plays the highest bandwidth.
+func WithQuality(q Quality) HLSStreamOption {
+	return func(s *HLSStream) { s.quality = q }
+}
+
+// ParseQuality parses a comma-separated list of quality preferences. The
+// empty string is no preference.
+func ParseQuality(s string) (Quality, error) {
+	var q Quality
+	for _, raw := range strings.Split(s, ",") {
+		raw = strings.ToLower(strings.TrimSpace(raw))
+		if raw == "" {
+			continue
+		}
+		p := qualityPref{raw: raw}
+		switch {
+		case raw == "best":
+			p.match = func(*libm3u8.Variant) bool { return true }
+		case raw == "source":
+			// Streams that do not name their source have it at the
+			// highest bandwidth.
+			q = append(q, qualityPref{raw: raw, match: isSource})
+			p.match = func(*libm3u8.Variant) bool { return true }
+		case raw == "worst":
+			p.match = func(v *libm3u8.Variant) bool { return !isAudioOnly(v) }
+			p.lowest = true
+		case raw == "audio_only" || raw == "audio":
+			p.match = isAudioOnly
+		case resolutionPref.MatchString(raw):
+			m := resolutionPref.FindStringSubmatch(raw)
+			height, _ := strconv.Atoi(m[1])
+			fps, _ := strconv.Atoi(m[2]) // 0 for any
+			p.match = func(v *libm3u8.Variant) bool {
+				return variantHeight(v) == height && (fps == 0 || math.Round(v.FrameRate) == float64(fps))
+			}
+		case frameRatePref.MatchString(raw):
+			fps, _ := strconv.ParseFloat(frameRatePref.FindStringSubmatch(raw)[1], 64)
+			p.match = func(v *libm3u8.Variant) bool {
+				return v.FrameRate > 0 && math.Round(v.FrameRate) <= fps
+			}
+		case bandwidthPref.MatchString(raw):
+			m := bandwidthPref.FindStringSubmatch(raw)
+			bw, _ := strconv.ParseFloat(m[1], 64)
+			switch m[2] {
+			case "k":
+				bw *= 1e3
+			case "m":
+				bw *= 1e6
+			}
+			p.match = func(v *libm3u8.Variant) bool { return float64(v.Bandwidth) <= bw }
+		case namePref.MatchString(raw):
+			p.match = func(v *libm3u8.Variant) bool { return strings.EqualFold(variantName(v), raw) }
+		default:
+			return nil, fmt.Errorf("invalid quality %q", raw)
+		}
+		q = append(q, p)
+	}
+	return q, nil
+}
+
+// String returns the preferences, comma-separated.
+func (q Quality) String() string {
+	raws := make([]string, 0, len(q))
+	for _, p := range q {
+		if len(raws) == 0 || raws[len(raws)-1] != p.raw {
+			raws = append(raws, p.raw)
+		}
+	}
+	return strings.Join(raws, ",")
+}
+
+// Select returns the variant satisfying the first preference any variant
+// satisfies. The error wrapping ErrNoVariant lists the variants there are.
+func (q Quality) Select(variants []*libm3u8.Variant) (*libm3u8.Variant, error) {
+	log := global.Log.WithField("func", "app.engine.forwarder.hls.Quality.Select")
+	for _, p := range q {
+		var pick *libm3u8.Variant
+		for _, v := range variants {
+			if v.Iframe || !p.match(v) {
+				continue
+			}
+			if pick == nil || p.lowest && v.Bandwidth < pick.Bandwidth || !p.lowest && v.Bandwidth > pick.Bandwidth {
+				pick = v
+			}
+		}
+		if pick != nil {
+			log.Debugf("selected variant %s (bandwidth=%d uri=%s) for quality %s", describeVariant(pick), pick.Bandwidth, pick.URI, p.raw)
+			return pick, nil
+		}
+	}
+	var available []string
+	for _, v := range variants {
+		if !v.Iframe {
+			available = append(available, describeVariant(v))
+		}
+	}
+	return nil, fmt.Errorf("%w quality %q (available: %s)", ErrNoVariant, q.String(), strings.Join(available, ", "))
+}
+
+// variantName returns the name a master playlist gives variant v: the NAME
+// of its VIDEO rendition, as Twitch names its qualities, its own NAME, or
+// its VIDEO group.
+func variantName(v *libm3u8.Variant) string {
+	for _, alt := range v.Alternatives {
+		if alt != nil && alt.Type == "VIDEO" && alt.GroupId == v.Video && alt.Name != "" {
+			return alt.Name
+		}
+	}
+	if v.Name != "" {
+		return v.Name
+	}
+	return v.Video
+}
+
+// describeVariant returns a name for v to list in errors and logs.
+func describeVariant(v *libm3u8.Variant) string {
+	if name := variantName(v); name != "" {
+		return name
+	}
+	if h := variantHeight(v); h > 0 {
+		if v.FrameRate > 0 {
+			return fmt.Sprintf("%dp%.0f", h, v.FrameRate)
+		}
+		return fmt.Sprintf("%dp", h)
+	}
+	return fmt.Sprintf("%dk", v.Bandwidth/1000)
+}
+
+// variantHeight returns the height of v's RESOLUTION, or 0.
+func variantHeight(v *libm3u8.Variant) int {
+	_, h, ok := strings.Cut(v.Resolution, "x")
+	if !ok {
+		return 0
+	}
+	height, _ := strconv.Atoi(h)
+	return height
+}
+
+// isSource reports whether v is named as the source, which Twitch puts in
+// the "chunked" group and names "1080p60 (source)".
+func isSource(v *libm3u8.Variant) bool {
+	return v.Video == "chunked" || strings.Contains(strings.ToLower(variantName(v)), "source")
+}
+
+// isAudioOnly reports whether v has no video: it is named so, or lists
+// audio codecs only and no resolution.
+func isAudioOnly(v *libm3u8.Variant) bool {
+	if strings.EqualFold(variantName(v), "audio_only") {
+		return true
+	}
+	if v.Resolution != "" || v.Codecs == "" {
+		return false
+	}
+	for _, c := range strings.Split(v.Codecs, ",") {
+		c = strings.TrimSpace(c)
+		if !strings.HasPrefix(c, "mp4a") && !strings.HasPrefix(c, "ac-3") && !strings.HasPrefix(c, "ec-3") && !strings.HasPrefix(c, "opus") && !strings.HasPrefix(c, "flac") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,290 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultWindow is the number of segments listed in a re-published media
+// playlist.
+var DefaultWindow = 6
+
+// windowGrace is the number of segments kept after they leave the playlist,
+// for clients that loaded it just before.
+const windowGrace = 3
+
+// Segment is a media segment held in memory by a Window.
+type Segment struct {
+	SeqID         uint64
+	Duration      float64 // seconds
+	Discontinuity bool    // starts a new timeline or encoding
+	InitID        int     // init section of the segment, 0 for none
+	KeyID         int     // key of the segment, 0 if it is clear
+	Ext           string  // file extension, e.g. ".ts"
+	Data          []byte
+}
+
+// Key is the key of encrypted segments held by a Window. Players fetch it
+// from the window, with the IV given explicitly since segments are
+// renumbered.
+type Key struct {
+	Method    string // MethodAES128 or MethodSampleAES
+	IV        []byte
+	KeyFormat string
+	Data      []byte
+}
+
+// Window is a sliding window of recent media segments, re-published as a
+// live media playlist. Segments are numbered by the window, so the playlist
+// stays continuous across upstream reconnects. It is safe for concurrent
+// use.
+type Window struct {
+	mu               sync.Mutex
+	size             int
+	segments         []*Segment
+	nextSeq          uint64
+	discontinuitySeq uint64 // discontinuities that left the playlist
+	discontinuity    bool   // the next segment starts a discontinuity
+	inits            map[int][]byte
+	initID           int
+	keys             map[int]*Key
+	keyID            int // 0 while segments are clear
+	lastKeyID        int // IDs are never reused, as players cache keys by URI
+	ended            bool
+	changed          chan struct{} // closed and replaced on every change
+}
+
+// NewWindow returns a window listing the size most recent segments.
+func NewWindow(size int) *Window {
+	return &Window{
+		size:    max(size, 1),
+		inits:   make(map[int][]byte),
+		keys:    make(map[int]*Key),
+		changed: make(chan struct{}),
+	}
+}
+
+// SetInit sets the init section (EXT-X-MAP) of the segments appended after
+// it. Setting the current one again is a no-op.
+func (w *Window) SetInit(data []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if cur, ok := w.inits[w.initID]; ok && string(cur) == string(data) {
+		return
+	}
+	w.initID++
+	w.inits[w.initID] = data
+}
+
+// SetKey sets the key of the segments appended after it, nil if they are
+// clear. Setting the current one again is a no-op.
+func (w *Window) SetKey(k *Key) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	cur := w.keys[w.keyID]
+	switch {
+	case k == nil:
+		w.keyID = 0
+	case cur != nil && cur.Method == k.Method && cur.KeyFormat == k.KeyFormat &&
+		string(cur.IV) == string(k.IV) && string(cur.Data) == string(k.Data):
+	default:
+		w.lastKeyID++
+		w.keyID = w.lastKeyID
+		w.keys[w.keyID] = k
+	}
+}
+
+// Discontinue marks the next segment as the start of a discontinuity.
+func (w *Window) Discontinue() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.segments) > 0 {
+		w.discontinuity = true
+	}
+}
+
+// Append adds a segment of the given duration in seconds and returns its
+// sequence number.
+func (w *Window) Append(duration float64, ext string, data []byte) uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	seg := &Segment{
+		SeqID:         w.nextSeq,
+		Duration:      duration,
+		Discontinuity: w.discontinuity,
+		KeyID:         w.keyID,
+		Ext:           ext,
+		Data:          data,
+	}
+	if _, ok := w.inits[w.initID]; ok {
+		seg.InitID = w.initID
+	}
+	w.nextSeq++
+	w.discontinuity = false
+	w.segments = append(w.segments, seg)
+	if i := len(w.segments) - w.size - 1; i >= 0 && w.segments[i].Discontinuity {
+		// Its tag just left the playlist.
+		w.discontinuitySeq++
+	}
+	if n := len(w.segments) - w.size - windowGrace; n > 0 {
+		w.segments = w.segments[n:]
+		w.pruneInits()
+		w.pruneKeys()
+	}
+	w.notify()
+	return seg.SeqID
+}
+
+// End marks the stream as ended; the playlist gets an EXT-X-ENDLIST tag.
+func (w *Window) End() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.ended {
+		w.ended = true
+		w.notify()
+	}
+}
+
+// Segment returns the segment with sequence number seq, if still held.
+func (w *Window) Segment(seq uint64) (*Segment, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.segments) == 0 || seq < w.segments[0].SeqID || seq >= w.nextSeq {
+		return nil, false
+	}
+	return w.segments[seq-w.segments[0].SeqID], true
+}
+
+// Init returns the init section with the given ID, if still referenced.
+func (w *Window) Init(id int) ([]byte, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	data, ok := w.inits[id]
+	return data, ok
+}
+
+// Key returns the key with the given ID, if still referenced.
+func (w *Window) Key(id int) (*Key, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	k, ok := w.keys[id]
+	return k, ok
+}
+
+// Wait blocks until the window lists a segment or has ended, or ctx is done.
+func (w *Window) Wait(ctx context.Context) error {
+	for {
+		w.mu.Lock()
+		ready, changed := len(w.segments) > 0 || w.ended, w.changed
+		w.mu.Unlock()
+		if ready {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Playlist renders the window as a media playlist. Segment, init and key
+// URIs are relative, named after the playlist: "<name>-<seq><ext>",
+// "<name>-init<id>.mp4" and "<name>-key<id>.key".
+func (w *Window) Playlist(name string) []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	listed := w.listed()
+	version, target := 3, 1.0
+	for _, seg := range listed {
+		target = max(target, seg.Duration)
+		if seg.InitID != 0 {
+			version = 6
+		}
+		if k := w.keys[seg.KeyID]; k != nil && (k.Method == MethodSampleAES || k.KeyFormat != "") {
+			version = max(version, 5)
+		}
+	}
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#EXT-X-VERSION:%d\n", version)
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target)))
+	if len(listed) > 0 {
+		fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", listed[0].SeqID)
+	} else {
+		fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", w.nextSeq)
+	}
+	if w.discontinuitySeq > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", w.discontinuitySeq)
+	}
+	initID, keyID := 0, 0
+	for _, seg := range listed {
+		if seg.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if seg.InitID != initID && seg.InitID != 0 {
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"%s-init%d.mp4\"\n", name, seg.InitID)
+		}
+		initID = seg.InitID
+		if seg.KeyID != keyID {
+			if k := w.keys[seg.KeyID]; k != nil {
+				fmt.Fprintf(&b, "#EXT-X-KEY:METHOD=%s,URI=\"%s-key%d.key\",IV=0x%X", k.Method, name, seg.KeyID, k.IV)
+				if k.KeyFormat != "" {
+					fmt.Fprintf(&b, ",KEYFORMAT=\"%s\"", k.KeyFormat)
+				}
+				b.WriteString("\n")
+			} else {
+				b.WriteString("#EXT-X-KEY:METHOD=NONE\n")
+			}
+		}
+		keyID = seg.KeyID
+		fmt.Fprintf(&b, "#EXTINF:%s,\n", strconv.FormatFloat(seg.Duration, 'f', 3, 64))
+		fmt.Fprintf(&b, "%s-%d%s\n", name, seg.SeqID, seg.Ext)
+	}
+	if w.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return []byte(b.String())
+}
+
+// pruneInits drops the init sections no held segment refers to, except the
+// current one.
+func (w *Window) pruneInits() {
+	used := map[int]bool{w.initID: true}
+	for _, seg := range w.segments {
+		used[seg.InitID] = true
+	}
+	for id := range w.inits {
+		if !used[id] {
+			delete(w.inits, id)
+		}
+	}
+}
+
+// pruneKeys drops the keys no held segment refers to, except the current
+// one.
+func (w *Window) pruneKeys() {
+	used := map[int]bool{w.keyID: true}
+	for _, seg := range w.segments {
+		used[seg.KeyID] = true
+	}
+	for id := range w.keys {
+		if !used[id] {
+			delete(w.keys, id)
+		}
+	}
+}
+
+// listed returns the segments in the playlist, the last size held.
+func (w *Window) listed() []*Segment {
+	return w.segments[max(len(w.segments)-w.size, 0):]
+}
+
+func (w *Window) notify() {
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
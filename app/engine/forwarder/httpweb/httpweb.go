@@ -1,6 +1,7 @@
 package httpweb
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -34,11 +35,12 @@ func (h *HTTPWebForwarder) Stream(extractFn stream.ExtractFunc, opts ...stream.S
 	return stream.NewStream(extractFn, h.fetch, opts...)
 }
 
-// fetch makes a GET request and returns the response body.
-func (h *HTTPWebForwarder) fetch(u string, headers http.Header) (io.ReadCloser, error) {
+// fetch makes a GET request and returns the response body. The body stops
+// reading once ctx is canceled.
+func (h *HTTPWebForwarder) fetch(ctx context.Context, u string, headers http.Header) (io.ReadCloser, error) {
 	log := global.Log.WithField("func", "app.engine.forwarder.httpweb.fetch")
 	log.WithField("field", "backend url").Debug(u)
-	req, err := http.NewRequest("GET", u, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
 		return nil, fmt.Errorf("making backend request error: %w", err)
 	}
@@ -47,7 +49,7 @@ func (h *HTTPWebForwarder) fetch(u string, headers http.Header) (io.ReadCloser,
 	}
 	resp, err := h.Client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("sending backend request error: %w", err)
+		return nil, stream.WrapError("", stream.PhaseFetch, u, fmt.Errorf("sending backend request error: %w", err))
 	}
 	switch resp.StatusCode {
 	case 200:
@@ -62,10 +64,10 @@ func (h *HTTPWebForwarder) fetch(u string, headers http.Header) (io.ReadCloser,
 		if err != nil {
 			return nil, fmt.Errorf("err url in location")
 		}
-		return h.fetch(loc, headers)
+		return h.fetch(ctx, loc, headers)
 	default:
 		resp.Body.Close()
-		return nil, fmt.Errorf("err got: %s", resp.Status)
+		return nil, stream.StatusError("", stream.PhaseFetch, u, resp)
 	}
 }
 
@@ -75,7 +77,7 @@ func (h *HTTPWebForwarder) Forward(ctx *gin.Context, headers http.Header, u stri
 	if depth > 10 {
 		return errors.New("too many redirections")
 	}
-	req, err := http.NewRequest("GET", u, nil)
+	req, err := http.NewRequestWithContext(ctx.Request.Context(), "GET", u, nil)
 	if err != nil {
 		return fmt.Errorf("making backend request error: %w\n", err)
 	}
@@ -0,0 +1,340 @@
+package mpegts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+
+	"github.com/nv4d1k/live-stream-forwarder/global"
+)
+
+// Frame is a PES packet of an elementary stream: usually one access unit of
+// video, or one or more audio frames.
+type Frame struct {
+	PID          uint16
+	StreamType   byte  // StreamType* of the PID in the PMT
+	PTS, DTS     int64 // 90 kHz, 33 bits; DTS equals PTS if absent
+	RandomAccess bool  // the adaptation field flagged a random access point
+	Data         []byte
+}
+
+// pesBuffer collects the packets of a PES packet.
+type pesBuffer struct {
+	data         []byte
+	randomAccess bool
+	started      bool // a unit start has been seen since the last error
+	cc           byte
+	ccValid      bool
+}
+
+// Demuxer splits a transport stream, written in chunks of any size, into the
+// PES packets of the elementary streams listed in the first program's PMT.
+// Data between packets is skipped up to the next position where packets are
+// aligned again; PES packets with lost packets are dropped.
+type Demuxer struct {
+	onFrame func(Frame) error
+
+	buf     []byte
+	pmtPID  int // -1 until the PAT has been seen
+	streams []Stream
+	pes     map[uint16]*pesBuffer
+
+	resyncing bool
+	resyncs   int
+	skipped   int64
+}
+
+// NewDemuxer returns a Demuxer that calls onFrame for every complete PES
+// packet in stream order. A PES packet of unbounded length is complete when
+// the next one on its PID begins, or on Flush. The Frame's Data is only
+// valid during the call.
+func NewDemuxer(onFrame func(Frame) error) *Demuxer {
+	return &Demuxer{onFrame: onFrame, pmtPID: -1, pes: make(map[uint16]*pesBuffer)}
+}
+
+// Streams returns the elementary streams of the last PMT.
+func (d *Demuxer) Streams() []Stream {
+	return slices.Clone(d.streams)
+}
+
+// Resyncs returns the number of times the demuxer lost and regained packet
+// alignment, and the number of bytes it skipped doing so.
+func (d *Demuxer) Resyncs() (count int, skipped int64) {
+	return d.resyncs, d.skipped
+}
+
+// Write parses p and calls onFrame for every PES packet it completes.
+// Errors from onFrame are returned as is, after the packet completing the
+// frame has been consumed.
+func (d *Demuxer) Write(p []byte) (int, error) {
+	d.buf = append(d.buf, p...)
+	off := 0
+	var err error
+	for err == nil && off+PacketSize <= len(d.buf) {
+		b := d.buf[off:]
+		if b[0] != syncByte || (len(b) > PacketSize && b[PacketSize] != syncByte) {
+			n, ok := d.resync(b)
+			off += n
+			if !ok {
+				break
+			}
+			continue
+		}
+		if d.resyncing {
+			d.resyncing = false
+			global.Log.WithField("func", "app.engine.forwarder.mpegts.Demuxer.Write").
+				WithField("skipped", d.skipped).Debug("transport stream alignment recovered")
+		}
+		err = d.packet(b[:PacketSize])
+		off += PacketSize
+	}
+	d.buf = append(d.buf[:0], d.buf[off:]...)
+	return len(p), err
+}
+
+// Flush completes the PES packets still being collected, as at the end of
+// the stream.
+func (d *Demuxer) Flush() error {
+	for _, s := range d.streams {
+		if err := d.emit(s.PID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resync looks for the next packet in b, which does not start with an
+// aligned packet: a sync byte followed by another one a packet later. It
+// returns the number of bytes to skip, and whether a packet was found at that
+// offset; if not, the caller waits for more data.
+func (d *Demuxer) resync(b []byte) (int, bool) {
+	if !d.resyncing {
+		d.resyncing = true
+		d.resyncs++
+		global.Log.WithField("func", "app.engine.forwarder.mpegts.Demuxer.resync").
+			Warn("transport stream out of sync, resynchronizing")
+	}
+	for i := 1; i < len(b); i++ {
+		if b[i] != syncByte {
+			continue
+		}
+		if i+PacketSize >= len(b) {
+			d.skipped += int64(i)
+			return i, false
+		}
+		if b[i+PacketSize] == syncByte {
+			d.skipped += int64(i)
+			return i, true
+		}
+	}
+	d.skipped += int64(len(b))
+	return len(b), false
+}
+
+// packet parses a single transport packet.
+func (d *Demuxer) packet(p []byte) error {
+	if p[1]&0x80 != 0 {
+		return nil // transport_error_indicator
+	}
+	pid := uint16(p[1]&0x1F)<<8 | uint16(p[2])
+	unitStart := p[1]&0x40 != 0
+	control := p[3] >> 4 & 0x03
+	payload := p[4:]
+	randomAccess := false
+	if control&0x02 != 0 {
+		n := int(payload[0])
+		if n > len(payload)-1 {
+			return nil
+		}
+		randomAccess = n > 0 && payload[1]&0x40 != 0
+		payload = payload[1+n:]
+	}
+	if control&0x01 == 0 {
+		return nil // no payload
+	}
+
+	switch {
+	case pid == PIDPAT:
+		if unitStart {
+			d.parsePAT(payload)
+		}
+		return nil
+	case int(pid) == d.pmtPID:
+		if unitStart {
+			d.parsePMT(payload)
+		}
+		return nil
+	}
+	b := d.pes[pid]
+	if b == nil {
+		return nil // not an elementary stream of the program
+	}
+
+	cc := p[3] & 0x0F
+	if b.ccValid && cc == b.cc {
+		return nil // duplicate packet
+	}
+	lost := b.ccValid && cc != (b.cc+1)&0x0F
+	b.cc, b.ccValid = cc, true
+
+	var err error
+	if unitStart {
+		err = d.emit(pid)
+		b.started = true
+		b.randomAccess = randomAccess
+	} else if lost && b.started {
+		global.Log.WithField("func", "app.engine.forwarder.mpegts.Demuxer.packet").
+			WithField("pid", pid).Debug("packet loss, dropping PES packet")
+		b.data = b.data[:0]
+		b.started = false
+	}
+	if !b.started {
+		return err
+	}
+	b.data = append(b.data, payload...)
+	if n := pesLength(b.data); n > 0 && len(b.data) >= n {
+		if emitErr := d.emit(pid); err == nil {
+			err = emitErr
+		}
+	}
+	return err
+}
+
+// pesLength returns the size of the PES packet starting in b, or 0 if it is
+// unbounded or not known yet.
+func pesLength(b []byte) int {
+	if len(b) < 6 {
+		return 0
+	}
+	if n := int(binary.BigEndian.Uint16(b[4:])); n > 0 {
+		return 6 + n
+	}
+	return 0
+}
+
+// emit parses the PES packet collected for pid and passes it to onFrame.
+func (d *Demuxer) emit(pid uint16) error {
+	b := d.pes[pid]
+	if b == nil || len(b.data) == 0 {
+		return nil
+	}
+	pes := b.data
+	b.data = b.data[:0]
+	b.started = false
+	if n := pesLength(pes); n > 0 && len(pes) > n {
+		pes = pes[:n]
+	}
+
+	log := global.Log.WithField("func", "app.engine.forwarder.mpegts.Demuxer.emit").WithField("pid", pid)
+	if len(pes) < 9 || !bytes.HasPrefix(pes, []byte{0x00, 0x00, 0x01}) {
+		log.Debug("malformed PES packet")
+		return nil
+	}
+	headerEnd := 9 + int(pes[8])
+	flags := pes[7] >> 6
+	if headerEnd > len(pes) || flags == 0x01 || (flags&0x02 != 0 && headerEnd < 14) || (flags == 0x03 && headerEnd < 19) {
+		log.Debug("malformed PES header")
+		return nil
+	}
+	if flags == 0 {
+		log.Debug("PES packet without PTS")
+		return nil
+	}
+	f := Frame{PID: pid, RandomAccess: b.randomAccess, Data: pes[headerEnd:]}
+	f.PTS = readTimestamp(pes[9:])
+	f.DTS = f.PTS
+	if flags == 0x03 {
+		f.DTS = readTimestamp(pes[14:])
+	}
+	for _, s := range d.streams {
+		if s.PID == pid {
+			f.StreamType = s.Type
+		}
+	}
+	if d.onFrame == nil {
+		return nil
+	}
+	return d.onFrame(f)
+}
+
+// readTimestamp reads a 33-bit PTS or DTS.
+func readTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// section returns the body of the PSI section starting a payload unit, the
+// part between the section length and the CRC, if it has tableID, fits in
+// the packet and its CRC is correct.
+func section(payload []byte, tableID byte) ([]byte, bool) {
+	if len(payload) < 1 || 1+int(payload[0])+3 > len(payload) {
+		return nil, false
+	}
+	s := payload[1+int(payload[0]):]
+	length := int(binary.BigEndian.Uint16(s[1:]) & 0x0FFF)
+	if s[0] != tableID || length < 4+5 || 3+length > len(s) {
+		return nil, false
+	}
+	s = s[:3+length]
+	if crc32(s[:len(s)-4]) != binary.BigEndian.Uint32(s[len(s)-4:]) {
+		return nil, false
+	}
+	return s[3 : len(s)-4], true
+}
+
+// parsePAT finds the PMT PID of the first program.
+func (d *Demuxer) parsePAT(payload []byte) {
+	body, ok := section(payload, 0x00)
+	if !ok {
+		return
+	}
+	for programs := body[5:]; len(programs) >= 4; programs = programs[4:] {
+		if binary.BigEndian.Uint16(programs) == 0 {
+			continue // network PID
+		}
+		pid := int(binary.BigEndian.Uint16(programs[2:]) & 0x1FFF)
+		if pid != d.pmtPID {
+			global.Log.WithField("func", "app.engine.forwarder.mpegts.Demuxer.parsePAT").
+				WithField("pid", pid).Debug("program map table PID")
+			d.pmtPID = pid
+		}
+		return
+	}
+}
+
+// parsePMT updates the elementary streams of the program.
+func (d *Demuxer) parsePMT(payload []byte) {
+	body, ok := section(payload, 0x02)
+	if !ok || len(body) < 9 {
+		return
+	}
+	infoEnd := 9 + int(binary.BigEndian.Uint16(body[7:])&0x0FFF)
+	if infoEnd > len(body) {
+		return
+	}
+	var streams []Stream
+	for es := body[infoEnd:]; len(es) >= 5; {
+		s := Stream{PID: binary.BigEndian.Uint16(es[1:]) & 0x1FFF, Type: es[0]}
+		streams = append(streams, s)
+		n := 5 + int(binary.BigEndian.Uint16(es[3:])&0x0FFF)
+		if n > len(es) {
+			break
+		}
+		es = es[n:]
+	}
+	if slices.Equal(streams, d.streams) {
+		return
+	}
+	global.Log.WithField("func", "app.engine.forwarder.mpegts.Demuxer.parsePMT").
+		WithField("streams", streams).Debug("program streams changed")
+	for pid := range d.pes {
+		if !slices.ContainsFunc(streams, func(s Stream) bool { return s.PID == pid }) {
+			delete(d.pes, pid)
+		}
+	}
+	for _, s := range streams {
+		if d.pes[s.PID] == nil {
+			d.pes[s.PID] = &pesBuffer{}
+		}
+	}
+	d.streams = streams
+}
@@ -0,0 +1,64 @@
+// Package mpegts reads and writes MPEG transport streams (ISO/IEC 13818-1)
+// carrying a single program: the container of HLS, and of what players
+// that only accept TS are served.
+package mpegts
+
+// PacketSize is the size of a transport stream packet.
+const PacketSize = 188
+
+const syncByte = 0x47
+
+// Well-known PIDs. The program map table and elementary stream PIDs are the
+// ones most muxers use.
+const (
+	PIDPAT   uint16 = 0x0000
+	PIDPMT   uint16 = 0x1000
+	PIDVideo uint16 = 0x0100
+	PIDAudio uint16 = 0x0101
+)
+
+// Stream types of the program map table.
+const (
+	StreamTypeMPEG1Audio byte = 0x03 // MP3
+	StreamTypeMPEG2Audio byte = 0x04
+	StreamTypeAAC        byte = 0x0F // AAC in ADTS
+	StreamTypeH264       byte = 0x1B
+	StreamTypeH265       byte = 0x24
+)
+
+// Clock is the frequency of PTS and DTS values.
+const Clock = 90000
+
+// timestampMask wraps 33-bit PTS and DTS values.
+const timestampMask = 1<<33 - 1
+
+// crcTable is the CRC-32/MPEG-2 table: polynomial 0x04C11DB7, not reflected.
+var crcTable = func() [256]uint32 {
+	var t [256]uint32
+	for i := range t {
+		c := uint32(i) << 24
+		for range 8 {
+			if c&0x80000000 != 0 {
+				c = c<<1 ^ 0x04C11DB7
+			} else {
+				c <<= 1
+			}
+		}
+		t[i] = c
+	}
+	return t
+}()
+
+// crc32 returns the CRC of a PSI section.
+func crc32(b []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, c := range b {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^c]
+	}
+	return crc
+}
+
+// IsVideo reports whether streamType is a video stream type.
+func IsVideo(streamType byte) bool {
+	return streamType == StreamTypeH264 || streamType == StreamTypeH265
+}
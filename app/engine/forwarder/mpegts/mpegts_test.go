@@ -0,0 +1,259 @@
+package mpegts
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+func TestCRC32(t *testing.T) {
+	// Check value of CRC-32/MPEG-2.
+	if got := crc32([]byte("123456789")); got != 0x0376E6E7 {
+		t.Errorf("crc32() = 0x%08X, want 0x0376E6E7", got)
+	}
+}
+
+// tsUnits reassembles the payload units of every PID in a transport stream,
+// checking packet framing and continuity counters.
+func tsUnits(t *testing.T, ts []byte) map[uint16][][]byte {
+	t.Helper()
+	if len(ts)%PacketSize != 0 {
+		t.Fatalf("stream of %d bytes is not a whole number of packets", len(ts))
+	}
+	units := make(map[uint16][][]byte)
+	cc := make(map[uint16]byte)
+	for off := 0; off < len(ts); off += PacketSize {
+		p := ts[off : off+PacketSize]
+		if p[0] != syncByte {
+			t.Fatalf("packet at %d: sync byte 0x%02X", off, p[0])
+		}
+		pid := uint16(p[1]&0x1F)<<8 | uint16(p[2])
+		if last, ok := cc[pid]; ok && p[3]&0x0F != (last+1)&0x0F {
+			t.Fatalf("packet at %d: PID 0x%04X continuity counter %d after %d", off, pid, p[3]&0x0F, last)
+		}
+		cc[pid] = p[3] & 0x0F
+		payload := p[4:]
+		if p[3]&0x20 != 0 {
+			payload = payload[1+int(payload[0]):]
+		}
+		if p[1]&0x40 != 0 {
+			units[pid] = append(units[pid], nil)
+		}
+		if n := len(units[pid]); n > 0 {
+			units[pid][n-1] = append(units[pid][n-1], payload...)
+		}
+	}
+	return units
+}
+
+// parsePES returns the PTS, DTS and data of a PES packet.
+func parsePES(t *testing.T, pes []byte) (pts, dts int64, data []byte) {
+	t.Helper()
+	if !bytes.HasPrefix(pes, []byte{0, 0, 1}) {
+		t.Fatalf("PES packet starts with %x", pes[:4])
+	}
+	ts := func(b []byte) int64 {
+		return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+	}
+	flags := pes[7]
+	pts = ts(pes[9:])
+	dts = pts
+	if flags&0x40 != 0 {
+		dts = ts(pes[14:])
+	}
+	data = pes[9+int(pes[8]):]
+	if length := int(binary.BigEndian.Uint16(pes[4:])); length != 0 && length != len(pes)-6 {
+		t.Fatalf("PES length %d, want %d", length, len(pes)-6)
+	}
+	return pts, dts, data
+}
+
+// checkSection verifies the CRC of a PSI unit and returns the section body.
+func checkSection(t *testing.T, unit []byte) []byte {
+	t.Helper()
+	section := unit[1+int(unit[0]):]
+	length := int(binary.BigEndian.Uint16(section[1:]) & 0x0FFF)
+	section = section[:3+length]
+	if got, want := crc32(section[:len(section)-4]), binary.BigEndian.Uint32(section[len(section)-4:]); got != want {
+		t.Fatalf("section CRC 0x%08X, want 0x%08X", got, want)
+	}
+	return section[3 : len(section)-4]
+}
+
+func TestMuxer(t *testing.T) {
+	var out bytes.Buffer
+	m := NewMuxer(&out)
+	m.SetStream(PIDVideo, StreamTypeH264)
+	m.SetStream(PIDAudio, StreamTypeAAC)
+
+	type frame struct {
+		pid      uint16
+		pts, dts int64
+		key      bool
+		size     int
+	}
+	// Sizes around the packet boundaries exercise every stuffing case.
+	frames := []frame{
+		{PIDVideo, 126000, 120000, true, 1000},
+		{PIDAudio, 120000, 120000, false, 1},
+		{PIDAudio, 121920, 121920, false, 170},
+		{PIDAudio, 123840, 123840, false, 169},
+		{PIDVideo, 129000, 123000, false, 175},
+		{PIDVideo, 132000, 132000, false, 176},
+		{PIDAudio, 125760, 125760, false, 184},
+		{PIDVideo, 135000, 135000, true, 366},
+	}
+	for i, f := range frames {
+		data := bytes.Repeat([]byte{byte(i + 1)}, f.size)
+		if err := m.WritePES(f.pid, f.pts, f.dts, f.key, data); err != nil {
+			t.Fatalf("WritePES: %v", err)
+		}
+	}
+	if err := m.WritePES(0x200, 0, 0, false, []byte{1}); err == nil {
+		t.Error("WritePES() to an unknown PID succeeded")
+	}
+
+	units := tsUnits(t, out.Bytes())
+	if got := len(units[PIDPAT]); got != 2 {
+		t.Errorf("%d PATs, want one at the start and one per keyframe", got)
+	}
+	pat := checkSection(t, units[PIDPAT][0])
+	if pmtPID := binary.BigEndian.Uint16(pat[7:]) & 0x1FFF; pmtPID != PIDPMT {
+		t.Errorf("PAT points to PID 0x%04X, want 0x%04X", pmtPID, PIDPMT)
+	}
+	pmt := checkSection(t, units[PIDPMT][0])
+	if pcrPID := binary.BigEndian.Uint16(pmt[5:]) & 0x1FFF; pcrPID != PIDVideo {
+		t.Errorf("PCR PID 0x%04X, want 0x%04X", pcrPID, PIDVideo)
+	}
+	wantES := []byte{StreamTypeH264, 0xE1, 0x00, 0xF0, 0x00, StreamTypeAAC, 0xE1, 0x01, 0xF0, 0x00}
+	if es := pmt[9:]; !bytes.Equal(es, wantES) {
+		t.Errorf("PMT streams = %x, want %x", es, wantES)
+	}
+
+	next := map[uint16]int{}
+	for i, f := range frames {
+		pes := units[f.pid][next[f.pid]]
+		next[f.pid]++
+		pts, dts, data := parsePES(t, pes)
+		if pts != f.pts || dts != f.dts {
+			t.Errorf("frame %d: PTS/DTS = %d/%d, want %d/%d", i, pts, dts, f.pts, f.dts)
+		}
+		if want := bytes.Repeat([]byte{byte(i + 1)}, f.size); !bytes.Equal(data, want) {
+			t.Errorf("frame %d: got %d bytes of data, want %d", i, len(data), f.size)
+		}
+	}
+
+	// A new stream bumps the PMT version.
+	out.Reset()
+	m.SetStream(PIDAudio, StreamTypeMPEG1Audio)
+	if err := m.WritePES(PIDAudio, 0, 0, false, []byte{1}); err != nil {
+		t.Fatalf("WritePES: %v", err)
+	}
+	units = tsUnits(t, out.Bytes())
+	pmt = checkSection(t, units[PIDPMT][0])
+	if version := pmt[2] >> 1 & 0x1F; version != 1 {
+		t.Errorf("PMT version = %d, want 1", version)
+	}
+}
+
+func TestDemuxer(t *testing.T) {
+	type frame struct {
+		pid      uint16
+		pts, dts int64
+		key      bool
+		size     int
+	}
+	frames := []frame{
+		{PIDVideo, 126000, 120000, true, 1000},
+		{PIDAudio, 120000, 120000, false, 300},
+		{PIDVideo, 129000, 123000, false, 184},
+		{PIDAudio, 121920, 121920, false, 1},
+		{PIDVideo, 132000, 132000, false, 5000},
+	}
+	var ts bytes.Buffer
+	m := NewMuxer(&ts)
+	m.SetStream(PIDVideo, StreamTypeH264)
+	m.SetStream(PIDAudio, StreamTypeAAC)
+	for i, f := range frames {
+		if err := m.WritePES(f.pid, f.pts, f.dts, f.key, bytes.Repeat([]byte{byte(i + 1)}, f.size)); err != nil {
+			t.Fatalf("WritePES: %v", err)
+		}
+	}
+	stream := ts.Bytes()
+
+	tests := []struct {
+		name        string
+		input       []byte
+		chunk       int
+		want        []int // indexes into frames
+		wantResyncs int
+	}{
+		{name: "whole", input: stream, chunk: len(stream), want: []int{0, 1, 2, 3, 4}},
+		{name: "byte by byte", input: stream, chunk: 1, want: []int{0, 1, 2, 3, 4}},
+		{
+			name:        "garbage between packets",
+			input:       slices.Concat(stream[:3*PacketSize], []byte{0x47, 0x00, 0x47}, stream[3*PacketSize:]),
+			chunk:       100,
+			want:        []int{0, 1, 2, 3, 4},
+			wantResyncs: 1,
+		},
+		{
+			// The second packet of the first video frame is lost.
+			name:  "lost packet",
+			input: slices.Concat(stream[:3*PacketSize], stream[4*PacketSize:]),
+			chunk: 1000,
+			want:  []int{1, 2, 3, 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []Frame
+			d := NewDemuxer(func(f Frame) error {
+				f.Data = bytes.Clone(f.Data)
+				got = append(got, f)
+				return nil
+			})
+			for b := tt.input; len(b) > 0; {
+				n := min(tt.chunk, len(b))
+				if _, err := d.Write(b[:n]); err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+				b = b[n:]
+			}
+			if err := d.Flush(); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+			if want := m.Streams(); !slices.Equal(d.Streams(), want) {
+				t.Errorf("Streams() = %v, want %v", d.Streams(), want)
+			}
+			if resyncs, _ := d.Resyncs(); resyncs != tt.wantResyncs {
+				t.Errorf("Resyncs() = %d, want %d", resyncs, tt.wantResyncs)
+			}
+			// Video frames are unbounded and only complete when the
+			// next one begins, so only the order per PID is kept.
+			slices.SortStableFunc(got, func(a, b Frame) int { return cmp.Compare(a.PID, b.PID) })
+			want := slices.Clone(tt.want)
+			slices.SortStableFunc(want, func(a, b int) int { return cmp.Compare(frames[a].pid, frames[b].pid) })
+			if len(got) != len(want) {
+				t.Fatalf("got %d frames, want %d", len(got), len(want))
+			}
+			for i, g := range got {
+				idx := want[i]
+				f := frames[idx]
+				wantType := StreamTypeAAC
+				if f.pid == PIDVideo {
+					wantType = StreamTypeH264
+				}
+				if g.PID != f.pid || g.StreamType != wantType || g.PTS != f.pts || g.DTS != f.dts || g.RandomAccess != f.key {
+					t.Errorf("frame %d = {PID 0x%04X type 0x%02X PTS %d DTS %d key %v}, want frame %d",
+						i, g.PID, g.StreamType, g.PTS, g.DTS, g.RandomAccess, idx)
+				}
+				if want := bytes.Repeat([]byte{byte(idx + 1)}, f.size); !bytes.Equal(g.Data, want) {
+					t.Errorf("frame %d: got %d bytes of data, want %d", i, len(g.Data), f.size)
+				}
+			}
+		})
+	}
+}
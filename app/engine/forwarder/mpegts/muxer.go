@@ -0,0 +1,280 @@
+package mpegts
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// psiInterval is the number of packets after which the PAT and PMT are
+// repeated even without a keyframe, so a player tuning in mid-stream does not
+// wait long for them.
+const psiInterval = 400
+
+// pcrDelay is how far the PCR runs behind the DTS of the frame it is sent
+// with, giving decoders room to buffer. Callers keep timestamps above it.
+const pcrDelay = Clock * 7 / 10
+
+// Stream is an elementary stream of the program.
+type Stream struct {
+	PID  uint16
+	Type byte // StreamType*
+}
+
+// Muxer writes frames of the program's elementary streams as PES packets
+// into a transport stream. The PAT and PMT are written before the first
+// frame, before every keyframe, periodically, and whenever the set of
+// streams changes. A Muxer is not safe for concurrent use.
+type Muxer struct {
+	w       io.Writer
+	streams []Stream
+
+	pmtVersion byte
+	psiDirty   bool // streams changed since the PMT was last written
+	psiWritten bool
+	sincePSI   int // packets since the last PAT/PMT
+	cc         map[uint16]byte
+	buf        []byte
+}
+
+func NewMuxer(w io.Writer) *Muxer {
+	return &Muxer{w: w, cc: make(map[uint16]byte)}
+}
+
+// SetStream adds an elementary stream to the program, or changes the type of
+// an existing one.
+func (m *Muxer) SetStream(pid uint16, streamType byte) {
+	i := slices.IndexFunc(m.streams, func(s Stream) bool { return s.PID == pid })
+	switch {
+	case i < 0:
+		m.streams = append(m.streams, Stream{PID: pid, Type: streamType})
+	case m.streams[i].Type != streamType:
+		m.streams[i].Type = streamType
+	default:
+		return
+	}
+	m.psiDirty = true
+	if m.psiWritten {
+		m.pmtVersion = (m.pmtVersion + 1) & 0x1F
+	}
+}
+
+// Streams returns the program's elementary streams.
+func (m *Muxer) Streams() []Stream {
+	return slices.Clone(m.streams)
+}
+
+// pcrPID returns the PID carrying the PCR: the video stream if there is one.
+func (m *Muxer) pcrPID() uint16 {
+	for _, s := range m.streams {
+		if IsVideo(s.Type) {
+			return s.PID
+		}
+	}
+	if len(m.streams) > 0 {
+		return m.streams[0].PID
+	}
+	return 0x1FFF
+}
+
+// WritePES writes one frame of the stream on pid with the given 90 kHz
+// presentation and decoding timestamps. randomAccess marks a keyframe.
+func (m *Muxer) WritePES(pid uint16, pts, dts int64, randomAccess bool, data []byte) error {
+	i := slices.IndexFunc(m.streams, func(s Stream) bool { return s.PID == pid })
+	if i < 0 {
+		return fmt.Errorf("no stream with PID 0x%04x", pid)
+	}
+	video := IsVideo(m.streams[i].Type)
+	pcrPID := m.pcrPID()
+
+	m.buf = m.buf[:0]
+	if !m.psiWritten || m.psiDirty || m.sincePSI >= psiInterval || (randomAccess && pid == pcrPID) {
+		m.appendPSI()
+	}
+
+	pes := m.appendPESHeader(nil, video, pts, dts, len(data))
+	pcr := int64(-1)
+	if pid == pcrPID {
+		pcr = max(dts-pcrDelay, 0)
+	}
+	m.appendPackets(pid, pes, data, pcr, randomAccess)
+
+	_, err := m.w.Write(m.buf)
+	return err
+}
+
+// appendPESHeader appends a PES header for a frame of dataSize bytes.
+func (m *Muxer) appendPESHeader(b []byte, video bool, pts, dts int64, dataSize int) []byte {
+	streamID := byte(0xC0)
+	if video {
+		streamID = 0xE0
+	}
+	pts &= timestampMask
+	dts &= timestampMask
+	withDTS := dts != pts
+	headerLen := 5
+	if withDTS {
+		headerLen = 10
+	}
+	length := 3 + headerLen + dataSize
+	if video || length > 0xFFFF {
+		// Unbounded, allowed for video only; audio frames are small.
+		length = 0
+	}
+	b = append(b, 0x00, 0x00, 0x01, streamID, byte(length>>8), byte(length))
+	if withDTS {
+		b = append(b, 0x84, 0xC0, byte(headerLen))
+		b = appendTimestamp(b, 0x3, pts)
+		return appendTimestamp(b, 0x1, dts)
+	}
+	b = append(b, 0x84, 0x80, byte(headerLen)) // data aligned
+	return appendTimestamp(b, 0x2, pts)
+}
+
+// appendTimestamp appends a 33-bit PTS or DTS with its 4-bit prefix.
+func appendTimestamp(b []byte, prefix byte, ts int64) []byte {
+	return append(b,
+		prefix<<4|byte(ts>>29)&0x0E|1,
+		byte(ts>>22),
+		byte(ts>>14)&0xFE|1,
+		byte(ts>>7),
+		byte(ts<<1)&0xFE|1,
+	)
+}
+
+// appendPackets splits a PES packet, given as header and data, into transport
+// packets. The first packet carries the PCR if pcr >= 0 and the random access
+// indicator if requested.
+func (m *Muxer) appendPackets(pid uint16, header, data []byte, pcr int64, randomAccess bool) {
+	first := true
+	for len(header) > 0 || len(data) > 0 {
+		var af []byte // adaptation field after its length byte
+		if first && (pcr >= 0 || randomAccess) {
+			var flags byte
+			if randomAccess {
+				flags |= 0x40
+			}
+			if pcr >= 0 {
+				flags |= 0x10
+			}
+			af = append(af, flags)
+			if pcr >= 0 {
+				af = appendPCR(af, pcr)
+			}
+		}
+		afSize := 0
+		if af != nil {
+			afSize = 1 + len(af)
+		}
+		space := PacketSize - 4 - afSize
+		if remaining := len(header) + len(data); remaining < space {
+			stuffing := space - remaining
+			if af == nil {
+				// The length byte alone stuffs one byte; more
+				// needs the flags byte too.
+				af = []byte{}
+				stuffing--
+				if stuffing > 0 {
+					af = append(af, 0x00)
+					stuffing--
+				}
+			}
+			for range stuffing {
+				af = append(af, 0xFF)
+			}
+			afSize = 1 + len(af)
+			space = PacketSize - 4 - afSize
+		}
+
+		m.buf = m.appendPacketHeader(m.buf, pid, first, af != nil)
+		if af != nil {
+			m.buf = append(m.buf, byte(len(af)))
+			m.buf = append(m.buf, af...)
+		}
+		n := min(space, len(header))
+		m.buf = append(m.buf, header[:n]...)
+		header = header[n:]
+		space -= n
+		n = min(space, len(data))
+		m.buf = append(m.buf, data[:n]...)
+		data = data[n:]
+		first = false
+	}
+}
+
+// appendPCR appends a PCR with the given 90 kHz base.
+func appendPCR(b []byte, base int64) []byte {
+	base &= timestampMask
+	return append(b,
+		byte(base>>25),
+		byte(base>>17),
+		byte(base>>9),
+		byte(base>>1),
+		byte(base<<7)|0x7E, // 6 reserved bits, extension 0
+		0x00,
+	)
+}
+
+// appendPacketHeader appends the 4-byte header of a packet with a payload.
+func (m *Muxer) appendPacketHeader(b []byte, pid uint16, unitStart, adaptation bool) []byte {
+	b1 := byte(pid>>8) & 0x1F
+	if unitStart {
+		b1 |= 0x40
+	}
+	control := byte(0x10) // payload only
+	if adaptation {
+		control = 0x30
+	}
+	cc := m.cc[pid]
+	m.cc[pid] = (cc + 1) & 0x0F
+	m.sincePSI++
+	return append(b, syncByte, b1, byte(pid), control|cc)
+}
+
+// appendPSI appends a PAT and a PMT packet.
+func (m *Muxer) appendPSI() {
+	pmtPID := PIDPMT
+	pat := []byte{
+		0x00, 0x01, // transport_stream_id
+		0xC1,       // version 0, current
+		0x00, 0x00, // section numbers
+		0x00, 0x01, // program_number 1
+		0xE0 | byte(pmtPID>>8), byte(pmtPID),
+	}
+	m.appendSection(PIDPAT, 0x00, pat)
+
+	pcrPID := m.pcrPID()
+	pmt := []byte{
+		0x00, 0x01, // program_number
+		0xC1 | m.pmtVersion<<1,
+		0x00, 0x00,
+		0xE0 | byte(pcrPID>>8), byte(pcrPID),
+		0xF0, 0x00, // no program descriptors
+	}
+	for _, s := range m.streams {
+		pmt = append(pmt, s.Type, 0xE0|byte(s.PID>>8), byte(s.PID), 0xF0, 0x00)
+	}
+	m.appendSection(PIDPMT, 0x02, pmt)
+
+	m.psiDirty = false
+	m.psiWritten = true
+	m.sincePSI = 0
+}
+
+// appendSection appends a single-packet PSI section with the given table ID
+// and body, the part between the section length and the CRC.
+func (m *Muxer) appendSection(pid uint16, tableID byte, body []byte) {
+	section := make([]byte, 0, 3+len(body)+4)
+	length := len(body) + 4
+	section = append(section, tableID, 0xB0|byte(length>>8), byte(length))
+	section = append(section, body...)
+	section = binary.BigEndian.AppendUint32(section, crc32(section))
+
+	m.buf = m.appendPacketHeader(m.buf, pid, true, false)
+	m.buf = append(m.buf, 0x00) // pointer_field
+	m.buf = append(m.buf, section...)
+	for range PacketSize - 5 - len(section) {
+		m.buf = append(m.buf, 0xFF)
+	}
+}
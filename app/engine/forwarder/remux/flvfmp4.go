@@ -0,0 +1,413 @@
+package remux
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/codec"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/flv"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/fmp4"
+	"github.com/nv4d1k/live-stream-forwarder/global"
+)
+
+// Track IDs of the fragmented MP4 output.
+const (
+	fmp4VideoTrackID = 1
+	fmp4AudioTrackID = 2
+)
+
+// fmp4VideoTimescale is the timescale of the video track: FLV milliseconds.
+const fmp4VideoTimescale = 1000
+
+// defaultFrameDuration is the duration, in milliseconds, given to a video
+// sample whose successor is unknown.
+const defaultFrameDuration = 40
+
+// Fragment lengths, in milliseconds. Video is fragmented per GOP, but long
+// GOPs are cut so fragments do not pile up in memory; audio-only streams are
+// fragmented every audioFragmentDuration.
+const (
+	maxFragmentDuration   = 10000
+	audioFragmentDuration = 1000
+)
+
+// FLVToFMP4 remuxes an FLV stream into fragmented MP4 for Media Source
+// Extensions: an init segment, then one moof/mdat fragment per GOP starting
+// on a keyframe. H.264 and H.265 video (legacy or Enhanced RTMP) and AAC
+// audio are carried over; tags of other codecs are dropped. A new init
+// segment is written when a sequence header changes.
+type FLVToFMP4 struct {
+	demux *flv.Demuxer
+	w     io.Writer
+
+	video       fmp4VideoTrack
+	audio       fmp4AudioTrack
+	keySeen     bool // samples are collected from the first keyframe on
+	initWritten bool
+	initDirty   bool   // a sequence header changed since the init segment
+	seq         uint32 // sequence number of the last fragment
+	contentType string
+	unsupported map[string]bool // codecs already reported as dropped
+	buf         []byte
+
+	// onInit, if set, receives init segments instead of the output.
+	onInit func(init []byte) error
+}
+
+// flvSample is a sample waiting for its fragment.
+type flvSample struct {
+	dts  uint32 // milliseconds
+	cto  int32  // milliseconds
+	key  bool
+	data []byte
+}
+
+type fmp4VideoTrack struct {
+	entry         string // sample entry type; "" until a sequence header has been seen
+	config        []byte // decoder configuration record
+	codec         string // RFC 6381 codec parameter
+	width, height int
+	samples       []flvSample
+	lastDuration  uint32
+}
+
+type fmp4AudioTrack struct {
+	asc     codec.AudioSpecificConfig
+	config  []byte // AudioSpecificConfig; nil until a sequence header has been seen
+	samples []flvSample
+	next    int64 // decode time following the last fragment, in samples; -1 if none
+}
+
+// NewFLVToFMP4 returns an FLVToFMP4 writing fragmented MP4 to w.
+func NewFLVToFMP4(w io.Writer) Converter {
+	return newFLVToFMP4(w)
+}
+
+func newFLVToFMP4(w io.Writer) *FLVToFMP4 {
+	log := global.Log.WithField("func", "app.engine.forwarder.remux.NewFLVToFMP4")
+	log.Debug("creating FLV to fragmented MP4 remuxer")
+	r := &FLVToFMP4{w: w, unsupported: make(map[string]bool)}
+	r.audio.next = -1
+	r.demux = flv.NewDemuxer(r.writeTag)
+	return r
+}
+
+// Write parses the next chunk of the FLV stream. Fragments are written as
+// GOPs complete.
+func (r *FLVToFMP4) Write(p []byte) (int, error) {
+	return r.demux.Write(p)
+}
+
+// Flush writes the samples of the last, incomplete GOP as a fragment, at the
+// end of the stream.
+func (r *FLVToFMP4) Flush() error {
+	return r.flush(0, false)
+}
+
+// ContentType returns the MIME type of the output with its codecs
+// parameter, once the init segment has been written.
+func (r *FLVToFMP4) ContentType() string {
+	return r.contentType
+}
+
+// drop logs the first tag of an unsupported codec and drops it.
+func (r *FLVToFMP4) drop(what string) error {
+	if !r.unsupported[what] {
+		r.unsupported[what] = true
+		global.Log.WithField("func", "app.engine.forwarder.remux.FLVToFMP4.drop").
+			Warnf("%s cannot be carried in fragmented MP4, dropping it", what)
+	}
+	return nil
+}
+
+func (r *FLVToFMP4) writeTag(t flv.Tag) error {
+	switch t.Type {
+	case flv.TagVideo:
+		return r.writeVideo(t)
+	case flv.TagAudio:
+		return r.writeAudio(t)
+	}
+	return nil
+}
+
+func (r *FLVToFMP4) writeVideo(t flv.Tag) error {
+	h, err := t.Video()
+	if err != nil || h.FrameType == flv.FrameInfoCommand {
+		return nil
+	}
+	c := flvVideoCodec(h)
+	if c != flv.FourCCAVC && c != flv.FourCCHEVC {
+		return r.drop(c)
+	}
+
+	payload := t.Payload()
+	switch h.PacketType {
+	case flv.PacketSequenceHeader: // ExPacketSequenceStart too
+		return r.setVideoConfig(c == flv.FourCCHEVC, payload)
+	case flv.PacketNALU, flv.ExPacketCodedFramesX:
+	default:
+		return nil
+	}
+	if r.video.entry == "" {
+		return nil // no sequence header yet
+	}
+	keyframe := h.FrameType == flv.FrameKey
+	if !r.keySeen && !keyframe {
+		return nil
+	}
+	r.keySeen = true
+
+	if len(r.video.samples) > 0 && (keyframe || t.Timestamp-r.video.samples[0].dts >= maxFragmentDuration) {
+		if err := r.flush(t.Timestamp, true); err != nil {
+			return err
+		}
+	}
+	r.video.samples = append(r.video.samples, flvSample{
+		dts:  t.Timestamp,
+		cto:  h.CompositionTime,
+		key:  keyframe,
+		data: bytes.Clone(payload),
+	})
+	return nil
+}
+
+// setVideoConfig records a video sequence header. A changed configuration
+// ends the current fragment and makes the next one start with a new init
+// segment.
+func (r *FLVToFMP4) setVideoConfig(hevc bool, record []byte) error {
+	log := global.Log.WithField("func", "app.engine.forwarder.remux.FLVToFMP4.setVideoConfig")
+	if bytes.Equal(record, r.video.config) {
+		return nil
+	}
+	v := fmp4VideoTrack{config: bytes.Clone(record), lastDuration: r.video.lastDuration}
+	if hevc {
+		c, err := codec.ParseHEVCConfig(record)
+		if err != nil {
+			log.WithError(err).Warn("ignoring video sequence header")
+			return nil
+		}
+		v.entry = "hvc1"
+		v.codec = c.CodecString()
+		v.width, v.height = c.Size()
+	} else {
+		c, err := codec.ParseAVCConfig(record)
+		if err != nil {
+			log.WithError(err).Warn("ignoring video sequence header")
+			return nil
+		}
+		v.entry = "avc1"
+		v.codec = c.CodecString()
+		v.width, v.height = c.Size()
+	}
+	if err := r.flush(0, false); err != nil {
+		return err
+	}
+	log.WithField("codec", v.codec).Debug("video configuration changed")
+	r.video = v
+	r.initDirty = true
+	return nil
+}
+
+func (r *FLVToFMP4) writeAudio(t flv.Tag) error {
+	h, err := t.Audio()
+	if err != nil {
+		return nil
+	}
+	if c := flvAudioCodec(h); c != flv.FourCCAAC {
+		return r.drop(c)
+	}
+	payload := t.Payload()
+	switch h.PacketType {
+	case flv.PacketSequenceHeader:
+		return r.setAudioConfig(payload)
+	case flv.PacketNALU:
+	default:
+		return nil
+	}
+	if r.audio.config == nil {
+		return nil // no sequence header yet
+	}
+	if r.video.entry != "" && !r.keySeen {
+		// Start audio with the video, so the stream begins on a
+		// keyframe.
+		return nil
+	}
+	r.audio.samples = append(r.audio.samples, flvSample{dts: t.Timestamp, data: bytes.Clone(payload)})
+	if r.video.entry == "" && t.Timestamp-r.audio.samples[0].dts >= audioFragmentDuration {
+		return r.flush(0, false)
+	}
+	return nil
+}
+
+// setAudioConfig records an AAC sequence header.
+func (r *FLVToFMP4) setAudioConfig(config []byte) error {
+	if bytes.Equal(config, r.audio.config) {
+		return nil
+	}
+	asc, err := codec.ParseAudioSpecificConfig(config)
+	if err != nil {
+		global.Log.WithField("func", "app.engine.forwarder.remux.FLVToFMP4.setAudioConfig").
+			WithError(err).Warn("ignoring AAC sequence header")
+		return nil
+	}
+	if err := r.flush(0, false); err != nil {
+		return err
+	}
+	r.audio = fmp4AudioTrack{asc: asc, config: bytes.Clone(config), next: -1}
+	r.initDirty = true
+	return nil
+}
+
+// tracks returns the tracks of the init segment.
+func (r *FLVToFMP4) tracks() []fmp4.Track {
+	var tracks []fmp4.Track
+	if r.video.entry != "" {
+		tracks = append(tracks, fmp4.Track{
+			ID:          fmp4VideoTrackID,
+			Handler:     fmp4.HandlerVideo,
+			Timescale:   fmp4VideoTimescale,
+			SampleEntry: r.video.entry,
+			Config:      r.video.config,
+			Width:       r.video.width,
+			Height:      r.video.height,
+		})
+	}
+	if r.audio.config != nil {
+		channels := r.audio.asc.Channels
+		if channels == 0 {
+			channels = 2
+		}
+		tracks = append(tracks, fmp4.Track{
+			ID:          fmp4AudioTrackID,
+			Handler:     fmp4.HandlerAudio,
+			Timescale:   uint32(r.audio.asc.SampleRate),
+			SampleEntry: "mp4a",
+			Config:      r.audio.config,
+			Channels:    channels,
+			SampleRate:  r.audio.asc.SampleRate,
+		})
+	}
+	return tracks
+}
+
+// flush writes the collected samples as a fragment, preceded by an init
+// segment if needed. next is the timestamp of the video sample following
+// them, if known.
+func (r *FLVToFMP4) flush(next uint32, haveNext bool) error {
+	if len(r.video.samples) == 0 && len(r.audio.samples) == 0 {
+		return nil
+	}
+	r.buf = r.buf[:0]
+	if !r.initWritten || r.initDirty {
+		tracks := r.tracks()
+		if r.onInit != nil {
+			if err := r.onInit(fmp4.AppendInit(nil, tracks...)); err != nil {
+				return err
+			}
+		} else {
+			r.buf = fmp4.AppendInit(r.buf, tracks...)
+		}
+		r.contentType = mimeType(tracks, r.video.codec, r.audio.asc.CodecString())
+		r.initWritten = true
+		r.initDirty = false
+		global.Log.WithField("func", "app.engine.forwarder.remux.FLVToFMP4.flush").
+			WithField("contentType", r.contentType).Debug("init segment written")
+	}
+
+	var trafs []fmp4.TrackFragment
+	if samples := r.video.samples; len(samples) > 0 {
+		tf := fmp4.TrackFragment{TrackID: fmp4VideoTrackID, BaseMediaDecodeTime: uint64(samples[0].dts)}
+		for i, s := range samples {
+			duration := r.video.lastDuration
+			switch {
+			case i+1 < len(samples):
+				duration = samples[i+1].dts - s.dts
+			case haveNext:
+				duration = next - s.dts
+			}
+			if duration == 0 || duration > maxFragmentDuration {
+				duration = defaultFrameDuration
+			}
+			r.video.lastDuration = duration
+			tf.Samples = append(tf.Samples, fmp4.Sample{Duration: duration, CompositionOffset: s.cto, Keyframe: s.key, Data: s.data})
+		}
+		trafs = append(trafs, tf)
+	}
+	if samples := r.audio.samples; len(samples) > 0 {
+		// Every AAC frame has the same number of samples; timestamps
+		// only place the fragment, unless they drift away.
+		rate := int64(r.audio.asc.SampleRate)
+		base := int64(samples[0].dts) * rate / 1000
+		if r.audio.next >= 0 && base-r.audio.next < aacFrameSamples && r.audio.next-base < aacFrameSamples {
+			base = r.audio.next
+		}
+		tf := fmp4.TrackFragment{TrackID: fmp4AudioTrackID, BaseMediaDecodeTime: uint64(base)}
+		for _, s := range samples {
+			tf.Samples = append(tf.Samples, fmp4.Sample{Duration: aacFrameSamples, Keyframe: true, Data: s.data})
+		}
+		r.audio.next = base + int64(len(samples))*aacFrameSamples
+		trafs = append(trafs, tf)
+	}
+	r.seq++
+	r.buf = fmp4.AppendFragment(r.buf, r.seq, trafs...)
+	r.video.samples = r.video.samples[:0]
+	r.audio.samples = r.audio.samples[:0]
+	_, err := r.w.Write(r.buf)
+	return err
+}
+
+// pendingStart returns the timestamp of the first sample waiting for a
+// fragment.
+func (r *FLVToFMP4) pendingStart() (uint32, bool) {
+	switch v, a := r.video.samples, r.audio.samples; {
+	case len(v) > 0 && len(a) > 0:
+		return min(v[0].dts, a[0].dts), true
+	case len(v) > 0:
+		return v[0].dts, true
+	case len(a) > 0:
+		return a[0].dts, true
+	}
+	return 0, false
+}
+
+// mimeType returns the MIME type of fragmented MP4 with tracks, whose video
+// and audio codec parameters are given.
+func mimeType(tracks []fmp4.Track, videoCodec, audioCodec string) string {
+	typ := "audio/mp4"
+	var codecs []string
+	for _, t := range tracks {
+		if t.Handler == fmp4.HandlerVideo {
+			typ = "video/mp4"
+			codecs = append(codecs, videoCodec)
+		} else {
+			codecs = append(codecs, audioCodec)
+		}
+	}
+	return typ + `; codecs="` + strings.Join(codecs, ",") + `"`
+}
+
+// tsToFMP4 remuxes a transport stream into fragmented MP4 by way of FLV.
+type tsToFMP4 struct {
+	*TSToFLV
+	fmp4 *FLVToFMP4
+}
+
+// NewTSToFMP4 returns a Converter remuxing a transport stream, such as the
+// concatenated segments of an HLS stream, into fragmented MP4 like
+// FLVToFMP4.
+func NewTSToFMP4(w io.Writer) Converter {
+	f := newFLVToFMP4(w)
+	return &tsToFMP4{TSToFLV: newTSToFLV(f), fmp4: f}
+}
+
+func (r *tsToFMP4) Flush() error {
+	if err := r.TSToFLV.Flush(); err != nil {
+		return err
+	}
+	return r.fmp4.Flush()
+}
+
+func (r *tsToFMP4) ContentType() string {
+	return r.fmp4.ContentType()
+}
@@ -0,0 +1,248 @@
+package remux
+
+import (
+	"io"
+
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/codec"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/flv"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/mpegts"
+	"github.com/nv4d1k/live-stream-forwarder/global"
+)
+
+// tsTimestampOffset is added to every FLV timestamp so PTS, DTS and the PCR
+// running behind them stay positive, even for B-frames with a negative
+// composition time offset.
+const tsTimestampOffset = 2 * mpegts.Clock
+
+// FLVToTS remuxes an FLV stream into an MPEG transport stream. H.264 and
+// H.265 video (legacy or Enhanced RTMP) is converted to Annex B with the
+// parameter sets repeated before every keyframe, AAC audio is framed as ADTS
+// and MP3 passes through. Tags of other codecs are dropped.
+type FLVToTS struct {
+	demux *flv.Demuxer
+	mux   *mpegts.Muxer
+
+	video       videoTrack
+	audio       audioTrack
+	keySeen     bool            // video frames are muxed from the first keyframe on
+	unsupported map[string]bool // codecs already reported as dropped
+}
+
+type videoTrack struct {
+	streamType byte   // 0 until a sequence header has been seen
+	lengthSize int    // NAL unit length prefix size
+	paramSets  []byte // Annex B parameter sets sent before keyframes
+}
+
+type audioTrack struct {
+	streamType byte
+	asc        codec.AudioSpecificConfig
+}
+
+// NewFLVToTS returns an FLVToTS writing the transport stream to w.
+func NewFLVToTS(w io.Writer) Converter {
+	return newFLVToTS(w)
+}
+
+func newFLVToTS(w io.Writer) *FLVToTS {
+	log := global.Log.WithField("func", "app.engine.forwarder.remux.NewFLVToTS")
+	log.Debug("creating FLV to MPEG-TS remuxer")
+	r := &FLVToTS{mux: mpegts.NewMuxer(w), unsupported: make(map[string]bool)}
+	r.demux = flv.NewDemuxer(r.writeTag)
+	return r
+}
+
+// Write parses the next chunk of the FLV stream and writes the transport
+// packets of every tag it completes.
+func (r *FLVToTS) Write(p []byte) (int, error) {
+	return r.demux.Write(p)
+}
+
+func (r *FLVToTS) writeTag(t flv.Tag) error {
+	switch t.Type {
+	case flv.TagVideo:
+		return r.writeVideo(t)
+	case flv.TagAudio:
+		return r.writeAudio(t)
+	}
+	return nil
+}
+
+// drop logs the first tag of an unsupported codec and drops it.
+func (r *FLVToTS) drop(what string) error {
+	if !r.unsupported[what] {
+		r.unsupported[what] = true
+		global.Log.WithField("func", "app.engine.forwarder.remux.FLVToTS.drop").
+			Warnf("%s cannot be carried in MPEG-TS, dropping it", what)
+	}
+	return nil
+}
+
+func (r *FLVToTS) writeVideo(t flv.Tag) error {
+	h, err := t.Video()
+	if err != nil || h.FrameType == flv.FrameInfoCommand {
+		return nil
+	}
+	var hevc bool
+	switch c := flvVideoCodec(h); c {
+	case flv.FourCCAVC:
+	case flv.FourCCHEVC:
+		hevc = true
+	default:
+		return r.drop(c)
+	}
+
+	payload := t.Payload()
+	switch h.PacketType {
+	case flv.PacketSequenceHeader: // ExPacketSequenceStart too
+		return r.setVideoConfig(hevc, payload)
+	case flv.PacketNALU, flv.ExPacketCodedFramesX:
+	default:
+		return nil
+	}
+	if r.video.streamType == 0 {
+		return nil // no sequence header yet
+	}
+	keyframe := h.FrameType == flv.FrameKey
+	if !r.keySeen && !keyframe {
+		return nil
+	}
+	r.keySeen = true
+
+	nalus, err := codec.SplitLengthPrefixed(payload, r.video.lengthSize)
+	if err != nil {
+		global.Log.WithField("func", "app.engine.forwarder.remux.FLVToTS.writeVideo").
+			WithError(err).Debug("malformed video frame")
+	}
+	frame := make([]byte, 0, len(payload)+len(r.video.paramSets)+16)
+	if hevc {
+		frame = codec.AppendAnnexB(frame, []byte{codec.HEVCNALAUD << 1, 0x01, 0x50})
+	} else {
+		frame = codec.AppendAnnexB(frame, []byte{codec.AVCNALAUD, 0xF0})
+	}
+	if keyframe && !hasParameterSets(nalus, hevc) {
+		frame = append(frame, r.video.paramSets...)
+	}
+	for _, n := range nalus {
+		if isAUD(n, hevc) {
+			continue
+		}
+		frame = codec.AppendAnnexB(frame, n)
+	}
+
+	dts := int64(t.Timestamp)*90 + tsTimestampOffset
+	pts := dts + int64(h.CompositionTime)*90
+	return r.mux.WritePES(mpegts.PIDVideo, pts, dts, keyframe, frame)
+}
+
+// setVideoConfig records the parameter sets of a video sequence header.
+func (r *FLVToTS) setVideoConfig(hevc bool, record []byte) error {
+	log := global.Log.WithField("func", "app.engine.forwarder.remux.FLVToTS.setVideoConfig")
+	var sets []byte
+	if hevc {
+		c, err := codec.ParseHEVCConfig(record)
+		if err != nil {
+			log.WithError(err).Warn("ignoring video sequence header")
+			return nil
+		}
+		sets = codec.AppendAnnexB(sets, c.VPS...)
+		sets = codec.AppendAnnexB(sets, c.SPS...)
+		sets = codec.AppendAnnexB(sets, c.PPS...)
+		r.video.lengthSize = c.NALULengthSize
+		r.video.streamType = mpegts.StreamTypeH265
+	} else {
+		c, err := codec.ParseAVCConfig(record)
+		if err != nil {
+			log.WithError(err).Warn("ignoring video sequence header")
+			return nil
+		}
+		sets = codec.AppendAnnexB(sets, c.SPS...)
+		sets = codec.AppendAnnexB(sets, c.PPS...)
+		r.video.lengthSize = c.NALULengthSize
+		r.video.streamType = mpegts.StreamTypeH264
+	}
+	r.video.paramSets = sets
+	r.mux.SetStream(mpegts.PIDVideo, r.video.streamType)
+	return nil
+}
+
+func hasParameterSets(nalus [][]byte, hevc bool) bool {
+	for _, n := range nalus {
+		if hevc && codec.HEVCNALType(n) == codec.HEVCNALSPS || !hevc && codec.AVCNALType(n) == codec.AVCNALSPS {
+			return true
+		}
+	}
+	return false
+}
+
+func isAUD(nalu []byte, hevc bool) bool {
+	if hevc {
+		return codec.HEVCNALType(nalu) == codec.HEVCNALAUD
+	}
+	return codec.AVCNALType(nalu) == codec.AVCNALAUD
+}
+
+func (r *FLVToTS) writeAudio(t flv.Tag) error {
+	h, err := t.Audio()
+	if err != nil {
+		return nil
+	}
+	var aac bool
+	switch c := flvAudioCodec(h); c {
+	case flv.FourCCAAC:
+		aac = true
+	case flv.FourCCMP3:
+	default:
+		return r.drop(c)
+	}
+
+	payload := t.Payload()
+	var frame []byte
+	if aac {
+		switch h.PacketType {
+		case flv.PacketSequenceHeader:
+			asc, err := codec.ParseAudioSpecificConfig(payload)
+			if err != nil {
+				global.Log.WithField("func", "app.engine.forwarder.remux.FLVToTS.writeAudio").
+					WithError(err).Warn("ignoring AAC sequence header")
+				return nil
+			}
+			r.audio.asc = asc
+			r.setAudioStream(mpegts.StreamTypeAAC)
+			return nil
+		case flv.PacketNALU:
+		default:
+			return nil
+		}
+		if r.audio.streamType != mpegts.StreamTypeAAC {
+			return nil // no sequence header yet
+		}
+		frame, err = r.audio.asc.AppendADTSHeader(make([]byte, 0, codec.ADTSHeaderSize+len(payload)), len(payload))
+		if err != nil {
+			return r.drop(err.Error())
+		}
+		frame = append(frame, payload...)
+	} else {
+		if h.Ex != nil && h.PacketType != flv.ExPacketCodedFrames {
+			return nil
+		}
+		r.setAudioStream(mpegts.StreamTypeMPEG1Audio)
+		frame = payload
+	}
+
+	if r.video.streamType != 0 && !r.keySeen {
+		// Start audio with the video, so the stream begins on a
+		// keyframe.
+		return nil
+	}
+	pts := int64(t.Timestamp)*90 + tsTimestampOffset
+	return r.mux.WritePES(mpegts.PIDAudio, pts, pts, false, frame)
+}
+
+func (r *FLVToTS) setAudioStream(streamType byte) {
+	if r.audio.streamType == streamType {
+		return
+	}
+	r.audio.streamType = streamType
+	r.mux.SetStream(mpegts.PIDAudio, streamType)
+}
@@ -0,0 +1,140 @@
+// Package remux converts live streams between containers without touching
+// the coded audio and video, so any room can be served in the container a
+// player accepts.
+package remux
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/flv"
+)
+
+// Converter receives a stream in one container through Write and writes it
+// in another container to the writer it was created with.
+type Converter interface {
+	io.Writer
+}
+
+// flusher is implemented by Converters that hold back data until more input
+// arrives, such as the last frame of a transport stream.
+type flusher interface {
+	Flush() error
+}
+
+// NewConverterFunc creates a Converter writing its output to w.
+type NewConverterFunc func(w io.Writer) Converter
+
+// contentTyper is implemented by Converters whose output MIME type depends
+// on the stream, such as fragmented MP4 with its codecs parameter.
+type contentTyper interface {
+	ContentType() string
+}
+
+// Reader converts a source stream as it is read.
+type Reader struct {
+	src  io.ReadCloser
+	conv Converter
+	out  bytes.Buffer
+	buf  []byte
+	err  error
+}
+
+// NewReader returns a Reader yielding src converted by the Converter newConv
+// creates. Closing it closes src.
+func NewReader(src io.ReadCloser, newConv NewConverterFunc) *Reader {
+	r := &Reader{src: src, buf: make([]byte, 65536)}
+	r.conv = newConv(&r.out)
+	return r
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.fill()
+	}
+	return r.out.Read(p)
+}
+
+// ContentType returns the MIME type of the converted stream. For Converters
+// whose type depends on the stream it reads from the source until the
+// Converter has produced output, which may take until the first keyframe;
+// for others it returns def at once.
+func (r *Reader) ContentType(def string) (string, error) {
+	ct, ok := r.conv.(contentTyper)
+	if !ok {
+		return def, nil
+	}
+	for r.out.Len() == 0 {
+		if r.err != nil {
+			return "", r.err
+		}
+		r.fill()
+	}
+	return ct.ContentType(), nil
+}
+
+// fill converts the next chunk of the source.
+func (r *Reader) fill() {
+	n, err := r.src.Read(r.buf)
+	if n > 0 {
+		if _, convErr := r.conv.Write(r.buf[:n]); convErr != nil {
+			err = convErr
+		}
+	}
+	if err != nil {
+		if f, ok := r.conv.(flusher); ok && err == io.EOF {
+			if flushErr := f.Flush(); flushErr != nil {
+				err = flushErr
+			}
+		}
+		r.err = err
+	}
+}
+
+func (r *Reader) Close() error {
+	return r.src.Close()
+}
+
+// flvVideoCodec returns the codec of an FLV video tag, legacy or Enhanced
+// RTMP: flv.FourCCAVC, flv.FourCCHEVC, or a description of any other codec
+// for logging.
+func flvVideoCodec(h flv.VideoHeader) string {
+	switch {
+	case h.Ex != nil && h.Ex.Multitrack:
+		return "multitrack video"
+	case h.Ex != nil && (h.Ex.FourCC == flv.FourCCAVC || h.Ex.FourCC == flv.FourCCHEVC):
+		return h.Ex.FourCC
+	case h.Ex != nil:
+		return fmt.Sprintf("video codec %q", h.Ex.FourCC)
+	case h.CodecID == flv.CodecAVC:
+		return flv.FourCCAVC
+	case h.CodecID == flv.CodecHEVC:
+		return flv.FourCCHEVC
+	default:
+		return fmt.Sprintf("video codec ID %d", h.CodecID)
+	}
+}
+
+// flvAudioCodec returns the codec of an FLV audio tag, legacy or Enhanced
+// RTMP: flv.FourCCAAC, flv.FourCCMP3, or a description of any other codec
+// for logging.
+func flvAudioCodec(h flv.AudioHeader) string {
+	switch {
+	case h.Ex != nil && h.Ex.Multitrack:
+		return "multitrack audio"
+	case h.Ex != nil && (h.Ex.FourCC == flv.FourCCAAC || h.Ex.FourCC == flv.FourCCMP3):
+		return h.Ex.FourCC
+	case h.Ex != nil:
+		return fmt.Sprintf("audio codec %q", h.Ex.FourCC)
+	case h.SoundFormat == flv.SoundFormatAAC:
+		return flv.FourCCAAC
+	case h.SoundFormat == flv.SoundFormatMP3:
+		return flv.FourCCMP3
+	default:
+		return fmt.Sprintf("sound format %d", h.SoundFormat)
+	}
+}
@@ -0,0 +1,662 @@
+package remux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/codec"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/flv"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/mpegts"
+	"github.com/nv4d1k/live-stream-forwarder/global"
+	"github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	global.Log = logrus.New()
+	global.Log.SetLevel(logrus.DebugLevel)
+	os.Exit(m.Run())
+}
+
+var (
+	testSPS  = []byte{0x67, 0x64, 0x00, 0x1F, 0xAC}
+	testPPS  = []byte{0x68, 0xEE, 0x3C, 0x80}
+	testIDR  = []byte{0x65, 0x88, 0x84, 0x21}
+	testSEI  = []byte{0x06, 0x05, 0x01, 0xFF}
+	testP    = []byte{0x41, 0x9A, 0x02}
+	testVPS  = []byte{0x40, 0x01, 0x0C}
+	testHSPS = []byte{0x42, 0x01, 0x01}
+	testHPPS = []byte{0x44, 0x01, 0xC1}
+	testCRA  = []byte{0x2A, 0x01, 0xAF}
+	testAAC  = []byte{0x21, 0x10, 0x04, 0x60}
+
+	// Main profile H.265 SPS, 1280x720.
+	testHEVCSPS = []byte{
+		0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03,
+		0x00, 0x5D, 0xA0, 0x02, 0x80, 0x80, 0x2D, 0x16, 0x59, 0x59, 0xA4, 0x93, 0x2B, 0xC0, 0x5A, 0x70,
+		0x80, 0x00, 0x01, 0xF4, 0x80, 0x00, 0x3A, 0x98, 0x04,
+	}
+)
+
+// avcRecord returns an AVCDecoderConfigurationRecord for testSPS and testPPS.
+func avcRecord() []byte {
+	b := []byte{0x01, 0x64, 0x00, 0x1F, 0xFF, 0xE1, 0x00, byte(len(testSPS))}
+	b = append(b, testSPS...)
+	b = append(b, 0x01, 0x00, byte(len(testPPS)))
+	return append(b, testPPS...)
+}
+
+// hevcRecord returns an HEVCDecoderConfigurationRecord for the test HEVC
+// parameter sets.
+func hevcRecord() []byte {
+	b := make([]byte, 23)
+	b[0], b[21], b[22] = 1, 0x0F, 3
+	for _, nalu := range [][]byte{testVPS, testHSPS, testHPPS} {
+		b = append(b, 0x80|(nalu[0]>>1), 0x00, 0x01, 0x00, byte(len(nalu)))
+		b = append(b, nalu...)
+	}
+	return b
+}
+
+// avcc prefixes every NAL unit with its 4-byte length.
+func avcc(nalus ...[]byte) []byte {
+	var b []byte
+	for _, n := range nalus {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(n)))
+		b = append(b, n...)
+	}
+	return b
+}
+
+func annexB(nalus ...[]byte) []byte {
+	var b []byte
+	for _, n := range nalus {
+		b = append(append(b, 0, 0, 0, 1), n...)
+	}
+	return b
+}
+
+var (
+	aud     = []byte{0x09, 0xF0}
+	hevcAUD = []byte{0x46, 0x01, 0x50}
+)
+
+// adts frames a raw AAC-LC 44.1 kHz stereo frame.
+func adts(payload []byte) []byte {
+	n := len(payload) + 7
+	return append([]byte{0xFF, 0xF1, 0x50, 0x80, byte(n >> 3), byte(n&7)<<5 | 0x1F, 0xFC}, payload...)
+}
+
+func buildFLV(t *testing.T, tags ...flv.Tag) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	m := flv.NewMuxer(&b)
+	if err := m.WriteHeader(flv.Header{HasAudio: true, HasVideo: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range tags {
+		if err := m.WriteTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b.Bytes()
+}
+
+// pesFrame is a frame read back from a transport stream.
+type pesFrame struct {
+	pid      uint16
+	pts, dts int64
+	key      bool
+	data     []byte
+}
+
+// readTS splits a transport stream into its PES frames and returns them with
+// the stream types of the last PMT.
+func readTS(t *testing.T, ts []byte) ([]pesFrame, map[uint16]byte) {
+	t.Helper()
+	if len(ts)%mpegts.PacketSize != 0 {
+		t.Fatalf("stream of %d bytes is not a whole number of packets", len(ts))
+	}
+	var frames []pesFrame
+	types := make(map[uint16]byte)
+	open := make(map[uint16]int) // PID to index in frames
+	for off := 0; off < len(ts); off += mpegts.PacketSize {
+		p := ts[off : off+mpegts.PacketSize]
+		pid := uint16(p[1]&0x1F)<<8 | uint16(p[2])
+		payload := p[4:]
+		key := false
+		if p[3]&0x20 != 0 {
+			key = payload[0] > 0 && payload[1]&0x40 != 0
+			payload = payload[1+int(payload[0]):]
+		}
+		switch {
+		case pid == mpegts.PIDPMT:
+			section := payload[1+int(payload[0]):]
+			end := 3 + int(binary.BigEndian.Uint16(section[1:])&0x0FFF) - 4
+			for es := section[12:end]; len(es) >= 5; es = es[5:] {
+				types[uint16(es[1]&0x1F)<<8|uint16(es[2])] = es[0]
+			}
+		case pid == mpegts.PIDPAT:
+		case p[1]&0x40 != 0:
+			open[pid] = len(frames)
+			frames = append(frames, pesFrame{pid: pid, key: key, data: payload})
+		default:
+			i := open[pid]
+			frames[i].data = append(frames[i].data, payload...)
+		}
+	}
+	for i := range frames {
+		pes := frames[i].data
+		ts := func(b []byte) int64 {
+			return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+		}
+		frames[i].pts = ts(pes[9:])
+		frames[i].dts = frames[i].pts
+		if pes[7]&0x40 != 0 {
+			frames[i].dts = ts(pes[14:])
+		}
+		frames[i].data = pes[9+int(pes[8]):]
+	}
+	return frames, types
+}
+
+func TestFLVToTS(t *testing.T) {
+	const offset = 2 * 90000
+
+	tests := []struct {
+		name      string
+		tags      []flv.Tag
+		wantTypes map[uint16]byte
+		want      []pesFrame
+	}{
+		{
+			name: "H.264 and AAC",
+			tags: []flv.Tag{
+				{Type: flv.TagVideo, Data: append([]byte{0x17, 0x00, 0, 0, 0}, avcRecord()...)},
+				{Type: flv.TagAudio, Data: []byte{0xAF, 0x00, 0x12, 0x10}},
+				{Type: flv.TagVideo, Timestamp: 0, Data: append([]byte{0x27, 0x01, 0, 0, 0}, avcc(testP)...)},
+				{Type: flv.TagAudio, Timestamp: 0, Data: append([]byte{0xAF, 0x01}, testAAC...)},
+				{Type: flv.TagVideo, Timestamp: 40, Data: append([]byte{0x17, 0x01, 0, 0, 80}, avcc(testSEI, testIDR)...)},
+				{Type: flv.TagAudio, Timestamp: 46, Data: append([]byte{0xAF, 0x01}, testAAC...)},
+				{Type: flv.TagVideo, Timestamp: 80, Data: append([]byte{0x27, 0x01, 0, 0, 0}, avcc(aud, testP)...)},
+			},
+			wantTypes: map[uint16]byte{mpegts.PIDVideo: mpegts.StreamTypeH264, mpegts.PIDAudio: mpegts.StreamTypeAAC},
+			want: []pesFrame{
+				{pid: mpegts.PIDVideo, pts: offset + 120*90, dts: offset + 40*90, key: true, data: annexB(aud, testSPS, testPPS, testSEI, testIDR)},
+				{pid: mpegts.PIDAudio, pts: offset + 46*90, dts: offset + 46*90, data: adts(testAAC)},
+				{pid: mpegts.PIDVideo, pts: offset + 80*90, dts: offset + 80*90, data: annexB(aud, testP)},
+			},
+		},
+		{
+			name: "Enhanced RTMP HEVC",
+			tags: []flv.Tag{
+				{Type: flv.TagVideo, Data: append([]byte{0x90, 'h', 'v', 'c', '1'}, hevcRecord()...)},
+				{Type: flv.TagVideo, Timestamp: 0, Data: append([]byte{0x91, 'h', 'v', 'c', '1', 0, 0, 40}, avcc(testCRA)...)},
+				{Type: flv.TagVideo, Timestamp: 33, Data: append([]byte{0xA3, 'h', 'v', 'c', '1'}, avcc(testP)...)},
+			},
+			wantTypes: map[uint16]byte{mpegts.PIDVideo: mpegts.StreamTypeH265},
+			want: []pesFrame{
+				{pid: mpegts.PIDVideo, pts: offset + 40*90, dts: offset, key: true, data: annexB(hevcAUD, testVPS, testHSPS, testHPPS, testCRA)},
+				{pid: mpegts.PIDVideo, pts: offset + 33*90, dts: offset + 33*90, data: annexB(hevcAUD, testP)},
+			},
+		},
+		{
+			name: "audio only MP3",
+			tags: []flv.Tag{
+				{Type: flv.TagAudio, Timestamp: 10, Data: []byte{0x2F, 0xFF, 0xFB, 0x90}},
+			},
+			wantTypes: map[uint16]byte{mpegts.PIDAudio: mpegts.StreamTypeMPEG1Audio},
+			want: []pesFrame{
+				{pid: mpegts.PIDAudio, pts: offset + 10*90, dts: offset + 10*90, key: false, data: []byte{0xFF, 0xFB, 0x90}},
+			},
+		},
+		{
+			name: "unsupported codecs dropped",
+			tags: []flv.Tag{
+				{Type: flv.TagVideo, Data: []byte{0x90, 'a', 'v', '0', '1', 0x81}},
+				{Type: flv.TagVideo, Data: []byte{0x91, 'a', 'v', '0', '1', 0x12, 0x00}},
+				{Type: flv.TagAudio, Data: []byte{0x90, 'O', 'p', 'u', 's', 'O'}},
+				{Type: flv.TagAudio, Data: []byte{0x91, 'O', 'p', 'u', 's', 0xFC}},
+			},
+			wantTypes: map[uint16]byte{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := io.NopCloser(bytes.NewReader(buildFLV(t, tt.tags...)))
+			out, err := io.ReadAll(NewReader(src, NewFLVToTS))
+			if err != nil {
+				t.Fatalf("ReadAll: %v", err)
+			}
+			frames, types := readTS(t, out)
+			if len(types) != len(tt.wantTypes) {
+				t.Errorf("stream types = %v, want %v", types, tt.wantTypes)
+			}
+			for pid, typ := range tt.wantTypes {
+				if types[pid] != typ {
+					t.Errorf("stream type of PID 0x%04X = 0x%02X, want 0x%02X", pid, types[pid], typ)
+				}
+			}
+			if len(frames) != len(tt.want) {
+				t.Fatalf("got %d frames, want %d", len(frames), len(tt.want))
+			}
+			for i, f := range frames {
+				w := tt.want[i]
+				if f.pid != w.pid || f.pts != w.pts || f.dts != w.dts || f.key != w.key {
+					t.Errorf("frame %d: PID 0x%04X PTS %d DTS %d key %v, want PID 0x%04X PTS %d DTS %d key %v",
+						i, f.pid, f.pts, f.dts, f.key, w.pid, w.pts, w.dts, w.key)
+				}
+				if !bytes.Equal(f.data, w.data) {
+					t.Errorf("frame %d: data = %x, want %x", i, f.data, w.data)
+				}
+			}
+		})
+	}
+}
+
+// tsFrame is a PES packet written to build a transport stream.
+type tsFrame struct {
+	pid      uint16
+	pts, dts int64
+	data     []byte
+}
+
+func TestTSToFLV(t *testing.T) {
+	const wrap = 1 << 33
+	const base = wrap - 90000 // one second before the 33-bit wraparound
+	sps2 := []byte{0x67, 0x4D, 0x00, 0x28, 0xAC}
+	avcConfig := func(sps []byte) []byte {
+		c, err := codec.NewAVCConfig([][]byte{sps}, [][]byte{testPPS})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append([]byte{0x17, 0x00, 0, 0, 0}, c.AppendTo(nil)...)
+	}
+	hevcConfig, err := codec.NewHEVCConfig([][]byte{testVPS}, [][]byte{testHEVCSPS}, [][]byte{testHPPS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trail := []byte{0x02, 0x01, 0xD0}
+
+	tests := []struct {
+		name       string
+		streams    []mpegts.Stream
+		frames     []tsFrame
+		wantHeader flv.Header
+		want       []flv.Tag
+	}{
+		{
+			name:    "H.264 and AAC",
+			streams: []mpegts.Stream{{PID: mpegts.PIDVideo, Type: mpegts.StreamTypeH264}, {PID: mpegts.PIDAudio, Type: mpegts.StreamTypeAAC}},
+			frames: []tsFrame{
+				{mpegts.PIDVideo, base - 3600, base - 3600, annexB(aud, testP)}, // before the parameter sets
+				{mpegts.PIDVideo, base + 3600, base, annexB(aud, testSPS, testPPS, testSEI, testIDR)},
+				{mpegts.PIDAudio, base + 900, base + 900, append(adts(testAAC), adts(testAAC)...)}, // before the keyframe is complete
+				{mpegts.PIDVideo, base + 10800, base + 3600, annexB(aud, testP)},
+				{mpegts.PIDAudio, 900, 900, adts(testAAC)},                          // wrapped around
+				{mpegts.PIDVideo, 1710000, 1710000, annexB(sps2, testPPS, testIDR)}, // discontinuity
+			},
+			wantHeader: flv.Header{Version: 1, HasAudio: true, HasVideo: true},
+			want: []flv.Tag{
+				{Type: flv.TagAudio, Timestamp: 0, Data: []byte{0xAF, 0x00, 0x12, 0x10}},
+				{Type: flv.TagVideo, Timestamp: 0, Data: avcConfig(testSPS)},
+				{Type: flv.TagVideo, Timestamp: 0, Data: append([]byte{0x17, 0x01, 0, 0, 40}, avcc(testSEI, testIDR)...)},
+				{Type: flv.TagAudio, Timestamp: 1000, Data: append([]byte{0xAF, 0x01}, testAAC...)},
+				{Type: flv.TagVideo, Timestamp: 30, Data: append([]byte{0x27, 0x01, 0, 0, 80}, avcc(testP)...)},
+				{Type: flv.TagVideo, Timestamp: 70, Data: avcConfig(sps2)},
+				{Type: flv.TagVideo, Timestamp: 70, Data: append([]byte{0x17, 0x01, 0, 0, 0}, avcc(testIDR)...)},
+			},
+		},
+		{
+			name:    "H.265 as Enhanced RTMP",
+			streams: []mpegts.Stream{{PID: mpegts.PIDVideo, Type: mpegts.StreamTypeH265}},
+			frames: []tsFrame{
+				{mpegts.PIDVideo, 93600, 90000, annexB(hevcAUD, testVPS, testHEVCSPS, testHPPS, testCRA)},
+				{mpegts.PIDVideo, 93000, 93000, annexB(hevcAUD, trail)},
+			},
+			wantHeader: flv.Header{Version: 1, HasVideo: true},
+			want: []flv.Tag{
+				{Type: flv.TagVideo, Timestamp: 0, Data: append([]byte{0x90, 'h', 'v', 'c', '1'}, hevcConfig.AppendTo(nil)...)},
+				{Type: flv.TagVideo, Timestamp: 0, Data: append([]byte{0x91, 'h', 'v', 'c', '1', 0, 0, 40}, avcc(testCRA)...)},
+				{Type: flv.TagVideo, Timestamp: 33, Data: append([]byte{0xA1, 'h', 'v', 'c', '1', 0, 0, 0}, avcc(trail)...)},
+			},
+		},
+		{
+			name:    "MP3 with an unsupported stream",
+			streams: []mpegts.Stream{{PID: mpegts.PIDAudio, Type: mpegts.StreamTypeMPEG1Audio}, {PID: 0x102, Type: 0x81}},
+			frames: []tsFrame{
+				{0x102, 90000, 90000, []byte{0x0B, 0x77, 0x01}},
+				{mpegts.PIDAudio, 90000, 90000, []byte{0xFF, 0xFB, 0x90}},
+				{mpegts.PIDAudio, 92351, 92351, []byte{0xFF, 0xFB, 0x91}},
+			},
+			wantHeader: flv.Header{Version: 1, HasAudio: true},
+			want: []flv.Tag{
+				{Type: flv.TagAudio, Timestamp: 0, Data: []byte{0x2F, 0xFF, 0xFB, 0x90}},
+				{Type: flv.TagAudio, Timestamp: 26, Data: []byte{0x2F, 0xFF, 0xFB, 0x91}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ts bytes.Buffer
+			m := mpegts.NewMuxer(&ts)
+			for _, s := range tt.streams {
+				m.SetStream(s.PID, s.Type)
+			}
+			for _, f := range tt.frames {
+				if err := m.WritePES(f.pid, f.pts, f.dts, false, f.data); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			out, err := io.ReadAll(NewReader(io.NopCloser(&ts), NewTSToFLV))
+			if err != nil {
+				t.Fatalf("ReadAll: %v", err)
+			}
+			var header flv.Header
+			var tags []flv.Tag
+			d := flv.NewDemuxer(func(tag flv.Tag) error {
+				tags = append(tags, tag.Clone())
+				return nil
+			})
+			d.OnHeader(func(h flv.Header) error {
+				header = h
+				return nil
+			})
+			if _, err := d.Write(out); err != nil {
+				t.Fatalf("demuxing the output: %v", err)
+			}
+			if len(d.Pending()) != 0 {
+				t.Errorf("%d bytes of incomplete output", len(d.Pending()))
+			}
+			if header != tt.wantHeader {
+				t.Errorf("header = %+v, want %+v", header, tt.wantHeader)
+			}
+			if len(tags) != len(tt.want) {
+				t.Fatalf("got %d tags, want %d", len(tags), len(tt.want))
+			}
+			for i, tag := range tags {
+				w := tt.want[i]
+				if tag.Type != w.Type || tag.Timestamp != w.Timestamp || !bytes.Equal(tag.Data, w.Data) {
+					t.Errorf("tag %d = {type %d ts %d data %x}, want {type %d ts %d data %x}",
+						i, tag.Type, tag.Timestamp, tag.Data, w.Type, w.Timestamp, w.Data)
+				}
+			}
+		})
+	}
+}
+
+// mp4Box is a box of fragmented MP4 output.
+type mp4Box struct {
+	typ     string
+	payload []byte
+}
+
+// splitBoxes splits b into its boxes.
+func splitBoxes(t *testing.T, b []byte) []mp4Box {
+	t.Helper()
+	var boxes []mp4Box
+	for len(b) > 0 {
+		size := 0
+		if len(b) >= 8 {
+			size = int(binary.BigEndian.Uint32(b))
+		}
+		if size < 8 || size > len(b) {
+			t.Fatalf("malformed box at %x", b[:min(len(b), 8)])
+		}
+		boxes = append(boxes, mp4Box{string(b[4:8]), b[8:size]})
+		b = b[size:]
+	}
+	return boxes
+}
+
+// child returns the payload of the first box of type typ in b.
+func child(t *testing.T, b []byte, typ string) []byte {
+	t.Helper()
+	for _, box := range splitBoxes(t, b) {
+		if box.typ == typ {
+			return box.payload
+		}
+	}
+	t.Fatalf("no %q box", typ)
+	return nil
+}
+
+// fmp4Run is a track run read back from a fragment.
+type fmp4Run struct {
+	base      uint64
+	durations []uint32
+	ctos      []int32
+	keys      []bool
+	data      [][]byte
+}
+
+// readFragment returns the track runs of a moof box and its mdat, by track
+// ID.
+func readFragment(t *testing.T, moof, mdat []byte) map[uint32]fmp4Run {
+	t.Helper()
+	runs := make(map[uint32]fmp4Run)
+	mdatStart := 8 + len(moof) + 8 // offsets count from the moof header
+	for _, box := range splitBoxes(t, moof) {
+		if box.typ != "traf" {
+			continue
+		}
+		id := binary.BigEndian.Uint32(child(t, box.payload, "tfhd")[4:])
+		run := fmp4Run{base: binary.BigEndian.Uint64(child(t, box.payload, "tfdt")[4:])}
+		trun := child(t, box.payload, "trun")
+		offset := int(binary.BigEndian.Uint32(trun[8:])) - mdatStart
+		for s := trun[12:]; len(s) >= 16; s = s[16:] {
+			size := int(binary.BigEndian.Uint32(s[4:]))
+			run.durations = append(run.durations, binary.BigEndian.Uint32(s))
+			run.keys = append(run.keys, binary.BigEndian.Uint32(s[8:])&0x00010000 == 0)
+			run.ctos = append(run.ctos, int32(binary.BigEndian.Uint32(s[12:])))
+			run.data = append(run.data, mdat[offset:offset+size])
+			offset += size
+		}
+		runs[id] = run
+	}
+	return runs
+}
+
+func TestFLVToFMP4(t *testing.T) {
+	tags := []flv.Tag{
+		{Type: flv.TagVideo, Data: append([]byte{0x17, 0x00, 0, 0, 0}, avcRecord()...)},
+		{Type: flv.TagAudio, Data: []byte{0xAF, 0x00, 0x12, 0x10}},
+		{Type: flv.TagAudio, Data: []byte{0x2F, 0xFF, 0xFB}}, // MP3 is dropped
+		{Type: flv.TagVideo, Timestamp: 0, Data: append([]byte{0x27, 0x01, 0, 0, 0}, avcc(testP)...)},
+		{Type: flv.TagAudio, Timestamp: 23, Data: append([]byte{0xAF, 0x01}, testAAC...)},
+		{Type: flv.TagVideo, Timestamp: 40, Data: append([]byte{0x17, 0x01, 0, 0, 40}, avcc(testSEI, testIDR)...)},
+		{Type: flv.TagAudio, Timestamp: 46, Data: append([]byte{0xAF, 0x01}, testAAC...)},
+		{Type: flv.TagAudio, Timestamp: 69, Data: append([]byte{0xAF, 0x01}, testAAC...)},
+		{Type: flv.TagVideo, Timestamp: 80, Data: append([]byte{0x27, 0x01, 0, 0, 0}, avcc(testP)...)},
+		{Type: flv.TagVideo, Timestamp: 120, Data: append([]byte{0x17, 0x01, 0, 0, 0}, avcc(testIDR)...)},
+		{Type: flv.TagAudio, Timestamp: 93, Data: append([]byte{0xAF, 0x01}, testAAC...)},
+		{Type: flv.TagVideo, Timestamp: 160, Data: append([]byte{0x27, 0x01, 0, 0, 0}, avcc(testP)...)},
+	}
+	r := NewReader(io.NopCloser(bytes.NewReader(buildFLV(t, tags...))), NewFLVToFMP4)
+	contentType, err := r.ContentType("")
+	if err != nil {
+		t.Fatalf("ContentType: %v", err)
+	}
+	if want := `video/mp4; codecs="avc1.64001F,mp4a.40.2"`; contentType != want {
+		t.Errorf("ContentType() = %s, want %s", contentType, want)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+
+	boxes := splitBoxes(t, out)
+	var types []string
+	for _, b := range boxes {
+		types = append(types, b.typ)
+	}
+	if want := []string{"ftyp", "moov", "moof", "mdat", "moof", "mdat"}; !slices.Equal(types, want) {
+		t.Fatalf("boxes = %v, want %v", types, want)
+	}
+
+	idr, p := avcc(testSEI, testIDR), avcc(testP)
+	want := []map[uint32]fmp4Run{
+		{
+			1: {base: 40, durations: []uint32{40, 40}, ctos: []int32{40, 0}, keys: []bool{true, false}, data: [][]byte{idr, p}},
+			2: {base: 46 * 44100 / 1000, durations: []uint32{1024, 1024}, ctos: []int32{0, 0}, keys: []bool{true, true}, data: [][]byte{testAAC, testAAC}},
+		},
+		{
+			1: {base: 120, durations: []uint32{40, 40}, ctos: []int32{0, 0}, keys: []bool{true, false}, data: [][]byte{avcc(testIDR), p}},
+			// Continues the previous fragment despite timestamp jitter.
+			2: {base: 46*44100/1000 + 2048, durations: []uint32{1024}, ctos: []int32{0}, keys: []bool{true}, data: [][]byte{testAAC}},
+		},
+	}
+	for i := range want {
+		got := readFragment(t, boxes[2+2*i].payload, boxes[3+2*i].payload)
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("fragment %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+}
+
+func TestTSToFMP4(t *testing.T) {
+	var ts bytes.Buffer
+	m := mpegts.NewMuxer(&ts)
+	m.SetStream(mpegts.PIDVideo, mpegts.StreamTypeH264)
+	m.SetStream(mpegts.PIDAudio, mpegts.StreamTypeAAC)
+	for _, f := range []tsFrame{
+		{mpegts.PIDVideo, 90000, 90000, annexB(aud, testSPS, testPPS, testIDR)},
+		{mpegts.PIDAudio, 90000, 90000, adts(testAAC)},
+		{mpegts.PIDVideo, 93600, 93600, annexB(aud, testP)},
+		{mpegts.PIDVideo, 97200, 97200, annexB(aud, testSPS, testPPS, testIDR)},
+	} {
+		if err := m.WritePES(f.pid, f.pts, f.dts, false, f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewReader(io.NopCloser(&ts), NewTSToFMP4)
+	contentType, err := r.ContentType("")
+	if err != nil {
+		t.Fatalf("ContentType: %v", err)
+	}
+	if want := `video/mp4; codecs="avc1.64001F,mp4a.40.2"`; contentType != want {
+		t.Errorf("ContentType() = %s, want %s", contentType, want)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	var fragments int
+	for _, b := range splitBoxes(t, out) {
+		if b.typ == "moof" {
+			fragments++
+		}
+	}
+	if fragments != 2 {
+		t.Errorf("%d fragments, want one per GOP", fragments)
+	}
+}
+
+func TestReader_ContentType(t *testing.T) {
+	r := NewReader(io.NopCloser(bytes.NewReader(nil)), NewFLVToTS)
+	if got, err := r.ContentType("video/mp2t"); got != "video/mp2t" || err != nil {
+		t.Errorf("ContentType() = %q, %v, want the default", got, err)
+	}
+	r = NewReader(io.NopCloser(bytes.NewReader(buildFLV(t))), NewFLVToFMP4)
+	if _, err := r.ContentType(""); err != io.EOF {
+		t.Errorf("ContentType() of a stream without media error = %v, want EOF", err)
+	}
+}
+
+// segmentLog records what a Segmenter sends to its sink.
+type segmentLog struct {
+	events   []string
+	segments [][]byte
+}
+
+func (l *segmentLog) SetInit(data []byte) { l.events = append(l.events, "init") }
+func (l *segmentLog) Discontinue()        { l.events = append(l.events, "discontinue") }
+
+func (l *segmentLog) Append(duration float64, ext string, data []byte) uint64 {
+	l.events = append(l.events, fmt.Sprintf("%g%s", duration, ext))
+	l.segments = append(l.segments, data)
+	return uint64(len(l.segments) - 1)
+}
+
+func TestSegmenter(t *testing.T) {
+	seq := func(ts uint32, record []byte) flv.Tag {
+		return flv.Tag{Type: flv.TagVideo, Timestamp: ts, Data: append([]byte{0x17, 0x00, 0, 0, 0}, record...)}
+	}
+	key := func(ts uint32) flv.Tag {
+		return flv.Tag{Type: flv.TagVideo, Timestamp: ts, Data: append([]byte{0x17, 0x01, 0, 0, 0}, avcc(testIDR)...)}
+	}
+	inter := func(ts uint32) flv.Tag {
+		return flv.Tag{Type: flv.TagVideo, Timestamp: ts, Data: append([]byte{0x27, 0x01, 0, 0, 0}, avcc(testP)...)}
+	}
+	gops := func(from, to uint32) []flv.Tag {
+		var tags []flv.Tag
+		for ts := from; ts < to; ts += 1000 {
+			tags = append(tags, key(ts), inter(ts+500))
+		}
+		return tags
+	}
+	level4 := avcRecord()
+	level4[3] = 0x28
+
+	tests := []struct {
+		name      string
+		container string
+		tags      []flv.Tag
+		want      []string
+		check     func(t *testing.T, seg []byte)
+	}{
+		{
+			name:      "ts",
+			container: SegmentTS,
+			tags:      append([]flv.Tag{seq(0, avcRecord())}, gops(0, 5000)...),
+			want:      []string{"2.ts", "2.ts", "0.5.ts"},
+			check: func(t *testing.T, seg []byte) {
+				// Every segment starts with the PAT.
+				if len(seg) < mpegts.PacketSize || seg[0] != 0x47 || binary.BigEndian.Uint16(seg[1:])&0x1FFF != mpegts.PIDPAT {
+					t.Errorf("segment does not start with a PAT: % x", seg[:min(len(seg), 4)])
+				}
+			},
+		},
+		{
+			name:      "fmp4",
+			container: SegmentFMP4,
+			tags: slices.Concat(
+				[]flv.Tag{seq(0, avcRecord())}, gops(0, 2000),
+				[]flv.Tag{key(2000), inter(2500), seq(3000, level4), key(3000), inter(3500)},
+			),
+			// The new configuration cuts the segment short.
+			want: []string{"init", "2.m4s", "1.m4s", "discontinue", "init", "0.5.m4s"},
+			check: func(t *testing.T, seg []byte) {
+				if boxes := splitBoxes(t, seg); boxes[0].typ != "moof" {
+					t.Errorf("segment starts with %s, want moof", boxes[0].typ)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var log segmentLog
+			s := NewSegmenter(&log, tt.container, 2*time.Second)
+			if _, err := s.Write(buildFLV(t, tt.tags...)); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if err := s.Flush(); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+			if !slices.Equal(log.events, tt.want) {
+				t.Errorf("events = %v, want %v", log.events, tt.want)
+			}
+			for _, seg := range log.segments {
+				tt.check(t, seg)
+			}
+		})
+	}
+}
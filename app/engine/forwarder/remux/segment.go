@@ -0,0 +1,154 @@
+package remux
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/flv"
+	"github.com/nv4d1k/live-stream-forwarder/global"
+)
+
+// Segment containers of a Segmenter.
+const (
+	SegmentTS   = "ts"
+	SegmentFMP4 = "fmp4"
+)
+
+// SegmentSink receives the segments cut by a Segmenter, such as an
+// *hls.Window.
+type SegmentSink interface {
+	// SetInit sets the init section of the segments appended after it.
+	SetInit(data []byte)
+	// Discontinue marks the next segment as the start of a discontinuity.
+	Discontinue()
+	// Append adds a segment of the given duration in seconds.
+	Append(duration float64, ext string, data []byte) uint64
+}
+
+// Segmenter cuts an FLV stream into HLS media segments of MPEG-TS or
+// fragmented MP4, remuxed like FLVToTS and FLVToFMP4. Segments start on a
+// video keyframe and last at least the target duration, or as long as the
+// GOPs run; audio-only streams are cut on any frame. Fragmented MP4 init
+// sections go to the sink separately, and a new one starts a new segment.
+type Segmenter struct {
+	demux  *flv.Demuxer
+	sink   SegmentSink
+	target uint32 // milliseconds
+	ext    string
+	buf    bytes.Buffer // output for the current segment
+	ts     *FLVToTS     // one of ts and mp4 is set
+	mp4    *FLVToFMP4
+
+	open  bool   // a segment has started
+	start uint32 // timestamp the current segment starts at
+	last  uint32 // timestamp of the latest tag
+	inits int    // init sections sent
+}
+
+// NewSegmenter returns a Segmenter cutting segments of container, SegmentTS
+// or SegmentFMP4, of about target duration into sink.
+func NewSegmenter(sink SegmentSink, container string, target time.Duration) *Segmenter {
+	log := global.Log.WithField("func", "app.engine.forwarder.remux.NewSegmenter")
+	log.Debugf("creating %s segmenter with %s segments", container, target)
+	s := &Segmenter{sink: sink, target: uint32(target.Milliseconds()), ext: ".ts"}
+	if container == SegmentFMP4 {
+		s.ext = ".m4s"
+		s.mp4 = newFLVToFMP4(&s.buf)
+		s.mp4.onInit = s.setInit
+	} else {
+		s.ts = newFLVToTS(&s.buf)
+	}
+	s.demux = flv.NewDemuxer(s.writeTag)
+	return s
+}
+
+// Write parses the next chunk of the FLV stream, appending the segments it
+// completes to the sink.
+func (s *Segmenter) Write(p []byte) (int, error) {
+	return s.demux.Write(p)
+}
+
+// Flush appends the last, incomplete segment at the end of the stream.
+func (s *Segmenter) Flush() error {
+	return s.cut(s.last)
+}
+
+func (s *Segmenter) writeTag(t flv.Tag) error {
+	if s.boundary(t) {
+		switch {
+		case !s.open:
+			s.open = true
+			s.start = t.Timestamp
+		case t.Timestamp < s.start || t.Timestamp-s.start >= s.target:
+			if err := s.cut(t.Timestamp); err != nil {
+				return err
+			}
+		}
+	}
+	s.last = t.Timestamp
+	if s.mp4 != nil {
+		return s.mp4.writeTag(t)
+	}
+	return s.ts.writeTag(t)
+}
+
+// boundary reports whether a segment may start with t: a video keyframe, or
+// an audio frame if the stream has no video.
+func (s *Segmenter) boundary(t flv.Tag) bool {
+	switch t.Type {
+	case flv.TagVideo:
+		h, err := t.Video()
+		return err == nil && h.FrameType == flv.FrameKey &&
+			(h.PacketType == flv.PacketNALU || h.PacketType == flv.ExPacketCodedFramesX)
+	case flv.TagAudio:
+		h, err := t.Audio()
+		return err == nil && h.PacketType != flv.PacketSequenceHeader && !s.hasVideo()
+	}
+	return false
+}
+
+func (s *Segmenter) hasVideo() bool {
+	if s.mp4 != nil {
+		return s.mp4.video.entry != ""
+	}
+	return s.ts.video.streamType != 0
+}
+
+// cut appends the current segment, which ends at end, and starts the next.
+func (s *Segmenter) cut(end uint32) error {
+	if s.mp4 != nil {
+		if err := s.mp4.flush(end, true); err != nil {
+			return err
+		}
+	}
+	s.appendSegment(end)
+	return nil
+}
+
+// appendSegment appends the output collected since the last segment as a
+// segment ending at end.
+func (s *Segmenter) appendSegment(end uint32) {
+	if s.buf.Len() > 0 {
+		duration := float64(s.target) / 1000
+		if end >= s.start {
+			duration = float64(end-s.start) / 1000
+		}
+		s.sink.Append(duration, s.ext, bytes.Clone(s.buf.Bytes()))
+		s.buf.Reset()
+	}
+	s.start = end
+}
+
+// setInit passes a fragmented MP4 init section to the sink. Samples of the
+// previous configuration end the current segment first.
+func (s *Segmenter) setInit(init []byte) error {
+	if start, ok := s.mp4.pendingStart(); ok {
+		s.appendSegment(start)
+	}
+	if s.inits > 0 {
+		s.sink.Discontinue()
+	}
+	s.inits++
+	s.sink.SetInit(init)
+	return nil
+}
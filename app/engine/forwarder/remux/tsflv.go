@@ -0,0 +1,327 @@
+package remux
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/codec"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/flv"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/mpegts"
+	"github.com/nv4d1k/live-stream-forwarder/global"
+)
+
+// maxTimestampJump is the largest step between the DTS of consecutive frames
+// that is taken as is. Larger steps, as at HLS discontinuities or upstream
+// reconnects, are replaced by flvFrameGap so FLV timestamps stay continuous.
+const maxTimestampJump = 10 * mpegts.Clock
+
+// flvFrameGap is the step, in 90 kHz units, inserted at a timestamp
+// discontinuity (roughly one frame at 25 fps).
+const flvFrameGap = 40 * mpegts.Clock / 1000
+
+// aacFrameSamples is the number of samples of an AAC frame.
+const aacFrameSamples = 1024
+
+// TSToFLV remuxes an MPEG transport stream, such as the concatenated
+// segments of an HLS stream, into an FLV stream. H.264 is written as AVC
+// tags and H.265 as Enhanced RTMP hvc1 tags, with sequence headers built from
+// the in-band parameter sets whenever they change. ADTS framed AAC becomes
+// raw AAC with an AudioSpecificConfig sequence header, and MP3 passes
+// through. Frames of other codecs are dropped.
+//
+// Timestamps start at 0 on the first keyframe and run on across 33-bit
+// wraparound and discontinuities.
+type TSToFLV struct {
+	demux *mpegts.Demuxer
+	mux   *flv.Muxer
+
+	headerWritten bool
+	video         tsVideoTrack
+	audioConfig   []byte // AudioSpecificConfig of the last AAC sequence header
+	keySeen       bool   // frames are written from the first keyframe on
+	clock         timeline
+	unsupported   map[string]bool // codecs already reported as dropped
+}
+
+type tsVideoTrack struct {
+	vps, sps, pps [][]byte
+	config        []byte // body of the last sequence header tag
+}
+
+// NewTSToFLV returns a TSToFLV writing the FLV stream to w.
+func NewTSToFLV(w io.Writer) Converter {
+	return newTSToFLV(w)
+}
+
+func newTSToFLV(w io.Writer) *TSToFLV {
+	log := global.Log.WithField("func", "app.engine.forwarder.remux.NewTSToFLV")
+	log.Debug("creating MPEG-TS to FLV remuxer")
+	r := &TSToFLV{mux: flv.NewMuxer(w), unsupported: make(map[string]bool)}
+	r.demux = mpegts.NewDemuxer(r.writeFrame)
+	return r
+}
+
+// Write parses the next chunk of the transport stream and writes the FLV
+// tags of every frame it completes.
+func (r *TSToFLV) Write(p []byte) (int, error) {
+	return r.demux.Write(p)
+}
+
+// Flush writes the frames still held by the demuxer, at the end of the
+// stream.
+func (r *TSToFLV) Flush() error {
+	return r.demux.Flush()
+}
+
+// drop logs the first frame of an unsupported codec and drops it.
+func (r *TSToFLV) drop(what string) error {
+	if !r.unsupported[what] {
+		r.unsupported[what] = true
+		global.Log.WithField("func", "app.engine.forwarder.remux.TSToFLV.drop").
+			Warnf("%s cannot be carried in FLV, dropping it", what)
+	}
+	return nil
+}
+
+func (r *TSToFLV) writeFrame(f mpegts.Frame) error {
+	switch f.StreamType {
+	case mpegts.StreamTypeH264:
+		return r.writeVideo(f, false)
+	case mpegts.StreamTypeH265:
+		return r.writeVideo(f, true)
+	case mpegts.StreamTypeAAC:
+		return r.writeAAC(f)
+	case mpegts.StreamTypeMPEG1Audio, mpegts.StreamTypeMPEG2Audio:
+		return r.writeMP3(f)
+	default:
+		return r.drop(fmt.Sprintf("stream type 0x%02x", f.StreamType))
+	}
+}
+
+// writeTag writes t, preceded by the FLV header if it is the first tag.
+func (r *TSToFLV) writeTag(t flv.Tag) error {
+	if !r.headerWritten {
+		var h flv.Header
+		for _, s := range r.demux.Streams() {
+			switch s.Type {
+			case mpegts.StreamTypeH264, mpegts.StreamTypeH265:
+				h.HasVideo = true
+			case mpegts.StreamTypeAAC, mpegts.StreamTypeMPEG1Audio, mpegts.StreamTypeMPEG2Audio:
+				h.HasAudio = true
+			}
+		}
+		if err := r.mux.WriteHeader(h); err != nil {
+			return err
+		}
+		r.headerWritten = true
+	}
+	return r.mux.WriteTag(t)
+}
+
+// hasVideo reports whether the program has a video stream that is carried
+// over.
+func (r *TSToFLV) hasVideo() bool {
+	for _, s := range r.demux.Streams() {
+		if s.Type == mpegts.StreamTypeH264 || s.Type == mpegts.StreamTypeH265 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *TSToFLV) writeVideo(f mpegts.Frame, hevc bool) error {
+	var nalus [][]byte
+	keyframe := false
+	paramSetsChanged := false
+	for _, n := range codec.SplitAnnexB(f.Data) {
+		if hevc {
+			switch t := codec.HEVCNALType(n); {
+			case t == codec.HEVCNALAUD:
+				continue
+			case t == codec.HEVCNALVPS, t == codec.HEVCNALSPS, t == codec.HEVCNALPPS:
+				paramSetsChanged = r.video.setParameterSet(t, n) || paramSetsChanged
+				continue
+			case t >= codec.HEVCNALBLAWLP && t <= codec.HEVCNALCRA:
+				keyframe = true
+			}
+		} else {
+			switch t := codec.AVCNALType(n); t {
+			case codec.AVCNALAUD:
+				continue
+			case codec.AVCNALSPS, codec.AVCNALPPS:
+				paramSetsChanged = r.video.setParameterSet(t, n) || paramSetsChanged
+				continue
+			case codec.AVCNALIDR:
+				keyframe = true
+			}
+		}
+		nalus = append(nalus, n)
+	}
+
+	if paramSetsChanged {
+		if err := r.writeVideoConfig(f, hevc); err != nil {
+			return err
+		}
+	}
+	if r.video.config == nil || len(nalus) == 0 {
+		return nil // no sequence header yet
+	}
+	if !r.keySeen && !keyframe {
+		return nil
+	}
+	r.keySeen = true
+
+	frameType := flv.FrameInter
+	if keyframe {
+		frameType = flv.FrameKey
+	}
+	ct := compositionTime(f)
+	var data []byte
+	if hevc {
+		data = append(data, 0x80|frameType<<4|flv.ExPacketCodedFrames)
+		data = append(data, flv.FourCCHEVC...)
+	} else {
+		data = append(data, frameType<<4|flv.CodecAVC, flv.PacketNALU)
+	}
+	data = append(data, byte(ct>>16), byte(ct>>8), byte(ct))
+	data = codec.AppendLengthPrefixed(data, nalus...)
+	return r.writeTag(flv.Tag{Type: flv.TagVideo, Timestamp: r.clock.ms(f.DTS), Data: data})
+}
+
+// setParameterSet records an in-band parameter set and reports whether it
+// differs from the one with the same type last seen. Only one parameter set
+// of each type is kept, as live streams rarely use more.
+func (v *tsVideoTrack) setParameterSet(nalType byte, nalu []byte) bool {
+	sets := &v.pps
+	switch nalType {
+	case codec.HEVCNALVPS:
+		sets = &v.vps
+	case codec.HEVCNALSPS, codec.AVCNALSPS:
+		sets = &v.sps
+	}
+	if len(*sets) == 1 && bytes.Equal((*sets)[0], nalu) {
+		return false
+	}
+	*sets = [][]byte{bytes.Clone(nalu)}
+	return true
+}
+
+// writeVideoConfig writes a sequence header for the current parameter sets
+// once they are complete.
+func (r *TSToFLV) writeVideoConfig(f mpegts.Frame, hevc bool) error {
+	log := global.Log.WithField("func", "app.engine.forwarder.remux.TSToFLV.writeVideoConfig")
+	var data []byte
+	if hevc {
+		if len(r.video.vps) == 0 || len(r.video.sps) == 0 || len(r.video.pps) == 0 {
+			return nil
+		}
+		c, err := codec.NewHEVCConfig(r.video.vps, r.video.sps, r.video.pps)
+		if err != nil {
+			log.WithError(err).Warn("ignoring H.265 parameter sets")
+			return nil
+		}
+		data = append(data, 0x80|flv.FrameKey<<4|flv.ExPacketSequenceStart)
+		data = append(data, flv.FourCCHEVC...)
+		data = c.AppendTo(data)
+	} else {
+		if len(r.video.sps) == 0 || len(r.video.pps) == 0 {
+			return nil
+		}
+		c, err := codec.NewAVCConfig(r.video.sps, r.video.pps)
+		if err != nil {
+			log.WithError(err).Warn("ignoring H.264 parameter sets")
+			return nil
+		}
+		data = append(data, flv.FrameKey<<4|flv.CodecAVC, flv.PacketSequenceHeader, 0, 0, 0)
+		data = c.AppendTo(data)
+	}
+	if bytes.Equal(data, r.video.config) {
+		return nil
+	}
+	log.Debug("video configuration changed")
+	r.video.config = data
+	return r.writeTag(flv.Tag{Type: flv.TagVideo, Timestamp: r.clock.ms(f.DTS), Data: data})
+}
+
+// compositionTime returns PTS - DTS of f in milliseconds.
+func compositionTime(f mpegts.Frame) int32 {
+	d := (f.PTS - f.DTS) & (1<<33 - 1)
+	if d >= 1<<32 {
+		d -= 1 << 33
+	}
+	return int32(d / 90)
+}
+
+func (r *TSToFLV) writeAAC(f mpegts.Frame) error {
+	log := global.Log.WithField("func", "app.engine.forwarder.remux.TSToFLV.writeAAC")
+	pts := f.PTS
+	for b := f.Data; len(b) > 0; {
+		h, err := codec.ParseADTSHeader(b)
+		if err != nil || h.FrameSize > len(b) {
+			log.WithError(err).Debug("malformed ADTS frame")
+			return nil
+		}
+		raw := b[h.HeaderSize:h.FrameSize]
+		b = b[h.FrameSize:]
+
+		if config := h.Config.AppendTo(nil); !bytes.Equal(config, r.audioConfig) {
+			log.WithField("config", h.Config).Debug("audio configuration changed")
+			r.audioConfig = config
+			data := append([]byte{flv.SoundFormatAAC<<4 | 0x0F, flv.PacketSequenceHeader}, config...)
+			if err := r.writeTag(flv.Tag{Type: flv.TagAudio, Timestamp: r.clock.ms(pts), Data: data}); err != nil {
+				return err
+			}
+		}
+		if r.keySeen || !r.hasVideo() {
+			// Start audio with the video, so the stream begins on a
+			// keyframe.
+			data := append([]byte{flv.SoundFormatAAC<<4 | 0x0F, flv.PacketNALU}, raw...)
+			if err := r.writeTag(flv.Tag{Type: flv.TagAudio, Timestamp: r.clock.ms(pts), Data: data}); err != nil {
+				return err
+			}
+		}
+		pts += aacFrameSamples * mpegts.Clock / int64(h.Config.SampleRate)
+	}
+	return nil
+}
+
+func (r *TSToFLV) writeMP3(f mpegts.Frame) error {
+	if !r.keySeen && r.hasVideo() {
+		return nil
+	}
+	data := append([]byte{flv.SoundFormatMP3<<4 | 0x0F}, f.Data...)
+	return r.writeTag(flv.Tag{Type: flv.TagAudio, Timestamp: r.clock.ms(f.PTS), Data: data})
+}
+
+// timeline maps 33-bit 90 kHz timestamps to continuous FLV milliseconds.
+type timeline struct {
+	started bool
+	last    int64 // last input timestamp
+	pos     int64 // position of last on the output timeline, in 90 kHz units
+}
+
+// ms returns the FLV timestamp of the 90 kHz timestamp ts. The first
+// timestamp maps to 0; timestamps before it are clamped to 0.
+func (tl *timeline) ms(ts int64) uint32 {
+	if !tl.started {
+		tl.started = true
+		tl.last = ts
+		return 0
+	}
+	d := (ts - tl.last) & (1<<33 - 1)
+	if d >= 1<<32 {
+		d -= 1 << 33 // backwards
+	}
+	if d > maxTimestampJump || d < -maxTimestampJump {
+		global.Log.WithField("func", "app.engine.forwarder.remux.timeline.ms").
+			WithField("jump", d).Debug("timestamp discontinuity")
+		d = flvFrameGap
+	}
+	tl.last = ts
+	tl.pos += d
+	if tl.pos < 0 {
+		return 0
+	}
+	return uint32(tl.pos / 90)
+}
@@ -0,0 +1,107 @@
+package stream
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/nv4d1k/live-stream-forwarder/global"
+)
+
+// ErrCircuitOpen is returned instead of calling a platform's extractor while
+// its circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open, platform extraction suspended")
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// CircuitBreaker suspends extraction for a platform after repeated
+// failures, so an API outage does not get hammered by every open stream.
+// After the cooldown a single trial call is let through (half-open); its
+// result closes or re-opens the breaker.
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	name      string
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+func NewCircuitBreaker(name string, threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Allow reports whether a call may proceed. It returns ErrCircuitOpen while
+// the breaker is open or a half-open trial call is in flight.
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return nil
+	}
+	if time.Now().Before(b.openUntil) || b.trial {
+		return ErrCircuitOpen
+	}
+	b.trial = true
+	return nil
+}
+
+// Success records a successful call and closes the breaker.
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures >= b.threshold {
+		log := global.Log.WithField("func", "app.engine.forwarder.stream.CircuitBreaker.Success")
+		log.WithField("platform", b.name).Infoln("circuit breaker closed")
+	}
+	b.failures = 0
+	b.trial = false
+}
+
+// Release ends a call without recording a result, e.g. because the caller
+// canceled it. A pending half-open trial is given up so the next call can
+// try again.
+func (b *CircuitBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+// Failure records a failed call, opening the breaker once the threshold of
+// consecutive failures is reached.
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.trial = false
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		log := global.Log.WithField("func", "app.engine.forwarder.stream.CircuitBreaker.Failure")
+		log.WithField("platform", b.name).Warnf("circuit breaker open for %s after %d failures", b.cooldown, b.failures)
+	}
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = map[string]*CircuitBreaker{}
+)
+
+// BreakerFor returns the process-wide circuit breaker for a platform.
+func BreakerFor(platform string) *CircuitBreaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[platform]
+	if !ok {
+		b = NewCircuitBreaker(platform, defaultBreakerThreshold, defaultBreakerCooldown)
+		breakers[platform] = b
+	}
+	return b
+}
@@ -0,0 +1,241 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Phase identifies the step of the upstream pipeline an error came from.
+type Phase string
+
+const (
+	PhaseExtract Phase = "extract" // resolving the stream URL from the platform API
+	PhaseFetch   Phase = "fetch"   // connecting to the stream URL (HTTP GET or websocket dial)
+	PhaseCopy    Phase = "copy"    // reading media data from an established connection
+)
+
+// UpstreamError describes a failure talking to a platform API or CDN. It is
+// returned by the extractors and forwarders so that retry decisions can be
+// made on the HTTP status instead of on error text.
+type UpstreamError struct {
+	Platform   string        // platform name, e.g. "douyu"; empty if unknown
+	Phase      Phase         // pipeline step that failed
+	URL        string        // request URL
+	StatusCode int           // HTTP status; 0 if no response was received
+	Status     string        // HTTP status text, e.g. "403 Forbidden"
+	RetryAfter time.Duration // server-requested delay from Retry-After, if any
+	Err        error         // underlying error, if any
+}
+
+func (e *UpstreamError) Error() string {
+	msg := string(e.Phase) + " error"
+	if e.Platform != "" {
+		msg = e.Platform + " " + msg
+	}
+	if u := redactURL(e.URL); u != "" {
+		msg += " (" + u + ")"
+	}
+	switch {
+	case e.StatusCode != 0 && e.Err != nil:
+		return fmt.Sprintf("%s: got %s: %s", msg, e.statusText(), e.Err.Error())
+	case e.StatusCode != 0:
+		return fmt.Sprintf("%s: got %s", msg, e.statusText())
+	case e.Err != nil:
+		return fmt.Sprintf("%s: %s", msg, e.Err.Error())
+	default:
+		return msg
+	}
+}
+
+func (e *UpstreamError) Unwrap() error { return e.Err }
+
+func (e *UpstreamError) statusText() string {
+	if e.Status != "" {
+		return e.Status
+	}
+	return fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// redactURL drops the query string, which usually carries signed tokens.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+	u.User = nil
+	return u.String()
+}
+
+// StatusError returns an UpstreamError for an unexpected HTTP response.
+func StatusError(platform string, phase Phase, u string, resp *http.Response) *UpstreamError {
+	e := &UpstreamError{
+		Platform:   platform,
+		Phase:      phase,
+		URL:        u,
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+	}
+	if s := resp.Header.Get("Retry-After"); s != "" {
+		if secs, err := strconv.Atoi(s); err == nil && secs > 0 {
+			e.RetryAfter = time.Duration(secs) * time.Second
+		} else if t, err := http.ParseTime(s); err == nil {
+			e.RetryAfter = time.Until(t)
+		}
+	}
+	return e
+}
+
+// WrapError returns an UpstreamError for a failed request that produced no
+// HTTP response (DNS, dial, TLS, reset, timeout ...). A nil err stays nil,
+// and an err that already is an UpstreamError is returned as is.
+func WrapError(platform string, phase Phase, u string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var ue *UpstreamError
+	if errors.As(err, &ue) {
+		return err
+	}
+	return &UpstreamError{Platform: platform, Phase: phase, URL: u, Err: err}
+}
+
+// WithPlatform sets the platform on err if it is an UpstreamError without one.
+func WithPlatform(err error, platform string) error {
+	var ue *UpstreamError
+	if errors.As(err, &ue) && ue.Platform == "" {
+		ue.Platform = platform
+	}
+	return err
+}
+
+// ErrorClass is the retry category of an upstream error.
+type ErrorClass int
+
+const (
+	ClassNone        ErrorClass = iota // no error
+	ClassFatal                         // retrying will not help
+	ClassExpired                       // the signed URL is no longer valid; re-extract
+	ClassTransient                     // temporary network or server fault; retry
+	ClassRateLimited                   // the server asked us to slow down; retry later
+	ClassOffline                       // the room or stream is gone
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ClassNone:
+		return "none"
+	case ClassFatal:
+		return "fatal"
+	case ClassExpired:
+		return "expired"
+	case ClassTransient:
+		return "transient"
+	case ClassRateLimited:
+		return "rate-limited"
+	case ClassOffline:
+		return "offline"
+	default:
+		return "unknown"
+	}
+}
+
+// Retriable reports whether a stream should reconnect after an error of
+// this class, rather than end.
+func (c ErrorClass) Retriable() bool {
+	return c != ClassNone && c != ClassFatal
+}
+
+// statusClasses is the shared HTTP status classification used by every
+// forwarder. Statuses not listed are fatal.
+var statusClasses = map[int]ErrorClass{
+	http.StatusUnauthorized:        ClassExpired,
+	http.StatusForbidden:           ClassExpired,
+	http.StatusGone:                ClassExpired,
+	http.StatusNotFound:            ClassOffline,
+	http.StatusRequestTimeout:      ClassTransient,
+	http.StatusTooManyRequests:     ClassRateLimited,
+	http.StatusInternalServerError: ClassTransient,
+	http.StatusBadGateway:          ClassTransient,
+	http.StatusServiceUnavailable:  ClassTransient,
+	http.StatusGatewayTimeout:      ClassTransient,
+}
+
+// Classify maps an error onto the shared retry classification. HTTP status
+// codes carried by an UpstreamError take precedence; otherwise network-level
+// failures are transient and everything else is fatal.
+func Classify(err error) ErrorClass {
+	if err == nil {
+		return ClassNone
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+		// Our own side shut the connection down.
+		return ClassFatal
+	}
+	if errors.Is(err, ErrCircuitOpen) {
+		return ClassRateLimited
+	}
+	if errors.Is(err, ErrStalled) {
+		return ClassTransient
+	}
+	if errors.Is(err, ErrOffline) {
+		return ClassOffline
+	}
+	var ue *UpstreamError
+	if errors.As(err, &ue) && ue.StatusCode != 0 {
+		if c, ok := statusClasses[ue.StatusCode]; ok {
+			return c
+		}
+		return ClassFatal
+	}
+	if isNetworkError(err) {
+		return ClassTransient
+	}
+	if ue != nil && ue.Phase == PhaseExtract {
+		// Platform API failures without a status (bad JSON, missing
+		// fields) are usually momentary.
+		return ClassTransient
+	}
+	return ClassFatal
+}
+
+// RetryAfter returns the server-requested delay carried by err, or 0.
+func RetryAfter(err error) time.Duration {
+	var ue *UpstreamError
+	if errors.As(err, &ue) && ue.RetryAfter > 0 {
+		return ue.RetryAfter
+	}
+	return 0
+}
+
+func isNetworkError(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
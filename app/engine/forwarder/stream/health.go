@@ -0,0 +1,128 @@
+package stream
+
+import (
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nv4d1k/live-stream-forwarder/global"
+)
+
+const (
+	defaultHealthPenalty    = 30 * time.Second
+	defaultHealthMaxPenalty = 5 * time.Minute
+)
+
+// Candidate is one URL a stream can be fetched from, typically the same
+// stream served by a different CDN edge.
+type Candidate struct {
+	URL      string
+	Priority int // lower is preferred; equal priorities keep list order
+}
+
+// HostHealth remembers which upstream hosts recently failed, so producers
+// can steer away from a bad CDN edge for a while. Each consecutive failure
+// doubles the time a host is avoided, up to a maximum; a success clears it.
+type HostHealth struct {
+	penalty    time.Duration
+	maxPenalty time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostScore
+}
+
+type hostScore struct {
+	failures   int
+	avoidUntil time.Time
+}
+
+// DefaultHealth is shared by all producers in the process.
+var DefaultHealth = NewHostHealth(defaultHealthPenalty, defaultHealthMaxPenalty)
+
+func NewHostHealth(penalty, maxPenalty time.Duration) *HostHealth {
+	return &HostHealth{
+		penalty:    penalty,
+		maxPenalty: maxPenalty,
+		hosts:      make(map[string]*hostScore),
+	}
+}
+
+// Failure records a failed connection to the host of rawURL.
+func (h *HostHealth) Failure(rawURL string) {
+	host := hostOf(rawURL)
+	if host == "" {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sc, ok := h.hosts[host]
+	if !ok {
+		sc = &hostScore{}
+		h.hosts[host] = sc
+	}
+	sc.failures++
+	d := h.penalty
+	for i := 1; i < sc.failures && d < h.maxPenalty; i++ {
+		d *= 2
+	}
+	d = min(d, h.maxPenalty)
+	sc.avoidUntil = time.Now().Add(d)
+	log := global.Log.WithField("func", "app.engine.forwarder.stream.HostHealth.Failure")
+	log.WithField("host", host).WithField("failures", sc.failures).Debugf("avoiding host for %s", d)
+}
+
+// Success records a working connection to the host of rawURL.
+func (h *HostHealth) Success(rawURL string) {
+	host := hostOf(rawURL)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.hosts, host)
+}
+
+// Avoided reports whether the host of rawURL failed recently.
+func (h *HostHealth) Avoided(rawURL string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sc, ok := h.hosts[hostOf(rawURL)]
+	return ok && time.Now().Before(sc.avoidUntil)
+}
+
+// Order returns the candidate URLs in the order they should be tried: hosts
+// that are not being avoided first, then by priority. Avoided hosts are kept
+// at the end as a last resort.
+func (h *HostHealth) Order(candidates []Candidate) []string {
+	type ranked struct {
+		url      string
+		avoided  bool
+		priority int
+	}
+	list := make([]ranked, 0, len(candidates))
+	seen := make(map[string]bool, len(candidates))
+	for _, c := range candidates {
+		if c.URL == "" || seen[c.URL] {
+			continue
+		}
+		seen[c.URL] = true
+		list = append(list, ranked{url: c.URL, avoided: h.Avoided(c.URL), priority: c.Priority})
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].avoided != list[j].avoided {
+			return !list[i].avoided
+		}
+		return list[i].priority < list[j].priority
+	})
+	urls := make([]string, len(list))
+	for i, r := range list {
+		urls[i] = r.url
+	}
+	return urls
+}
+
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
@@ -0,0 +1,391 @@
+package stream
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/nv4d1k/live-stream-forwarder/global"
+)
+
+// ErrSlowSubscriber is returned to a subscriber that fell too far behind the
+// shared upstream and was disconnected to protect the other subscribers. It
+// is the overflow error of the subscriber's bounded pipe.
+var ErrSlowSubscriber = ErrBufferOverflow
+
+// defaultMaxSubscriberLag is the number of unread bytes a subscriber may
+// accumulate before it is disconnected (roughly 6 seconds of 10 Mbps FLV).
+const defaultMaxSubscriberLag = 8 << 20
+
+// OpenFunc opens the shared upstream for a hub entry. It is called once per
+// entry, on behalf of the first subscriber, and returns the upstream reader
+// together with the content type that should be served to every subscriber.
+// ctx belongs to the entry, not to any one client: it is canceled when the
+// last subscriber leaves (or every waiting client gives up) and when the hub
+// is closed, so the upstream should be tied to it.
+type OpenFunc func(ctx context.Context) (io.ReadCloser, string, error)
+
+// JoinCache follows the data of a shared upstream so that subscribers joining
+// mid-stream can be brought up to date, e.g. with the media since the last
+// keyframe. The hub calls both methods under the entry's lock, so the
+// snapshot always ends exactly where the live data for the new subscriber
+// begins.
+type JoinCache interface {
+	Observe(p []byte) // called with every chunk, in order, before it is broadcast
+	Snapshot() []byte // data sent to a new subscriber ahead of the live data
+}
+
+// WithJoinCache attaches c to an upstream returned by an OpenFunc; the hub
+// feeds the upstream's data to c and primes late subscribers from it.
+func WithJoinCache(upstream io.ReadCloser, c JoinCache) io.ReadCloser {
+	return &joinCached{ReadCloser: upstream, cache: c}
+}
+
+type joinCached struct {
+	io.ReadCloser
+	cache JoinCache
+}
+
+// Hub fans a single upstream out to many subscribers. Entries are keyed by
+// "platform:room" plus whatever changes the upstream's data, such as a
+// forced format (the same key as flv.DefaultCache), so every client watching
+// the same room shares one upstream connection. The upstream is closed when
+// the last subscriber leaves.
+type Hub struct {
+	mu      sync.Mutex
+	entries map[string]*hubEntry
+	maxLag  int
+
+	ctx    context.Context // parent of every entry's context
+	cancel context.CancelFunc
+}
+
+type hubEntry struct {
+	hub         *Hub
+	key         string
+	ctx         context.Context
+	cancel      context.CancelFunc
+	ready       chan struct{} // closed once open has returned
+	openErr     error
+	upstream    io.ReadCloser
+	contentType string
+	join        JoinCache // nil unless the upstream was opened WithJoinCache
+
+	mu      sync.Mutex
+	subs    map[*Subscriber]struct{}
+	waiters int // Subscribe calls waiting for open to return
+	closed  bool
+}
+
+// Subscriber is one client's view of a shared upstream. It implements
+// io.ReadCloser; closing it detaches the client from the hub.
+type Subscriber struct {
+	entry     *hubEntry
+	pipe      *Pipe
+	closeOnce sync.Once
+}
+
+// DefaultHub is the process-wide stream hub.
+var DefaultHub = NewHub()
+
+func NewHub() *Hub {
+	log := global.Log.WithField("func", "app.engine.forwarder.stream.NewHub")
+	log.Debug("creating Hub")
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Hub{
+		entries: make(map[string]*hubEntry),
+		maxLag:  defaultMaxSubscriberLag,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Close cancels every shared upstream, ending all subscribers, and makes
+// further Subscribe calls fail. It is used on server shutdown.
+func (h *Hub) Close() {
+	log := global.Log.WithField("func", "app.engine.forwarder.stream.Hub.Close")
+	h.mu.Lock()
+	h.cancel()
+	entries := make([]*hubEntry, 0, len(h.entries))
+	for _, e := range h.entries {
+		entries = append(entries, e)
+	}
+	h.mu.Unlock()
+	log.Debugf("closing %d shared upstreams", len(entries))
+	for _, e := range entries {
+		select {
+		case <-e.ready:
+			if e.openErr == nil {
+				e.shutdown(context.Canceled)
+			}
+		default:
+			// Still opening; the canceled context aborts the open.
+		}
+	}
+}
+
+// Subscribe attaches a new subscriber to the upstream for key. If no upstream
+// exists yet, open is called to create it and a producer goroutine is started
+// to feed all subscribers. Concurrent callers for the same key wait for the
+// first open to finish and share its result. If ctx is done first, Subscribe
+// returns its error; an open that no caller is waiting for any more is
+// canceled.
+func (h *Hub) Subscribe(ctx context.Context, key string, open OpenFunc) (*Subscriber, error) {
+	log := global.Log.WithField("func", "app.engine.forwarder.stream.Hub.Subscribe").WithField("key", key)
+
+	for {
+		h.mu.Lock()
+		if err := h.ctx.Err(); err != nil {
+			h.mu.Unlock()
+			return nil, err
+		}
+		e, ok := h.entries[key]
+		var first *Subscriber // the opener's, attached by open
+		if !ok {
+			e = &hubEntry{
+				hub:   h,
+				key:   key,
+				ready: make(chan struct{}),
+				subs:  make(map[*Subscriber]struct{}),
+			}
+			e.ctx, e.cancel = context.WithCancel(h.ctx)
+			h.entries[key] = e
+			first = &Subscriber{entry: e, pipe: NewBoundedPipe(h.maxLag, OverflowDisconnect)}
+			log.Debug("opening shared upstream")
+			go e.open(open, first)
+		} else {
+			log.Debug("joining shared upstream")
+		}
+		e.mu.Lock()
+		e.waiters++
+		e.mu.Unlock()
+		h.mu.Unlock()
+
+		select {
+		case <-e.ready:
+		case <-ctx.Done():
+			e.abandon(first)
+			return nil, ctx.Err()
+		}
+
+		h.mu.Lock()
+		e.mu.Lock()
+		e.waiters--
+		if e.openErr != nil {
+			e.mu.Unlock()
+			h.mu.Unlock()
+			return nil, e.openErr
+		}
+		if first != nil {
+			// Attached before the first byte was broadcast; if the
+			// upstream has ended since, its data is still buffered.
+			log.WithField("subscribers", len(e.subs)).Debug("subscriber attached")
+			e.mu.Unlock()
+			h.mu.Unlock()
+			return first, nil
+		}
+		if e.closed {
+			// Upstream ended between open and subscribe; start over.
+			e.mu.Unlock()
+			h.mu.Unlock()
+			continue
+		}
+		sub := &Subscriber{entry: e, pipe: NewBoundedPipe(h.maxLag, OverflowDisconnect)}
+		if e.join != nil {
+			if snap := e.join.Snapshot(); len(snap) > 0 {
+				log.WithField("size", len(snap)).Debug("priming subscriber from join cache")
+				sub.pipe.Write(snap)
+			}
+		}
+		e.subs[sub] = struct{}{}
+		log.WithField("subscribers", len(e.subs)).Debug("subscriber attached")
+		e.mu.Unlock()
+		h.mu.Unlock()
+		return sub, nil
+	}
+}
+
+// Subscribers returns the number of subscribers attached to key.
+func (h *Hub) Subscribers(key string) int {
+	h.mu.Lock()
+	e, ok := h.entries[key]
+	h.mu.Unlock()
+	if !ok {
+		return 0
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.subs)
+}
+
+// open opens the upstream and attaches first, the subscriber of the caller
+// that created the entry, before the producer starts, so that it receives
+// the upstream from its first byte.
+func (e *hubEntry) open(open OpenFunc, first *Subscriber) {
+	upstream, contentType, err := open(e.ctx)
+
+	e.hub.mu.Lock()
+	e.mu.Lock()
+	if err == nil && e.waiters == 0 {
+		// Every client gave up while the upstream was opening.
+		err = context.Canceled
+		upstream.Close()
+	}
+	if err != nil {
+		e.openErr = err
+		e.closed = true
+		if e.hub.entries[e.key] == e {
+			delete(e.hub.entries, e.key)
+		}
+		e.mu.Unlock()
+		e.hub.mu.Unlock()
+		e.cancel()
+		close(e.ready)
+		return
+	}
+	e.upstream = upstream
+	e.contentType = contentType
+	if jc, ok := upstream.(*joinCached); ok {
+		e.join = jc.cache
+	}
+	e.subs[first] = struct{}{}
+	e.mu.Unlock()
+	e.hub.mu.Unlock()
+	close(e.ready)
+	go e.produce()
+}
+
+// abandon is called by a Subscribe caller that stops waiting for open, with
+// its subscriber if open attaches one. When no caller is left waiting and
+// nobody has subscribed, the entry is torn down: a pending open is canceled,
+// an opened upstream is closed.
+func (e *hubEntry) abandon(first *Subscriber) {
+	e.hub.mu.Lock()
+	e.mu.Lock()
+	e.waiters--
+	if first != nil {
+		delete(e.subs, first)
+	}
+	idle := e.waiters == 0 && len(e.subs) == 0 && !e.closed
+	opened := false
+	if idle {
+		select {
+		case <-e.ready:
+			opened = e.openErr == nil
+		default:
+		}
+		if opened {
+			e.closed = true
+			if e.hub.entries[e.key] == e {
+				delete(e.hub.entries, e.key)
+			}
+		}
+	}
+	e.mu.Unlock()
+	e.hub.mu.Unlock()
+
+	if idle {
+		e.cancel()
+	}
+	if opened {
+		e.upstream.Close()
+	}
+}
+
+// produce copies the upstream into every subscriber's pipe until the
+// upstream fails or is closed by the last subscriber leaving.
+func (e *hubEntry) produce() {
+	log := global.Log.WithField("func", "app.engine.forwarder.stream.hubEntry.produce").WithField("key", e.key)
+	buf := make([]byte, 65536)
+	for {
+		n, err := e.upstream.Read(buf)
+		if n > 0 {
+			e.broadcast(buf[:n])
+		}
+		if err != nil {
+			log.Debugf("shared upstream ended: %s", err.Error())
+			e.shutdown(err)
+			return
+		}
+	}
+}
+
+func (e *hubEntry) broadcast(p []byte) {
+	log := global.Log.WithField("func", "app.engine.forwarder.stream.hubEntry.broadcast").WithField("key", e.key)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.join != nil {
+		e.join.Observe(p)
+	}
+	for sub := range e.subs {
+		if sub.pipe.Err() != nil {
+			continue
+		}
+		// A full pipe disconnects the slow subscriber instead of holding
+		// up the others; it is removed from the hub when the client side
+		// notices the error and closes.
+		if _, err := sub.pipe.Write(p); err == ErrSlowSubscriber {
+			log.Warnf("subscriber lagging by more than %d bytes, disconnecting", e.hub.maxLag)
+		}
+	}
+}
+
+// shutdown detaches the entry from the hub and ends every subscriber with err
+// once they have drained their buffered data.
+func (e *hubEntry) shutdown(err error) {
+	e.hub.mu.Lock()
+	if e.hub.entries[e.key] == e {
+		delete(e.hub.entries, e.key)
+	}
+	e.mu.Lock()
+	e.closed = true
+	for sub := range e.subs {
+		sub.pipe.CloseWithError(err)
+	}
+	e.mu.Unlock()
+	e.hub.mu.Unlock()
+	e.cancel()
+	e.upstream.Close()
+}
+
+// ContentType returns the content type reported by the upstream's OpenFunc.
+func (s *Subscriber) ContentType() string {
+	return s.entry.contentType
+}
+
+// Read implements io.Reader. Blocks until data is available or the stream ends.
+func (s *Subscriber) Read(p []byte) (int, error) {
+	return s.pipe.Read(p)
+}
+
+// Close detaches the subscriber. When the last subscriber leaves, the shared
+// upstream is torn down.
+func (s *Subscriber) Close() error {
+	s.closeOnce.Do(func() {
+		log := global.Log.WithField("func", "app.engine.forwarder.stream.Subscriber.Close").WithField("key", s.entry.key)
+		s.pipe.BreakWithError(io.ErrClosedPipe)
+
+		e := s.entry
+		e.hub.mu.Lock()
+		e.mu.Lock()
+		delete(e.subs, s)
+		remaining := len(e.subs)
+		last := remaining == 0 && !e.closed
+		if last {
+			e.closed = true
+			if e.hub.entries[e.key] == e {
+				delete(e.hub.entries, e.key)
+			}
+		}
+		e.mu.Unlock()
+		e.hub.mu.Unlock()
+
+		log.WithField("subscribers", remaining).Debug("subscriber detached")
+		if last {
+			log.Debug("last subscriber left, closing shared upstream")
+			e.cancel()
+			e.upstream.Close()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,186 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/nv4d1k/live-stream-forwarder/global"
+)
+
+// ErrOffline is returned by extractors when the platform reports that the
+// streamer is not broadcasting. Forwarders react to it according to their
+// OfflinePolicy instead of retrying.
+var ErrOffline = errors.New("stream is offline")
+
+// OfflineAction is what a forwarder does when the stream goes offline.
+type OfflineAction int
+
+const (
+	OfflineClose       OfflineAction = iota // end the client response right away
+	OfflineWait                             // keep the response open until the stream resumes
+	OfflinePlaceholder                      // like OfflineWait, relaying a placeholder stream meanwhile
+)
+
+func (a OfflineAction) String() string {
+	switch a {
+	case OfflineClose:
+		return "close"
+	case OfflineWait:
+		return "wait"
+	case OfflinePlaceholder:
+		return "placeholder"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseOfflineAction parses the String form of an OfflineAction.
+func ParseOfflineAction(s string) (OfflineAction, error) {
+	for _, a := range []OfflineAction{OfflineClose, OfflineWait, OfflinePlaceholder} {
+		if strings.EqualFold(s, a.String()) {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown offline action %q (want close, wait or placeholder)", s)
+}
+
+// OfflinePolicy configures how forwarders handle ErrOffline.
+type OfflinePolicy struct {
+	Action      OfflineAction
+	Wait        time.Duration // how long to wait for the stream to resume before ending
+	Poll        time.Duration // interval between extraction attempts while waiting
+	Placeholder string        // URL relayed by HTTP-FLV streams while waiting; same format as the stream
+}
+
+// DefaultOfflinePolicy ends the response as soon as the stream goes offline.
+var DefaultOfflinePolicy = OfflinePolicy{
+	Action: OfflineClose,
+	Wait:   5 * time.Minute,
+	Poll:   15 * time.Second,
+}
+
+// IsOffline reports whether err says the stream is offline.
+func IsOffline(err error) bool {
+	return errors.Is(err, ErrOffline)
+}
+
+// Check decides whether a stream that went offline at since should end. It
+// returns the error to end it with, or nil if the caller should wait Poll
+// and extract again.
+func (p OfflinePolicy) Check(cause error, since time.Time) error {
+	if p.Action == OfflineClose {
+		return cause
+	}
+	if time.Since(since) >= p.Wait {
+		return fmt.Errorf("still offline after %s: %w", p.Wait, cause)
+	}
+	return nil
+}
+
+// whileOffline applies the offline policy after extraction reported cause.
+// It returns false once the stream has ended, and otherwise hands back
+// either nil, meaning extraction should be retried, or an upstream that was
+// connected while the placeholder ran.
+func (s *Stream) whileOffline(cause error, since time.Time, extractFn ExtractFunc, fetchFn FetchFunc, previous *ExtractResult) (*prefetched, bool) {
+	if err := s.offline.Check(cause, since); err != nil {
+		s.giveUp(err)
+		return nil, false
+	}
+	// The placeholder only makes sense once the client has received
+	// the stream's own header, which it is spliced onto.
+	if s.offline.Action == OfflinePlaceholder && s.offline.Placeholder != "" && previous != nil {
+		next := s.relayPlaceholder(extractFn, fetchFn, previous, since.Add(s.offline.Wait))
+		return next, s.pipe.Err() == nil && s.ctx.Err() == nil
+	}
+	return nil, s.sleep(s.offline.Poll)
+}
+
+// relayPlaceholder copies the placeholder stream into the pipe, restarting it
+// when it ends, while polling the platform every Poll interval. It returns
+// the upstream that was connected once the stream came back, or nil if the
+// deadline passed or the stream ended first.
+func (s *Stream) relayPlaceholder(extractFn ExtractFunc, fetchFn FetchFunc, previous *ExtractResult, deadline time.Time) *prefetched {
+	log := global.Log.WithField("func", "app.engine.forwarder.stream.relayPlaceholder")
+	ctx, cancel := context.WithDeadline(s.ctx, deadline)
+	defer cancel()
+
+	found := make(chan *prefetched, 1)
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		ticker := time.NewTicker(s.offline.Poll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if next := s.prefetch(ctx, extractFn, fetchFn, previous); next != nil {
+				found <- next
+				cancel()
+				return
+			}
+		}
+	}()
+
+	placeholder := &ExtractResult{URL: s.offline.Placeholder}
+	for ctx.Err() == nil && s.pipe.Err() == nil {
+		started := time.Now()
+		var n int64
+		body, cancelFetch, err := s.connect(ctx, fetchFn, placeholder)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Warnf("placeholder fetch error: %s", err.Error())
+			}
+		} else {
+			log.WithField("url", redactURL(placeholder.URL)).Debugln("relaying placeholder")
+			var w io.Writer = s.pipe
+			if s.writerWrapper != nil {
+				w = s.writerWrapper(s.pipe)
+			}
+			n, _ = io.Copy(w, body)
+			body.Close()
+			cancelFetch()
+		}
+		if n == 0 {
+			// Do not spin on a placeholder that fails or is empty.
+			select {
+			case <-ctx.Done():
+			case <-s.pipe.Done():
+			case <-time.After(s.offline.Poll - time.Since(started)):
+			}
+		}
+	}
+	cancel()
+	<-polled
+
+	select {
+	case next := <-found:
+		if s.pipe.Err() != nil {
+			next.close()
+			return nil
+		}
+		return next
+	default:
+		return nil
+	}
+}
+
+// sleep waits d and reports whether the stream is still running.
+func (s *Stream) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-s.pipe.Done():
+		return false
+	case <-s.ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,52 @@
+package stream
+
+import (
+	"context"
+	"time"
+)
+
+// Timeouts bounds the individual phases of a producer loop. A zero value
+// disables the limit for that phase.
+type Timeouts struct {
+	Extract time.Duration // platform API calls resolving the stream URL
+	Fetch   time.Duration // connecting to the stream URL, up to the response headers
+	Stall   time.Duration // silence from an established upstream before it is reconnected
+}
+
+// DefaultTimeouts is used by the stream, hls and websocket forwarders unless
+// overridden.
+var DefaultTimeouts = Timeouts{
+	Extract: 15 * time.Second,
+	Fetch:   15 * time.Second,
+	Stall:   15 * time.Second,
+}
+
+// WithPhaseTimeout returns a child of ctx that is canceled with cause
+// context.DeadlineExceeded if d elapses before stop is called. Unlike
+// context.WithTimeout, stopping in time leaves the context alive, so a
+// response body obtained under it can be read for as long as the stream
+// runs. stop reports whether the deadline was disarmed before it fired.
+// cancel must be called once the context is no longer needed.
+func WithPhaseTimeout(ctx context.Context, d time.Duration) (phaseCtx context.Context, stop func() bool, cancel context.CancelFunc) {
+	c, cancelCause := context.WithCancelCause(ctx)
+	cancel = func() { cancelCause(context.Canceled) }
+	if d <= 0 {
+		return c, func() bool { return true }, cancel
+	}
+	t := time.AfterFunc(d, func() { cancelCause(context.DeadlineExceeded) })
+	return c, t.Stop, cancel
+}
+
+// PhaseTimedOut reports whether ctx, created by WithPhaseTimeout, was
+// canceled because its deadline fired.
+func PhaseTimedOut(ctx context.Context) bool {
+	return context.Cause(ctx) == context.DeadlineExceeded
+}
+
+// WithTimeout is context.WithTimeout, except that d <= 0 means no limit.
+func WithTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
@@ -12,13 +12,16 @@ import (
 // underlying buffer is an interface. (io.Pipe is always unbuffered)
 type Pipe struct {
 	mu       sync.Mutex
-	c        sync.Cond     // c.L lazily initialized to &p.mu
-	b        pipeBuffer    // nil when done reading
-	unread   int           // bytes unread when done
-	err      error         // read error once empty. non-nil means closed.
-	breakErr error         // immediate read error (caller doesn't see rest of b)
-	donec    chan struct{} // closed on error
-	readFn   func()        // optional code to run in Read before error
+	c        sync.Cond      // c.L lazily initialized to &p.mu
+	b        pipeBuffer     // nil when done reading
+	unread   int            // bytes unread when done
+	err      error          // read error once empty. non-nil means closed.
+	breakErr error          // immediate read error (caller doesn't see rest of b)
+	donec    chan struct{}  // closed on error
+	readFn   func()         // optional code to run in Read before error
+	policy   OverflowPolicy // what Write does when a bounded buffer is full
+	hwm      int            // largest number of unread bytes seen
+	dropped  int64          // bytes discarded by OverflowDropOldest
 }
 
 type pipeBuffer interface {
@@ -27,12 +30,62 @@ type pipeBuffer interface {
 	io.Reader
 }
 
+// boundedBuffer is a pipeBuffer with a fixed capacity. Its Write stores as
+// much as fits and leaves overflow handling to the Pipe.
+type boundedBuffer interface {
+	pipeBuffer
+	Free() int
+	Discard(n int) int
+}
+
+// OverflowPolicy selects what a bounded Pipe does when a write does not fit
+// in its buffer.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes Write wait until the reader frees space. The
+	// producer is slowed to the consumer's pace.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest unread bytes to make room.
+	// The producer never waits, but the consumer loses data.
+	OverflowDropOldest
+	// OverflowDisconnect breaks the pipe with ErrBufferOverflow, so the
+	// consumer is cut off instead of holding up the producer.
+	OverflowDisconnect
+)
+
+func (o OverflowPolicy) String() string {
+	switch o {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowDisconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrBufferOverflow is returned to both sides of a pipe using
+// OverflowDisconnect once its buffer overflowed.
+var ErrBufferOverflow = errors.New("pipe buffer full, consumer disconnected")
+
+// NewPipe returns a Pipe backed by an unbounded buffer.
 func NewPipe() *Pipe {
 	p := &Pipe{}
 	p.setBuffer(bytes.NewBuffer(nil))
 	return p
 }
 
+// NewBoundedPipe returns a Pipe backed by a ring buffer holding at most size
+// bytes, applying policy when a write does not fit.
+func NewBoundedPipe(size int, policy OverflowPolicy) *Pipe {
+	p := &Pipe{policy: policy}
+	p.setBuffer(newRingBuffer(size))
+	return p
+}
+
 // setBuffer initializes the pipe buffer.
 // It has no effect if the pipe is already closed.
 func (p *Pipe) setBuffer(b pipeBuffer) {
@@ -66,6 +119,8 @@ func (p *Pipe) Read(d []byte) (n int, err error) {
 			return 0, p.breakErr
 		}
 		if p.b != nil && p.b.Len() > 0 {
+			// Wake a writer waiting for space in a bounded buffer.
+			p.c.Broadcast()
 			return p.b.Read(d)
 		}
 		if p.err != nil {
@@ -83,18 +138,80 @@ func (p *Pipe) Read(d []byte) (n int, err error) {
 var errClosedPipeWrite = errors.New("write on closed buffer")
 
 // Write copies bytes from p into the buffer and wakes a reader.
-// It is an error to write more data than the buffer can hold.
+// For a bounded pipe, the overflow policy decides what happens when the
+// data does not fit.
 func (p *Pipe) Write(d []byte) (n int, err error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	if p.c.L == nil {
 		p.c.L = &p.mu
 	}
-	defer p.c.Signal()
+	defer p.c.Broadcast()
 	if p.err != nil || p.breakErr != nil {
 		return 0, errClosedPipeWrite
 	}
-	return p.b.Write(d)
+	if bb, ok := p.b.(boundedBuffer); ok {
+		return p.writeBounded(bb, d)
+	}
+	n, err = p.b.Write(d)
+	p.updateHighWaterLocked()
+	return n, err
+}
+
+// writeBounded writes d into a bounded buffer, applying the pipe's overflow
+// policy whenever the buffer is full. Requires p.mu be held.
+func (p *Pipe) writeBounded(bb boundedBuffer, d []byte) (n int, err error) {
+	for len(d) > 0 {
+		if p.err != nil || p.breakErr != nil {
+			return n, errClosedPipeWrite
+		}
+		if bb.Free() == 0 {
+			switch p.policy {
+			case OverflowDropOldest:
+				drop := len(d)
+				if drop > bb.Len() {
+					drop = bb.Len()
+				}
+				p.dropped += int64(bb.Discard(drop))
+			case OverflowDisconnect:
+				p.breakErr = ErrBufferOverflow
+				p.unread += bb.Len()
+				p.b = nil
+				p.closeDoneLocked()
+				return n, ErrBufferOverflow
+			default:
+				p.c.Wait()
+			}
+			continue
+		}
+		w, _ := bb.Write(d)
+		n += w
+		d = d[w:]
+		p.updateHighWaterLocked()
+		p.c.Broadcast()
+	}
+	return n, nil
+}
+
+// requires p.mu be held.
+func (p *Pipe) updateHighWaterLocked() {
+	if p.b != nil && p.b.Len() > p.hwm {
+		p.hwm = p.b.Len()
+	}
+}
+
+// HighWaterMark returns the largest number of unread bytes the pipe has held.
+func (p *Pipe) HighWaterMark() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.hwm
+}
+
+// Dropped returns the number of bytes discarded under OverflowDropOldest.
+func (p *Pipe) Dropped() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dropped
 }
 
 // CloseWithError causes the next Read (waking up a current blocked
@@ -122,7 +239,7 @@ func (p *Pipe) closeWithError(dst *error, err error, fn func()) {
 	if p.c.L == nil {
 		p.c.L = &p.mu
 	}
-	defer p.c.Signal()
+	defer p.c.Broadcast()
 	if *dst != nil {
 		// Already been done.
 		return
@@ -0,0 +1,138 @@
+package stream
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/nv4d1k/live-stream-forwarder/global"
+)
+
+const (
+	refreshLead    = 60 * time.Second // how long before expiry to refresh
+	refreshMinWait = 5 * time.Second  // minimum wait, so short-lived URLs do not cause a refresh storm
+)
+
+// RefreshDelay returns how long to wait before re-extracting a URL that
+// expires at expireAt: 60 seconds before expiry, but no less than 5 seconds
+// from now unless the URL expires sooner than that.
+func RefreshDelay(expireAt time.Time) time.Duration {
+	remaining := time.Until(expireAt)
+	leadTime := refreshLead
+	if remaining <= leadTime+refreshMinWait {
+		leadTime = max(remaining-refreshMinWait, 0)
+	}
+	return max(remaining-leadTime, 0)
+}
+
+// prefetched is a fresh upstream connected before the current one expires.
+type prefetched struct {
+	extracted  *ExtractResult // the extraction it came from
+	alternates []string       // candidate URLs of that extraction not yet tried
+	result     *ExtractResult
+	body       io.ReadCloser
+	cancel     context.CancelFunc
+}
+
+func (p *prefetched) close() {
+	p.body.Close()
+	p.cancel()
+}
+
+// refreshBefore schedules a refresh of current shortly before its ExpireAt:
+// the URL is re-extracted, the new upstream connected, and then swap is
+// called to cut the current upstream. The returned stop function cancels a
+// pending refresh and returns the new upstream if one was connected, which
+// the caller then owns.
+func (s *Stream) refreshBefore(extractFn ExtractFunc, fetchFn FetchFunc, current *ExtractResult, swap func()) (stop func() *prefetched) {
+	if current.ExpireAt == nil {
+		return func() *prefetched { return nil }
+	}
+	log := global.Log.WithField("func", "app.engine.forwarder.stream.refreshBefore")
+	delay := RefreshDelay(*current.ExpireAt)
+	log.Debugf("scheduling upstream refresh in %s (expires at %s)", delay, current.ExpireAt.Format(time.RFC3339))
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	done := make(chan *prefetched, 1)
+	go func() {
+		var next *prefetched
+		defer func() { done <- next }()
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+		next = s.prefetch(ctx, extractFn, fetchFn, current)
+		if next != nil {
+			swap()
+		}
+	}()
+	return func() *prefetched {
+		cancel()
+		return <-done
+	}
+}
+
+// prefetch extracts a fresh URL and connects to it while current is still
+// streaming. It returns nil if either step fails or ctx is canceled first;
+// the current upstream then carries on until it fails on its own.
+func (s *Stream) prefetch(ctx context.Context, extractFn ExtractFunc, fetchFn FetchFunc, current *ExtractResult) *prefetched {
+	log := global.Log.WithField("func", "app.engine.forwarder.stream.prefetch")
+	ectx, cancelExtract := WithTimeout(ctx, s.timeouts.Extract)
+	extracted, err := extractFn(ectx, current)
+	cancelExtract()
+	if ctx.Err() != nil {
+		return nil
+	}
+	if IsOffline(err) {
+		log.Debugf("refresh extract reports stream offline: %s", err.Error())
+		return nil
+	}
+	if err != nil {
+		log.Warnf("refresh extract error, keeping current upstream: %s", err.Error())
+		return nil
+	}
+	if !formatMatches(current.URL, extracted.URL) {
+		log.Warnf("refresh returned different format (was %s, got %s), keeping current upstream", current.URL, extracted.URL)
+		return nil
+	}
+	urls := s.health.Order(extracted.AllCandidates())
+	if len(urls) == 0 {
+		return nil
+	}
+	result := extracted.WithURL(urls[0])
+
+	// The body must outlive ctx, which ends with the current upstream,
+	// but the connection attempt itself is abandoned along with it.
+	bctx, cancelBody := context.WithCancel(s.ctx)
+	stopAbort := context.AfterFunc(ctx, cancelBody)
+	body, cancelFetch, err := s.connect(bctx, fetchFn, result)
+	if !stopAbort() {
+		if err == nil {
+			body.Close()
+			cancelFetch()
+		}
+		cancelBody()
+		return nil
+	}
+	if err != nil {
+		cancelBody()
+		if Classify(err) == ClassTransient {
+			s.health.Failure(result.URL)
+		}
+		log.Warnf("refresh fetch error, keeping current upstream: %s", err.Error())
+		return nil
+	}
+	return &prefetched{
+		extracted:  extracted,
+		alternates: urls[1:],
+		result:     result,
+		body:       body,
+		cancel: func() {
+			cancelFetch()
+			cancelBody()
+		},
+	}
+}
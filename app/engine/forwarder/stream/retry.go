@@ -0,0 +1,119 @@
+package stream
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// ErrRetryBudgetExhausted is returned when a producer has used up the
+// attempts or time allowed by its RetryPolicy.
+var ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// ErrRetryCanceled is returned by Backoff.Wait when the stream was closed
+// while waiting for the next attempt.
+var ErrRetryCanceled = errors.New("retry canceled")
+
+// RetryPolicy controls how producer loops back off between failed attempts
+// to extract, fetch or reconnect an upstream.
+type RetryPolicy struct {
+	InitialDelay time.Duration // delay before the first retry
+	MaxDelay     time.Duration // upper bound for a single delay
+	Multiplier   float64       // growth factor applied after each failure
+	Jitter       float64       // random spread applied to each delay, 0..1
+	MaxAttempts  int           // consecutive failures allowed; 0 means unlimited
+	MaxElapsed   time.Duration // time allowed since the first failure; 0 means unlimited
+}
+
+// DefaultRetryPolicy is used by the stream, hls and websocket forwarders
+// unless overridden.
+var DefaultRetryPolicy = RetryPolicy{
+	InitialDelay: 500 * time.Millisecond,
+	MaxDelay:     30 * time.Second,
+	Multiplier:   2,
+	Jitter:       0.2,
+	MaxElapsed:   5 * time.Minute,
+}
+
+// Backoff tracks consecutive failures under a RetryPolicy. It is not safe for
+// concurrent use; each producer loop owns its own Backoff.
+type Backoff struct {
+	policy   RetryPolicy
+	attempts int
+	start    time.Time
+}
+
+// NewBackoff returns a Backoff in its initial state.
+func (p RetryPolicy) NewBackoff() *Backoff {
+	return &Backoff{policy: p}
+}
+
+// Reset clears the failure count after a successful attempt.
+func (b *Backoff) Reset() {
+	b.attempts = 0
+	b.start = time.Time{}
+}
+
+// Attempts returns the number of consecutive failures recorded.
+func (b *Backoff) Attempts() int {
+	return b.attempts
+}
+
+// Next records a failure and returns the delay before the next attempt.
+// It returns ErrRetryBudgetExhausted once the policy's limits are reached.
+func (b *Backoff) Next() (time.Duration, error) {
+	now := time.Now()
+	if b.attempts == 0 {
+		b.start = now
+	}
+	b.attempts++
+	if b.policy.MaxAttempts > 0 && b.attempts > b.policy.MaxAttempts {
+		return 0, ErrRetryBudgetExhausted
+	}
+	if b.policy.MaxElapsed > 0 && now.Sub(b.start) >= b.policy.MaxElapsed {
+		return 0, ErrRetryBudgetExhausted
+	}
+
+	delay := float64(b.policy.InitialDelay)
+	for i := 1; i < b.attempts; i++ {
+		delay *= b.policy.Multiplier
+		if b.policy.MaxDelay > 0 && delay >= float64(b.policy.MaxDelay) {
+			delay = float64(b.policy.MaxDelay)
+			break
+		}
+	}
+	if b.policy.Jitter > 0 {
+		delay += delay * b.policy.Jitter * (2*rand.Float64() - 1)
+	}
+	if b.policy.MaxDelay > 0 && delay > float64(b.policy.MaxDelay) {
+		delay = float64(b.policy.MaxDelay)
+	}
+	return time.Duration(delay), nil
+}
+
+// Wait records a failure and sleeps for the next delay. It returns
+// ErrRetryBudgetExhausted when no attempts are left, or ErrRetryCanceled if
+// done is closed while sleeping.
+func (b *Backoff) Wait(done <-chan struct{}) error {
+	return b.WaitAtLeast(done, 0)
+}
+
+// WaitAtLeast is like Wait but sleeps for at least min, e.g. to honour a
+// server's Retry-After.
+func (b *Backoff) WaitAtLeast(done <-chan struct{}, min time.Duration) error {
+	delay, err := b.Next()
+	if err != nil {
+		return err
+	}
+	if delay < min {
+		delay = min
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-done:
+		return ErrRetryCanceled
+	case <-t.C:
+		return nil
+	}
+}
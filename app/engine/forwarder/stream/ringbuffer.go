@@ -0,0 +1,106 @@
+package stream
+
+// ringBuffer is a bounded FIFO byte buffer. Storage grows on demand up to
+// max, so an idle or slow-starting stream does not pay for the full
+// capacity up front. Write never writes more than the free space; the
+// owning Pipe decides what happens when the buffer is full.
+type ringBuffer struct {
+	buf []byte
+	r   int // read position
+	n   int // number of unread bytes
+	max int
+}
+
+// minRingSize is the initial allocation for a ringBuffer.
+const minRingSize = 64 << 10
+
+func newRingBuffer(max int) *ringBuffer {
+	if max <= 0 {
+		panic("ring buffer size must be positive")
+	}
+	return &ringBuffer{max: max}
+}
+
+func (b *ringBuffer) Len() int { return b.n }
+
+// Cap returns the maximum number of bytes the buffer can hold.
+func (b *ringBuffer) Cap() int { return b.max }
+
+// Free returns the number of bytes that can be written without overflow.
+func (b *ringBuffer) Free() int { return b.max - b.n }
+
+// grow makes room for at least need unread bytes, up to max.
+func (b *ringBuffer) grow(need int) {
+	if need <= len(b.buf) {
+		return
+	}
+	size := len(b.buf)
+	if size < minRingSize {
+		size = minRingSize
+	}
+	for size < need {
+		size *= 2
+	}
+	if size > b.max {
+		size = b.max
+	}
+	nb := make([]byte, size)
+	b.copyOut(nb)
+	b.buf = nb
+	b.r = 0
+}
+
+// copyOut copies the unread bytes, in order, into dst without consuming them.
+func (b *ringBuffer) copyOut(dst []byte) int {
+	if b.n == 0 {
+		return 0
+	}
+	end := b.r + b.n
+	if end <= len(b.buf) {
+		return copy(dst, b.buf[b.r:end])
+	}
+	n := copy(dst, b.buf[b.r:])
+	return n + copy(dst[n:], b.buf[:end-len(b.buf)])
+}
+
+// Write appends as much of p as fits and returns the number of bytes written.
+func (b *ringBuffer) Write(p []byte) (int, error) {
+	if len(p) > b.Free() {
+		p = p[:b.Free()]
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	b.grow(b.n + len(p))
+	w := (b.r + b.n) % len(b.buf)
+	n := copy(b.buf[w:], p)
+	if n < len(p) {
+		copy(b.buf, p[n:])
+	}
+	b.n += len(p)
+	return len(p), nil
+}
+
+// Read consumes up to len(p) bytes.
+func (b *ringBuffer) Read(p []byte) (int, error) {
+	n := b.copyOut(p)
+	b.Discard(n)
+	return n, nil
+}
+
+// Discard drops up to n of the oldest unread bytes and returns how many were
+// dropped.
+func (b *ringBuffer) Discard(n int) int {
+	if n > b.n {
+		n = b.n
+	}
+	if n == 0 {
+		return 0
+	}
+	b.r = (b.r + n) % len(b.buf)
+	b.n -= n
+	if b.n == 0 {
+		b.r = 0
+	}
+	return n
+}
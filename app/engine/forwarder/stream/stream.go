@@ -1,12 +1,13 @@
 package stream
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"path"
-	"strings"
 	"sync"
 	"time"
 
@@ -15,19 +16,39 @@ import (
 
 // ExtractFunc is called to obtain a fresh stream URL from a platform extractor.
 // previous is nil on the first call, and set to the previous result on retries,
-// so the extractor can ensure format consistency.
-type ExtractFunc func(previous *ExtractResult) (*ExtractResult, error)
+// so the extractor can ensure format consistency. ctx is canceled when the
+// stream closes or the extract timeout elapses.
+type ExtractFunc func(ctx context.Context, previous *ExtractResult) (*ExtractResult, error)
 
 // ExtractResult holds the resolved URL and optional headers needed to fetch it.
 type ExtractResult struct {
 	URL             string
 	Headers         http.Header
-	ExpireAt        *time.Time // when the URL expires; nil means unknown or no expiry
-	VariantSelector any        // optional func([]*libm3u8.Variant) *libm3u8.Variant; used by HLS forwarder
+	Platform        string      // platform name, used to annotate upstream errors
+	ExpireAt        *time.Time  // when the URL expires; nil means unknown or no expiry
+	VariantSelector any         // optional func([]*libm3u8.Variant) *libm3u8.Variant; used by HLS forwarder
+	Candidates      []Candidate // alternate URLs for the same stream, including URL; nil means URL only
 }
 
-// FetchFunc returns the upstream response body for a given URL.
-type FetchFunc func(u string, headers http.Header) (io.ReadCloser, error)
+// AllCandidates returns the URLs the stream can be fetched from. Without
+// explicit candidates this is just URL.
+func (r *ExtractResult) AllCandidates() []Candidate {
+	if len(r.Candidates) == 0 {
+		return []Candidate{{URL: r.URL}}
+	}
+	return r.Candidates
+}
+
+// WithURL returns a copy of r that fetches u instead of r.URL.
+func (r *ExtractResult) WithURL(u string) *ExtractResult {
+	c := *r
+	c.URL = u
+	return &c
+}
+
+// FetchFunc returns the upstream response body for a given URL. The body must
+// stop reading once ctx is canceled.
+type FetchFunc func(ctx context.Context, u string, headers http.Header) (io.ReadCloser, error)
 
 // WriterWrapperFunc wraps an io.Writer with additional behavior.
 // Called once per produce iteration to create the writer target for io.Copy.
@@ -43,6 +64,50 @@ func WithWriterWrapper(fn WriterWrapperFunc) StreamOption {
 	return func(s *Stream) { s.writerWrapper = fn }
 }
 
+// DefaultBufferSize is the pipe buffer size used by producers unless
+// overridden. It holds a few seconds of high bitrate video.
+const DefaultBufferSize = 4 << 20
+
+// WithBuffer sets the size and overflow policy of the stream's pipe. The
+// default is DefaultBufferSize with OverflowBlock, which slows the upstream
+// to the consumer's pace.
+func WithBuffer(size int, policy OverflowPolicy) StreamOption {
+	return func(s *Stream) {
+		s.bufferSize = size
+		s.bufferPolicy = policy
+	}
+}
+
+// WithRetryPolicy overrides DefaultRetryPolicy for the stream's reconnect
+// loop.
+func WithRetryPolicy(p RetryPolicy) StreamOption {
+	return func(s *Stream) { s.retry = p }
+}
+
+// WithContext sets the parent context of the stream. Canceling it closes the
+// stream and aborts any in-flight extraction or fetch.
+func WithContext(ctx context.Context) StreamOption {
+	return func(s *Stream) { s.parent = ctx }
+}
+
+// WithTimeouts overrides DefaultTimeouts for the stream's extract and fetch
+// phases.
+func WithTimeouts(t Timeouts) StreamOption {
+	return func(s *Stream) { s.timeouts = t }
+}
+
+// WithOfflinePolicy overrides DefaultOfflinePolicy, which decides what
+// happens when extraction reports the stream offline.
+func WithOfflinePolicy(p OfflinePolicy) StreamOption {
+	return func(s *Stream) { s.offline = p }
+}
+
+// WithHostHealth overrides DefaultHealth, which orders candidate URLs and
+// records failing hosts.
+func WithHostHealth(h *HostHealth) StreamOption {
+	return func(s *Stream) { s.health = h }
+}
+
 // Stream wraps a Pipe so that a consumer reads continuously while a producer
 // goroutine feeds data in. When the producer encounters a 403 (URL expired),
 // it calls the ExtractFunc to get a fresh URL and reconnects — the consumer
@@ -53,6 +118,17 @@ type Stream struct {
 	closeErr      error
 	closeOnce     sync.Once
 	writerWrapper WriterWrapperFunc
+	retry         RetryPolicy
+	bufferSize    int
+	bufferPolicy  OverflowPolicy
+	timeouts      Timeouts
+	health        *HostHealth
+	offline       OfflinePolicy
+
+	parent     context.Context
+	ctx        context.Context // canceled when the stream ends
+	cancel     context.CancelFunc
+	stopParent func() bool // detaches the parent's AfterFunc
 }
 
 // NewStream creates a Stream and starts the producer goroutine.
@@ -63,12 +139,21 @@ func NewStream(extractFn ExtractFunc, fetchFn FetchFunc, opts ...StreamOption) *
 	log := global.Log.WithField("func", "app.engine.forwarder.stream.NewStream")
 	log.Debugln("creating stream")
 	s := &Stream{
-		pipe: NewPipe(),
-		done: make(chan struct{}),
+		done:         make(chan struct{}),
+		retry:        DefaultRetryPolicy,
+		bufferSize:   DefaultBufferSize,
+		bufferPolicy: OverflowBlock,
+		timeouts:     DefaultTimeouts,
+		health:       DefaultHealth,
+		offline:      DefaultOfflinePolicy,
+		parent:       context.Background(),
 	}
 	for _, opt := range opts {
 		opt(s)
 	}
+	s.pipe = NewBoundedPipe(s.bufferSize, s.bufferPolicy)
+	s.ctx, s.cancel = context.WithCancel(s.parent)
+	s.stopParent = context.AfterFunc(s.parent, func() { s.Close() })
 	go s.produce(extractFn, fetchFn)
 	return s
 }
@@ -82,11 +167,20 @@ func (s *Stream) Read(p []byte) (int, error) {
 func (s *Stream) Close() error {
 	log := global.Log.WithField("func", "app.engine.forwarder.stream.Close")
 	log.Debugln("closing stream")
+	s.pipe.BreakWithError(io.ErrClosedPipe)
+	s.finish(nil)
+	return nil
+}
+
+// finish marks the stream as done and releases its context. err is the
+// reason Wait reports; only the first call to finish records one.
+func (s *Stream) finish(err error) {
 	s.closeOnce.Do(func() {
-		s.pipe.BreakWithError(io.ErrClosedPipe)
+		s.closeErr = err
+		s.stopParent()
+		s.cancel()
 		close(s.done)
 	})
-	return nil
 }
 
 // Wait blocks until the producer goroutine finishes and returns the final error.
@@ -100,28 +194,121 @@ func (s *Stream) Wait() error {
 func (s *Stream) produce(extractFn ExtractFunc, fetchFn FetchFunc) {
 	log := global.Log.WithField("func", "app.engine.forwarder.stream.produce")
 	var previous *ExtractResult
+	var extracted *ExtractResult // latest extraction, source of alternates
+	var alternates []string      // its candidate URLs not yet tried
+	var next *prefetched         // upstream connected ahead of expiry
+	var offlineSince time.Time   // when extraction first reported the stream offline
+	backoff := s.retry.NewBackoff()
 
-	for {
-		result, err := extractFn(previous)
-		if err != nil {
-			log.Warnf("extract error: %s", err.Error())
-			continue
+	// retry waits before the next attempt. It returns false when the
+	// stream should stop, either because the client went away or the
+	// retry budget is spent.
+	retry := func(cause error) bool {
+		if err := backoff.WaitAtLeast(s.pipe.Done(), RetryAfter(cause)); err != nil {
+			if err != ErrRetryCanceled {
+				s.giveUp(fmt.Errorf("%w after %d attempts: %w", err, backoff.Attempts(), cause))
+			}
+			return false
 		}
+		return true
+	}
 
-		// On retry: validate that the new URL format matches the initial one.
-		if previous != nil && !formatMatches(previous.URL, result.URL) {
-			log.Warnf("extract returned different format (was %s, got %s), retrying", previous.URL, result.URL)
-			continue
+	// failover marks the host of u as unhealthy and reports whether
+	// another candidate from the same extraction should be tried before
+	// extracting again. Only connection-level failures fail over; an
+	// expired or offline stream needs a fresh extraction.
+	failover := func(u string, cause error) bool {
+		if Classify(cause) != ClassTransient {
+			alternates = nil
+			return false
+		}
+		s.health.Failure(u)
+		if len(alternates) == 0 {
+			return false
 		}
+		log.Warnf("upstream %s failed, trying alternate %s: %s", redactURL(u), redactURL(alternates[0]), cause.Error())
+		return true
+	}
 
-		body, err := fetchFn(result.URL, result.Headers)
-		if err != nil {
-			if isRetriable(err) {
-				log.Warnf("fetch retriable error: %s", err.Error())
-				continue
+	for {
+		var result *ExtractResult
+		var body io.ReadCloser
+		var cancelFetch context.CancelFunc
+		if next != nil {
+			result, body, cancelFetch = next.result, next.body, next.cancel
+			extracted, alternates = next.extracted, next.alternates
+			next = nil
+			offlineSince = time.Time{}
+		} else {
+			if len(alternates) > 0 {
+				result = extracted.WithURL(alternates[0])
+				alternates = alternates[1:]
+			} else {
+				ectx, cancelExtract := WithTimeout(s.ctx, s.timeouts.Extract)
+				extractResult, err := extractFn(ectx, previous)
+				cancelExtract()
+				if s.ctx.Err() != nil {
+					return
+				}
+				if IsOffline(err) {
+					if offlineSince.IsZero() {
+						offlineSince = time.Now()
+						log.Infof("stream offline, applying %s policy: %s", s.offline.Action, err.Error())
+					}
+					var ok bool
+					if next, ok = s.whileOffline(err, offlineSince, extractFn, fetchFn, previous); !ok {
+						return
+					}
+					continue
+				}
+				if err != nil {
+					log.Warnf("extract error: %s", err.Error())
+					if !retry(err) {
+						return
+					}
+					continue
+				}
+				if !offlineSince.IsZero() {
+					log.Infof("stream back online after %s", time.Since(offlineSince).Round(time.Second))
+					offlineSince = time.Time{}
+				}
+
+				// On retry: validate that the new URL format matches the initial one.
+				if previous != nil && !formatMatches(previous.URL, extractResult.URL) {
+					log.Warnf("extract returned different format (was %s, got %s), retrying", previous.URL, extractResult.URL)
+					if !retry(fmt.Errorf("format changed from %s to %s", previous.URL, extractResult.URL)) {
+						return
+					}
+					continue
+				}
+
+				extracted = extractResult
+				result = extractResult
+				if urls := s.health.Order(extractResult.AllCandidates()); len(urls) > 0 {
+					result = extractResult.WithURL(urls[0])
+					alternates = urls[1:]
+				}
+			}
+
+			var err error
+			body, cancelFetch, err = s.connect(s.ctx, fetchFn, result)
+			if err != nil {
+				if s.ctx.Err() != nil {
+					return
+				}
+				if failover(result.URL, err) {
+					continue
+				}
+				if isRetriable(err) {
+					log.Warnf("fetch retriable error: %s", err.Error())
+					if !retry(err) {
+						return
+					}
+					continue
+				}
+				s.closeWithError(err)
+				return
 			}
-			s.closeWithError(err)
-			return
 		}
 
 		previous = result
@@ -129,17 +316,56 @@ func (s *Stream) produce(extractFn ExtractFunc, fetchFn FetchFunc) {
 		if s.writerWrapper != nil {
 			w = s.writerWrapper(s.pipe)
 		}
-		_, err = io.Copy(w, body)
+		// A stalled upstream is cut off by canceling its request, which
+		// fails the pending read and sends us down the reconnect path.
+		// Shortly before the URL expires, a fresh upstream is connected
+		// and the current one is cut the same way.
+		watchdog := NewWatchdog(s.timeouts.Stall, cancelFetch)
+		stopRefresh := s.refreshBefore(extractFn, fetchFn, result, cancelFetch)
+		n, err := io.Copy(w, WatchReader(body, watchdog))
+		watchdog.Disarm()
 		body.Close()
+		cancelFetch()
+		next = stopRefresh()
+		if watchdog.Stalled() {
+			log.WithField("event", "stall").WithField("url", redactURL(result.URL)).
+				Warnf("no data from upstream for %s after %d bytes, reconnecting", s.timeouts.Stall, n)
+		}
 
 		if s.pipe.Err() != nil {
 			// Pipe was closed from the consumer side (client disconnected).
+			if next != nil {
+				next.close()
+			}
 			return
 		}
 
+		if n > 0 {
+			// Media flowed, so the upstream was healthy; start the
+			// retry budget afresh for the next failure.
+			backoff.Reset()
+		}
+
+		if next != nil {
+			// Whatever ended the copy, a fresh upstream is ready.
+			log.WithField("event", "refresh").WithField("url", redactURL(next.result.URL)).
+				Infof("switching to refreshed upstream after %d bytes", n)
+			if n > 0 && !watchdog.Stalled() {
+				s.health.Success(result.URL)
+			}
+			continue
+		}
+
 		if err != nil {
+			err = WithPlatform(WrapError(result.Platform, PhaseCopy, result.URL, err), result.Platform)
+			if failover(result.URL, err) {
+				continue
+			}
 			if isRetriable(err) {
 				log.Warnf("copy retriable error: %s", err.Error())
+				if !retry(err) {
+					return
+				}
 				continue
 			}
 			s.closeWithError(err)
@@ -148,15 +374,49 @@ func (s *Stream) produce(extractFn ExtractFunc, fetchFn FetchFunc) {
 
 		// io.Copy returned nil — upstream closed cleanly. Re-extract and reconnect.
 		log.Debugln("upstream closed cleanly, re-extracting")
+		alternates = nil
+		if n > 0 {
+			s.health.Success(result.URL)
+		} else if !retry(errors.New("upstream closed without data")) {
+			return
+		}
+	}
+}
+
+// connect fetches result.URL, bounding the time to the response headers by
+// the fetch timeout. ctx governs the body as well; the returned cancel
+// function must be called once the body is done.
+func (s *Stream) connect(ctx context.Context, fetchFn FetchFunc, result *ExtractResult) (io.ReadCloser, context.CancelFunc, error) {
+	fctx, stopFetchTimer, cancelFetch := WithPhaseTimeout(ctx, s.timeouts.Fetch)
+	body, err := fetchFn(fctx, result.URL, result.Headers)
+	if !stopFetchTimer() && err == nil {
+		body.Close()
+		err = context.DeadlineExceeded
+	}
+	if err != nil {
+		cancelFetch()
+		if PhaseTimedOut(fctx) {
+			err = fmt.Errorf("no response after %s: %w", s.timeouts.Fetch, context.DeadlineExceeded)
+		}
+		return nil, nil, WithPlatform(WrapError(result.Platform, PhaseFetch, result.URL, err), result.Platform)
 	}
+	return body, cancelFetch, nil
+}
+
+// giveUp ends the stream after the retry budget is spent. The consumer sees
+// a clean end-of-stream; Wait reports the reason.
+func (s *Stream) giveUp(err error) {
+	log := global.Log.WithField("func", "app.engine.forwarder.stream.giveUp")
+	log.Warnf("giving up on stream: %s", err.Error())
+	s.pipe.CloseWithError(io.EOF)
+	s.finish(err)
 }
 
 func (s *Stream) closeWithError(err error) {
 	log := global.Log.WithField("func", "app.engine.forwarder.stream.closeWithError")
 	log.Warnf("closing stream with error: %s", err.Error())
-	s.closeErr = err
 	s.pipe.CloseWithError(err)
-	close(s.done)
+	s.finish(err)
 }
 
 // formatMatches checks that two URLs have the same scheme and path extension,
@@ -180,16 +440,8 @@ func formatMatches(a, b string) bool {
 	return true
 }
 
-// isRetriable checks if an error indicates a 403 (URL expired) or other
-// retriable condition.
+// isRetriable reports whether the stream should reconnect after err,
+// according to the shared classification in Classify.
 func isRetriable(err error) bool {
-	if err == nil {
-		return false
-	}
-	msg := err.Error()
-	return strings.Contains(msg, "403")
+	return Classify(err).Retriable()
 }
-
-// Ensure ExtractResult is usable — the fmt import is needed for potential
-// future error formatting in this package.
-var _ = fmt.Sprintf
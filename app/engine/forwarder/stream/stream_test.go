@@ -1,10 +1,18 @@
 package stream
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -100,6 +108,122 @@ func TestPipe_CloseWithError(t *testing.T) {
 	}
 }
 
+func TestPipe_BoundedBlock(t *testing.T) {
+	p := NewBoundedPipe(4, OverflowBlock)
+
+	written := make(chan int, 1)
+	go func() {
+		n, _ := p.Write([]byte("abcdefgh"))
+		written <- n
+	}()
+
+	// The writer must block until the reader frees space.
+	select {
+	case <-written:
+		t.Fatal("Write on full pipe returned without blocking")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	var got []byte
+	buf := make([]byte, 3)
+	for len(got) < 8 {
+		n, err := p.Read(buf)
+		if err != nil {
+			t.Fatalf("Read returned error: %v", err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != "abcdefgh" {
+		t.Fatalf("Read got %q, want %q", got, "abcdefgh")
+	}
+	if n := <-written; n != 8 {
+		t.Fatalf("Write returned %d, want 8", n)
+	}
+	if hwm := p.HighWaterMark(); hwm != 4 {
+		t.Fatalf("HighWaterMark() = %d, want 4", hwm)
+	}
+}
+
+func TestPipe_BoundedBlockUnblocksOnBreak(t *testing.T) {
+	p := NewBoundedPipe(2, OverflowBlock)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := p.Write([]byte("abcd"))
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	p.BreakWithError(io.ErrClosedPipe)
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("blocked Write returned nil error after BreakWithError")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("blocked Write did not return after BreakWithError")
+	}
+}
+
+func TestPipe_BoundedDropOldest(t *testing.T) {
+	p := NewBoundedPipe(4, OverflowDropOldest)
+	if n, err := p.Write([]byte("abc")); n != 3 || err != nil {
+		t.Fatalf("Write = %d, %v; want 3, nil", n, err)
+	}
+	if n, err := p.Write([]byte("def")); n != 3 || err != nil {
+		t.Fatalf("Write = %d, %v; want 3, nil", n, err)
+	}
+
+	buf := make([]byte, 10)
+	n, _ := p.Read(buf)
+	if string(buf[:n]) != "cdef" {
+		t.Fatalf("Read got %q, want %q", buf[:n], "cdef")
+	}
+	if d := p.Dropped(); d != 2 {
+		t.Fatalf("Dropped() = %d, want 2", d)
+	}
+}
+
+func TestPipe_BoundedDisconnect(t *testing.T) {
+	p := NewBoundedPipe(4, OverflowDisconnect)
+	if _, err := p.Write([]byte("abcd")); err != nil {
+		t.Fatalf("Write within capacity returned error: %v", err)
+	}
+	if _, err := p.Write([]byte("e")); err != ErrBufferOverflow {
+		t.Fatalf("Write past capacity error = %v, want %v", err, ErrBufferOverflow)
+	}
+	buf := make([]byte, 10)
+	if _, err := p.Read(buf); err != ErrBufferOverflow {
+		t.Fatalf("Read after overflow error = %v, want %v", err, ErrBufferOverflow)
+	}
+}
+
+func TestRingBuffer_WrapAndGrow(t *testing.T) {
+	b := newRingBuffer(minRingSize * 4)
+	chunk := make([]byte, minRingSize/2+1)
+	for i := range chunk {
+		chunk[i] = byte(i)
+	}
+	out := make([]byte, len(chunk))
+
+	// Cycle enough data through to wrap the read position several times,
+	// with a growth step in between.
+	for round := 0; round < 6; round++ {
+		b.Write(chunk)
+		if round == 3 {
+			b.Write(chunk)
+			b.Write(chunk)
+			b.Read(out)
+			b.Read(out)
+		}
+		n, _ := b.Read(out)
+		if n != len(chunk) || !bytes.Equal(out, chunk) {
+			t.Fatalf("round %d: Read returned %d bytes with mismatched content", round, n)
+		}
+	}
+	if b.Len() != 0 {
+		t.Fatalf("Len() = %d, want 0", b.Len())
+	}
+}
+
 func TestFormatMatches(t *testing.T) {
 	tests := []struct {
 		name string
@@ -174,8 +298,8 @@ func TestIsRetriable(t *testing.T) {
 		want bool
 	}{
 		{
-			name: "error containing 403",
-			err:  errors.New("HTTP 403 Forbidden"),
+			name: "403 from upstream",
+			err:  &UpstreamError{Phase: PhaseFetch, StatusCode: 403},
 			want: true,
 		},
 		{
@@ -189,8 +313,13 @@ func TestIsRetriable(t *testing.T) {
 			want: false,
 		},
 		{
-			name: "error with 403 in middle",
+			name: "403 text without status is not retriable",
 			err:  errors.New("got status 403"),
+			want: false,
+		},
+		{
+			name: "wrapped connection reset",
+			err:  WrapError("test", PhaseCopy, "", &net.OpError{Op: "read", Err: syscall.ECONNRESET}),
 			want: true,
 		},
 	}
@@ -205,17 +334,61 @@ func TestIsRetriable(t *testing.T) {
 	}
 }
 
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"nil", nil, ClassNone},
+		{"403 expired", &UpstreamError{StatusCode: 403}, ClassExpired},
+		{"404 offline", &UpstreamError{StatusCode: 404}, ClassOffline},
+		{"429 rate limited", &UpstreamError{StatusCode: 429}, ClassRateLimited},
+		{"502 transient", &UpstreamError{StatusCode: 502}, ClassTransient},
+		{"400 fatal", &UpstreamError{StatusCode: 400}, ClassFatal},
+		{"wrapped status", fmt.Errorf("fetch: %w", &UpstreamError{StatusCode: 503}), ClassTransient},
+		{"unexpected EOF", io.ErrUnexpectedEOF, ClassTransient},
+		{"connection reset", &net.OpError{Op: "read", Err: syscall.ECONNRESET}, ClassTransient},
+		{"temporary DNS", &net.DNSError{IsTemporary: true}, ClassTransient},
+		{"permanent DNS", &net.DNSError{IsNotFound: true}, ClassFatal},
+		{"extract without status", &UpstreamError{Phase: PhaseExtract, Err: errors.New("bad json")}, ClassTransient},
+		{"closed pipe", WrapError("", PhaseCopy, "", io.ErrClosedPipe), ClassFatal},
+		{"circuit open", ErrCircuitOpen, ClassRateLimited},
+		{"offline extract", fmt.Errorf("room: %w", ErrOffline), ClassOffline},
+		{"plain error", errors.New("HTTP 403 Forbidden"), ClassFatal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Classify(tt.err); got != tt.want {
+				t.Errorf("Classify(%v) = %s, want %s", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamError_RedactsQuery(t *testing.T) {
+	resp := &http.Response{StatusCode: 429, Status: "429 Too Many Requests", Header: http.Header{"Retry-After": {"7"}}}
+	err := StatusError("douyu", PhaseFetch, "https://cdn.example/live.flv?token=secret", resp)
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("Error() leaks query string: %s", err.Error())
+	}
+	if got := RetryAfter(fmt.Errorf("wrapped: %w", err)); got != 7*time.Second {
+		t.Errorf("RetryAfter = %v, want 7s", got)
+	}
+}
+
 func TestStream_Close(t *testing.T) {
 	// Create a Stream with extract and fetch functions that block,
 	// then verify Close stops the produce goroutine.
 	extractCalled := make(chan struct{})
-	extractFn := func(previous *ExtractResult) (*ExtractResult, error) {
+	extractFn := func(_ context.Context, previous *ExtractResult) (*ExtractResult, error) {
 		extractCalled <- struct{}{}
 		// Block to keep produce loop waiting.
 		select {}
 	}
 
-	fetchFn := func(u string, headers http.Header) (io.ReadCloser, error) {
+	fetchFn := func(_ context.Context, u string, headers http.Header) (io.ReadCloser, error) {
 		// Should not be reached since extract blocks.
 		return nil, errors.New("unexpected fetch call")
 	}
@@ -249,3 +422,764 @@ func TestStream_Close(t *testing.T) {
 		t.Fatal("Wait timed out, produce goroutine may not have stopped")
 	}
 }
+
+func TestStream_ParentContextCancel(t *testing.T) {
+	fetched := make(chan struct{})
+	extractFn := func(_ context.Context, previous *ExtractResult) (*ExtractResult, error) {
+		return &ExtractResult{URL: "http://example.com/live.flv"}, nil
+	}
+	fetchFn := func(ctx context.Context, u string, headers http.Header) (io.ReadCloser, error) {
+		// A body that blocks until the request context is canceled.
+		pr, pw := io.Pipe()
+		context.AfterFunc(ctx, func() { pw.CloseWithError(ctx.Err()) })
+		close(fetched)
+		return pr, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewStream(extractFn, fetchFn, WithContext(ctx))
+	<-fetched
+	cancel()
+
+	waitCh := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 10)
+		_, err := s.Read(buf)
+		waitCh <- err
+	}()
+	select {
+	case err := <-waitCh:
+		if err == nil {
+			t.Fatal("Read after parent cancel returned nil error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Read still blocked after parent context was canceled")
+	}
+}
+
+func TestStream_FetchTimeout(t *testing.T) {
+	extractFn := func(_ context.Context, previous *ExtractResult) (*ExtractResult, error) {
+		return &ExtractResult{URL: "http://example.com/live.flv"}, nil
+	}
+	fetchFn := func(ctx context.Context, u string, headers http.Header) (io.ReadCloser, error) {
+		// Never responds; only the fetch timeout can end the call.
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	policy := RetryPolicy{InitialDelay: time.Millisecond, Multiplier: 2, MaxAttempts: 2}
+	s := NewStream(extractFn, fetchFn, WithRetryPolicy(policy), WithTimeouts(Timeouts{Fetch: 10 * time.Millisecond}))
+
+	done := make(chan error, 1)
+	go func() { done <- s.Wait() }()
+	select {
+	case err := <-done:
+		// A timed out fetch is retried like any other transient failure
+		// until the budget runs out.
+		if !errors.Is(err, ErrRetryBudgetExhausted) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Wait() = %v, want wrapped %v and %v", err, ErrRetryBudgetExhausted, context.DeadlineExceeded)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream did not give up after repeated fetch timeouts")
+	}
+}
+
+func TestStream_StallReconnects(t *testing.T) {
+	extractFn := func(_ context.Context, previous *ExtractResult) (*ExtractResult, error) {
+		return &ExtractResult{URL: "http://example.com/live.flv"}, nil
+	}
+	var fetches int
+	fetchFn := func(ctx context.Context, u string, headers http.Header) (io.ReadCloser, error) {
+		fetches++
+		pr, pw := io.Pipe()
+		context.AfterFunc(ctx, func() { pw.CloseWithError(ctx.Err()) })
+		go func() {
+			if fetches == 1 {
+				// Send some data, then go silent without closing.
+				pw.Write([]byte("ab"))
+				return
+			}
+			pw.Write([]byte("cd"))
+		}()
+		return pr, nil
+	}
+	s := NewStream(extractFn, fetchFn, WithTimeouts(Timeouts{Stall: 20 * time.Millisecond}))
+	defer s.Close()
+
+	got := make([]byte, 0, 4)
+	buf := make([]byte, 4)
+	deadline := time.After(2 * time.Second)
+	for len(got) < 4 {
+		readCh := make(chan int, 1)
+		go func() {
+			n, _ := s.Read(buf)
+			readCh <- n
+		}()
+		select {
+		case n := <-readCh:
+			got = append(got, buf[:n]...)
+		case <-deadline:
+			t.Fatalf("stalled upstream was not replaced, got %q", got)
+		}
+	}
+	if string(got) != "abcd" {
+		t.Fatalf("got %q, want %q", got, "abcd")
+	}
+}
+
+func TestWatchdog_ArmDisarm(t *testing.T) {
+	fired := make(chan struct{})
+	w := NewWatchdog(20*time.Millisecond, func() { close(fired) })
+
+	// Disarming before the timeout keeps it quiet.
+	w.Arm()
+	w.Disarm()
+	time.Sleep(40 * time.Millisecond)
+	if w.Stalled() {
+		t.Fatal("watchdog fired while disarmed")
+	}
+
+	w.Arm()
+	select {
+	case <-fired:
+	case <-time.After(2 * time.Second):
+		t.Fatal("armed watchdog did not fire")
+	}
+	if !w.Stalled() {
+		t.Fatal("Stalled() = false after firing")
+	}
+	if Classify(WrapError("", PhaseCopy, "", ErrStalled)) != ClassTransient {
+		t.Fatal("stall should classify as transient")
+	}
+}
+
+func TestHostHealth_Order(t *testing.T) {
+	h := NewHostHealth(time.Minute, time.Minute)
+	candidates := []Candidate{
+		{URL: "http://a.example.com/live.flv", Priority: 1},
+		{URL: "http://b.example.com/live.flv", Priority: 0},
+		{URL: "http://c.example.com/live.flv", Priority: 1},
+		{URL: "http://b.example.com/live.flv", Priority: 0},
+	}
+
+	got := h.Order(candidates)
+	want := []string{"http://b.example.com/live.flv", "http://a.example.com/live.flv", "http://c.example.com/live.flv"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Order() = %v, want %v", got, want)
+	}
+
+	// A failed host moves to the back until it succeeds again.
+	h.Failure("http://b.example.com/other.flv")
+	got = h.Order(candidates)
+	want = []string{"http://a.example.com/live.flv", "http://c.example.com/live.flv", "http://b.example.com/live.flv"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Order() after failure = %v, want %v", got, want)
+	}
+	h.Success("http://b.example.com/live.flv")
+	if h.Avoided("http://b.example.com/live.flv") {
+		t.Fatal("host still avoided after success")
+	}
+}
+
+func TestStream_FailsOverToAlternate(t *testing.T) {
+	extractFn := func(_ context.Context, previous *ExtractResult) (*ExtractResult, error) {
+		return &ExtractResult{
+			URL: "http://bad.example.com/live.flv",
+			Candidates: []Candidate{
+				{URL: "http://bad.example.com/live.flv"},
+				{URL: "http://good.example.com/live.flv"},
+			},
+		}, nil
+	}
+	var mu sync.Mutex
+	var fetched []string
+	fetchFn := func(_ context.Context, u string, headers http.Header) (io.ReadCloser, error) {
+		mu.Lock()
+		fetched = append(fetched, u)
+		mu.Unlock()
+		if strings.Contains(u, "bad") {
+			return nil, syscall.ECONNREFUSED
+		}
+		return io.NopCloser(strings.NewReader("data")), nil
+	}
+	health := NewHostHealth(time.Minute, time.Minute)
+	s := NewStream(extractFn, fetchFn, WithHostHealth(health))
+	defer s.Close()
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(buf) != "data" {
+		t.Fatalf("got %q, want %q", buf, "data")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(fetched) < 2 || fetched[0] != "http://bad.example.com/live.flv" || fetched[1] != "http://good.example.com/live.flv" {
+		t.Fatalf("fetched %v, want bad host then good host", fetched)
+	}
+	if !health.Avoided("http://bad.example.com/live.flv") {
+		t.Fatal("failed host should be avoided")
+	}
+}
+
+func TestRefreshDelay(t *testing.T) {
+	tests := []struct {
+		name      string
+		remaining time.Duration
+		min, max  time.Duration
+	}{
+		{"far expiry refreshes a minute early", 10 * time.Minute, 9*time.Minute - time.Second, 9 * time.Minute},
+		{"near expiry waits five seconds", 30 * time.Second, 4 * time.Second, 5 * time.Second},
+		{"imminent expiry refreshes at expiry", 2 * time.Second, time.Second, 2 * time.Second},
+		{"expired refreshes now", -time.Minute, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := RefreshDelay(time.Now().Add(tt.remaining))
+			if got < tt.min || got > tt.max {
+				t.Errorf("RefreshDelay() = %s, want between %s and %s", got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestStream_RefreshesBeforeExpiry(t *testing.T) {
+	var mu sync.Mutex
+	var extracts, fetches int
+	extractFn := func(_ context.Context, previous *ExtractResult) (*ExtractResult, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		extracts++
+		r := &ExtractResult{URL: fmt.Sprintf("http://example.com/live.flv?n=%d", extracts)}
+		if extracts == 1 {
+			exp := time.Now().Add(50 * time.Millisecond)
+			r.ExpireAt = &exp
+		}
+		return r, nil
+	}
+	firstCut := make(chan struct{})
+	fetchFn := func(ctx context.Context, u string, headers http.Header) (io.ReadCloser, error) {
+		mu.Lock()
+		fetches++
+		n := fetches
+		mu.Unlock()
+		pr, pw := io.Pipe()
+		context.AfterFunc(ctx, func() {
+			pw.CloseWithError(ctx.Err())
+			if n == 1 {
+				close(firstCut)
+			}
+		})
+		go pw.Write([]byte(fmt.Sprintf("%d", n)))
+		return pr, nil
+	}
+	s := NewStream(extractFn, fetchFn)
+	defer s.Close()
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(buf) != "12" {
+		t.Fatalf("got %q, want data from the original then the refreshed upstream", buf)
+	}
+	select {
+	case <-firstCut:
+	case <-time.After(2 * time.Second):
+		t.Fatal("original upstream was not closed after the swap")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fetches != 2 {
+		t.Fatalf("fetches = %d, want 2", fetches)
+	}
+}
+
+func TestOfflinePolicy_Check(t *testing.T) {
+	cause := fmt.Errorf("room: %w", ErrOffline)
+	tests := []struct {
+		name    string
+		policy  OfflinePolicy
+		elapsed time.Duration
+		wantEnd bool
+	}{
+		{"close", OfflinePolicy{Action: OfflineClose, Wait: time.Minute}, 0, true},
+		{"wait within limit", OfflinePolicy{Action: OfflineWait, Wait: time.Minute}, time.Second, false},
+		{"wait exceeded", OfflinePolicy{Action: OfflineWait, Wait: time.Minute}, 2 * time.Minute, true},
+		{"placeholder within limit", OfflinePolicy{Action: OfflinePlaceholder, Wait: time.Minute}, time.Second, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Check(cause, time.Now().Add(-tt.elapsed))
+			if (err != nil) != tt.wantEnd {
+				t.Fatalf("Check() = %v, want end %v", err, tt.wantEnd)
+			}
+			if err != nil && !IsOffline(err) {
+				t.Fatalf("Check() = %v, want it to wrap ErrOffline", err)
+			}
+		})
+	}
+}
+
+func TestParseOfflineAction(t *testing.T) {
+	for _, a := range []OfflineAction{OfflineClose, OfflineWait, OfflinePlaceholder} {
+		got, err := ParseOfflineAction(strings.ToUpper(a.String()))
+		if err != nil || got != a {
+			t.Errorf("ParseOfflineAction(%q) = %v, %v, want %v", a, got, err, a)
+		}
+	}
+	if _, err := ParseOfflineAction("linger"); err == nil {
+		t.Error("ParseOfflineAction(\"linger\") succeeded, want error")
+	}
+}
+
+// offlineSource serves "1" from a live upstream, then reports the stream
+// offline for the given number of extractions before serving "2".
+func offlineSource(offlineFor int) (ExtractFunc, FetchFunc, func() int) {
+	var mu sync.Mutex
+	extracts := 0
+	extractFn := func(_ context.Context, previous *ExtractResult) (*ExtractResult, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		extracts++
+		switch {
+		case extracts == 1:
+			return &ExtractResult{URL: "http://example.com/live.flv?n=1"}, nil
+		case extracts <= 1+offlineFor:
+			return nil, fmt.Errorf("room: %w", ErrOffline)
+		default:
+			return &ExtractResult{URL: "http://example.com/live.flv?n=2"}, nil
+		}
+	}
+	fetchFn := func(_ context.Context, u string, headers http.Header) (io.ReadCloser, error) {
+		switch {
+		case strings.HasSuffix(u, "n=1"):
+			return io.NopCloser(strings.NewReader("1")), nil
+		case strings.HasSuffix(u, "n=2"):
+			return io.NopCloser(strings.NewReader("2")), nil
+		default:
+			return io.NopCloser(strings.NewReader("P")), nil
+		}
+	}
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return extracts
+	}
+	return extractFn, fetchFn, count
+}
+
+func TestStream_OfflineClose(t *testing.T) {
+	extractFn, fetchFn, extracts := offlineSource(100)
+	s := NewStream(extractFn, fetchFn)
+
+	data, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(data) != "1" {
+		t.Fatalf("got %q, want %q", data, "1")
+	}
+	if err := s.Wait(); !IsOffline(err) {
+		t.Fatalf("Wait() = %v, want ErrOffline", err)
+	}
+	if n := extracts(); n != 2 {
+		t.Fatalf("extractFn called %d times, want 2", n)
+	}
+}
+
+func TestStream_OfflineWaitResumes(t *testing.T) {
+	extractFn, fetchFn, extracts := offlineSource(3)
+	policy := OfflinePolicy{Action: OfflineWait, Wait: time.Minute, Poll: 5 * time.Millisecond}
+	s := NewStream(extractFn, fetchFn, WithOfflinePolicy(policy))
+	defer s.Close()
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(buf) != "12" {
+		t.Fatalf("got %q, want %q", buf, "12")
+	}
+	if n := extracts(); n < 5 {
+		t.Fatalf("extractFn called %d times, want at least 5", n)
+	}
+}
+
+func TestStream_OfflineWaitGivesUp(t *testing.T) {
+	extractFn, fetchFn, _ := offlineSource(1 << 30)
+	policy := OfflinePolicy{Action: OfflineWait, Wait: 30 * time.Millisecond, Poll: 5 * time.Millisecond}
+	s := NewStream(extractFn, fetchFn, WithOfflinePolicy(policy))
+
+	data, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(data) != "1" {
+		t.Fatalf("got %q, want %q", data, "1")
+	}
+	if err := s.Wait(); !IsOffline(err) {
+		t.Fatalf("Wait() = %v, want ErrOffline", err)
+	}
+}
+
+func TestStream_OfflinePlaceholder(t *testing.T) {
+	extractFn, fetchFn, _ := offlineSource(3)
+	policy := OfflinePolicy{
+		Action:      OfflinePlaceholder,
+		Wait:        time.Minute,
+		Poll:        5 * time.Millisecond,
+		Placeholder: "http://example.com/placeholder.flv",
+	}
+	s := NewStream(extractFn, fetchFn, WithOfflinePolicy(policy))
+	defer s.Close()
+
+	var got []byte
+	buf := make([]byte, 1)
+	for !bytes.HasSuffix(got, []byte("2")) {
+		if _, err := io.ReadFull(s, buf); err != nil {
+			t.Fatalf("Read after %q: %v", got, err)
+		}
+		got = append(got, buf[0])
+	}
+	if len(got) < 3 || got[0] != '1' || strings.Trim(string(got[1:len(got)-1]), "P") != "" {
+		t.Fatalf("got %q, want the stream, placeholder data, then the stream again", got)
+	}
+}
+
+// closeTrackingReader is an io.ReadCloser backed by an io.Pipe that records
+// whether Close was called.
+type closeTrackingReader struct {
+	*io.PipeReader
+	closed chan struct{}
+}
+
+func (r *closeTrackingReader) Close() error {
+	select {
+	case <-r.closed:
+	default:
+		close(r.closed)
+	}
+	return r.PipeReader.Close()
+}
+
+func TestHub_FanOut(t *testing.T) {
+	h := NewHub()
+	pr, pw := io.Pipe()
+	upstream := &closeTrackingReader{PipeReader: pr, closed: make(chan struct{})}
+	opens := 0
+	open := func(context.Context) (io.ReadCloser, string, error) {
+		opens++
+		return upstream, "video/x-flv", nil
+	}
+
+	s1, err := h.Subscribe(context.Background(), "test:fanout", open)
+	if err != nil {
+		t.Fatalf("first Subscribe returned error: %v", err)
+	}
+	s2, err := h.Subscribe(context.Background(), "test:fanout", open)
+	if err != nil {
+		t.Fatalf("second Subscribe returned error: %v", err)
+	}
+	if opens != 1 {
+		t.Fatalf("open called %d times, want 1", opens)
+	}
+	if s2.ContentType() != "video/x-flv" {
+		t.Fatalf("ContentType() = %q, want %q", s2.ContentType(), "video/x-flv")
+	}
+	if got := h.Subscribers("test:fanout"); got != 2 {
+		t.Fatalf("Subscribers() = %d, want 2", got)
+	}
+
+	go pw.Write([]byte("shared"))
+
+	for i, s := range []*Subscriber{s1, s2} {
+		buf := make([]byte, 16)
+		n, err := s.Read(buf)
+		if err != nil {
+			t.Fatalf("subscriber %d Read returned error: %v", i, err)
+		}
+		if string(buf[:n]) != "shared" {
+			t.Fatalf("subscriber %d Read got %q, want %q", i, string(buf[:n]), "shared")
+		}
+	}
+
+	// Closing one subscriber must keep the upstream open for the other.
+	s1.Close()
+	select {
+	case <-upstream.closed:
+		t.Fatal("upstream closed while a subscriber remains")
+	default:
+	}
+
+	// Closing the last subscriber tears the upstream down.
+	s2.Close()
+	select {
+	case <-upstream.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream not closed after last subscriber left")
+	}
+	if got := h.Subscribers("test:fanout"); got != 0 {
+		t.Fatalf("Subscribers() after teardown = %d, want 0", got)
+	}
+}
+
+// lastChunkCache is a JoinCache that replays the last chunk it observed.
+type lastChunkCache struct {
+	last []byte
+}
+
+func (c *lastChunkCache) Observe(p []byte) { c.last = append([]byte(nil), p...) }
+
+func (c *lastChunkCache) Snapshot() []byte { return c.last }
+
+func TestHub_JoinCachePrimesLateSubscriber(t *testing.T) {
+	h := NewHub()
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	open := func(context.Context) (io.ReadCloser, string, error) {
+		return WithJoinCache(pr, &lastChunkCache{}), "video/x-flv", nil
+	}
+	read := func(s *Subscriber) string {
+		t.Helper()
+		buf := make([]byte, 16)
+		n, err := s.Read(buf)
+		if err != nil {
+			t.Fatalf("Read returned error: %v", err)
+		}
+		return string(buf[:n])
+	}
+
+	s1, err := h.Subscribe(context.Background(), "test:join", open)
+	if err != nil {
+		t.Fatalf("first Subscribe returned error: %v", err)
+	}
+	defer s1.Close()
+	go pw.Write([]byte("one"))
+	if got := read(s1); got != "one" {
+		t.Fatalf("first subscriber got %q, want %q", got, "one")
+	}
+
+	s2, err := h.Subscribe(context.Background(), "test:join", open)
+	if err != nil {
+		t.Fatalf("second Subscribe returned error: %v", err)
+	}
+	defer s2.Close()
+	go pw.Write([]byte("two"))
+	if got := read(s2); got != "one" {
+		t.Fatalf("late subscriber got %q first, want the snapshot %q", got, "one")
+	}
+	if got := read(s2); got != "two" {
+		t.Fatalf("late subscriber got %q after the snapshot, want %q", got, "two")
+	}
+	if got := read(s1); got != "two" {
+		t.Fatalf("first subscriber got %q, want %q", got, "two")
+	}
+}
+
+func TestHub_OpenerGetsStart(t *testing.T) {
+	// The upstream is read as soon as the producer starts, before the
+	// opener's Subscribe call returns.
+	h := NewHub()
+	for i := 0; i < 20; i++ {
+		s, err := h.Subscribe(context.Background(), "test:start", func(context.Context) (io.ReadCloser, string, error) {
+			return io.NopCloser(strings.NewReader("FLV header")), "video/x-flv", nil
+		})
+		if err != nil {
+			t.Fatalf("Subscribe returned error: %v", err)
+		}
+		got, _ := io.ReadAll(s)
+		s.Close()
+		if string(got) != "FLV header" {
+			t.Fatalf("opener got %q, want %q", got, "FLV header")
+		}
+	}
+}
+
+func TestHub_OpenError(t *testing.T) {
+	h := NewHub()
+	openErr := errors.New("offline")
+	_, err := h.Subscribe(context.Background(), "test:openerr", func(context.Context) (io.ReadCloser, string, error) {
+		return nil, "", openErr
+	})
+	if err != openErr {
+		t.Fatalf("Subscribe error = %v, want %v", err, openErr)
+	}
+
+	// A failed open must not poison the key for later clients.
+	pr, _ := io.Pipe()
+	s, err := h.Subscribe(context.Background(), "test:openerr", func(context.Context) (io.ReadCloser, string, error) {
+		return pr, "video/mp2t", nil
+	})
+	if err != nil {
+		t.Fatalf("Subscribe after failed open returned error: %v", err)
+	}
+	s.Close()
+}
+
+func TestHub_SlowSubscriber(t *testing.T) {
+	h := NewHub()
+	h.maxLag = 8
+	pr, pw := io.Pipe()
+	open := func(context.Context) (io.ReadCloser, string, error) {
+		return pr, "video/x-flv", nil
+	}
+	slow, err := h.Subscribe(context.Background(), "test:slow", open)
+	if err != nil {
+		t.Fatalf("Subscribe returned error: %v", err)
+	}
+	fast, err := h.Subscribe(context.Background(), "test:slow", open)
+	if err != nil {
+		t.Fatalf("Subscribe returned error: %v", err)
+	}
+
+	buf := make([]byte, 16)
+	pw.Write([]byte("aaaaa"))
+	if _, err := fast.Read(buf); err != nil {
+		t.Fatalf("fast Read returned error: %v", err)
+	}
+	// slow still has 5 unread bytes; 5 more overflow its 8 byte buffer.
+	pw.Write([]byte("bbbbb"))
+	if _, err := fast.Read(buf); err != nil {
+		t.Fatalf("fast Read returned error: %v", err)
+	}
+	if _, err := slow.Read(buf); err != ErrSlowSubscriber {
+		t.Fatalf("slow Read error = %v, want %v", err, ErrSlowSubscriber)
+	}
+	slow.Close()
+	fast.Close()
+}
+
+func TestHub_SubscribeCanceledAbortsOpen(t *testing.T) {
+	h := NewHub()
+	openCanceled := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := h.Subscribe(ctx, "test:cancel", func(octx context.Context) (io.ReadCloser, string, error) {
+		<-octx.Done()
+		close(openCanceled)
+		return nil, "", octx.Err()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Subscribe() error = %v, want context.Canceled", err)
+	}
+	select {
+	case <-openCanceled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("open was not canceled after its only waiter gave up")
+	}
+}
+
+func TestBackoff_Next(t *testing.T) {
+	b := RetryPolicy{
+		InitialDelay: 100 * time.Millisecond,
+		MaxDelay:     350 * time.Millisecond,
+		Multiplier:   2,
+		MaxAttempts:  4,
+	}.NewBackoff()
+
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 350 * time.Millisecond, 350 * time.Millisecond}
+	for i, w := range want {
+		got, err := b.Next()
+		if err != nil {
+			t.Fatalf("Next() #%d returned error: %v", i+1, err)
+		}
+		if got != w {
+			t.Errorf("Next() #%d = %s, want %s", i+1, got, w)
+		}
+	}
+	if _, err := b.Next(); err != ErrRetryBudgetExhausted {
+		t.Fatalf("Next() past MaxAttempts error = %v, want %v", err, ErrRetryBudgetExhausted)
+	}
+
+	b.Reset()
+	if got, err := b.Next(); err != nil || got != 100*time.Millisecond {
+		t.Fatalf("Next() after Reset = %s, %v; want 100ms, nil", got, err)
+	}
+}
+
+func TestBackoff_Jitter(t *testing.T) {
+	p := RetryPolicy{InitialDelay: time.Second, Multiplier: 2, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		got, _ := p.NewBackoff().Next()
+		if got < 500*time.Millisecond || got > 1500*time.Millisecond {
+			t.Fatalf("jittered delay %s outside [500ms, 1.5s]", got)
+		}
+	}
+}
+
+func TestBackoff_WaitCanceled(t *testing.T) {
+	b := RetryPolicy{InitialDelay: time.Hour}.NewBackoff()
+	done := make(chan struct{})
+	close(done)
+	if err := b.Wait(done); err != ErrRetryCanceled {
+		t.Fatalf("Wait() = %v, want %v", err, ErrRetryCanceled)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := NewCircuitBreaker("test", 2, 50*time.Millisecond)
+
+	b.Failure()
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow() below threshold = %v, want nil", err)
+	}
+	b.Failure()
+	if err := b.Allow(); err != ErrCircuitOpen {
+		t.Fatalf("Allow() after threshold = %v, want %v", err, ErrCircuitOpen)
+	}
+
+	// After the cooldown exactly one trial call is allowed.
+	time.Sleep(60 * time.Millisecond)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow() after cooldown = %v, want nil", err)
+	}
+	if err := b.Allow(); err != ErrCircuitOpen {
+		t.Fatalf("second Allow() during trial = %v, want %v", err, ErrCircuitOpen)
+	}
+
+	// A failed trial re-opens the breaker; a successful one closes it.
+	b.Failure()
+	if err := b.Allow(); err != ErrCircuitOpen {
+		t.Fatalf("Allow() after failed trial = %v, want %v", err, ErrCircuitOpen)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow() after second cooldown = %v, want nil", err)
+	}
+	b.Success()
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow() after success = %v, want nil", err)
+	}
+}
+
+func TestStream_GivesUpAfterRetryBudget(t *testing.T) {
+	extractErr := errors.New("room offline")
+	calls := 0
+	extractFn := func(_ context.Context, previous *ExtractResult) (*ExtractResult, error) {
+		calls++
+		return nil, extractErr
+	}
+	fetchFn := func(_ context.Context, u string, headers http.Header) (io.ReadCloser, error) {
+		return nil, errors.New("unexpected fetch call")
+	}
+	policy := RetryPolicy{InitialDelay: time.Millisecond, Multiplier: 2, MaxAttempts: 3}
+	s := NewStream(extractFn, fetchFn, WithRetryPolicy(policy))
+
+	// The client sees a clean end-of-stream.
+	buf := make([]byte, 10)
+	if _, err := s.Read(buf); err != io.EOF {
+		t.Fatalf("Read after give-up = %v, want io.EOF", err)
+	}
+	err := s.Wait()
+	if !errors.Is(err, ErrRetryBudgetExhausted) || !errors.Is(err, extractErr) {
+		t.Fatalf("Wait() = %v, want wrapped %v and %v", err, ErrRetryBudgetExhausted, extractErr)
+	}
+	if calls != 4 {
+		t.Fatalf("extractFn called %d times, want 4", calls)
+	}
+}
@@ -0,0 +1,98 @@
+package stream
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrStalled is reported when an upstream keeps its connection open but
+// sends no media for longer than the stall timeout. It is transient: the
+// producer re-extracts and reconnects.
+var ErrStalled = errors.New("upstream stalled")
+
+// Watchdog calls onStall if it stays armed for longer than its timeout.
+// Producers arm it while blocked waiting for upstream data and disarm it as
+// soon as data arrives, so time spent waiting on a slow consumer does not
+// count as a stall.
+type Watchdog struct {
+	timeout time.Duration
+	onStall func()
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	stalled bool
+}
+
+// NewWatchdog returns a disarmed watchdog. A timeout <= 0 disables it.
+func NewWatchdog(timeout time.Duration, onStall func()) *Watchdog {
+	return &Watchdog{timeout: timeout, onStall: onStall}
+}
+
+// Arm starts the countdown, restarting it if it is already running.
+func (w *Watchdog) Arm() {
+	if w.timeout <= 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stalled {
+		return
+	}
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.timeout, w.fire)
+		return
+	}
+	w.timer.Reset(w.timeout)
+}
+
+// Disarm stops the countdown.
+func (w *Watchdog) Disarm() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// Stalled reports whether the watchdog has fired.
+func (w *Watchdog) Stalled() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stalled
+}
+
+// Timeout returns the configured stall timeout.
+func (w *Watchdog) Timeout() time.Duration {
+	return w.timeout
+}
+
+func (w *Watchdog) fire() {
+	w.mu.Lock()
+	w.stalled = true
+	w.mu.Unlock()
+	w.onStall()
+}
+
+// WatchReader returns a reader that keeps w armed while blocked in r.Read.
+// Once the watchdog fires, reads fail with ErrStalled; onStall is expected
+// to unblock the pending read, e.g. by canceling the request.
+func WatchReader(r io.Reader, w *Watchdog) io.Reader {
+	return &watchedReader{r: r, w: w}
+}
+
+type watchedReader struct {
+	r io.Reader
+	w *Watchdog
+}
+
+func (r *watchedReader) Read(p []byte) (int, error) {
+	r.w.Arm()
+	n, err := r.r.Read(p)
+	r.w.Disarm()
+	if r.w.Stalled() {
+		return n, ErrStalled
+	}
+	return n, err
+}
@@ -3,6 +3,7 @@ package websocket
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 
@@ -45,6 +46,22 @@ func NewWebSocketForwarderWithRetry(proxy *url.URL, mobile bool, extractFn strea
 	}
 }
 
+// NewWebSocketStream dials the xp2p upstream at u and returns the running
+// client as a reader, reconnecting via extractFn on retriable errors. Unlike
+// Start it does not take over a client connection, so the result can be
+// shared between clients through stream.Hub.
+func NewWebSocketStream(proxy *url.URL, mobile bool, extractFn stream.ExtractFunc, cacheKey string, opts ...ClientOption) (Background, error) {
+	log := global.Log.WithField("func", "app.engine.forwarder.websocket.NewWebSocketStream")
+	log.WithField("mobile", mobile).WithField("cacheKey", cacheKey).Debug("creating websocket stream")
+	f := &WebSocketForwarder{proxy: proxy, mobile: mobile}
+	st := NewXP2PClientWithRetry(extractFn, f.httpHeader(), proxy, cacheKey, opts...)
+	if err := st.Start(); err != nil {
+		log.Errorln("start backend error:", err.Error())
+		return nil, err
+	}
+	return st, nil
+}
+
 func (s *WebSocketForwarder) httpHeader() http.Header {
 	h := make(http.Header)
 	h.Set("User-Agent", global.DEFAULT_USER_AGENT)
@@ -77,6 +94,11 @@ func (s *WebSocketForwarder) Start(c *gin.Context, u string) error {
 		log.Errorln("start backend error:", err.Error())
 		return err
 	}
+	// The stream's header stays cached as long as it runs.
+	var body io.ReadCloser = st
+	if s.cacheKey != "" {
+		body = flv.DefaultCache.Retain(s.cacheKey, st)
+	}
 	w := c.Writer
 
 	conn, _, err := w.(http.Hijacker).Hijack()
@@ -85,6 +107,7 @@ func (s *WebSocketForwarder) Start(c *gin.Context, u string) error {
 		if conn != nil {
 			conn.Close()
 		}
+		body.Close()
 		return err
 	}
 	buffer := bytes.NewBuffer(nil)
@@ -101,6 +124,8 @@ func (s *WebSocketForwarder) Start(c *gin.Context, u string) error {
 	_, err = conn.Write(buffer.Bytes())
 	if err != nil {
 		log.WithError(err).Errorln("write frontend error")
+		body.Close()
+		conn.Close()
 		return err
 	}
 
@@ -111,7 +136,7 @@ func (s *WebSocketForwarder) Start(c *gin.Context, u string) error {
 		if data := entry.Data(); data != nil {
 			if _, writeErr := conn.Write(data); writeErr != nil {
 				log.WithError(writeErr).Errorln("write cached header error")
-				st.Close()
+				body.Close()
 				conn.Close()
 				return writeErr
 			}
@@ -119,11 +144,11 @@ func (s *WebSocketForwarder) Start(c *gin.Context, u string) error {
 	}
 
 	go func() {
-		defer st.Close()
+		defer body.Close()
 		defer conn.Close()
 		for {
 			buf := make([]byte, 65536)
-			n, err := st.Read(buf)
+			n, err := body.Read(buf)
 			if err != nil {
 				return
 			}
@@ -5,6 +5,8 @@ import (
 	"os"
 	"testing"
 
+	ws "github.com/gorilla/websocket"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/stream"
 	"github.com/nv4d1k/live-stream-forwarder/global"
 	"github.com/sirupsen/logrus"
 )
@@ -75,10 +77,20 @@ func TestIsRetriableWS(t *testing.T) {
 		want bool
 	}{
 		{
-			name: "error containing 403",
-			err:  errors.New("websocket: close 403"),
+			name: "403 on dial",
+			err:  &stream.UpstreamError{Phase: stream.PhaseFetch, StatusCode: 403},
 			want: true,
 		},
+		{
+			name: "abnormal closure",
+			err:  &ws.CloseError{Code: ws.CloseAbnormalClosure},
+			want: true,
+		},
+		{
+			name: "normal closure",
+			err:  &ws.CloseError{Code: ws.CloseNormalClosure},
+			want: false,
+		},
 		{
 			name: "nil error",
 			err:  nil,
@@ -90,9 +102,9 @@ func TestIsRetriableWS(t *testing.T) {
 			want: false,
 		},
 		{
-			name: "error with 403 in message",
+			name: "403 in message text only",
 			err:  errors.New("HTTP 403 Forbidden"),
-			want: true,
+			want: false,
 		},
 	}
 
@@ -3,21 +3,60 @@ package websocket
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"runtime"
-	"strings"
 	"sync"
 	"time"
 
+	ws "github.com/gorilla/websocket"
 	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/flv"
 	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/stream"
 	"github.com/nv4d1k/live-stream-forwarder/global"
-	ws "github.com/gorilla/websocket"
 )
 
-func NewXP2PClient(u string, header http.Header, proxy *url.URL) Background {
+// ClientOption configures an xp2p client during creation.
+type ClientOption func(*client)
+
+// WithBuffer sets the size and overflow policy of the client's pipe. The
+// default is stream.DefaultBufferSize with stream.OverflowBlock, which stops
+// reading the websocket until the consumer catches up.
+func WithBuffer(size int, policy stream.OverflowPolicy) ClientOption {
+	return func(c *client) {
+		c.pipe = stream.NewBoundedPipe(size, policy)
+	}
+}
+
+// WithContext sets the parent context of the client. Canceling it closes the
+// client and aborts any in-flight extraction or dial.
+func WithContext(ctx context.Context) ClientOption {
+	return func(c *client) { c.parent = ctx }
+}
+
+// WithTimeouts overrides stream.DefaultTimeouts for extraction, the
+// websocket handshake, and the longest wait for the next message before the
+// connection is considered stalled.
+func WithTimeouts(t stream.Timeouts) ClientOption {
+	return func(c *client) { c.timeouts = t }
+}
+
+// WithHostHealth overrides stream.DefaultHealth, which orders candidate
+// websocket URLs and records failing hosts.
+func WithHostHealth(h *stream.HostHealth) ClientOption {
+	return func(c *client) { c.health = h }
+}
+
+// WithOfflinePolicy overrides stream.DefaultOfflinePolicy for reconnects
+// that find the stream offline. OfflinePlaceholder behaves like OfflineWait.
+func WithOfflinePolicy(p stream.OfflinePolicy) ClientOption {
+	return func(c *client) { c.offline = p }
+}
+
+func NewXP2PClient(u string, header http.Header, proxy *url.URL, opts ...ClientOption) Background {
 	log := global.Log.WithField("func", "app.engine.forwarder.websocket.NewXP2PClient")
 	log.WithField("url", u).Debug("creating XP2PClient")
 	c := &client{
@@ -49,8 +88,16 @@ func NewXP2PClient(u string, header http.Header, proxy *url.URL) Background {
 			ReadBufferSize:   4096,
 			WriteBufferSize:  4096,
 		},
-		pipe: stream.NewPipe(),
+		pipe:     stream.NewBoundedPipe(stream.DefaultBufferSize, stream.OverflowBlock),
+		retry:    stream.DefaultRetryPolicy,
+		timeouts: stream.DefaultTimeouts,
+		health:   stream.DefaultHealth,
+		parent:   context.Background(),
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.initContext()
 	if proxy != nil {
 		c.dialer.Proxy = http.ProxyURL(proxy)
 	}
@@ -63,7 +110,7 @@ func NewXP2PClient(u string, header http.Header, proxy *url.URL) Background {
 // NewXP2PClientWithRetry creates a client that will reconnect with a new URL
 // from extractFn when the connection fails with a retriable error (e.g. 403).
 // cacheKey enables FLV header caching; empty string disables it.
-func NewXP2PClientWithRetry(extractFn stream.ExtractFunc, header http.Header, proxy *url.URL, cacheKey string) Background {
+func NewXP2PClientWithRetry(extractFn stream.ExtractFunc, header http.Header, proxy *url.URL, cacheKey string, opts ...ClientOption) Background {
 	log := global.Log.WithField("func", "app.engine.forwarder.websocket.NewXP2PClientWithRetry")
 	log.WithField("cacheKey", cacheKey).Debug("creating XP2PClientWithRetry")
 	c := &client{
@@ -94,10 +141,21 @@ func NewXP2PClientWithRetry(extractFn stream.ExtractFunc, header http.Header, pr
 			ReadBufferSize:   4096,
 			WriteBufferSize:  4096,
 		},
-		pipe:      stream.NewPipe(),
+		pipe:      stream.NewBoundedPipe(stream.DefaultBufferSize, stream.OverflowBlock),
+		retry:     stream.DefaultRetryPolicy,
+		timeouts:  stream.DefaultTimeouts,
+		health:    stream.DefaultHealth,
+		offline:   stream.DefaultOfflinePolicy,
+		parent:    context.Background(),
 		extractFn: extractFn,
 		cacheKey:  cacheKey,
+		splicer:   flv.NewSplicer(cacheKey),
+		swapCh:    make(chan *refreshed),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	c.initContext()
 	if proxy != nil {
 		c.dialer.Proxy = http.ProxyURL(proxy)
 	}
@@ -108,38 +166,55 @@ func NewXP2PClientWithRetry(extractFn stream.ExtractFunc, header http.Header, pr
 }
 
 type client struct {
-	mu           sync.Mutex
-	url          string
-	header       http.Header
-	dialer       *ws.Dialer
-	conn         *ws.Conn
-	stopCh       chan struct{}
-	pipe         *stream.Pipe
-	extractFn    stream.ExtractFunc
-	previous     *stream.ExtractResult
-	cacheKey     string
-	headerWriter *flv.HeaderCacheWriter
+	mu          sync.Mutex
+	url         string
+	header      http.Header
+	dialer      *ws.Dialer
+	conn        *ws.Conn
+	stopCh      chan struct{}
+	pipe        *stream.Pipe
+	retry       stream.RetryPolicy
+	timeouts    stream.Timeouts
+	health      *stream.HostHealth
+	offline     stream.OfflinePolicy
+	extractFn   stream.ExtractFunc
+	previous    *stream.ExtractResult
+	alternates  []string // candidate URLs from the latest extraction not yet tried
+	cacheKey    string
+	splicer     *flv.Splicer // joins reconnected upstreams into one FLV stream
+	writer      io.Writer    // target for the current connection's messages
+	swapCh      chan *refreshed
+	stopRefresh context.CancelFunc
+
+	parent     context.Context
+	ctx        context.Context // canceled when the client is closed
+	cancel     context.CancelFunc
+	stopParent func() bool
+}
+
+// initContext derives the client's context from its parent once options
+// have been applied.
+func (c *client) initContext() {
+	c.ctx, c.cancel = context.WithCancel(c.parent)
+	c.stopParent = context.AfterFunc(c.parent, func() { c.Close() })
 }
 
 func (c *client) Start() error {
 	log := global.Log.WithField("func", "app.engine.forwarder.websocket.client.Start")
 	if c.extractFn != nil {
-		result, err := c.extractFn(c.previous)
+		result, err := c.extract()
 		if err != nil {
 			return fmt.Errorf("extract for websocket error: %w", err)
 		}
-		c.url = result.URL
-		c.previous = result
+		c.use(result)
 		log.WithField("field", "extracted url").Debug(c.url)
 	}
 
-	ctx := context.TODO()
-	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
-	defer cancel()
-	err := c.DialContext(ctx)
+	err := c.dialWithFailover()
 	if err != nil {
 		return fmt.Errorf("dial context error: %w", err)
 	}
+	c.scheduleRefresh(c.previous)
 	go c.ReadLoop()
 	return nil
 }
@@ -149,29 +224,42 @@ func (c *client) DialContext(ctx context.Context) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	conn, resp, err := c.dialer.DialContext(ctx, c.url, c.header)
+	conn, err := c.dial(ctx, c.url, c.platform())
 	if err != nil {
-		if resp != nil && resp.StatusCode == 403 {
-			log.WithField("url", c.url).Warnf("dial forbidden: %s", resp.Status)
-			return fmt.Errorf("err got: %s", resp.Status)
-		}
-		log.WithField("url", c.url).Warnf("dial error: %s", err.Error())
 		return err
 	}
-	if resp.StatusCode != http.StatusSwitchingProtocols {
-		log.WithField("url", c.url).Warnf("unexpected status: %s", resp.Status)
-		return fmt.Errorf("dial err: %s", resp.Status)
-	}
-
 	c.conn = conn
 	log.WithField("url", c.url).Debug("dial succeeded")
 	return nil
 }
 
+// dial opens a websocket connection to u. platform annotates errors.
+func (c *client) dial(ctx context.Context, u, platform string) (*ws.Conn, error) {
+	log := global.Log.WithField("func", "app.engine.forwarder.websocket.client.dial")
+	conn, resp, err := c.dialer.DialContext(ctx, u, c.header)
+	if err != nil {
+		if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			log.WithField("url", u).Warnf("dial rejected: %s", resp.Status)
+			return nil, stream.StatusError(platform, stream.PhaseFetch, u, resp)
+		}
+		log.WithField("url", u).Warnf("dial error: %s", err.Error())
+		return nil, stream.WrapError(platform, stream.PhaseFetch, u, err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		log.WithField("url", u).Warnf("unexpected status: %s", resp.Status)
+		conn.Close()
+		return nil, stream.StatusError(platform, stream.PhaseFetch, u, resp)
+	}
+	return conn, nil
+}
+
 func (c *client) Close() error {
 	log := global.Log.WithField("func", "app.engine.forwarder.websocket.client.Close")
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.pipe.BreakWithError(io.ErrClosedPipe)
+	c.stopParent()
+	c.cancel()
 	if c.conn == nil {
 		return nil
 	}
@@ -184,42 +272,42 @@ func (c *client) Close() error {
 func (c *client) ReadLoop() {
 	log := global.Log.WithField("func", "app.engine.forwarder.websocket.client.ReadLoop")
 	for {
-		mt, body, err := c.conn.ReadMessage()
+		c.mu.Lock()
+		conn := c.conn
+		c.mu.Unlock()
+		if conn == nil {
+			// Closed by the consumer.
+			return
+		}
+		if c.timeouts.Stall > 0 {
+			conn.SetReadDeadline(time.Now().Add(c.timeouts.Stall))
+		}
+		mt, body, err := conn.ReadMessage()
 		if err != nil {
+			if c.ctx.Err() != nil {
+				return
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				log.WithField("event", "stall").Warnf("no message from upstream for %s, reconnecting", c.timeouts.Stall)
+				err = fmt.Errorf("%w: %w", stream.ErrStalled, err)
+			}
+			err = stream.WrapError(c.platform(), stream.PhaseCopy, c.url, err)
 			if c.extractFn != nil && isRetriableWS(err) {
 				log.Warnf("retriable websocket error: %s, reconnecting...", err.Error())
-				c.conn.Close()
-				result, extractErr := c.extractFn(c.previous)
-				if extractErr != nil {
-					log.Errorf("extract for reconnect error: %s", extractErr.Error())
-					c.pipe.CloseWithError(err)
-					return
-				}
-				// Validate that the re-extracted URL is still a websocket URL
-				if !isWebSocketURL(result.URL) {
-					log.Warnf("extract returned non-websocket URL: %s, retrying", result.URL)
-					c.pipe.CloseWithError(fmt.Errorf("extract returned non-websocket URL on retry"))
-					return
+				conn.Close()
+				if c.failover(err) && c.dialWithFailover() == nil {
+					c.writer = nil
+					continue
 				}
-				c.url = result.URL
-				c.previous = result
-				// Reset header writer so the new stream's header is re-detected.
-				c.headerWriter = nil
-				c.mu.Lock()
-				conn, resp, dialErr := c.dialer.DialContext(context.TODO(), c.url, c.header)
-				c.mu.Unlock()
-				if dialErr != nil {
-					log.Errorf("reconnect dial error: %s", dialErr.Error())
-					c.pipe.CloseWithError(dialErr)
+				if reconnectErr := c.reconnect(); reconnectErr != nil {
+					if reconnectErr != stream.ErrRetryCanceled {
+						// Give up with a clean end-of-stream for the client.
+						log.Errorf("reconnect failed: %s", reconnectErr.Error())
+						c.pipe.CloseWithError(io.EOF)
+					}
 					return
 				}
-				if resp.StatusCode != http.StatusSwitchingProtocols {
-					c.pipe.CloseWithError(fmt.Errorf("reconnect dial err: %s", resp.Status))
-					return
-				}
-				c.mu.Lock()
-				c.conn = conn
-				c.mu.Unlock()
 				continue
 			}
 			c.pipe.CloseWithError(err)
@@ -227,16 +315,12 @@ func (c *client) ReadLoop() {
 		}
 		switch mt {
 		case ws.BinaryMessage:
-			if c.cacheKey != "" {
-				if c.headerWriter == nil {
-					c.headerWriter = flv.NewHeaderCacheWriter(c.pipe, flv.DefaultCache, c.cacheKey)
-				}
-				if _, writeErr := c.headerWriter.Write(body); writeErr != nil {
-					c.pipe.CloseWithError(writeErr)
-					return
-				}
-			} else {
-				c.pipe.Write(body)
+			if c.writer == nil {
+				c.writer = c.newWriter()
+			}
+			if _, writeErr := c.writer.Write(body); writeErr != nil {
+				c.pipe.CloseWithError(writeErr)
+				return
 			}
 		case ws.TextMessage:
 		case ws.CloseMessage:
@@ -246,19 +330,268 @@ func (c *client) ReadLoop() {
 			c.pipe.CloseWithError(fmt.Errorf("unknown msg type: %d", mt))
 			return
 		}
+
+		// Switch to a refreshed connection between messages.
+		select {
+		case next := <-c.swapCh:
+			if !c.swapTo(next) {
+				return
+			}
+		default:
+		}
+	}
+}
+
+// newWriter returns the writer for a new upstream connection's messages.
+func (c *client) newWriter() io.Writer {
+	var w io.Writer = c.pipe
+	if c.splicer != nil {
+		w = c.splicer.Wrap(w)
+	}
+	if c.cacheKey != "" {
+		w = flv.NewHeaderCacheWriter(w, flv.DefaultCache, c.cacheKey)
+	}
+	return w
+}
+
+// reconnect re-extracts and redials the upstream, backing off between
+// failures according to the client's retry policy. While the stream is
+// offline it polls according to the offline policy instead.
+func (c *client) reconnect() error {
+	log := global.Log.WithField("func", "app.engine.forwarder.websocket.client.reconnect")
+	backoff := c.retry.NewBackoff()
+	var offlineSince time.Time
+	for {
+		err := c.redial()
+		if err == nil {
+			return nil
+		}
+		if stream.IsOffline(err) {
+			if offlineSince.IsZero() {
+				offlineSince = time.Now()
+				log.Infof("stream offline, applying %s policy: %s", c.offline.Action, err.Error())
+			}
+			if checkErr := c.offline.Check(err, offlineSince); checkErr != nil {
+				return checkErr
+			}
+			select {
+			case <-time.After(c.offline.Poll):
+			case <-c.pipe.Done():
+				return stream.ErrRetryCanceled
+			case <-c.ctx.Done():
+				return stream.ErrRetryCanceled
+			}
+			continue
+		}
+		log.Warnf("reconnect attempt %d error: %s", backoff.Attempts()+1, err.Error())
+		if waitErr := backoff.Wait(c.pipe.Done()); waitErr != nil {
+			if waitErr == stream.ErrRetryCanceled {
+				return waitErr
+			}
+			return fmt.Errorf("%w after %d attempts: %w", waitErr, backoff.Attempts(), err)
+		}
+	}
+}
+
+// redial makes a single attempt to obtain a fresh URL and connect to it.
+func (c *client) redial() error {
+	result, err := c.extract()
+	if err != nil {
+		return fmt.Errorf("extract for reconnect error: %w", err)
+	}
+	// Validate that the re-extracted URL is still a websocket URL
+	if !isWebSocketURL(result.URL) {
+		return fmt.Errorf("extract returned non-websocket URL: %s", result.URL)
+	}
+	c.use(result)
+	// Reset the writer so the new stream's header is re-detected.
+	c.writer = nil
+	if err := c.dialWithFailover(); err != nil {
+		return err
+	}
+	c.scheduleRefresh(result)
+	return nil
+}
+
+// use switches the client to the best candidate of an extraction result and
+// keeps the others for failover.
+func (c *client) use(result *stream.ExtractResult) {
+	c.previous = result
+	c.url = result.URL
+	c.alternates = nil
+	if urls := c.health.Order(result.AllCandidates()); len(urls) > 0 {
+		c.url = urls[0]
+		c.alternates = urls[1:]
+	}
+}
+
+// dialWithFailover dials c.url, moving on to the remaining candidates while
+// the dial fails at the connection level.
+func (c *client) dialWithFailover() error {
+	for {
+		ctx, cancel := stream.WithTimeout(c.ctx, c.timeouts.Fetch)
+		err := c.DialContext(ctx)
+		cancel()
+		if err == nil || c.ctx.Err() != nil || !c.failover(err) {
+			return err
+		}
+	}
+}
+
+// failover marks the current host as unhealthy and switches c.url to the
+// next candidate. It reports false if cause is not a connection-level
+// failure or no candidate is left.
+func (c *client) failover(cause error) bool {
+	log := global.Log.WithField("func", "app.engine.forwarder.websocket.client.failover")
+	if stream.Classify(cause) != stream.ClassTransient {
+		c.alternates = nil
+		return false
+	}
+	c.health.Failure(c.url)
+	if len(c.alternates) == 0 {
+		return false
+	}
+	log.Warnf("upstream host failed, trying alternate: %s", cause.Error())
+	c.url = c.alternates[0]
+	c.alternates = c.alternates[1:]
+	return true
+}
+
+// extract calls extractFn under the client's context and extract timeout.
+func (c *client) extract() (*stream.ExtractResult, error) {
+	ctx, cancel := stream.WithTimeout(c.ctx, c.timeouts.Extract)
+	defer cancel()
+	return c.extractFn(ctx, c.previous)
+}
+
+// refreshed is a connection dialed before the current URL expires.
+type refreshed struct {
+	result     *stream.ExtractResult
+	url        string
+	alternates []string
+	conn       *ws.Conn
+}
+
+// scheduleRefresh arranges for a fresh URL to be extracted and dialed
+// shortly before result expires. ReadLoop switches to the new connection
+// between messages, and the splicer hides the switch from the client.
+func (c *client) scheduleRefresh(result *stream.ExtractResult) {
+	log := global.Log.WithField("func", "app.engine.forwarder.websocket.client.scheduleRefresh")
+	if c.stopRefresh != nil {
+		c.stopRefresh()
+		c.stopRefresh = nil
+	}
+	if c.extractFn == nil || result == nil || result.ExpireAt == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.stopRefresh = cancel
+	delay := stream.RefreshDelay(*result.ExpireAt)
+	log.Debugf("scheduling upstream refresh in %s (expires at %s)", delay, result.ExpireAt.Format(time.RFC3339))
+	go func() {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+		next := c.prefetch(ctx, result)
+		if next == nil {
+			return
+		}
+		select {
+		case c.swapCh <- next:
+		case <-ctx.Done():
+			next.conn.Close()
+		}
+	}()
+}
+
+// prefetch extracts a fresh URL and dials it while the current connection
+// keeps streaming. It returns nil on failure; the current connection then
+// carries on until it fails on its own.
+func (c *client) prefetch(ctx context.Context, current *stream.ExtractResult) *refreshed {
+	log := global.Log.WithField("func", "app.engine.forwarder.websocket.client.prefetch")
+	ectx, cancel := stream.WithTimeout(ctx, c.timeouts.Extract)
+	result, err := c.extractFn(ectx, current)
+	cancel()
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		log.Warnf("refresh extract error, keeping current connection: %s", err.Error())
+		return nil
+	}
+	if !isWebSocketURL(result.URL) {
+		log.Warnf("refresh returned non-websocket URL, keeping current connection: %s", result.URL)
+		return nil
 	}
+	urls := c.health.Order(result.AllCandidates())
+	if len(urls) == 0 {
+		return nil
+	}
+	dctx, cancel := stream.WithTimeout(ctx, c.timeouts.Fetch)
+	conn, err := c.dial(dctx, urls[0], result.Platform)
+	cancel()
+	if err != nil {
+		if stream.Classify(err) == stream.ClassTransient {
+			c.health.Failure(urls[0])
+		}
+		log.Warnf("refresh dial error, keeping current connection: %s", err.Error())
+		return nil
+	}
+	return &refreshed{result: result, url: urls[0], alternates: urls[1:], conn: conn}
+}
+
+// swapTo replaces the current connection with next. It returns false if the
+// client was closed in the meantime.
+func (c *client) swapTo(next *refreshed) bool {
+	log := global.Log.WithField("func", "app.engine.forwarder.websocket.client.swapTo")
+	c.mu.Lock()
+	old := c.conn
+	if old == nil {
+		c.mu.Unlock()
+		next.conn.Close()
+		return false
+	}
+	c.conn = next.conn
+	c.url = next.url
+	c.alternates = next.alternates
+	c.previous = next.result
+	c.mu.Unlock()
+	old.Close()
+	c.writer = nil
+	log.WithField("event", "refresh").Infoln("switched to refreshed upstream connection")
+	c.scheduleRefresh(next.result)
+	return true
 }
 
 func (c *client) Read(b []byte) (int, error) {
 	return c.pipe.Read(b)
 }
 
+// isRetriableWS reports whether the client should reconnect after err. The
+// shared classification applies, plus websocket close codes that signal a
+// server-side restart rather than the end of the stream.
 func isRetriableWS(err error) bool {
-	if err == nil {
+	var ce *ws.CloseError
+	if errors.As(err, &ce) {
+		switch ce.Code {
+		case ws.CloseAbnormalClosure, ws.CloseGoingAway, ws.CloseServiceRestart, ws.CloseTryAgainLater:
+			return true
+		}
 		return false
 	}
-	msg := err.Error()
-	return strings.Contains(msg, "403")
+	return stream.Classify(err).Retriable()
+}
+
+// platform returns the platform name from the latest extraction, if any.
+func (c *client) platform() string {
+	if c.previous == nil {
+		return ""
+	}
+	return c.previous.Platform
 }
 
 func isWebSocketURL(u string) bool {
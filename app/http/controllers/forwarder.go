@@ -1,6 +1,10 @@
 package controllers
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
@@ -8,6 +12,7 @@ import (
 	"path"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -21,8 +26,10 @@ import (
 
 	"github.com/nv4d1k/live-stream-forwarder/app/engine/extractor"
 	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/flv"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/fmp4"
 	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/hls"
 	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/httpweb"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/remux"
 	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/stream"
 	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/websocket"
 	"github.com/nv4d1k/live-stream-forwarder/global"
@@ -32,6 +39,10 @@ import (
 // long-lived HTTP stream. The client sees a single continuous response
 // even if the producer reconnects on 403.
 func streamToClient(c *gin.Context, r io.ReadCloser, contentType string) {
+	// Unblock a pending Read as soon as the client goes away.
+	stop := context.AfterFunc(c.Request.Context(), func() { r.Close() })
+	defer stop()
+
 	c.Writer.Header().Set("Content-Type", contentType)
 	c.Writer.Header().Set("Transfer-Encoding", "identity")
 	c.Writer.Header().Set("Connection", "close")
@@ -94,48 +105,184 @@ func resolveDesiredFormat(queryFormat string, ext extractor.Extractor) string {
 	return ext.DefaultFormat()
 }
 
-// flvStreamWithCache creates an FLV stream with header caching support.
-func flvStreamWithCache(extractFn stream.ExtractFunc, proxyURL *url.URL, mobile bool, key string) io.ReadCloser {
+// upstreamError carries the HTTP status to report when opening a shared
+// upstream fails, so every client waiting on the same hub entry gets it.
+type upstreamError struct {
+	status int
+	err    error
+}
+
+func (e *upstreamError) Error() string { return e.err.Error() }
+
+func (e *upstreamError) Unwrap() error { return e.err }
+
+// StallTimeouts overrides the forwarders' stall timeouts, per upstream type.
+// Zero keeps the forwarder's default; a negative value disables stall
+// detection. Set from the command line.
+var StallTimeouts struct {
+	FLV time.Duration // HTTP-FLV reads
+	HLS time.Duration // HLS segment reads and playlist progress
+	WS  time.Duration // xp2p websocket reads
+}
+
+// HLSPrefetch overrides the registry's number of HLS segments downloaded at
+// once, per platform. Set from the command line.
+var HLSPrefetch map[string]int
+
+// hlsPrefetch returns the number of HLS segments to download at once for
+// platform, or 0 for the forwarder's default.
+func hlsPrefetch(platform string, entry extractor.RegistryEntry) int {
+	if n, ok := HLSPrefetch[platform]; ok {
+		return n
+	}
+	return entry.HLSPrefetch
+}
+
+// HLSAds overrides the registry's ad strategy ("passthrough", "skip" or
+// "switch"), per platform. Set from the command line.
+var HLSAds map[string]string
+
+// hlsAds returns how the HLS forwarders handle the ads of platform. adFree
+// extracts the playlist AdsSwitch plays during ad breaks, if the extractor
+// has one.
+func hlsAds(platform string, entry extractor.RegistryEntry, adFree stream.ExtractFunc) hls.AdPolicy {
+	if entry.HLSAds.Detector == nil {
+		return hls.AdPolicy{}
+	}
+	strategy := entry.HLSAds.Strategy
+	if name, ok := HLSAds[platform]; ok {
+		var err error
+		if strategy, err = hls.ParseAdStrategy(name); err != nil {
+			global.Log.WithField("func", "app.http.controllers.hlsAds").Warnf("%v, forwarding ads", err)
+		}
+	}
+	return hls.AdPolicy{Detect: entry.HLSAds.Detector, Strategy: strategy, Alternate: adFree}
+}
+
+// OfflinePolicy decides what the forwarders do when a stream goes offline
+// after it has started. Set from the command line.
+var OfflinePolicy = stream.DefaultOfflinePolicy
+
+// stallTimeouts returns stream.DefaultTimeouts with the stall timeout
+// replaced by override, if set.
+func stallTimeouts(override time.Duration, def time.Duration) stream.Timeouts {
+	t := stream.DefaultTimeouts
+	t.Stall = def
+	if override != 0 {
+		t.Stall = override
+	}
+	return t
+}
+
+// flvStreamWithCache creates an FLV stream whose header is recorded in the
+// header cache, for the cache's stats. Upstream reconnects are spliced so
+// clients see a single FLV stream with continuous timestamps.
+func flvStreamWithCache(ctx context.Context, extractFn stream.ExtractFunc, proxyURL *url.URL, mobile bool, key string) io.ReadCloser {
 	f := httpweb.NewHTTPWebForwarder(proxyURL, mobile)
+	splicer := flv.NewSplicer(key)
 	writerWrapper := func(w io.Writer) io.Writer {
-		return flv.NewHeaderCacheWriter(w, flv.DefaultCache, key)
+		return flv.NewHeaderCacheWriter(splicer.Wrap(w), flv.DefaultCache, key)
 	}
-	s := f.Stream(extractFn, stream.WithWriterWrapper(writerWrapper))
-	return flv.NewFLVStream(s, flv.DefaultCache, key)
+	return f.Stream(extractFn,
+		stream.WithContext(ctx),
+		stream.WithTimeouts(stallTimeouts(StallTimeouts.FLV, stream.DefaultTimeouts.Stall)),
+		stream.WithOfflinePolicy(OfflinePolicy),
+		stream.WithWriterWrapper(writerWrapper))
 }
 
-// dispatchStream routes the stream to the appropriate forwarder based on URL
-// scheme and path extension.
-func dispatchStream(c *gin.Context, u *url.URL, extractFn stream.ExtractFunc, proxyURL *url.URL, mobile bool, key string) {
+// dispatchStream creates the upstream reader for the stream based on URL
+// scheme and path extension, and returns it with the content type to serve.
+// The upstream is closed when ctx is canceled.
+func dispatchStream(ctx context.Context, u *url.URL, extractFn stream.ExtractFunc, proxyURL *url.URL, mobile bool, prefetch int, ads hls.AdPolicy, quality hls.Quality, key string) (io.ReadCloser, string, error) {
 	switch u.Scheme {
 	case "ws", "wss":
-		f := websocket.NewWebSocketForwarderWithRetry(proxyURL, mobile, extractFn, key)
-		err := f.Start(c, u.String())
+		s, err := websocket.NewWebSocketStream(proxyURL, mobile, extractFn, key,
+			websocket.WithContext(ctx),
+			websocket.WithTimeouts(stallTimeouts(StallTimeouts.WS, stream.DefaultTimeouts.Stall)),
+			websocket.WithOfflinePolicy(OfflinePolicy))
 		if err != nil {
-			global.Log.WithField("func", "app.http.controllers.dispatchStream").
-				Errorf("forward ws(s) stream error: %s\n", err.Error())
+			return nil, "", fmt.Errorf("forward ws(s) stream error: %w", err)
 		}
+		return s, "video/x-flv", nil
 	default:
 		switch path.Ext(u.Path) {
 		case ".m3u8":
 			h := hls.NewHLSForwarder(proxyURL, mobile)
-			s := h.Stream(extractFn)
-			streamToClient(c, s, "video/mp2t")
+			s := h.Stream(extractFn,
+				hls.WithContext(ctx),
+				hls.WithTimeouts(stallTimeouts(StallTimeouts.HLS, hls.DefaultStallTimeout)),
+				hls.WithOfflinePolicy(OfflinePolicy),
+				hls.WithPrefetch(prefetch),
+				hls.WithAds(ads),
+				hls.WithQuality(quality))
+			// MPEG-TS or fragmented MP4, known from the first media
+			// playlist.
+			contentType, err := s.ContentType()
+			if err != nil {
+				s.Close()
+				return nil, "", fmt.Errorf("forward hls stream error: %w", err)
+			}
+			return s, contentType, nil
 		case ".flv", ".xs":
-			streamToClient(c, flvStreamWithCache(extractFn, proxyURL, mobile, key), "video/x-flv")
+			return flvStreamWithCache(ctx, extractFn, proxyURL, mobile, key), "video/x-flv", nil
 		default:
-			c.String(500, "unsupported format")
+			return nil, "", errors.New("unsupported format")
 		}
 	}
 }
 
+// hubKey returns the stream.Hub key for a room. Clients that force a format
+// with ?format= or a variant with ?quality= only share an upstream with
+// clients asking for the same one. So do clients asking for ?output=flv,
+// since an MPEG-TS upstream is remuxed to FLV for all clients sharing it.
+func hubKey(key, format, quality, output string) string {
+	q := url.Values{}
+	if format != "" {
+		q.Set("format", format)
+	}
+	if output == "flv" {
+		q.Set("output", "flv")
+	}
+	if quality != "" {
+		q.Set("quality", quality)
+	}
+	if len(q) > 0 {
+		key += "?" + q.Encode()
+	}
+	return key
+}
+
+// upstreamKey appends to a hub key a hash of the client's BiliBili cookie
+// and proxy, which the upstream is opened with. Clients only share an
+// upstream extracted with the same login through the same proxy, and the
+// key, listed in the stats, reveals neither.
+func upstreamKey(key, platform, rawCookie string, proxyURL *url.URL) string {
+	var cookie, proxy string
+	if platform == "bilibili" {
+		cookie = rawCookie // only BiliBili is sent the cookie
+	}
+	if proxyURL != nil {
+		proxy = proxyURL.String()
+	}
+	if cookie == "" && proxy == "" {
+		return key
+	}
+	sum := sha256.Sum256([]byte(cookie + "\x00" + proxy))
+	return key + "#" + hex.EncodeToString(sum[:8])
+}
+
 func Forwarder(c *gin.Context) {
 	log := global.Log.WithField("func", "app.http.controllers.Forwarder")
 	log.WithField("http request", "headers").Debug(c.Request.Header)
 	proxy := c.GetString("proxy")
 	format := c.DefaultQuery("format", "")
+	output := c.DefaultQuery("output", "")
+	quality, err := hls.ParseQuality(c.DefaultQuery("quality", ""))
+	if err != nil {
+		c.String(400, err.Error())
+		return
+	}
 	var proxyURL *url.URL
-	var err error
 	if proxy != "" {
 		proxyURL, err = url.Parse(proxy)
 		if err != nil {
@@ -162,43 +309,206 @@ func Forwarder(c *gin.Context) {
 		c.String(400, "unsupported platform")
 		return
 	}
+	if output != "" && output != "ts" && output != "flv" && output != "fmp4" {
+		c.String(400, "unsupported output")
+		return
+	}
+
+	// Clients that force a format, a quality or FLV output, or bring their
+	// own cookie or proxy, get their own upstream, and with it their own FLV
+	// header cache entry.
+	rawCookie := c.GetString("bilibili-cookie")
+	key := upstreamKey(hubKey(fmt.Sprintf("%s:%s", platform, room), format, quality.String(), output), platform, rawCookie, proxyURL)
 
-	// 2. Create the extractor instance.
-	ext, err := entry.Factory(room, proxyURL)
+	// 2. Join the shared upstream for this room, opening it if this is the
+	// first client. Extraction only runs for the first client. The upstream
+	// runs under the hub entry's context rather than this request's, since
+	// other clients may join it; it is canceled when the last one leaves.
+	sub, err := stream.DefaultHub.Subscribe(c.Request.Context(), key, func(ctx context.Context) (io.ReadCloser, string, error) {
+		return openUpstream(ctx, entry, platform, room, format, output, quality, rawCookie, proxyURL, key)
+	})
 	if err != nil {
-		log.Errorf("create extractor error: %s\n", err.Error())
-		c.String(entry.InitialError, err.Error())
+		log.Errorf("open upstream error: %s\n", err.Error())
+		status := 500
+		var ue *upstreamError
+		if errors.As(err, &ue) {
+			status = ue.status
+		}
+		c.String(status, err.Error())
 		return
 	}
 
-	// 2b. Inject cookie into the extractor if supported.
+	var r io.ReadCloser = sub
+	contentType := sub.ContentType()
+	if isMP4(contentType) && (output == "ts" || output == "flv") {
+		sub.Close()
+		log.Errorf("cannot remux fmp4 to %s\n", output)
+		c.String(502, fmt.Sprintf("cannot remux %s to %s", contentType, output))
+		return
+	}
+	if contentType == "video/x-flv" && output == "ts" {
+		// Remuxed per client, so the shared upstream stays FLV for
+		// everyone else.
+		r = remux.NewReader(r, remux.NewFLVToTS)
+		contentType = "video/mp2t"
+	}
+	if output == "fmp4" {
+		r, contentType, err = fmp4Output(c.Request.Context(), r, contentType)
+		if err != nil {
+			log.Errorf("remux to fmp4 error: %s\n", err.Error())
+			c.String(502, err.Error())
+			return
+		}
+	}
+	streamToClient(c, r, contentType)
+}
+
+// fmp4Output remuxes a client's FLV or MPEG-TS stream to fragmented MP4. It
+// waits for the init segment, since the codecs of the returned content type
+// are only known from it, or until ctx is canceled.
+func fmp4Output(ctx context.Context, r io.ReadCloser, contentType string) (io.ReadCloser, string, error) {
+	if isMP4(contentType) {
+		return r, contentType, nil // an fMP4 HLS upstream
+	}
+	var rr *remux.Reader
+	switch contentType {
+	case "video/x-flv":
+		rr = remux.NewReader(r, remux.NewFLVToFMP4)
+	case "video/mp2t":
+		rr = remux.NewReader(r, remux.NewTSToFMP4)
+	default:
+		r.Close()
+		return nil, "", fmt.Errorf("cannot remux %s to fmp4", contentType)
+	}
+	stop := context.AfterFunc(ctx, func() { rr.Close() })
+	defer stop()
+	contentType, err := rr.ContentType("video/mp4")
+	if err != nil {
+		rr.Close()
+		return nil, "", fmt.Errorf("wait for fmp4 init segment error: %w", err)
+	}
+	return rr, contentType, nil
+}
+
+// isMP4 reports whether contentType is fragmented MP4, with or without
+// codecs.
+func isMP4(contentType string) bool {
+	return contentType == "video/mp4" || strings.HasPrefix(contentType, "video/mp4;")
+}
+
+// openUpstream creates the extractor for a room, performs the initial
+// extraction and starts the matching forwarder. It runs once per shared
+// upstream; ctx bounds the upstream's lifetime. With output "flv", an
+// MPEG-TS upstream is remuxed to FLV. quality picks the variant of an HLS
+// upstream; it does not apply to others.
+func openUpstream(ctx context.Context, entry extractor.RegistryEntry, platform, room, format, output string, quality hls.Quality, rawCookie string, proxyURL *url.URL, key string) (io.ReadCloser, string, error) {
+	extractFn, adFreeFn, result, err := extractStream(ctx, entry, platform, room, format, rawCookie, proxyURL)
+	if err != nil {
+		return nil, "", err
+	}
+	return startUpstream(ctx, entry, platform, output, quality, proxyURL, key, extractFn, adFreeFn, result)
+}
+
+// startUpstream starts the forwarder for an extraction made by
+// extractStream, as openUpstream does.
+func startUpstream(ctx context.Context, entry extractor.RegistryEntry, platform, output string, quality hls.Quality, proxyURL *url.URL, key string, extractFn, adFreeFn stream.ExtractFunc, result *stream.ExtractResult) (io.ReadCloser, string, error) {
+	// Dispatch to the appropriate forwarder. The new upstream sends its
+	// own FLV header, which may not match one cached from a previous
+	// upstream for this key.
+	flv.DefaultCache.Invalidate(key)
+	u, _ := url.Parse(result.URL)
+	r, contentType, err := dispatchStream(ctx, u, extractFn, proxyURL, entry.Mobile, hlsPrefetch(platform, entry), hlsAds(platform, entry, adFreeFn), quality, key)
+	if err != nil {
+		status := 500
+		if errors.Is(err, hls.ErrNoVariant) {
+			// The stream is live, but not in that quality.
+			status = 404
+		}
+		return nil, "", &upstreamError{status: status, err: err}
+	}
+	if output == "flv" && contentType == "video/mp2t" {
+		// Remuxed once for every client of the key, recording the
+		// header as the FLV forwarder does.
+		r = remux.NewReader(r, func(w io.Writer) remux.Converter {
+			return remux.NewTSToFLV(flv.NewHeaderCacheWriter(w, flv.DefaultCache, key))
+		})
+		contentType = "video/x-flv"
+	}
+	switch {
+	case contentType == "video/x-flv":
+		// Clients joining later get the header and start on the
+		// latest keyframe. The recorded header stays cached while the
+		// upstream is open.
+		r = stream.WithJoinCache(flv.DefaultCache.Retain(key, r), flv.NewGOPCache(key))
+	case isMP4(contentType):
+		// Clients joining later need the init segment first.
+		r = stream.WithJoinCache(r, fmp4.NewInitCache())
+	}
+	return r, contentType, nil
+}
+
+// extractStream creates the extractor for a room and performs the initial
+// extraction. It returns the extractFn the forwarders re-extract with, one
+// extracting the extractor's ad-free playlist (nil unless it is an
+// extractor.AdFreeExtractor), and the initial result. Errors are
+// *upstreamError.
+func extractStream(ctx context.Context, entry extractor.RegistryEntry, platform, room, format, rawCookie string, proxyURL *url.URL) (stream.ExtractFunc, stream.ExtractFunc, *stream.ExtractResult, error) {
+	log := global.Log.WithField("func", "app.http.controllers.extractStream").WithField("platform", platform).WithField("room", room)
+
+	// 1. Create the extractor instance.
+	fctx, cancel := stream.WithTimeout(ctx, stream.DefaultTimeouts.Extract)
+	ext, err := entry.New(fctx, room, proxyURL)
+	cancel()
+	if err != nil {
+		log.Errorf("create extractor error: %s\n", err.Error())
+		status := entry.InitialError
+		if stream.IsOffline(err) {
+			status = 404
+		}
+		return nil, nil, nil, &upstreamError{status: status, err: err}
+	}
+
+	// 1b. Inject cookie into the extractor if supported.
 	// Cookie is set in context by middleware: from ?cookie= (decoded) or --bilibili-cookie (raw).
 	if cs, ok := ext.(extractor.CookieSetter); ok {
-		if rawCookie := c.GetString("bilibili-cookie"); rawCookie != "" && platform == "bilibili" {
+		if rawCookie != "" && platform == "bilibili" {
 			cs.SetCookie(rawCookie)
 		}
 	}
 
-	// 3. Resolve the desired format.
+	// 2. Resolve the desired format.
 	desiredFormat := resolveDesiredFormat(format, ext)
 
-	// 4. Build the unified extractFn closure.
+	// 3. Build the unified extractFn closure. Extraction goes through the
+	// platform's circuit breaker so an API outage is not hammered.
+	breaker := stream.BreakerFor(platform)
 	var initialFormat string
-	extractFn := func(previous *stream.ExtractResult) (*stream.ExtractResult, error) {
+	extractFn := func(ctx context.Context, previous *stream.ExtractResult) (*stream.ExtractResult, error) {
 		extractFormat := desiredFormat
 		if previous != nil {
 			extractFormat = initialFormat
 		}
-		result, err := ext.Extract(extractFormat)
-		if err != nil {
-			return nil, fmt.Errorf("extract error: %w", err)
+		if err := breaker.Allow(); err != nil {
+			return nil, err
 		}
-		streamResult := &stream.ExtractResult{
-			URL:             result.URL,
-			Headers:         result.Headers,
-			ExpireAt:        result.ExpireAt,
-			VariantSelector: result.VariantSelector,
+		result, err := extractor.ExtractContext(ctx, ext, extractFormat)
+		if err != nil && ctx.Err() == context.Canceled {
+			// Not the platform's fault; the stream was closed.
+			breaker.Release()
+			return nil, err
 		}
+		if err != nil {
+			if stream.IsOffline(err) {
+				// The platform answered; the streamer is just not live.
+				breaker.Success()
+			} else {
+				breaker.Failure()
+			}
+			err = stream.WrapError(platform, stream.PhaseExtract, "", err)
+			return nil, fmt.Errorf("extract error: %w", stream.WithPlatform(err, platform))
+		}
+		breaker.Success()
+		streamResult := toStreamResult(platform, result)
 		u, parseErr := url.Parse(result.URL)
 		if parseErr != nil {
 			return nil, fmt.Errorf("parse extracted URL error: %w", parseErr)
@@ -214,16 +524,47 @@ func Forwarder(c *gin.Context) {
 		return streamResult, nil
 	}
 
-	// 5. Perform initial extraction.
-	result, err := extractFn(nil)
+	// 3b. Ad breaks may be played from another playlist of the stream.
+	var adFreeFn stream.ExtractFunc
+	if af, ok := ext.(extractor.AdFreeExtractor); ok {
+		adFreeFn = func(ctx context.Context, _ *stream.ExtractResult) (*stream.ExtractResult, error) {
+			result, err := af.ExtractAdFree(ctx, initialFormat)
+			if err != nil {
+				err = stream.WrapError(platform, stream.PhaseExtract, "", err)
+				return nil, fmt.Errorf("extract ad-free error: %w", stream.WithPlatform(err, platform))
+			}
+			return toStreamResult(platform, result), nil
+		}
+	}
+
+	// 4. Perform initial extraction.
+	ectx, cancel := stream.WithTimeout(ctx, stream.DefaultTimeouts.Extract)
+	result, err := extractFn(ectx, nil)
+	cancel()
 	if err != nil {
 		log.Errorf("initial extract error: %s\n", err.Error())
-		c.String(entry.InitialError, err.Error())
-		return
+		status := entry.InitialError
+		if errors.Is(err, stream.ErrCircuitOpen) {
+			status = 503
+		} else if stream.IsOffline(err) {
+			status = 404
+		}
+		return nil, nil, nil, &upstreamError{status: status, err: err}
 	}
+	return extractFn, adFreeFn, result, nil
+}
 
-	// 6. Dispatch to the appropriate forwarder.
-	u, _ := url.Parse(result.URL)
-	key := fmt.Sprintf("%s:%s", platform, room)
-	dispatchStream(c, u, extractFn, proxyURL, entry.Mobile, key)
+// toStreamResult converts an extractor result for the forwarders.
+func toStreamResult(platform string, result *extractor.Result) *stream.ExtractResult {
+	streamResult := &stream.ExtractResult{
+		Platform:        platform,
+		URL:             result.URL,
+		Headers:         result.Headers,
+		ExpireAt:        result.ExpireAt,
+		VariantSelector: result.VariantSelector,
+	}
+	for _, c := range result.Candidates {
+		streamResult.Candidates = append(streamResult.Candidates, stream.Candidate{URL: c.URL, Priority: c.Priority})
+	}
+	return streamResult
 }
@@ -0,0 +1,175 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/extractor"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/hls"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/remux"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/stream"
+	"github.com/nv4d1k/live-stream-forwarder/global"
+)
+
+// HLSSegments configures how non-HLS upstreams are cut into HLS segments.
+// Set from the command line.
+var HLSSegments = struct {
+	Duration  time.Duration // target segment duration
+	Container string        // remux.SegmentTS or remux.SegmentFMP4
+}{Duration: 4 * time.Second, Container: remux.SegmentTS}
+
+// HLS serves a room re-published as HLS: index.m3u8 and the playlists,
+// segments and init sections it refers to. All clients of a room share one
+// hls.Publisher, which polls an HLS upstream, or cuts any other upstream
+// into segments, and caches its recent segments.
+func HLS(c *gin.Context) {
+	log := global.Log.WithField("func", "app.http.controllers.HLS")
+	format := c.DefaultQuery("format", "")
+	proxy := c.GetString("proxy")
+	var proxyURL *url.URL
+	var err error
+	if proxy != "" {
+		proxyURL, err = url.Parse(proxy)
+		if err != nil {
+			log.Errorf("parsing proxy error: %s\n", err.Error())
+			c.String(400, "invalid proxy")
+			return
+		}
+	}
+
+	platform := strings.ToLower(c.Param("platform"))
+	room := c.Param("room")
+	file := c.Param("file")
+	log = log.WithField("platform", platform).WithField("room", room)
+
+	entry, ok := extractor.Registry[platform]
+	if !ok {
+		c.String(400, "unsupported platform")
+		return
+	}
+
+	// Clients that force a format or bring their own cookie or proxy get
+	// their own publisher, sharing the hub upstream of FLV clients with the
+	// same ones. The playlists carry the query on to the files they list.
+	rawCookie := c.GetString("bilibili-cookie")
+	key := upstreamKey(hubKey(fmt.Sprintf("%s:%s", platform, room), format, "", ""), platform, rawCookie, proxyURL)
+	p, err := hls.DefaultPublishers.Get(c.Request.Context(), key, func(ctx context.Context) (*hls.Publisher, error) {
+		return openPublisher(ctx, entry, platform, room, format, rawCookie, proxyURL, key)
+	})
+	if err != nil {
+		log.Errorf("open publisher error: %s\n", err.Error())
+		status := 500
+		var ue *upstreamError
+		if errors.As(err, &ue) {
+			status = ue.status
+		}
+		c.String(status, err.Error())
+		return
+	}
+
+	data, contentType, err := p.File(c.Request.Context(), file)
+	if err != nil {
+		switch {
+		case errors.Is(err, hls.ErrNotFound):
+			c.String(404, "not found")
+		case stream.IsOffline(err):
+			c.String(404, err.Error())
+		case c.Request.Context().Err() != nil:
+			// The client went away.
+		default:
+			log.Errorf("serve %s error: %s\n", file, err.Error())
+			c.String(502, err.Error())
+		}
+		return
+	}
+	if contentType == hls.ContentTypePlaylist {
+		data = playlistWithQuery(data, c.Request.URL.Query().Encode())
+		c.Header("Cache-Control", "no-cache")
+	} else {
+		// Segments never change once listed.
+		c.Header("Cache-Control", "max-age=60")
+	}
+	c.Data(200, contentType, data)
+}
+
+// openPublisher extracts a room and starts its publisher, which lives as long
+// as ctx. An HLS upstream is re-published; any other is cut into segments
+// from the room's shared upstream, which FLV clients of the room also use:
+// key is its hub key.
+func openPublisher(ctx context.Context, entry extractor.RegistryEntry, platform, room, format, rawCookie string, proxyURL *url.URL, key string) (*hls.Publisher, error) {
+	extractFn, adFreeFn, result, err := extractStream(ctx, entry, platform, room, format, rawCookie, proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(result.URL)
+	if formatFromURL(u) == "m3u8" {
+		h := hls.NewHLSForwarder(proxyURL, entry.Mobile)
+		return h.Publish(extractFn,
+			hls.WithContext(ctx),
+			hls.WithTimeouts(stallTimeouts(StallTimeouts.HLS, hls.DefaultStallTimeout)),
+			hls.WithOfflinePolicy(OfflinePolicy),
+			hls.WithAds(hlsAds(platform, entry, adFreeFn))), nil
+	}
+
+	// The upstream reuses the extraction that told the format apart,
+	// instead of extracting again. If the hub has to open it once more, it
+	// extracts afresh.
+	var initial atomic.Pointer[stream.ExtractResult]
+	initial.Store(result)
+	feed := func(ctx context.Context, w *hls.Window) error {
+		sub, err := stream.DefaultHub.Subscribe(ctx, key, func(ctx context.Context) (io.ReadCloser, string, error) {
+			if result := initial.Swap(nil); result != nil {
+				return startUpstream(ctx, entry, platform, "", nil, proxyURL, key, extractFn, adFreeFn, result)
+			}
+			return openUpstream(ctx, entry, platform, room, format, "", nil, rawCookie, proxyURL, key)
+		})
+		if err != nil {
+			return err
+		}
+		defer sub.Close()
+		if contentType := sub.ContentType(); contentType != "video/x-flv" {
+			return fmt.Errorf("cannot segment %s", contentType)
+		}
+		stop := context.AfterFunc(ctx, func() { sub.Close() })
+		defer stop()
+		seg := remux.NewSegmenter(w, HLSSegments.Container, HLSSegments.Duration)
+		if _, err := io.Copy(seg, sub); err != nil {
+			return err
+		}
+		return seg.Flush()
+	}
+	return hls.NewFeedPublisher(ctx, feed), nil
+}
+
+// playlistWithQuery appends rawQuery, which must be encoded, to the URIs of
+// a playlist served by a Publisher. They are relative, so without it a
+// player would request the files they list without the ?format=, ?cookie=
+// or ?proxy= the publisher is keyed by.
+func playlistWithQuery(playlist []byte, rawQuery string) []byte {
+	if rawQuery == "" {
+		return playlist
+	}
+	lines := strings.Split(string(playlist), "\n")
+	for i, line := range lines {
+		switch {
+		case line == "":
+		case !strings.HasPrefix(line, "#"):
+			lines[i] = line + "?" + rawQuery
+		default:
+			// EXT-X-MEDIA, EXT-X-MAP and EXT-X-KEY.
+			lines[i] = uriAttr.ReplaceAllString(line, `URI="$1?`+rawQuery+`"`)
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+var uriAttr = regexp.MustCompile(`URI="([^"?]*)"`)
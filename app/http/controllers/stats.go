@@ -0,0 +1,15 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/flv"
+)
+
+// Stats registers read-only views of the forwarder's caches.
+func Stats(r *gin.RouterGroup) {
+	r.GET("/flv-header-cache", func(c *gin.Context) {
+		c.JSON(http.StatusOK, flv.DefaultCache.Stats())
+	})
+}
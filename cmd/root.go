@@ -4,16 +4,22 @@ Copyright © 2023 Naumov Vadik <nv4d1k@ya.ru>
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
+	"syscall"
 	"time"
 
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/hls"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/remux"
+	"github.com/nv4d1k/live-stream-forwarder/app/engine/forwarder/stream"
 	"github.com/nv4d1k/live-stream-forwarder/app/http/controllers"
 	"github.com/nv4d1k/live-stream-forwarder/global"
 
@@ -31,6 +37,7 @@ var (
 	proxy          string
 	bilibiliCookie string
 	logFile        string
+	offlineAction  string
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -50,6 +57,22 @@ var rootCmd = &cobra.Command{
 		if global.LogLevel < 6 {
 			gin.SetMode(gin.ReleaseMode)
 		}
+		action, err := stream.ParseOfflineAction(offlineAction)
+		if err != nil {
+			log.Fatalf("parse offline action error: %s\n", err.Error())
+		}
+		controllers.OfflinePolicy.Action = action
+		if controllers.OfflinePolicy.Action == stream.OfflinePlaceholder && controllers.OfflinePolicy.Placeholder == "" {
+			log.Fatalf("--offline-action=placeholder requires --offline-placeholder\n")
+		}
+		if c := controllers.HLSSegments.Container; c != remux.SegmentTS && c != remux.SegmentFMP4 {
+			log.Fatalf("invalid --hls-container %q: want ts or fmp4\n", c)
+		}
+		for platform, strategy := range controllers.HLSAds {
+			if _, err := hls.ParseAdStrategy(strategy); err != nil {
+				log.Fatalf("invalid --hls-ads for %s: %s\n", platform, err.Error())
+			}
+		}
 		corsConfig := cors.Config{
 			AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "HEAD"},
 			AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "Authorization"},
@@ -82,7 +105,9 @@ var rootCmd = &cobra.Command{
 		})
 		r.Use(ginlogrus.Logger(global.Log), gin.Recovery())
 		r.GET("/tools/cookie", controllers.CookieTool)
+		controllers.Stats(r.Group("/stats"))
 		r.GET("/:platform/:room", controllers.Forwarder)
+		r.GET("/:platform/:room/:file", controllers.HLS)
 		if global.LogLevel >= 6 {
 			controllers.Debug(r.Group("/debug"))
 		}
@@ -92,8 +117,24 @@ var rootCmd = &cobra.Command{
 		}
 		fmt.Printf("listening on %s ...\n", ln.Addr().String())
 		fmt.Printf("access in player with room id. eg. http://%s/twitch/eslcs\n\n", ln.Addr().String())
-		err = http.Serve(ln, r)
-		if err != nil {
+		srv := &http.Server{Handler: r}
+		go func() {
+			sigCh := make(chan os.Signal, 1)
+			signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+			<-sigCh
+			fmt.Println("shutting down ...")
+			// End every running stream first: open streams keep their
+			// requests active, which would hold up Shutdown.
+			stream.DefaultHub.Close()
+			hls.DefaultPublishers.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("http shutdown error: %s\n", err.Error())
+			}
+		}()
+		err = srv.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("http serve error: %s\n", err.Error())
 		}
 	},
@@ -135,6 +176,20 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&proxy, "proxy", "", "proxy url")
 	rootCmd.PersistentFlags().StringVar(&bilibiliCookie, "bilibili-cookie", "", "raw cookie string for BiliBili authenticated streams")
 	rootCmd.PersistentFlags().StringVar(&logFile, "log-file", "", "logging file")
+	rootCmd.PersistentFlags().DurationVar(&controllers.StallTimeouts.FLV, "stall-timeout-flv", 0, "reconnect an HTTP-FLV upstream after this long without data (0 = default 15s, negative = off)")
+	rootCmd.PersistentFlags().DurationVar(&controllers.StallTimeouts.HLS, "stall-timeout-hls", 0, "re-extract an HLS upstream whose segments or playlist stop for this long (0 = default 30s, negative = off)")
+	rootCmd.PersistentFlags().DurationVar(&controllers.StallTimeouts.WS, "stall-timeout-ws", 0, "reconnect an xp2p websocket upstream after this long without messages (0 = default 15s, negative = off)")
+	rootCmd.PersistentFlags().StringVar(&offlineAction, "offline-action", stream.DefaultOfflinePolicy.Action.String(), "what to do when a stream goes offline: close, wait or placeholder")
+	rootCmd.PersistentFlags().DurationVar(&controllers.OfflinePolicy.Wait, "offline-wait", stream.DefaultOfflinePolicy.Wait, "how long to keep clients connected waiting for an offline stream to resume")
+	rootCmd.PersistentFlags().DurationVar(&controllers.OfflinePolicy.Poll, "offline-poll", stream.DefaultOfflinePolicy.Poll, "how often to check whether an offline stream has resumed")
+	rootCmd.PersistentFlags().StringVar(&controllers.OfflinePolicy.Placeholder, "offline-placeholder", "", "HTTP-FLV URL relayed to clients while the stream is offline (with --offline-action=placeholder)")
+	rootCmd.PersistentFlags().DurationVar(&controllers.HLSSegments.Duration, "hls-segment-duration", controllers.HLSSegments.Duration, "target duration of the HLS segments cut from non-HLS streams (cut at the next keyframe)")
+	rootCmd.PersistentFlags().StringVar(&controllers.HLSSegments.Container, "hls-container", controllers.HLSSegments.Container, "container of the HLS segments cut from non-HLS streams: ts or fmp4")
+	rootCmd.PersistentFlags().StringToIntVar(&controllers.HLSPrefetch, "hls-prefetch", nil, "HLS segments downloaded at once per platform, e.g. twitch=4,kick=2 (default 3, 1 = one by one)")
+	rootCmd.PersistentFlags().BoolVar(&hls.DefaultLowLatency, "hls-low-latency", hls.DefaultLowLatency, "follow low-latency HLS playlists part by part (EXT-X-PART, preload hints, blocking reloads, Twitch prefetch)")
+	rootCmd.PersistentFlags().StringToStringVar(&controllers.HLSAds, "hls-ads", nil, "handling of ads stitched into HLS playlists per platform, e.g. twitch=skip: passthrough, skip or switch (to an ad-free playlist during ad breaks)")
+	rootCmd.PersistentFlags().DurationVar(&hls.DefaultAdHold, "hls-ad-hold", hls.DefaultAdHold, "how long --hls-ads=switch plays the ad-free playlist before returning to the main one")
+	rootCmd.PersistentFlags().IntVar(&hls.DefaultWindow, "hls-window", hls.DefaultWindow, "number of segments listed in the served HLS playlists")
 	rootCmd.PersistentFlags().Uint32Var(&global.LogLevel, "log-level", 3, "log level (0 - 6, 3 = warn , 5 = debug)")
 
 	rootCmd.SetVersionTemplate(fmt.Sprintf(`{{with .Name}}{{printf "%%s version information: " .}}{{end}}